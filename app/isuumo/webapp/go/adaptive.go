@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 検索のレイテンシが高い間はperPageを小さく制限する
+var flagAdaptivePerPage = newFeatureFlag("ADAPTIVE_PER_PAGE", false)
+
+// perPageを制限したときに付けるレスポンスヘッダ 値は元のperPage
+const perPageClampedHeader = "X-PerPage-Clamped"
+
+const (
+	// レイテンシを平均する窓の秒数
+	latencyWindow = 10
+	// この件数に満たないうちは判定しない
+	latencyMinRequests = 50
+)
+
+var (
+	// adaptivePerPageThreshold 窓内の平均レイテンシがこれを超えたら制限する
+	adaptivePerPageThreshold = parseDurationEnv("ADAPTIVE_PER_PAGE_LATENCY", 300*time.Millisecond)
+	// adaptivePerPageMax 制限中のperPageの上限 (フロントエンドと同じ値)
+	adaptivePerPageMax = parseIntEnv("ADAPTIVE_PER_PAGE_MAX", 20)
+)
+
+func parseDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnv(key, defaultValue.String()))
+	if err != nil {
+		return defaultValue
+	}
+	return d
+}
+
+func parseIntEnv(key string, defaultValue int) int {
+	v, err := strconv.Atoi(getEnv(key, strconv.Itoa(defaultValue)))
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+func parseFloatEnv(key string, defaultValue float64) float64 {
+	v, err := strconv.ParseFloat(getEnv(key, ""), 64)
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+type latencyBucket struct {
+	second int64
+	count  int64
+	total  time.Duration
+}
+
+// latencyTracker レイテンシをスライディングウィンドウで平均する
+type latencyTracker struct {
+	mu      sync.Mutex
+	buckets [latencyWindow]latencyBucket
+}
+
+// searchLatency 検索系エンドポイントのレイテンシ
+var searchLatency = &latencyTracker{}
+
+func (lt *latencyTracker) record(now time.Time, d time.Duration) {
+	sec := now.Unix()
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	b := &lt.buckets[sec%latencyWindow]
+	if b.second != sec {
+		*b = latencyBucket{second: sec}
+	}
+	b.count++
+	b.total += d
+}
+
+// overloaded 窓内の平均レイテンシがthresholdを超えていればtrueを返す
+func (lt *latencyTracker) overloaded(now time.Time, threshold time.Duration) bool {
+	sec := now.Unix()
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+
+	var count int64
+	var total time.Duration
+	for _, b := range lt.buckets {
+		if sec-b.second < latencyWindow {
+			count += b.count
+			total += b.total
+		}
+	}
+	return count >= latencyMinRequests && total/time.Duration(count) > threshold
+}
+
+// latencyMiddleware リクエストのレイテンシをltに記録する
+func latencyMiddleware(lt *latencyTracker) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			lt.record(time.Now(), time.Since(start))
+			return err
+		}
+	}
+}
+
+// clampPerPage 過負荷のときはperPageを adaptivePerPageMax までに制限する
+// 検索はログインなしで呼ばれるので全てのリクエストが対象で、それ以下の値はクライアントの指定をそのまま使う
+// 制限した場合はレスポンスヘッダに元の値を付ける
+func clampPerPage(c echo.Context, perPage int) int {
+	if !flagAdaptivePerPage.Enabled() || perPage <= adaptivePerPageMax {
+		return perPage
+	}
+	if !searchLatency.overloaded(time.Now(), adaptivePerPageThreshold) {
+		return perPage
+	}
+	c.Response().Header().Set(perPageClampedHeader, strconv.Itoa(perPage))
+	return adaptivePerPageMax
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestOperationID(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"POST", "/initialize", "PostInitialize"},
+		{"GET", "/api/chair/:id", "GetChairByID"},
+		{"DELETE", "/api/chair/:id", "DeleteChairByID"},
+		{"GET", "/api/chair/:id/also_bought", "GetChairByIDAlsoBought"},
+		{"POST", "/api/chair/buy/:id", "PostChairBuyByID"},
+		{"GET", "/internal/peer/:kind/:id", "GetInternalPeerByKindByID"},
+	}
+	for _, tt := range tests {
+		if got := operationID(Route{Method: tt.method, Path: tt.path}); got != tt.want {
+			t.Errorf("operationID(%s %s) = %s, want %s", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestOperationIDsUnique(t *testing.T) {
+	seen := map[string]string{}
+	for _, r := range routes {
+		id := operationID(r)
+		if other, ok := seen[id]; ok {
+			t.Errorf("%s %s and %s have the same operation id %s", r.Method, r.Path, other, id)
+		}
+		seen[id] = r.Method + " " + r.Path
+	}
+}
+
+func TestOpenAPIUpToDate(t *testing.T) {
+	want, err := openAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile("openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("openapi.json is out of date : run go run . openapi > openapi.json")
+	}
+}
+
+func TestClientSDKUpToDate(t *testing.T) {
+	want, err := clientSDK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile("client/client.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("client/client.go is out of date : run go run . sdk > client/client.go")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "strings"
+
+// 「県」が付かない都道府県
+var prefecturesWithoutKen = []string{"北海道", "東京都", "京都府", "大阪府"}
+
+// prefectureOf 住所の先頭から都道府県を取り出す 取り出せなければ空文字列を返す
+// 5_estate_prefecture.sql と同じ規則にする
+func prefectureOf(address string) string {
+	for _, p := range prefecturesWithoutKen {
+		if strings.HasPrefix(address, p) {
+			return p
+		}
+	}
+	rs := []rune(address)
+	for _, n := range []int{3, 4} {
+		if len(rs) >= n && rs[n-1] == '県' {
+			return string(rs[:n])
+		}
+	}
+	return ""
+}
+
+// likeEscaper LIKEの前方一致に使う文字列をエスケープする
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// areaCondition area パラメータの条件を返す
+// 都道府県そのものなら索引のある prefecture カラムで、そうでなければ住所の前方一致で絞り込む
+func areaCondition(area string) (string, interface{}) {
+	if prefectureOf(area) == area {
+		return "prefecture = ?", area
+	}
+	return "address LIKE ?", likeEscaper.Replace(area) + "%"
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// adminToken AuthRequired のルートに必要なトークン
+// 管理用, /internal, /debug のルートは Authorization: Bearer <ADMIN_TOKEN> がなければ401を返す
+// 空なら誰も認証できないので、それらのルートは全て403を返す (起動時に警告する)
+var adminToken = getEnv("ADMIN_TOKEN", "")
+
+// authMiddleware Authorization ヘッダのトークンが adminToken と一致するか確かめる
+func authMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if adminToken == "" {
+			return Problem(c, http.StatusForbidden, problemCode(http.StatusForbidden), "ADMIN_TOKEN is not configured")
+		}
+		token := strings.TrimPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return Problem(c, http.StatusUnauthorized, problemCode(http.StatusUnauthorized), "authentication required")
+		}
+		return next(c)
+	}
+}
+
+// peerTransport 他のサーバーの /internal を呼ぶときに adminToken を付ける
+type peerTransport struct {
+	base http.RoundTripper
+}
+
+func (t peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if adminToken == "" {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+adminToken)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// 書き込んだサーバー以外のキャッシュも捨てるように、PEERS の全てのサーバーに無効化を知らせる
+var flagInvalidationBroadcast = newFeatureFlag("INVALIDATION_BROADCAST", true)
+
+// cacheInvalidation 他のサーバーに知らせる無効化の内容
+type cacheInvalidation struct {
+	// Kind peerKindChair か peerKindEstate
+	Kind string `json:"kind"`
+	// IDs 書き換わったid 詳細のキャッシュから捨てる
+	IDs []int `json:"ids,omitempty"`
+	// Search 検索結果に関するキャッシュを捨てる
+	Search bool `json:"search,omitempty"`
+	// LowPriced low_priced を作り直す
+	// falseでもIDsが含まれていれば作り直す
+	LowPriced bool `json:"lowPriced,omitempty"`
+	// Epoch ETagを変える
+	Epoch bool `json:"epoch,omitempty"`
+}
+
+// broadcastInvalidation 自分以外の全てのサーバーに無効化を知らせる
+// 書き込みのレスポンスを待たせないようにバックグラウンドで送る
+// 無効にしていても、詳細を分け持っている (peercache.go) 持ち主のサーバーには IDs だけを知らせる
+func broadcastInvalidation(inv cacheInvalidation) {
+	targets := peers.others()
+	if !flagInvalidationBroadcast.Enabled() {
+		targets = peers.ownersOf(inv.Kind, inv.IDs)
+		inv = cacheInvalidation{Kind: inv.Kind, IDs: inv.IDs}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	body, err := json.Marshal(inv)
+	if err != nil {
+		log.Errorf("broadcastInvalidation encode error : %v", err)
+		return
+	}
+	tasks.Go("broadcastInvalidation", func() {
+		for _, p := range targets {
+			res, err := peerClient.Post(p+"/internal/invalidate", echo.MIMEApplicationJSON, bytes.NewReader(body))
+			if err != nil {
+				log.Errorf("broadcastInvalidation %v : %v", p, err)
+				continue
+			}
+			res.Body.Close()
+		}
+	})
+}
+
+// postInvalidation 他のサーバーで書き込まれたときに手元のキャッシュを捨てる
+// ここからはさらに知らせない
+func postInvalidation(c echo.Context) error {
+	var inv cacheInvalidation
+	if err := c.Bind(&inv); err != nil {
+		c.Echo().Logger.Infof("postInvalidation bind error : %v", err)
+		return badRequest(c, "invalid request body")
+	}
+
+	switch inv.Kind {
+	case peerKindChair:
+		applyChairInvalidation(inv)
+	case peerKindEstate:
+		applyEstateInvalidation(inv)
+	default:
+		return invalidParam(c, "kind", "must be chair or estate")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func applyChairInvalidation(inv cacheInvalidation) {
+	for _, id := range inv.IDs {
+		cachedChairs.Remove(id)
+	}
+	chairMemIndex.markStale(inv.IDs...)
+	if inv.Search {
+		invalidateChairSearchCaches()
+	}
+	if inv.Epoch {
+		bumpChairETagEpoch()
+	}
+
+	ids := make(map[int64]bool, len(inv.IDs))
+	for _, id := range inv.IDs {
+		ids[int64(id)] = true
+	}
+	lowPricedChairMutex.Lock()
+	invalidate := inv.LowPriced
+	if !invalidate && lowPricedChair != nil {
+		for _, chair := range lowPricedChair.Chairs {
+			if ids[chair.ID] {
+				invalidate = true
+				break
+			}
+		}
+	}
+	if invalidate {
+		clearLowPricedChair()
+	}
+	lowPricedChairMutex.Unlock()
+	scheduleLowPricedChairRefresh()
+}
+
+func applyEstateInvalidation(inv cacheInvalidation) {
+	for _, id := range inv.IDs {
+		cachedEstates.Remove(id)
+	}
+	estateMemIndex.markStale(inv.IDs...)
+	if inv.Search {
+		invalidateEstateSearchCaches()
+		invalidateRecommendedEstateIDs()
+	}
+	if inv.Epoch {
+		bumpEstateETagEpoch()
+	}
+	if inv.LowPriced {
+		lowPricedEstateMutex.Lock()
+		clearLowPricedEstate()
+		lowPricedEstateMutex.Unlock()
+		scheduleLowPricedEstateRefresh()
+	}
+}
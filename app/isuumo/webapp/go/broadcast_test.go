@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBroadcastInvalidation(t *testing.T) {
+	defer func(old *peerRing) { peers = old }(peers)
+	defer flagInvalidationBroadcast.Set(flagInvalidationBroadcast.Enabled())
+	defer func(old string) { adminToken = old }(adminToken)
+	adminToken = "secret"
+
+	type received struct {
+		peer string
+		inv  cacheInvalidation
+	}
+	got := make(chan received, 10)
+	var urls []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var inv cacheInvalidation
+			json.NewDecoder(r.Body).Decode(&inv)
+			got <- received{name, inv}
+		}))
+		defer ts.Close()
+		urls = append(urls, ts.URL)
+	}
+	const self = "http://self.invalid"
+	peers = newPeerRing(strings.Join(append(urls, self), ","), self)
+
+	// a の持ち主のidを探す
+	id := 0
+	for peers.owner(peerKey(peerKindChair, id)) != urls[0] {
+		id++
+	}
+	inv := cacheInvalidation{Kind: peerKindChair, IDs: []int{id}, Search: true}
+
+	tests := []struct {
+		name      string
+		broadcast bool
+		inv       cacheInvalidation
+		want      []string
+		sent      cacheInvalidation
+	}{
+		{"broadcast", true, inv, []string{"a", "b"}, inv},
+		{"owners only", false, inv, []string{"a"}, cacheInvalidation{Kind: peerKindChair, IDs: []int{id}}},
+		{"no ids", false, cacheInvalidation{Kind: peerKindChair, Search: true}, nil, cacheInvalidation{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flagInvalidationBroadcast.Set(tt.broadcast)
+			broadcastInvalidation(tt.inv)
+
+			var peersGot []string
+			for range tt.want {
+				select {
+				case r := <-got:
+					peersGot = append(peersGot, r.peer)
+					if !reflect.DeepEqual(r.inv, tt.sent) {
+						t.Errorf("%s received %+v, want %+v", r.peer, r.inv, tt.sent)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the invalidation")
+				}
+			}
+			select {
+			case r := <-got:
+				t.Errorf("unexpected invalidation to %s", r.peer)
+			case <-time.After(50 * time.Millisecond):
+			}
+			sort.Strings(peersGot)
+			if !reflect.DeepEqual(peersGot, tt.want) {
+				t.Errorf("sent to %v, want %v", peersGot, tt.want)
+			}
+		})
+	}
+}
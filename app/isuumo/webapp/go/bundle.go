@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo"
+)
+
+// Bundle 椅子とその椅子が通る物件の組
+type Bundle struct {
+	Chair  Chair  `json:"chair"`
+	Estate Estate `json:"estate"`
+}
+
+type BundleListResponse struct {
+	Bundles []Bundle `json:"bundles"`
+}
+
+// getRecommendedBundle 安い椅子とその椅子が通る物件の組を、椅子と物件の人気の合計順に Limit 件返す
+// 椅子ごとのおすすめ物件は人気順に Limit 件あれば上位 Limit 組を作るのに足りるので recommendedEstateIDs を使う
+func getRecommendedBundle(c echo.Context) error {
+	lowPriced, err := loadLowPricedChair()
+	if err != nil {
+		c.Logger().Errorf("getRecommendedBundle DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	// buyChairが在庫を書き換えるのでロックしてコピーする
+	lowPricedChairMutex.RLock()
+	chairs := make([]Chair, 0, len(lowPriced.Chairs))
+	for _, chair := range lowPriced.Chairs {
+		if chair.Stock > 0 {
+			chairs = append(chairs, chair)
+		}
+	}
+	lowPricedChairMutex.RUnlock()
+
+	estates := getEmptyEstateSlice()
+	defer releaseEstateSlice(estates)
+
+	bundles := make([]Bundle, 0, Limit)
+	for _, chair := range chairs {
+		estates, err = loadRecommendedEstates(c.Request().Context(), chair, estates[:0])
+		if err != nil {
+			c.Logger().Errorf("getRecommendedBundle DB execution error : %v", err)
+			return internalError(c)
+		}
+		for _, estate := range estates {
+			bundles = append(bundles, Bundle{Chair: chair, Estate: estate})
+		}
+	}
+
+	sort.SliceStable(bundles, func(i, j int) bool {
+		pi := bundles[i].Chair.Popularity + bundles[i].Estate.Popularity
+		pj := bundles[j].Chair.Popularity + bundles[j].Estate.Popularity
+		if pi != pj {
+			return pi > pj
+		}
+		if bundles[i].Chair.ID != bundles[j].Chair.ID {
+			return bundles[i].Chair.ID < bundles[j].Chair.ID
+		}
+		return bundles[i].Estate.ID < bundles[j].Estate.ID
+	})
+	if len(bundles) > Limit {
+		bundles = bundles[:Limit]
+	}
+
+	return JSON(c, http.StatusOK, BundleListResponse{Bundles: bundles})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strconv"
+	"time"
+
+	"github.com/labstack/gommon/log"
+)
+
+// Cache 複数のアプリケーションサーバーで共有するキャッシュ
+// 失敗してもDBから取り直せばよいので、呼び出し側はエラーをミスとして扱う
+type Cache interface {
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(keys ...string) error
+}
+
+// nopCache REDIS_HOST がないときの Cache 何も保存しない
+type nopCache struct{}
+
+func (nopCache) Get(string) ([]byte, bool, error)        { return nil, false, nil }
+func (nopCache) Set(string, []byte, time.Duration) error { return nil }
+func (nopCache) Delete(...string) error                  { return nil }
+
+// sharedCacheTTL 共有キャッシュに置く期間
+// 他のサーバーの書き込みで消し損ねた場合もこの期間で入れ替わる
+var sharedCacheTTL = parseDurationEnv("REDIS_CACHE_TTL", 30*time.Second)
+
+// sharedCache REDIS_HOST があれば low_priced, 詳細, 検索の件数をRedisで共有する
+var sharedCache = newSharedCache()
+
+func newSharedCache() Cache {
+	host := getEnv("REDIS_HOST", "")
+	if host == "" {
+		return nopCache{}
+	}
+	return newRedisCache(host, parseIntEnv("REDIS_POOL_SIZE", 64), parseDurationEnv("REDIS_TIMEOUT", 100*time.Millisecond))
+}
+
+const sharedCachePrefix = "isuumo:"
+
+// sharedCacheGet keyの値をvにgobで読み込む
+// json:"-" の列も含めて保存したいのでJSONではなくgobにする
+func sharedCacheGet(key string, v interface{}) bool {
+	b, ok, err := sharedCache.Get(sharedCachePrefix + key)
+	if err != nil {
+		log.Errorf("sharedCacheGet %v : %v", key, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(v); err != nil {
+		log.Errorf("sharedCacheGet %v decode error : %v", key, err)
+		return false
+	}
+	return true
+}
+
+func sharedCacheSet(key string, v interface{}) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		log.Errorf("sharedCacheSet %v encode error : %v", key, err)
+		return
+	}
+	if err := sharedCache.Set(sharedCachePrefix+key, buf.Bytes(), sharedCacheTTL); err != nil {
+		log.Errorf("sharedCacheSet %v : %v", key, err)
+	}
+}
+
+func sharedCacheDelete(keys ...string) {
+	for i := range keys {
+		keys[i] = sharedCachePrefix + keys[i]
+	}
+	if err := sharedCache.Delete(keys...); err != nil {
+		log.Errorf("sharedCacheDelete %v : %v", keys, err)
+	}
+}
+
+// sharedNamespace まとめて捨てられるキーの集まり
+// キーに世代を含め、invalidate で世代を変えると古いキーはTTLで消える
+type sharedNamespace string
+
+var (
+	sharedChairs      sharedNamespace = "chair"
+	sharedEstates     sharedNamespace = "estate"
+	sharedChairCount  sharedNamespace = "chair_count"
+	sharedEstateCount sharedNamespace = "estate_count"
+)
+
+// key 今の世代のキー 共有キャッシュがないか世代が取れなければfalse
+// 書き込む前に無効化されたときに新しい世代へ古い値を書かないように、読み込む前にキーを決めておく
+func (ns sharedNamespace) key(k string) (string, bool) {
+	keys, ok := ns.keys(k)
+	if !ok {
+		return "", false
+	}
+	return keys[0], true
+}
+
+// keys 世代を1回だけ読んで複数のキーを作る
+func (ns sharedNamespace) keys(ks ...string) ([]string, bool) {
+	if _, ok := sharedCache.(nopCache); ok {
+		return nil, false
+	}
+	var generation int64
+	b, ok, err := sharedCache.Get(sharedCachePrefix + "ns:" + string(ns))
+	if err != nil {
+		log.Errorf("sharedNamespace %v : %v", ns, err)
+		return nil, false
+	}
+	if ok {
+		generation, _ = strconv.ParseInt(string(b), 10, 64)
+	}
+	prefix := string(ns) + ":" + strconv.FormatInt(generation, 36) + ":"
+	res := make([]string, len(ks))
+	for i, k := range ks {
+		res[i] = prefix + k
+	}
+	return res, true
+}
+
+// delete ksを捨てる
+func (ns sharedNamespace) delete(ks ...string) {
+	if len(ks) == 0 {
+		return
+	}
+	if keys, ok := ns.keys(ks...); ok {
+		sharedCacheDelete(keys...)
+	}
+}
+
+// invalidate 世代を変えて全てのキーを捨てる 世代のキーにはTTLを付けない
+func (ns sharedNamespace) invalidate() {
+	if _, ok := sharedCache.(nopCache); ok {
+		return
+	}
+	generation := strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := sharedCache.Set(sharedCachePrefix+"ns:"+string(ns), []byte(generation), 0); err != nil {
+		log.Errorf("sharedNamespace %v invalidate : %v", ns, err)
+	}
+}
+
+// idKeys idを共有キャッシュのキーにする
+func idKeys(ids []int) []string {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = strconv.Itoa(id)
+	}
+	return keys
+}
@@ -0,0 +1,41 @@
+package cache
+
+import "sync/atomic"
+
+// HitCounter キャッシュのヒット率を数える
+type HitCounter struct {
+	hits   int64
+	misses int64
+	// evictions 上限や期限切れで捨てた数 書き込みによる無効化は含めない
+	evictions int64
+}
+
+func (hc *HitCounter) Hit()   { atomic.AddInt64(&hc.hits, 1) }
+func (hc *HitCounter) Miss()  { atomic.AddInt64(&hc.misses, 1) }
+func (hc *HitCounter) Evict() { atomic.AddInt64(&hc.evictions, 1) }
+
+// HitStat HitCounter のある時点の値
+type HitStat struct {
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	Evictions int64   `json:"evictions"`
+	HitRate   float64 `json:"hitRate"`
+}
+
+func newHitStat(hits, misses, evictions int64) HitStat {
+	st := HitStat{Hits: hits, Misses: misses, Evictions: evictions}
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRate = float64(st.Hits) / float64(total)
+	}
+	return st
+}
+
+// Snapshot 今の値を返す
+func (hc *HitCounter) Snapshot() HitStat {
+	return newHitStat(atomic.LoadInt64(&hc.hits), atomic.LoadInt64(&hc.misses), atomic.LoadInt64(&hc.evictions))
+}
+
+// Reset 0に戻して戻す前の値を返す
+func (hc *HitCounter) Reset() HitStat {
+	return newHitStat(atomic.SwapInt64(&hc.hits, 0), atomic.SwapInt64(&hc.misses, 0), atomic.SwapInt64(&hc.evictions, 0))
+}
@@ -0,0 +1,124 @@
+// Package cache プロセス内のキャッシュとヒット率の集計
+// 何をキャッシュするか、いつ捨てるかは呼び出し側が決める
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LRU 件数の上限とTTLを持つキャッシュ
+// 上限を超えたら最も長く使われていないものから捨て、TTLを過ぎたものは取り出すときに捨てる
+// 値はinterface{}で持つので、呼び出し側で型を戻す
+type LRU struct {
+	Name       string
+	maxEntries int
+	// ttl 0以下なら期限切れにしない
+	ttl time.Duration
+
+	mu      sync.Mutex
+	ll      *list.List
+	items   map[interface{}]*list.Element
+	counter HitCounter
+}
+
+type lruEntry struct {
+	key    interface{}
+	value  interface{}
+	expiry time.Time
+}
+
+// NewLRU maxEntries が0以下なら件数で捨てない
+func NewLRU(name string, maxEntries int, ttl time.Duration) *LRU {
+	return &LRU{
+		Name:       name,
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		ll:         list.New(),
+		items:      map[interface{}]*list.Element{},
+	}
+}
+
+// MaxEntries 件数の上限
+func (lc *LRU) MaxEntries() int {
+	return lc.maxEntries
+}
+
+// Counter ヒット数、ミス数、追い出した数
+func (lc *LRU) Counter() *HitCounter {
+	return &lc.counter
+}
+
+func (lc *LRU) Get(key interface{}) (interface{}, bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	el, ok := lc.items[key]
+	if !ok {
+		lc.counter.Miss()
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if lc.ttl > 0 && !time.Now().Before(e.expiry) {
+		lc.removeElement(el)
+		lc.counter.Evict()
+		lc.counter.Miss()
+		return nil, false
+	}
+	lc.ll.MoveToFront(el)
+	lc.counter.Hit()
+	return e.value, true
+}
+
+func (lc *LRU) Add(key, value interface{}) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	var expiry time.Time
+	if lc.ttl > 0 {
+		expiry = time.Now().Add(lc.ttl)
+	}
+	if el, ok := lc.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		e.value = value
+		e.expiry = expiry
+		lc.ll.MoveToFront(el)
+		return
+	}
+	lc.items[key] = lc.ll.PushFront(&lruEntry{key: key, value: value, expiry: expiry})
+	for lc.maxEntries > 0 && lc.ll.Len() > lc.maxEntries {
+		lc.removeElement(lc.ll.Back())
+		lc.counter.Evict()
+	}
+}
+
+// Remove keysを捨てる
+func (lc *LRU) Remove(keys ...interface{}) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := lc.items[key]; ok {
+			lc.removeElement(el)
+		}
+	}
+}
+
+// Purge 全て捨てる
+func (lc *LRU) Purge() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.ll.Init()
+	lc.items = map[interface{}]*list.Element{}
+}
+
+func (lc *LRU) Len() int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.ll.Len()
+}
+
+func (lc *LRU) removeElement(el *list.Element) {
+	lc.ll.Remove(el)
+	delete(lc.items, el.Value.(*lruEntry).key)
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		ttl        time.Duration
+		add        []int
+		get        []int
+		sleep      time.Duration
+		want       map[int]bool
+		stat       HitStat
+	}{
+		{
+			name:       "evicts least recently used",
+			maxEntries: 2,
+			add:        []int{1, 2, 3},
+			want:       map[int]bool{1: false, 2: true, 3: true},
+			stat:       HitStat{Hits: 2, Misses: 1, HitRate: 2.0 / 3},
+		},
+		{
+			name:       "get refreshes recency",
+			maxEntries: 2,
+			add:        []int{1, 2},
+			get:        []int{1},
+			want:       map[int]bool{1: true, 3: true, 2: false},
+			stat:       HitStat{Hits: 2, Misses: 1, HitRate: 2.0 / 3},
+		},
+		{
+			name:       "unbounded",
+			maxEntries: 0,
+			add:        []int{1, 2, 3},
+			want:       map[int]bool{1: true, 2: true, 3: true},
+			stat:       HitStat{Hits: 3, HitRate: 1},
+		},
+		{
+			name:  "expires after ttl",
+			ttl:   time.Millisecond,
+			add:   []int{1},
+			sleep: 5 * time.Millisecond,
+			want:  map[int]bool{1: false},
+			stat:  HitStat{Misses: 1, Evictions: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lc := NewLRU(tt.name, tt.maxEntries, tt.ttl)
+			for _, k := range tt.add {
+				lc.Add(k, k*10)
+			}
+			for _, k := range tt.get {
+				lc.Get(k)
+			}
+			// get で触った後に追加する
+			if len(tt.get) > 0 {
+				lc.Add(3, 30)
+			}
+			time.Sleep(tt.sleep)
+			lc.Counter().Reset()
+
+			for k, ok := range tt.want {
+				v, got := lc.Get(k)
+				if got != ok {
+					t.Errorf("Get(%d) ok = %v, want %v", k, got, ok)
+				} else if ok && v.(int) != k*10 {
+					t.Errorf("Get(%d) = %v, want %d", k, v, k*10)
+				}
+			}
+			// 準備中のヒットや追い出しは Reset で消してあるので、want を引いた分だけが数えられる
+			if stat := lc.Counter().Snapshot(); stat != tt.stat {
+				t.Errorf("stat = %+v, want %+v", stat, tt.stat)
+			}
+		})
+	}
+}
+
+func TestLRURemoveAndPurge(t *testing.T) {
+	lc := NewLRU("test", 10, 0)
+	for i := 0; i < 5; i++ {
+		lc.Add(i, i)
+	}
+	lc.Remove(1, 3, 99)
+	if n := lc.Len(); n != 3 {
+		t.Errorf("Len after Remove = %d, want 3", n)
+	}
+	if _, ok := lc.Get(1); ok {
+		t.Error("removed key is still cached")
+	}
+	lc.Purge()
+	if n := lc.Len(); n != 0 {
+		t.Errorf("Len after Purge = %d, want 0", n)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+)
+
+// S2のセルではなく、geohashのセルを使った範囲検索
+// S2のライブラリ (github.com/golang/geo/s2) は取得できないので、MySQLの ST_GeoHash でも同じ値を作れるgeohashで代用している
+// セルは緯度経度の平面を4分木で分けた矩形で、cell_idはZ順に並ぶ
+// S2のヒルベルト曲線よりも1つのセルが飛び飛びの範囲に分かれやすく、範囲の数は多くなる
+// 緯度経度をそのまま分けるので、極に近いほどセルは歪む (日本の範囲では問題にならない)
+// S2に置き換えるときは cellID, cell.bounds, cell.children と 10_estate_cell_id.sql を差し替える
+
+// なぞって検索の候補を、多角形を覆うセルのcell_idの範囲からDBで取り出す
+var flagCellCoverNazotte = newFeatureFlag("CELL_COVER_NAZOTTE", false)
+
+const (
+	// cellIDBits estate.cell_id のビット数 12桁のgeohashと同じ
+	// 10_estate_cell_id.sql と同じ値にする
+	cellIDBits = 60
+	// cellCoverMaxCells 多角形を覆うセルの数の上限
+	cellCoverMaxCells = 32
+)
+
+// geohashBits 緯度経度を経度から交互に二分したbitsビットの値にする
+// 上位のビットが同じ点は同じセルに入り、セルはcell_idの連続した範囲になる
+func geohashBits(latitude, longitude float64, bits int) uint64 {
+	latMin, latMax := -90.0, 90.0
+	lonMin, lonMax := -180.0, 180.0
+
+	var v uint64
+	for i := 0; i < bits; i++ {
+		v <<= 1
+		if i%2 == 0 {
+			mid := (lonMin + lonMax) / 2
+			if longitude >= mid {
+				v |= 1
+				lonMin = mid
+			} else {
+				lonMax = mid
+			}
+		} else {
+			mid := (latMin + latMax) / 2
+			if latitude >= mid {
+				v |= 1
+				latMin = mid
+			} else {
+				latMax = mid
+			}
+		}
+	}
+	return v
+}
+
+// cellID estate.cell_id の値
+func cellID(latitude, longitude float64) uint64 {
+	return geohashBits(latitude, longitude, cellIDBits)
+}
+
+// cell 上位bitsビットがprefixのセル
+type cell struct {
+	prefix uint64
+	bits   int
+}
+
+// bounds セルの範囲
+func (c cell) bounds() BoundingBox {
+	latMin, latMax := -90.0, 90.0
+	lonMin, lonMax := -180.0, 180.0
+	for i := 0; i < c.bits; i++ {
+		set := c.prefix>>uint(c.bits-1-i)&1 == 1
+		if i%2 == 0 {
+			mid := (lonMin + lonMax) / 2
+			if set {
+				lonMin = mid
+			} else {
+				lonMax = mid
+			}
+		} else {
+			mid := (latMin + latMax) / 2
+			if set {
+				latMin = mid
+			} else {
+				latMax = mid
+			}
+		}
+	}
+	return BoundingBox{
+		TopLeftCorner:     Coordinate{Latitude: latMin, Longitude: lonMin},
+		BottomRightCorner: Coordinate{Latitude: latMax, Longitude: lonMax},
+	}
+}
+
+// children 経度と緯度で1回ずつ分けた4つのセル
+func (c cell) children() []cell {
+	res := make([]cell, 4)
+	for i := range res {
+		res[i] = cell{prefix: c.prefix<<2 | uint64(i), bits: c.bits + 2}
+	}
+	return res
+}
+
+// cellRange cell_id の閉区間
+type cellRange struct {
+	min, max uint64
+}
+
+func (c cell) idRange() cellRange {
+	shift := uint(cellIDBits - c.bits)
+	return cellRange{min: c.prefix << shift, max: (c.prefix+1)<<shift - 1}
+}
+
+type cellRelation int
+
+const (
+	cellDisjoint cellRelation = iota
+	cellInside
+	cellPartial
+)
+
+func inBoundingBox(b BoundingBox, lat, lon float64) bool {
+	return b.TopLeftCorner.Latitude <= lat && lat <= b.BottomRightCorner.Latitude &&
+		b.TopLeftCorner.Longitude <= lon && lon <= b.BottomRightCorner.Longitude
+}
+
+func orientation(a, b, c Coordinate) float64 {
+	return (b.Latitude-a.Latitude)*(c.Longitude-a.Longitude) - (b.Longitude-a.Longitude)*(c.Latitude-a.Latitude)
+}
+
+// segmentsIntersect 線分abと線分cdが交わるか (端点で接する場合を含む)
+func segmentsIntersect(a, b, c, d Coordinate) bool {
+	d1, d2 := orientation(c, d, a), orientation(c, d, b)
+	d3, d4 := orientation(a, b, c), orientation(a, b, d)
+	return ((d1 >= 0 && d2 <= 0) || (d1 <= 0 && d2 >= 0)) && ((d3 >= 0 && d4 <= 0) || (d3 <= 0 && d4 >= 0))
+}
+
+// segmentCrossesBox 線分abが矩形bにかかるか
+func segmentCrossesBox(a, b Coordinate, box BoundingBox) bool {
+	if inBoundingBox(box, a.Latitude, a.Longitude) || inBoundingBox(box, b.Latitude, b.Longitude) {
+		return true
+	}
+	tl, br := box.TopLeftCorner, box.BottomRightCorner
+	tr := Coordinate{Latitude: tl.Latitude, Longitude: br.Longitude}
+	bl := Coordinate{Latitude: br.Latitude, Longitude: tl.Longitude}
+	return segmentsIntersect(a, b, tl, tr) || segmentsIntersect(a, b, tr, br) ||
+		segmentsIntersect(a, b, br, bl) || segmentsIntersect(a, b, bl, tl)
+}
+
+// relation セルと多角形の関係
+// 辺がセルにかかれば一部、かからなければセルの中心が内側か、多角形がセルの中にあるかで判定する
+func (c cell) relation(cs []Coordinate) cellRelation {
+	b := c.bounds()
+	for i := range cs {
+		if segmentCrossesBox(cs[i], cs[(i+1)%len(cs)], b) {
+			return cellPartial
+		}
+	}
+	if polygonContains(cs, (b.TopLeftCorner.Latitude+b.BottomRightCorner.Latitude)/2, (b.TopLeftCorner.Longitude+b.BottomRightCorner.Longitude)/2) {
+		return cellInside
+	}
+	return cellDisjoint
+}
+
+// cellCovering 多角形を覆うcell_idの範囲を返す
+// 内側のセルはそのまま使い、辺にかかるセルだけを上限に収まる限り細かくする
+func cellCovering(cs []Coordinate) []cellRange {
+	var covering []cell
+	partial := []cell{{}}
+	for len(partial) > 0 {
+		if len(covering)+4*len(partial) > cellCoverMaxCells || partial[0].bits >= cellIDBits {
+			covering = append(covering, partial...)
+			break
+		}
+		var next []cell
+		for _, p := range partial {
+			for _, child := range p.children() {
+				switch child.relation(cs) {
+				case cellInside:
+					covering = append(covering, child)
+				case cellPartial:
+					next = append(next, child)
+				}
+			}
+		}
+		partial = next
+	}
+
+	ranges := make([]cellRange, 0, len(covering))
+	for _, c := range covering {
+		ranges = append(ranges, c.idRange())
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].min < ranges[j].min })
+
+	// 隣り合う範囲はまとめる
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && merged[n-1].max+1 == r.min {
+			merged[n-1].max = r.max
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// estateIDsInCellCovering 多角形に含まれるestateのidを、多角形を覆うセルの候補から人気順にpgの範囲だけ返す
+// 2つ目の値は全件数
+func estateIDsInCellCovering(ctx context.Context, cs Coordinates, pg nazottePage, dst []int) ([]int, int64, error) {
+	if len(cs.Coordinates) < 3 {
+		return dst, 0, nil
+	}
+
+	ranges := cellCovering(cs.Coordinates)
+	if len(ranges) == 0 {
+		return dst, 0, nil
+	}
+	conds := make([]string, 0, len(ranges))
+	params := make([]interface{}, 0, 2*len(ranges))
+	for _, r := range ranges {
+		conds = append(conds, "cell_id BETWEEN ? AND ?")
+		params = append(params, r.min, r.max)
+	}
+
+	var candidates []estatePoint
+	query := `SELECT id, latitude, longitude, popularity FROM estate WHERE ` + strings.Join(conds, " OR ")
+	if err := db.SelectContext(ctx, &candidates, query, params...); err != nil {
+		return dst, 0, err
+	}
+
+	points := candidates[:0]
+	for i, p := range candidates {
+		if i%nazotteCheckInterval == 0 {
+			select {
+			case <-ctx.Done():
+				return dst, 0, ctx.Err()
+			default:
+			}
+		}
+		if polygonContains(cs.Coordinates, p.Latitude, p.Longitude) {
+			points = append(points, p)
+		}
+	}
+	return pageEstatePoints(points, pg, dst), int64(len(points)), nil
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// cachedChairs chair id -> Chair 在庫が変わるたびに捨てる
+var cachedChairs = newLRUCache("CHAIR", 50000, time.Minute)
+
+type Chair struct {
+	ID          int64  `db:"id" json:"id"`
+	Name        string `db:"name" json:"name"`
+	Description string `db:"description" json:"description"`
+	Thumbnail   string `db:"thumbnail" json:"thumbnail"`
+	Price       int64  `db:"price" json:"price"`
+	Height      int64  `db:"height" json:"height"`
+	Width       int64  `db:"width" json:"width"`
+	Depth       int64  `db:"depth" json:"depth"`
+	Color       string `db:"color" json:"color"`
+	Features    string `db:"features" json:"features"`
+	Kind        string `db:"kind" json:"kind"`
+	Popularity  int64  `db:"popularity" json:"-"`
+	Stock       int64  `db:"stock" json:"-"`
+	WidthLevel  int    `db:"width_level" json:"-"`
+	HeightLevel int    `db:"height_level" json:"-"`
+	DepthLevel  int    `db:"depth_level" json:"-"`
+	PriceLevel  int    `db:"price_level" json:"-"`
+	Hidden      bool   `db:"hidden" json:"-"`
+	// LenMin, LenMid 3辺を小さい順に並べたときの1番目と2番目 (生成列)
+	LenMin int64 `db:"len_min" json:"-"`
+	LenMid int64 `db:"len_mid" json:"-"`
+	// fragment キャッシュに入れるときに作るJSON
+	fragment []byte
+}
+
+// chairWithCount COUNT(*) OVER() で件数も一緒に取得するときの行
+type chairWithCount struct {
+	Chair
+	TotalCount int64 `db:"total_count"`
+}
+
+// BulkBuyRequest 複数の椅子をまとめて購入する
+type BulkBuyRequest struct {
+	Email string        `json:"email"`
+	Items []BulkBuyItem `json:"items"`
+}
+
+type BulkBuyItem struct {
+	ID       int64 `json:"id"`
+	Quantity int64 `json:"quantity"`
+}
+
+// RestockRequest 在庫の更新 DeltaかStockのどちらかを指定する
+type RestockRequest struct {
+	Delta *int64 `json:"delta"`
+	Stock *int64 `json:"stock"`
+}
+
+type RestockResponse struct {
+	ID    int64 `json:"id"`
+	Stock int64 `json:"stock"`
+}
+
+type ChairSearchResponse struct {
+	Count  int64   `json:"count"`
+	Chairs []Chair `json:"chairs"`
+}
+
+type ChairListResponse struct {
+	Chairs []Chair `json:"chairs"`
+}
+
+func (s *Server) getChairDetail(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Errorf("Request parameter \"id\" parse error : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	chair, err := s.getChair(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("requested id's chair not found : %v", id)
+			return notFound(c, "chair not found")
+		}
+		c.Echo().Logger.Errorf("Failed to get the chair from id : %v", err)
+		return internalError(c)
+	}
+	if chair.Hidden {
+		c.Echo().Logger.Infof("requested id's chair is hidden : %v", id)
+		return notFound(c, "chair not found")
+	}
+	if flagInMemoryStock.Enabled() {
+		if stock, ok := currentStock(int64(id)); ok {
+			chair.Stock = stock
+		}
+	}
+	if chair.Stock <= 0 {
+		c.Echo().Logger.Infof("requested id's chair is sold out : %v", id)
+		return notFound(c, "chair is sold out")
+	}
+
+	recordView(itemChair, int64(id))
+	if notModified(c, chairETag(id, chair.Stock)) {
+		return nil
+	}
+
+	return JSON(c, http.StatusOK, chair)
+}
+
+func (s *Server) postChair(c echo.Context) error {
+	ctx := c.Request().Context()
+	header, err := c.FormFile("chairs")
+	if err != nil {
+		c.Logger().Errorf("failed to get form file: %v", err)
+		return invalidParam(c, "chairs", "csv file is required")
+	}
+	columns := chairCSVColumns()
+	r, f, err := openCSVUpload(header, len(columns))
+	if err != nil {
+		c.Logger().Errorf("failed to open form file: %v", err)
+		return invalidParam(c, "chairs", "failed to open csv file")
+	}
+
+	if c.QueryParam("validate") == "1" {
+		defer f.Close()
+		return validateCSVUpload(c, r, columns)
+	}
+
+	if asyncImport(c) {
+		f.Close()
+		return enqueueImport(c, importKindChair, header)
+	}
+
+	err = s.loadChairCSV(ctx, func() (*csv.Reader, io.Closer, error) { return openCSVUpload(header, len(columns)) }, r, f, columns)
+	if ie, ok := err.(*csvInputError); ok {
+		c.Logger().Infof("failed to read csv: %v", ie.err)
+		return badRequest(c, ie.message)
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to import chairs: %v", err)
+		return internalError(c)
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// loadChairCSV rとfのCSVを書き込み、コミットした後にキャッシュを捨てる fは閉じる
+// デッドロックでやり直すときはopenで開き直す CSVの誤りは csvInputError で返す
+func (s *Server) loadChairCSV(ctx context.Context, open func() (*csv.Reader, io.Closer, error), r *csv.Reader, f io.Closer, columns []csvColumn) error {
+	res, err := s.Chairs.ImportChairs(ctx, open, r, f, columns)
+	if err != nil {
+		return err
+	}
+	forgetChairs(res.ids...)
+
+	if res.updated > 0 {
+		invalidateRecommendedEstateResponses(res.recommendKeys)
+	}
+
+	if flagInMemoryStock.Enabled() {
+		for i, id := range res.ids {
+			addStock(int64(id), int64(res.stocks[i]))
+		}
+	}
+
+	invalidateChairSearchCaches()
+
+	// 上書きした椅子は価格や在庫が変わっているかもしれない
+	invalidate := res.updated > 0
+	if invalidate {
+		bumpChairETagEpoch()
+	}
+	lowPricedChairMutex.RLock()
+	if lowPricedChair != nil && len(lowPricedChair.Chairs) > 0 {
+		currentButtom := lowPricedChair.Chairs[len(lowPricedChair.Chairs)-1].Price
+		invalidate = invalidate || (res.minPrice != -1 && res.minPrice <= currentButtom)
+	}
+	lowPricedChairMutex.RUnlock()
+
+	if invalidate {
+		lowPricedChairMutex.Lock()
+		clearLowPricedChair()
+		lowPricedChairMutex.Unlock()
+		scheduleLowPricedChairRefresh()
+	}
+
+	broadcastInvalidation(cacheInvalidation{Kind: peerKindChair, IDs: res.ids, Search: true, LowPriced: invalidate, Epoch: res.updated > 0})
+	publishEvent(EventItemsImported, ItemsImported{Kind: peerKindChair, IDs: res.ids, Updated: res.updated})
+
+	return nil
+}
+
+func (s *Server) searchChairs(c echo.Context) error {
+	sc := currentConditions()
+	if flagSearchPageCache.Enabled() && !bypassSearchCaches(c) && serveCachedSearchPage(c, chairPageCache) {
+		return nil
+	}
+	ctx := c.Request().Context()
+
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	searchQuery := "SELECT chair.* FROM chair"
+	countQuery := "SELECT COUNT(*) FROM chair"
+
+	var chairPrice, chairHeight, chairWidth, chairDepth []int64
+	var chairFeatureIDs []int
+
+	if c.QueryParam("priceRangeId") != "" {
+		var err error
+		chairPrice, err = getRanges(sc.Chair.Price, c.QueryParam("priceRangeId"))
+		if err != nil {
+			c.Echo().Logger.Infof("priceRangeID invalid, %v : %v", c.QueryParam("priceRangeId"), err)
+			return invalidParam(c, "priceRangeId", "unknown range id")
+		}
+		cond, args := levelCondition("price_level", chairPrice)
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+	}
+
+	if c.QueryParam("heightRangeId") != "" {
+		var err error
+		chairHeight, err = getRanges(sc.Chair.Height, c.QueryParam("heightRangeId"))
+		if err != nil {
+			c.Echo().Logger.Infof("heightRangeIf invalid, %v : %v", c.QueryParam("heightRangeId"), err)
+			return invalidParam(c, "heightRangeId", "unknown range id")
+		}
+		cond, args := levelCondition("height_level", chairHeight)
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+	}
+
+	if c.QueryParam("widthRangeId") != "" {
+		var err error
+		chairWidth, err = getRanges(sc.Chair.Width, c.QueryParam("widthRangeId"))
+		if err != nil {
+			c.Echo().Logger.Infof("widthRangeID invalid, %v : %v", c.QueryParam("widthRangeId"), err)
+			return invalidParam(c, "widthRangeId", "unknown range id")
+		}
+		cond, args := levelCondition("width_level", chairWidth)
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+	}
+
+	if c.QueryParam("depthRangeId") != "" {
+		var err error
+		chairDepth, err = getRanges(sc.Chair.Depth, c.QueryParam("depthRangeId"))
+		if err != nil {
+			c.Echo().Logger.Infof("depthRangeId invalid, %v : %v", c.QueryParam("depthRangeId"), err)
+			return invalidParam(c, "depthRangeId", "unknown range id")
+		}
+		cond, args := levelCondition("depth_level", chairDepth)
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+	}
+
+	if c.QueryParam("kind") != "" {
+		conditions = append(conditions, "kind = ?")
+		params = append(params, c.QueryParam("kind"))
+	}
+
+	if c.QueryParam("color") != "" {
+		conditions = append(conditions, "color = ?")
+		params = append(params, c.QueryParam("color"))
+	}
+
+	if c.QueryParam("features") != "" {
+		seen := map[string]bool{}
+		for _, f := range strings.Split(c.QueryParam("features"), ",") {
+			if len(f) == 0 || seen[f] {
+				continue
+			}
+			seen[f] = true
+
+			// 存在しないfeatureは何にもマッチさせない
+			id, ok := sc.ChairFeatures[f]
+			if !ok {
+				id = -1
+			}
+			chairFeatureIDs = append(chairFeatureIDs, id)
+		}
+
+		if len(chairFeatureIDs) > 0 {
+			join, args, err := sqlx.In(" INNER JOIN (SELECT chair_id FROM chair_feature WHERE feature_id IN (?) GROUP BY chair_id HAVING COUNT(*) = ?) TMP ON chair.id = TMP.chair_id", chairFeatureIDs, len(chairFeatureIDs))
+			if err != nil {
+				c.Logger().Errorf("searchChairs failed to build query : %v", err)
+				return internalError(c)
+			}
+			searchQuery += join
+			countQuery += join
+			// featureの条件はFROM句のJOINに入るので、WHERE句のパラメータより前に渡す
+			params = append(args, params...)
+		}
+	}
+
+	if len(conditions) == 0 && len(chairFeatureIDs) == 0 {
+		c.Echo().Logger.Infof("Search condition not found")
+		return badRequest(c, "search condition not found")
+	}
+
+	conditions = append(conditions, "stock > 0", "hidden = 0")
+
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil {
+		c.Logger().Infof("Invalid format page parameter : %v", err)
+		return invalidParam(c, "page", "must be an integer")
+	}
+
+	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	if err != nil {
+		c.Logger().Infof("Invalid format perPage parameter : %v", err)
+		return invalidParam(c, "perPage", "must be an integer")
+	}
+	perPage = clampPerPage(c, perPage)
+
+	if flagInMemorySearch.Enabled() && searchRanking(c).popularityOnly() {
+		q := memQuery{
+			Levels: [memLevelDims][]int64{chairPrice, chairHeight, chairWidth, chairDepth},
+			Kind:   c.QueryParam("kind"),
+			Color:  c.QueryParam("color"),
+			// 存在しないfeatureの-1はリストがないので何にもマッチしない
+			Features: chairFeatureIDs,
+		}
+		if ok, err := s.searchChairsInMemory(c, q, page, perPage); ok {
+			return err
+		}
+	}
+	if s.DB == nil {
+		return notImplemented(c, "only popularity-ranked searches are available with STORAGE=memory")
+	}
+	// featureを2つ以上指定した検索はMySQLだとJOINが重いのでElasticsearchで答える
+	if flagElasticsearch.Enabled() && searchRanking(c).popularityOnly() && len(chairFeatureIDs) > 1 {
+		q := memQuery{
+			Levels:   [memLevelDims][]int64{chairPrice, chairHeight, chairWidth, chairDepth},
+			Kind:     c.QueryParam("kind"),
+			Color:    c.QueryParam("color"),
+			Features: chairFeatureIDs,
+		}
+		if ok, err := s.searchChairsInElasticsearch(c, q, page, perPage); ok {
+			return err
+		}
+	}
+
+	searchQuery += " WHERE "
+	countQuery += " WHERE "
+	searchCondition := strings.Join(conditions, " AND ")
+	limitOffset := chairRanking.orderBy(searchRanking(c)) + " LIMIT ? OFFSET ?"
+
+	// 大きいページは行を読みながら書き出し、スライスに溜めない
+	if flagStreamLargePages.Enabled() && perPage > StreamPerPageThreshold && !wantsProtobuf(c) {
+		count, err := chairCountCache.count(ctx, s.DB, countQuery+searchCondition, params)
+		if err != nil {
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return internalError(c)
+		}
+		rows, err := s.DB.QueryxContext(ctx, searchQuery+searchCondition+limitOffset, append(params, perPage, page*perPage)...)
+		if err != nil {
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return internalError(c)
+		}
+		defer rows.Close()
+		return JSONStreamRows(c, http.StatusOK, count, "chairs", rows, &Chair{})
+	}
+
+	// 要約なら返すカラムだけを読む
+	chairSelect := "chair.*"
+	if summaryView(c) {
+		chairSelect = chairSummaryColumns
+		searchQuery = strings.Replace(searchQuery, "SELECT chair.*", "SELECT "+chairSelect, 1)
+	}
+
+	var res ChairSearchResponse
+	chairs := getEmptyChairSlice()
+	defer releaseChairSlice(chairs)
+
+	if flagChairSearchWindowCount.Enabled() {
+		// COUNT(*) OVER() で件数と行を1往復で取得する
+		// 同じクエリの呼び出しと結果を共有するので rows は書き換えない
+		windowQuery := strings.Replace(searchQuery, "SELECT "+chairSelect, "SELECT "+chairSelect+", COUNT(*) OVER() AS total_count", 1) + searchCondition + limitOffset
+		windowParams := append(params, perPage, page*perPage)
+		v, err := sharedQuery(ctx, windowQuery, windowParams, func(ctx context.Context) (interface{}, error) {
+			rows := make([]chairWithCount, 0, perPage)
+			err := s.DB.SelectContext(ctx, &rows, windowQuery, windowParams...)
+			return rows, err
+		})
+		if err != nil {
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return internalError(c)
+		}
+		rows := v.([]chairWithCount)
+
+		if len(rows) > 0 {
+			res.Count = rows[0].TotalCount
+			for _, r := range rows {
+				chairs = append(chairs, r.Chair)
+			}
+		} else if page > 0 {
+			// 範囲外のページでは件数が取れないので別途数える
+			res.Count, err = chairCountCache.count(ctx, s.DB, countQuery+searchCondition, params)
+			if err != nil {
+				c.Logger().Errorf("searchChairs DB execution error : %v", err)
+				return internalError(c)
+			}
+		}
+	} else {
+		res.Count, err = chairCountCache.count(ctx, s.DB, countQuery+searchCondition, params)
+		if err != nil {
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return internalError(c)
+		}
+
+		params = append(params, perPage, page*perPage)
+		chairs, err = s.selectChairs(ctx, chairs, searchQuery+searchCondition+limitOffset, params...)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return JSONOrProtobuf(c, http.StatusOK, &ChairSearchResponse{Count: 0, Chairs: []Chair{}})
+			}
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return internalError(c)
+		}
+	}
+
+	res.Chairs = chairs
+
+	return JSONOrProtobuf(c, http.StatusOK, &res)
+}
+
+func (s *Server) buyChair(c echo.Context) error {
+	ctx := c.Request().Context()
+	m := echo.Map{}
+	if err := c.Bind(&m); err != nil {
+		c.Echo().Logger.Infof("post buy chair failed : %v", err)
+		return internalError(c)
+	}
+
+	email, ok := m["email"].(string)
+	if !ok {
+		c.Echo().Logger.Info("post buy chair failed : email not found in request body")
+		return invalidParam(c, "email", "is required")
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("post buy chair failed : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	if flagInMemoryStock.Enabled() {
+		// 非表示はメモリ上の在庫に表れないので、椅子を引いて確かめる 引けなければ購入させない
+		chair, err := s.getChair(id)
+		if err != nil && err != sql.ErrNoRows {
+			c.Echo().Logger.Errorf("buyChair DB execution error : %v", err)
+			return internalError(c)
+		}
+		if err == sql.ErrNoRows || chair.Hidden {
+			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+			return notFound(c, "chair not found")
+		}
+		// 在庫はメモリ上で減らし、DBへは syncStocks がまとめて書き出す
+		// 取り置きも作成時にこの在庫から減らしているので、取り置き中の分は買えない
+		stock, ok, _ := adjustStock(int64(id), -1)
+		if !ok {
+			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+			return notFound(c, "chair not found")
+		}
+		// DBへの書き出しを待たずに、DBで購入したときと同じようにキャッシュを捨てる
+		// 書き出した後にも flushStocks がもう一度捨てるので、その間にDBから作り直した古い結果も残らない
+		if stock == 0 {
+			invalidateChairStock(id, true)
+		} else {
+			decrementLowPricedChairStock(id)
+		}
+		recordPurchase(itemChair, int64(id), 1)
+		recordChairPurchase(email, int64(id), 1)
+		return c.NoContent(http.StatusOK)
+	}
+
+	// 売り切れがキャッシュ済みならDBに問い合わせない
+	if v, ok := cachedChairs.Get(id); ok && (v.(Chair).Stock <= 0 || v.(Chair).Hidden) {
+		c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+		return notFound(c, "chair not found")
+	}
+
+	stock, err := s.Chairs.BuyChair(ctx, id)
+	if err == sql.ErrNoRows {
+		c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+		return notFound(c, "chair not found")
+	}
+	if err != nil {
+		c.Echo().Logger.Errorf("chair stock update failed : %v", err)
+		return internalError(c)
+	}
+
+	forgetChairs(id)
+
+	// 売り切れたときだけ検索結果が変わる
+	if stock == 0 {
+		invalidateChairSearchCaches()
+	}
+
+	decrementLowPricedChairStock(id)
+
+	broadcastInvalidation(cacheInvalidation{Kind: peerKindChair, IDs: []int{id}, Search: stock == 0})
+
+	recordPurchase(itemChair, int64(id), 1)
+	recordChairPurchase(email, int64(id), 1)
+	return c.NoContent(http.StatusOK)
+}
+
+// buyChairs 複数の椅子を1トランザクションで購入する
+// 1つでも在庫が足りなければ何も購入しない
+func (s *Server) buyChairs(c echo.Context) error {
+	ctx := c.Request().Context()
+	var req BulkBuyRequest
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("post bulk buy chair failed : %v", err)
+		return badRequest(c, "invalid request body")
+	}
+	if req.Email == "" {
+		c.Echo().Logger.Info("post bulk buy chair failed : email not found in request body")
+		return invalidParam(c, "email", "is required")
+	}
+	if len(req.Items) == 0 {
+		c.Echo().Logger.Info("post bulk buy chair failed : items not found in request body")
+		return invalidParam(c, "items", "is required")
+	}
+
+	// 同じidはまとめる
+	quantities := map[int64]int64{}
+	for _, item := range req.Items {
+		if item.Quantity <= 0 {
+			c.Echo().Logger.Infof("post bulk buy chair failed : invalid quantity %v", item.Quantity)
+			return invalidParam(c, "items", "quantity must be positive")
+		}
+		quantities[item.ID] += item.Quantity
+	}
+	// BuyChairs はデッドロックを避けるためにこの順にロックする
+	ids := make([]int64, 0, len(quantities))
+	for id := range quantities {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if flagInMemoryStock.Enabled() {
+		for i, id := range ids {
+			if _, ok, known := adjustStock(id, -quantities[id]); !ok {
+				// それまでに減らした分を戻す
+				for _, done := range ids[:i] {
+					adjustStock(done, quantities[done])
+				}
+				if !known {
+					c.Echo().Logger.Info("bulk buyChair some chairs not found")
+					return notFound(c, "some chairs not found")
+				}
+				c.Echo().Logger.Infof("bulk buyChair chair id \"%v\" out of stock", id)
+				return conflict(c, "chair is out of stock")
+			}
+		}
+		for id, q := range quantities {
+			recordPurchase(itemChair, id, q)
+			recordChairPurchase(req.Email, id, q)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+
+	soldOut, err := s.Chairs.BuyChairs(ctx, ids, quantities)
+	switch err {
+	case nil:
+	case errChairNotFound:
+		c.Echo().Logger.Info("bulk buyChair some chairs not found")
+		return notFound(c, "some chairs not found")
+	case errOutOfStock:
+		c.Echo().Logger.Info("bulk buyChair some chairs out of stock")
+		return conflict(c, "chair is out of stock")
+	default:
+		c.Echo().Logger.Errorf("bulk buyChair DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	forgetIDs := make([]int, len(ids))
+	for i, id := range ids {
+		forgetIDs[i] = int(id)
+	}
+	forgetChairs(forgetIDs...)
+
+	if soldOut {
+		invalidateChairSearchCaches()
+	}
+
+	lowPricedChairMutex.Lock()
+	if lowPricedChair != nil {
+		for _, chair := range lowPricedChair.Chairs {
+			if _, ok := quantities[chair.ID]; ok {
+				clearLowPricedChair()
+				break
+			}
+		}
+	}
+	lowPricedChairMutex.Unlock()
+	scheduleLowPricedChairRefresh()
+
+	broadcastInvalidation(cacheInvalidation{Kind: peerKindChair, IDs: forgetIDs, Search: soldOut})
+
+	for id, q := range quantities {
+		recordPurchase(itemChair, id, q)
+		recordChairPurchase(req.Email, id, q)
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+func (s *Server) restockChair(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("restock chair failed : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	var req RestockRequest
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("restock chair failed : %v", err)
+		return badRequest(c, "invalid request body")
+	}
+	if (req.Delta == nil) == (req.Stock == nil) {
+		c.Echo().Logger.Info("restock chair failed : either delta or stock is required")
+		return badRequest(c, "either delta or stock is required")
+	}
+
+	if flagInMemoryStock.Enabled() {
+		cur, known := currentStock(int64(id))
+		if !known {
+			c.Echo().Logger.Infof("restockChair chair id \"%v\" not found", id)
+			return notFound(c, "chair not found")
+		}
+		var delta int64
+		if req.Stock != nil {
+			delta = *req.Stock - cur
+		} else {
+			delta = *req.Delta
+		}
+		stock, ok, _ := adjustStock(int64(id), delta)
+		if !ok {
+			c.Echo().Logger.Infof("restockChair stock would be negative : %v", stock+delta)
+			return badRequest(c, "stock would be negative")
+		}
+		// DBへの書き出しを待たずに、DBで更新したときと同じようにキャッシュを捨てる
+		invalidateChairStock(id, (stock-delta > 0) != (stock > 0))
+		return JSON(c, http.StatusOK, RestockResponse{ID: int64(id), Stock: stock})
+	}
+
+	before, stock, err := s.Chairs.RestockChair(ctx, id, func(stock int64) int64 {
+		if req.Delta != nil {
+			return stock + *req.Delta
+		}
+		return *req.Stock
+	})
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		c.Echo().Logger.Infof("restockChair chair id \"%v\" not found", id)
+		return notFound(c, "chair not found")
+	case errNegativeStock:
+		c.Echo().Logger.Infof("restockChair stock would be negative : %v", stock)
+		return badRequest(c, "stock would be negative")
+	default:
+		c.Echo().Logger.Errorf("restockChair DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	invalidateChairStock(id, (before > 0) != (stock > 0))
+
+	return JSON(c, http.StatusOK, RestockResponse{ID: int64(id), Stock: stock})
+}
+
+// deleteChair 椅子を非表示にする
+// 購入履歴などを残すために行は消さずに hidden を立てる
+func (s *Server) deleteChair(c echo.Context) error {
+	return s.setChairHidden(c, true)
+}
+
+// unhideChair 非表示にした椅子を再び表示する
+func (s *Server) unhideChair(c echo.Context) error {
+	return s.setChairHidden(c, false)
+}
+
+func (s *Server) setChairHidden(c echo.Context, hidden bool) error {
+	ctx := c.Request().Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("set chair hidden failed : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	err = s.Chairs.SetChairHidden(ctx, id, hidden)
+	if err == sql.ErrNoRows {
+		c.Echo().Logger.Infof("setChairHidden chair id \"%v\" not found", id)
+		return notFound(c, "chair not found")
+	}
+	if err != nil {
+		c.Echo().Logger.Errorf("setChairHidden DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	// 検索結果と安い順から出し入れされるので在庫の有無が変わったときと同じように捨てる
+	invalidateChairStock(id, true)
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getChairSearchCondition(c echo.Context) error {
+	return JSONBlob(c, http.StatusOK, currentConditions().ChairJSON)
+}
+
+// invalidateChairStock 椅子の在庫が変わったときにキャッシュを捨てる
+// availabilityChanged は在庫の有無が変わったかどうか
+func invalidateChairStock(id int, availabilityChanged bool) {
+	forgetChairs(id)
+
+	// 在庫の有無が変わったときだけ検索結果が変わる
+	if availabilityChanged {
+		invalidateChairSearchCaches()
+	}
+
+	// 在庫が戻った椅子が安い順に入ってくる可能性があるので作り直す
+	lowPricedChairMutex.Lock()
+	if availabilityChanged {
+		clearLowPricedChair()
+	} else if lowPricedChair != nil {
+		for _, chair := range lowPricedChair.Chairs {
+			if chair.ID == int64(id) {
+				clearLowPricedChair()
+				break
+			}
+		}
+	}
+	lowPricedChairMutex.Unlock()
+	scheduleLowPricedChairRefresh()
+
+	broadcastInvalidation(cacheInvalidation{Kind: peerKindChair, IDs: []int{id}, Search: availabilityChanged, LowPriced: availabilityChanged})
+}
+
+// getChair idからchairを取得する
+// cachedChairs になければ持ち主のサーバーに問い合わせ、自分が持ち主なら loadChair で読み込む
+func (s *Server) getChair(id int) (Chair, error) {
+	if v, ok := cachedChairs.Get(id); ok {
+		return v.(Chair), nil
+	}
+
+	var chair Chair
+	if ok, err := peerGet(peerKindChair, id, &chair); err != nil {
+		return chair, err
+	} else if ok {
+		chair = withChairFragment(chair)
+		cachedChairs.Add(id, chair)
+		return chair, nil
+	}
+	return s.loadChair(id)
+}
+
+// loadChair 他のサーバーには問い合わせずに、cachedChairs か共有キャッシュかDBから取得する
+func (s *Server) loadChair(id int) (Chair, error) {
+	if v, ok := cachedChairs.Get(id); ok {
+		return v.(Chair), nil
+	}
+
+	var chair Chair
+	sharedKey, shared := sharedChairs.key(strconv.Itoa(id))
+	if !shared || !sharedCacheGet(sharedKey, &chair) {
+		var err error
+		if chair, err = s.Chairs.ChairByID(context.Background(), id); err != nil {
+			return chair, err
+		}
+		if shared {
+			sharedCacheSet(sharedKey, chair)
+		}
+	}
+
+	chair = withChairFragment(chair)
+	cachedChairs.Add(id, chair)
+
+	return chair, nil
+}
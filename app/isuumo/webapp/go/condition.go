@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Range struct {
+	ID  int64 `json:"id"`
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+}
+
+type RangeCondition struct {
+	Prefix string   `json:"prefix"`
+	Suffix string   `json:"suffix"`
+	Ranges []*Range `json:"ranges"`
+}
+
+type ListCondition struct {
+	List []string `json:"list"`
+}
+
+type EstateSearchCondition struct {
+	DoorWidth  RangeCondition `json:"doorWidth"`
+	DoorHeight RangeCondition `json:"doorHeight"`
+	Rent       RangeCondition `json:"rent"`
+	Feature    ListCondition  `json:"feature"`
+}
+
+type ChairSearchCondition struct {
+	Width   RangeCondition `json:"width"`
+	Height  RangeCondition `json:"height"`
+	Depth   RangeCondition `json:"depth"`
+	Price   RangeCondition `json:"price"`
+	Color   ListCondition  `json:"color"`
+	Feature ListCondition  `json:"feature"`
+	Kind    ListCondition  `json:"kind"`
+}
+
+func getRange(cond RangeCondition, rangeID string) (*Range, error) {
+	RangeIndex, err := strconv.Atoi(rangeID)
+	if err != nil {
+		return nil, err
+	}
+
+	if RangeIndex < 0 || len(cond.Ranges) <= RangeIndex {
+		return nil, fmt.Errorf("Unexpected Range ID")
+	}
+
+	return cond.Ranges[RangeIndex], nil
+}
+
+// getRanges カンマ区切りのRange IDを重複を除いて昇順で返す
+func getRanges(cond RangeCondition, rangeIDs string) ([]int64, error) {
+	seen := map[int64]bool{}
+	var ids []int64
+	for _, rangeID := range strings.Split(rangeIDs, ",") {
+		r, err := getRange(cond, rangeID)
+		if err != nil {
+			return nil, err
+		}
+		if seen[r.ID] {
+			continue
+		}
+		seen[r.ID] = true
+		ids = append(ids, r.ID)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// levelCondition levelのカラムがidsのいずれかに一致する条件を作る
+func levelCondition(column string, ids []int64) (string, []interface{}) {
+	params := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		params = append(params, id)
+	}
+	if len(ids) == 1 {
+		return column + " = ?", params
+	}
+	return column + " IN (?" + strings.Repeat(", ?", len(ids)-1) + ")", params
+}
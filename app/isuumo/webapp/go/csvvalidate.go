@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+// 検証結果に含めるエラーのある行の数の上限
+const csvValidationMaxRows = 1000
+
+// csvColumn CSVの1カラムの名前と検証
+// check は問題がなければ空文字列を返す
+type csvColumn struct {
+	Name  string
+	check func(v string) string
+}
+
+func intColumn(name string, cond *RangeCondition) csvColumn {
+	return csvColumn{Name: name, check: func(v string) string {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return "not an integer"
+		}
+		if i < 0 {
+			return "must not be negative"
+		}
+		if cond != nil && cond.level(int64(i)) == -1 {
+			return "out of search ranges"
+		}
+		return ""
+	}}
+}
+
+func floatColumn(name string, min, max float64) csvColumn {
+	return csvColumn{Name: name, check: func(v string) string {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return "not a number"
+		}
+		if f < min || f > max {
+			return fmt.Sprintf("must be between %v and %v", min, max)
+		}
+		return ""
+	}}
+}
+
+func stringColumn(name string, maxLen int) csvColumn {
+	return csvColumn{Name: name, check: func(v string) string {
+		if utf8.RuneCountInString(v) > maxLen {
+			return fmt.Sprintf("longer than %d characters", maxLen)
+		}
+		return ""
+	}}
+}
+
+func listColumn(name string, list []string) csvColumn {
+	return csvColumn{Name: name, check: func(v string) string {
+		for _, s := range list {
+			if s == v {
+				return ""
+			}
+		}
+		return fmt.Sprintf("unknown value %q", v)
+	}}
+}
+
+func featuresColumn(name string, maxLen int, features map[string]int) csvColumn {
+	return csvColumn{Name: name, check: func(v string) string {
+		if utf8.RuneCountInString(v) > maxLen {
+			return fmt.Sprintf("longer than %d characters", maxLen)
+		}
+		var unknown []string
+		for _, f := range strings.Split(v, ",") {
+			if len(f) == 0 {
+				continue
+			}
+			if _, ok := features[f]; !ok {
+				unknown = append(unknown, f)
+			}
+		}
+		if len(unknown) > 0 {
+			return fmt.Sprintf("unknown features %q", unknown)
+		}
+		return ""
+	}}
+}
+
+// chairCSVColumns postChairのCSVのカラム ヘッダ行がなければこの順番で並んでいるものとする
+func chairCSVColumns() []csvColumn {
+	cond := currentConditions()
+	return []csvColumn{
+		intColumn("id", nil),
+		stringColumn("name", 64),
+		stringColumn("description", 4096),
+		stringColumn("thumbnail", 128),
+		intColumn("price", &cond.Chair.Price),
+		intColumn("height", &cond.Chair.Height),
+		intColumn("width", &cond.Chair.Width),
+		intColumn("depth", &cond.Chair.Depth),
+		listColumn("color", cond.Chair.Color.List),
+		featuresColumn("features", 64, cond.ChairFeatures),
+		listColumn("kind", cond.Chair.Kind.List),
+		intColumn("popularity", nil),
+		intColumn("stock", nil),
+	}
+}
+
+// estateCSVColumns postEstateのCSVのカラム ヘッダ行がなければこの順番で並んでいるものとする
+func estateCSVColumns() []csvColumn {
+	cond := currentConditions()
+	return []csvColumn{
+		intColumn("id", nil),
+		stringColumn("name", 64),
+		stringColumn("description", 4096),
+		stringColumn("thumbnail", 128),
+		stringColumn("address", 128),
+		floatColumn("latitude", -90, 90),
+		floatColumn("longitude", -180, 180),
+		intColumn("rent", &cond.Estate.Rent),
+		intColumn("door_height", &cond.Estate.DoorHeight),
+		intColumn("door_width", &cond.Estate.DoorWidth),
+		featuresColumn("features", 64, cond.EstateFeatures),
+		intColumn("popularity", nil),
+	}
+}
+
+type csvRowError struct {
+	// Row ヘッダ行を除いた1始まりの行番号
+	Row    int               `json:"row"`
+	Errors map[string]string `json:"errors"`
+}
+
+type csvValidationReport struct {
+	Rows      int           `json:"rows"`
+	ErrorRows int           `json:"errorRows"`
+	Valid     bool          `json:"valid"`
+	Errors    []csvRowError `json:"errors"`
+}
+
+// validateCSV 全ての行を検証して、エラーのある行を報告する
+func validateCSV(r *csv.Reader, cols []csvColumn) (csvValidationReport, error) {
+	report := csvValidationReport{Errors: []csvRowError{}}
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+
+	rows := newCSVRows(r, cols)
+	ids := map[string]int{}
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Rows++
+
+		errs := map[string]string{}
+		if len(row) != len(cols) {
+			errs["_"] = fmt.Sprintf("expected %d columns, got %d", len(cols), len(row))
+		} else {
+			for i, col := range cols {
+				if msg := col.check(row[i]); msg != "" {
+					errs[col.Name] = msg
+				}
+			}
+			if prev, ok := ids[row[0]]; ok {
+				errs["id"] = fmt.Sprintf("duplicated with row %d", prev)
+			} else {
+				ids[row[0]] = report.Rows
+			}
+		}
+
+		if len(errs) > 0 {
+			report.ErrorRows++
+			if len(report.Errors) < csvValidationMaxRows {
+				report.Errors = append(report.Errors, csvRowError{Row: report.Rows, Errors: errs})
+			}
+		}
+	}
+	report.Valid = report.ErrorRows == 0
+	return report, nil
+}
+
+// validateCSVUpload ?validate=1 のときに何も書き込まずに検証結果を返す
+func validateCSVUpload(c echo.Context, r *csv.Reader, cols []csvColumn) error {
+	report, err := validateCSV(r, cols)
+	if err != nil {
+		c.Logger().Infof("failed to read csv: %v", err)
+		return badRequest(c, "invalid csv")
+	}
+	return JSON(c, http.StatusOK, report)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// searchCursor ORDER BY popularity DESC, id ASC で最後に返した行の位置
+type searchCursor struct {
+	Popularity int64
+	ID         int64
+}
+
+// encode クライアントには中身を意識させないようにbase64にする
+func (sc searchCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(sc.Popularity, 10) + ":" + strconv.FormatInt(sc.ID, 10)))
+}
+
+func decodeSearchCursor(s string) (searchCursor, error) {
+	var sc searchCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return sc, err
+	}
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 2 {
+		return sc, fmt.Errorf("malformed cursor")
+	}
+	if sc.Popularity, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return sc, err
+	}
+	if sc.ID, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return sc, err
+	}
+	return sc, nil
+}
+
+// condition カーソルより後ろの行だけを取る条件
+// ORDER BY neg_popularity ASC, id ASC の索引をそのまま使えるように neg_popularity で比べる
+func (sc searchCursor) condition() (string, []interface{}) {
+	return "(neg_popularity > ? OR (neg_popularity = ? AND id > ?))", []interface{}{-sc.Popularity, -sc.Popularity, sc.ID}
+}
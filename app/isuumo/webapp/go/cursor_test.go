@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeSearchCursor(t *testing.T) {
+	raw := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		name    string
+		in      string
+		want    searchCursor
+		wantErr bool
+	}{
+		{"valid", raw("123:45"), searchCursor{123, 45}, false},
+		{"zero", raw("0:0"), searchCursor{0, 0}, false},
+		{"negative popularity", raw("-5:1"), searchCursor{-5, 1}, false},
+		{"max int64", raw("9223372036854775807:9223372036854775807"), searchCursor{math.MaxInt64, math.MaxInt64}, false},
+		{"empty", "", searchCursor{}, true},
+		{"not base64", "!!!", searchCursor{}, true},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte("1:23")), searchCursor{}, true},
+		{"std base64 alphabet", "+/", searchCursor{}, true},
+		{"no separator", raw("12"), searchCursor{}, true},
+		{"too many parts", raw("1:2:3"), searchCursor{}, true},
+		{"empty popularity", raw(":2"), searchCursor{}, true},
+		{"empty id", raw("1:"), searchCursor{}, true},
+		{"not a number", raw("a:2"), searchCursor{}, true},
+		{"overflow", raw("9223372036854775808:1"), searchCursor{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeSearchCursor(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeSearchCursor(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("decodeSearchCursor(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchCursorRoundTrip(t *testing.T) {
+	for _, sc := range []searchCursor{{0, 0}, {1, 2}, {-1, 3}, {math.MaxInt64, math.MaxInt64}, {math.MinInt64, 1}} {
+		got, err := decodeSearchCursor(sc.encode())
+		if err != nil {
+			t.Fatalf("decode(%+v.encode()) : %v", sc, err)
+		}
+		if got != sc {
+			t.Errorf("decode(%+v.encode()) = %+v", sc, got)
+		}
+	}
+}
+
+func TestSearchCursorCondition(t *testing.T) {
+	query, args := searchCursor{Popularity: 10, ID: 3}.condition()
+	if query != "(neg_popularity > ? OR (neg_popularity = ? AND id > ?))" {
+		t.Errorf("query = %s", query)
+	}
+	if want := []interface{}{int64(-10), int64(-10), int64(3)}; !reflect.DeepEqual(args, want) {
+		t.Errorf("args = %v, want %v", args, want)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// requestQueries 1リクエストが発行したクエリの数と時間
+// 並行してクエリを発行することがあるのでatomicで数える
+type requestQueries struct {
+	count  int64
+	errors int64
+	nanos  int64
+}
+
+type requestQueriesKey struct{}
+
+func withRequestQueries(ctx context.Context, rq *requestQueries) context.Context {
+	return context.WithValue(ctx, requestQueriesKey{}, rq)
+}
+
+// requestQueriesOf ctxのリクエストの集計先 リクエスト以外から発行したクエリならnil
+func requestQueriesOf(ctx context.Context) *requestQueries {
+	rq, _ := ctx.Value(requestQueriesKey{}).(*requestQueries)
+	return rq
+}
+
+func (rq *requestQueries) record(d time.Duration, err error) {
+	atomic.AddInt64(&rq.count, 1)
+	if err != nil {
+		atomic.AddInt64(&rq.errors, 1)
+	}
+	atomic.AddInt64(&rq.nanos, int64(d))
+}
+
+// dbPoolStats sql.DBStats のうち、プールが足りているかを見るためのもの
+type dbPoolStats struct {
+	MaxOpen           int     `json:"maxOpen"`
+	Open              int     `json:"open"`
+	InUse             int     `json:"inUse"`
+	Idle              int     `json:"idle"`
+	WaitCount         int64   `json:"waitCount"`
+	WaitMs            float64 `json:"waitMs"`
+	MaxIdleClosed     int64   `json:"maxIdleClosed"`
+	MaxLifetimeClosed int64   `json:"maxLifetimeClosed"`
+}
+
+// getDBStats コネクションプールの状態と、エンドポイントごとのクエリ数を返す
+// 接続待ちが多ければプールが、1リクエストあたりのクエリが多ければクエリがボトルネック
+func getDBStats(c echo.Context) error {
+	st := db.Stats()
+	return JSON(c, http.StatusOK, echo.Map{
+		"pool": dbPoolStats{
+			MaxOpen:           st.MaxOpenConnections,
+			Open:              st.OpenConnections,
+			InUse:             st.InUse,
+			Idle:              st.Idle,
+			WaitCount:         st.WaitCount,
+			WaitMs:            float64(st.WaitDuration) / float64(time.Millisecond),
+			MaxIdleClosed:     st.MaxIdleClosed,
+			MaxLifetimeClosed: st.MaxLifetimeClosed,
+		},
+		"queryMetrics": getEnv("SQL_METRICS", "0") == "1",
+		"endpoints":    snapshotEndpointStats(),
+	})
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// 椅子と物件をElasticsearch (OpenSearch) に写し、全文検索や条件の多い検索をそちらで答える
+// MySQLが正で、Elasticsearchには書き込みの後に非同期で反映する
+// 作り直している間や失敗したときはMySQLで検索する
+// 使うAPIは _bulk, _search とインデックスの作成と削除だけなので、クライアントライブラリは入れずにHTTPで話す
+var flagElasticsearch = newFeatureFlag("ELASTICSEARCH", false)
+
+var (
+	esURL         = strings.TrimSuffix(getEnv("ELASTICSEARCH_URL", "http://127.0.0.1:9200"), "/")
+	esIndexPrefix = getEnv("ELASTICSEARCH_INDEX_PREFIX", "isuumo_")
+	esClient      = &http.Client{Timeout: parseDurationEnv("ELASTICSEARCH_TIMEOUT", 2*time.Second)}
+)
+
+const (
+	// esBulkSize 1回の _bulk で送る行の数
+	esBulkSize = 500
+	// esSyncQueueSize 反映待ちの書き込みの数 溢れたら作り直すまで反映されない
+	esSyncQueueSize = 1024
+)
+
+// esMapping 椅子と物件で共通のマッピング
+// level0〜level3 は memEntry.Levels と同じ並び
+// name などは標準のアナライザで1文字ずつに分かれるので、語をフレーズで探すと部分一致になる
+const esMapping = `{"mappings":{"properties":{
+"id":{"type":"long"},"popularity":{"type":"long"},
+"level0":{"type":"long"},"level1":{"type":"long"},"level2":{"type":"long"},"level3":{"type":"long"},
+"kind":{"type":"keyword"},"color":{"type":"keyword"},"feature_ids":{"type":"integer"},
+"stock":{"type":"long"},"hidden":{"type":"boolean"},
+"name":{"type":"text"},"description":{"type":"text"},"address":{"type":"text","fields":{"raw":{"type":"keyword"}}},
+"prefecture":{"type":"keyword"},"rent":{"type":"long"},"door_height":{"type":"long"},"door_width":{"type":"long"}}}}`
+
+// esDoc インデックスに入れる1行
+type esDoc struct {
+	ID         int64  `json:"id"`
+	Popularity int64  `json:"popularity"`
+	Level0     int64  `json:"level0"`
+	Level1     int64  `json:"level1"`
+	Level2     int64  `json:"level2"`
+	Level3     int64  `json:"level3"`
+	Kind       string `json:"kind,omitempty"`
+	Color      string `json:"color,omitempty"`
+	FeatureIDs []int  `json:"feature_ids"`
+	Stock      int64  `json:"stock"`
+	Hidden     bool   `json:"hidden"`
+
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	Address     string `json:"address,omitempty"`
+	Prefecture  string `json:"prefecture,omitempty"`
+	Rent        int64  `json:"rent,omitempty"`
+	DoorHeight  int64  `json:"door_height,omitempty"`
+	DoorWidth   int64  `json:"door_width,omitempty"`
+}
+
+// esIndex 椅子か物件のインデックス
+type esIndex struct {
+	name  string
+	table string
+	load  func(ids []int64) ([]esDoc, error)
+	// ready 作り直しが終わっていれば1 0の間はMySQLで検索する
+	ready int32
+}
+
+var (
+	esChairIndex  = &esIndex{name: esIndexPrefix + "chair", table: "chair", load: loadChairESDocs}
+	esEstateIndex = &esIndex{name: esIndexPrefix + "estate", table: "estate", load: loadEstateESDocs}
+)
+
+// esMutex 作り直しと反映を直列化する
+// 作り直しでインデックスを消している間に反映すると、マッピングなしでインデックスが作られてしまう
+var esMutex sync.Mutex
+
+type esSyncRequest struct {
+	index *esIndex
+	ids   []int
+}
+
+var esSyncQueue = make(chan esSyncRequest, esSyncQueueSize)
+
+func (ix *esIndex) searchable() bool {
+	return flagElasticsearch.Enabled() && atomic.LoadInt32(&ix.ready) == 1
+}
+
+// esError Elasticsearchが2xx以外を返した
+type esError struct {
+	status int
+	body   string
+}
+
+func (e *esError) Error() string {
+	return fmt.Sprintf("elasticsearch: %d %s", e.status, e.body)
+}
+
+// esDo リクエストを送り、outがnilでなければ応答のJSONを読む
+func esDo(ctx context.Context, method, path, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, esURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := esClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return &esError{status: res.StatusCode, body: string(b)}
+	}
+	if out == nil {
+		_, err := io.Copy(ioutil.Discard, res.Body)
+		return err
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func loadChairESDocs(ids []int64) ([]esDoc, error) {
+	entries, err := srv.loadChairMemEntries(ids)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]esDoc, len(entries))
+	for i := range entries {
+		e := &entries[i]
+		docs[i] = esDoc{
+			ID:         e.ID,
+			Popularity: e.Popularity,
+			Level0:     e.Levels[0],
+			Level1:     e.Levels[1],
+			Level2:     e.Levels[2],
+			Level3:     e.Levels[3],
+			Kind:       e.Kind,
+			Color:      e.Color,
+			FeatureIDs: e.FeatureIDs,
+			Stock:      memChairStock(e),
+			Hidden:     e.Hidden,
+		}
+	}
+	return docs, nil
+}
+
+func loadEstateESDocs(ids []int64) ([]esDoc, error) {
+	rows, err := srv.Estates.IndexEstates(context.Background(), ids)
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]esDoc, len(rows))
+	for i, r := range rows {
+		docs[i] = esDoc{
+			ID:          r.ID,
+			Popularity:  r.Popularity,
+			Level0:      int64(r.RentLevel),
+			Level1:      int64(r.HeightLevel),
+			Level2:      int64(r.WidthLevel),
+			FeatureIDs:  featureIDs(r.Features, currentConditions().EstateFeatures),
+			Stock:       1,
+			Name:        r.Name,
+			Description: r.Description,
+			Address:     r.Address,
+			Prefecture:  r.Prefecture,
+			Rent:        r.Rent,
+			DoorHeight:  r.DoorHeight,
+			DoorWidth:   r.DoorWidth,
+		}
+	}
+	return docs, nil
+}
+
+// esSyncLater 書き込んだidをバックグラウンドでインデックスに反映させる
+func esSyncLater(ix *esIndex, ids []int) {
+	if !flagElasticsearch.Enabled() || len(ids) == 0 {
+		return
+	}
+	select {
+	case esSyncQueue <- esSyncRequest{index: ix, ids: ids}:
+	default:
+		log.Errorf("elasticsearch sync queue is full : dropped %d %s ids until the next reindex", len(ids), ix.table)
+	}
+}
+
+// syncElasticsearch 書き込まれたidを esBulkSize 件ずつ読み直してインデックスに反映する
+func syncElasticsearch() {
+	for req := range esSyncQueue {
+		ids := make([]int64, len(req.ids))
+		for i, id := range req.ids {
+			ids[i] = int64(id)
+		}
+		esMutex.Lock()
+		err := req.index.sync(ids)
+		esMutex.Unlock()
+		if err != nil {
+			log.Errorf("syncElasticsearch %s : %v", req.index.name, err)
+		}
+	}
+}
+
+// sync idsの行をDBから読み直してインデックスに入れる DBになければ消す
+func (ix *esIndex) sync(ids []int64) error {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > esBulkSize {
+			n = esBulkSize
+		}
+		if err := ix.bulk(ids[:n]); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+func (ix *esIndex) bulk(ids []int64) error {
+	docs, err := ix.load(ids)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	found := make(map[int64]bool, len(docs))
+	for _, d := range docs {
+		found[d.ID] = true
+		fmt.Fprintf(&body, `{"index":{"_index":%q,"_id":"%d"}}`+"\n", ix.name, d.ID)
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		body.Write(b)
+		body.WriteByte('\n')
+	}
+	for _, id := range ids {
+		if !found[id] {
+			fmt.Fprintf(&body, `{"delete":{"_index":%q,"_id":"%d"}}`+"\n", ix.name, id)
+		}
+	}
+
+	var res struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := esDo(context.Background(), http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes(), &res); err != nil {
+		return err
+	}
+	if !res.Errors {
+		return nil
+	}
+	for _, item := range res.Items {
+		for action, r := range item {
+			// 無いものを消そうとしたのは失敗ではない
+			if r.Error == nil || (action == "delete" && r.Status == http.StatusNotFound) {
+				continue
+			}
+			return fmt.Errorf("elasticsearch bulk %s: %s", action, r.Error)
+		}
+	}
+	return nil
+}
+
+// reindex インデックスを消して作り直し、テーブルの全ての行を入れる
+func (ix *esIndex) reindex() error {
+	esMutex.Lock()
+	defer esMutex.Unlock()
+
+	atomic.StoreInt32(&ix.ready, 0)
+	err := esDo(context.Background(), http.MethodDelete, "/"+ix.name, "", nil, nil)
+	if e, ok := err.(*esError); err != nil && !(ok && e.status == http.StatusNotFound) {
+		return err
+	}
+	if err := esDo(context.Background(), http.MethodPut, "/"+ix.name, echo.MIMEApplicationJSON, []byte(esMapping), nil); err != nil {
+		return err
+	}
+
+	var ids []int64
+	if err := db.Select(&ids, "SELECT id FROM "+ix.table+" ORDER BY id"); err != nil {
+		return err
+	}
+	if err := ix.sync(ids); err != nil {
+		return err
+	}
+	// 入れたものがすぐ検索できるようにする
+	if err := esDo(context.Background(), http.MethodPost, "/"+ix.name+"/_refresh", "", nil, nil); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&ix.ready, 1)
+	return nil
+}
+
+// scheduleElasticsearchReindex 起動時と initialize, rebucket の後に両方のインデックスをバックグラウンドで作り直す
+// 作り直しが終わるまでは古いインデックスで答えないように、先に検索を止める
+func scheduleElasticsearchReindex() {
+	if !flagElasticsearch.Enabled() {
+		return
+	}
+	atomic.StoreInt32(&esChairIndex.ready, 0)
+	atomic.StoreInt32(&esEstateIndex.ready, 0)
+	tasks.Go("reindexElasticsearch", reindexElasticsearch)
+}
+
+func reindexElasticsearch() {
+	for _, ix := range []*esIndex{esChairIndex, esEstateIndex} {
+		if err := ix.reindex(); err != nil {
+			log.Errorf("reindexElasticsearch %s : %v", ix.name, err)
+		}
+	}
+}
+
+// esQuery memQuery に加えて、物件の全文検索と範囲の条件
+type esQuery struct {
+	memQuery
+	// Terms 全て name, description, address のどれかに含むものにマッチする
+	Terms []string
+	Area  string
+	// Min, Max フィールド名 -> 値
+	Min, Max map[string]int64
+}
+
+// body _search に送る検索式 人気順に並べる
+func (q *esQuery) body(offset, limit int) ([]byte, error) {
+	type M = map[string]interface{}
+
+	filter := []interface{}{}
+	for i, levels := range q.Levels {
+		if levels != nil {
+			filter = append(filter, M{"terms": M{"level" + strconv.Itoa(i): levels}})
+		}
+	}
+	if q.Kind != "" {
+		filter = append(filter, M{"term": M{"kind": q.Kind}})
+	}
+	if q.Color != "" {
+		filter = append(filter, M{"term": M{"color": q.Color}})
+	}
+	for _, f := range q.Features {
+		filter = append(filter, M{"term": M{"feature_ids": f}})
+	}
+	if q.Area != "" {
+		if prefectureOf(q.Area) == q.Area {
+			filter = append(filter, M{"term": M{"prefecture": q.Area}})
+		} else {
+			filter = append(filter, M{"prefix": M{"address.raw": q.Area}})
+		}
+	}
+	for field, v := range q.Min {
+		filter = append(filter, M{"range": M{field: M{"gte": v}}})
+	}
+	for field, v := range q.Max {
+		filter = append(filter, M{"range": M{field: M{"lte": v}}})
+	}
+	filter = append(filter, M{"range": M{"stock": M{"gt": 0}}}, M{"term": M{"hidden": false}})
+
+	must := []interface{}{}
+	for _, t := range q.Terms {
+		must = append(must, M{"multi_match": M{"query": t, "type": "phrase", "fields": []string{"name", "description", "address"}}})
+	}
+
+	return json.Marshal(M{
+		"query":            M{"bool": M{"filter": filter, "must": must}},
+		"sort":             []interface{}{M{"popularity": "desc"}, M{"id": "asc"}},
+		"from":             offset,
+		"size":             limit,
+		"track_total_hits": true,
+		"_source":          false,
+	})
+}
+
+// search qにマッチするidを人気順に offset から limit 件と、マッチした数を返す
+func (ix *esIndex) search(ctx context.Context, q *esQuery, offset, limit int) ([]int64, int64, error) {
+	body, err := q.body(offset, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	var res struct {
+		Hits struct {
+			// Total 7系からは {"value": n} 6系は数
+			Total json.RawMessage `json:"total"`
+			Hits  []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := esDo(ctx, http.MethodPost, "/"+ix.name+"/_search", echo.MIMEApplicationJSON, body, &res); err != nil {
+		return nil, 0, err
+	}
+
+	var total struct {
+		Value int64 `json:"value"`
+	}
+	if err := json.Unmarshal(res.Hits.Total, &total); err != nil {
+		if err := json.Unmarshal(res.Hits.Total, &total.Value); err != nil {
+			return nil, 0, err
+		}
+	}
+	ids := make([]int64, 0, len(res.Hits.Hits))
+	for _, h := range res.Hits.Hits {
+		id, err := strconv.ParseInt(h.ID, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, total.Value, nil
+}
+
+// searchChairsInElasticsearch esChairIndex で検索する 使えないか失敗したらfalseを返し、MySQLで検索させる
+func (s *Server) searchChairsInElasticsearch(c echo.Context, q memQuery, page, perPage int) (bool, error) {
+	if !esChairIndex.searchable() {
+		return false, nil
+	}
+	ids, count, err := esChairIndex.search(c.Request().Context(), &esQuery{memQuery: q}, page*perPage, perPage)
+	if err != nil {
+		c.Logger().Errorf("searchChairs elasticsearch error : %v", err)
+		return false, nil
+	}
+	return true, s.respondChairIDs(c, ids, count)
+}
+
+// searchEstatesInElasticsearch esEstateIndex で検索する 使えないか失敗したらfalseを返し、MySQLで検索させる
+// q, area, rentMin などは searchEstates で検証済みのものを読み直す
+func (s *Server) searchEstatesInElasticsearch(c echo.Context, q memQuery, page, perPage int) (bool, error) {
+	if !esEstateIndex.searchable() {
+		return false, nil
+	}
+	eq := &esQuery{
+		memQuery: q,
+		Terms:    strings.Fields(strings.ReplaceAll(c.QueryParam("q"), `"`, " ")),
+		Area:     c.QueryParam("area"),
+		Min:      map[string]int64{},
+		Max:      map[string]int64{},
+	}
+	for _, f := range []struct {
+		param string
+		field string
+		m     map[string]int64
+	}{
+		{"rentMin", "rent", eq.Min},
+		{"rentMax", "rent", eq.Max},
+		{"doorWidthMin", "door_width", eq.Min},
+		{"doorHeightMin", "door_height", eq.Min},
+	} {
+		if v, err := strconv.ParseInt(c.QueryParam(f.param), 10, 64); err == nil {
+			f.m[f.field] = v
+		}
+	}
+
+	ids, count, err := esEstateIndex.search(c.Request().Context(), eq, page*perPage, perPage)
+	if err != nil {
+		c.Logger().Errorf("searchEstates elasticsearch error : %v", err)
+		return false, nil
+	}
+	return true, s.respondEstateIDs(c, ids, count)
+}
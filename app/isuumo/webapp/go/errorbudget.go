@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// エラー率を計算する窓の秒数
+	errorBudgetWindow = 10
+	// この件数に満たないうちは判定しない
+	errorBudgetMinRequests = 50
+	// これを超えるエラー率でフォールバックする
+	errorBudgetMaxErrorRate = 0.05
+)
+
+type errorBudgetBucket struct {
+	second int64
+	total  int64
+	errors int64
+}
+
+// errorBudget エンドポイントごとのエラー率をスライディングウィンドウで追跡する
+type errorBudget struct {
+	mu        sync.Mutex
+	buckets   [errorBudgetWindow]errorBudgetBucket
+	fallbacks []*featureFlag
+}
+
+// record 結果を記録し、エラー率が閾値を超えたらtrueを返す
+func (eb *errorBudget) record(now time.Time, failed bool) bool {
+	sec := now.Unix()
+
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	b := &eb.buckets[sec%errorBudgetWindow]
+	if b.second != sec {
+		*b = errorBudgetBucket{second: sec}
+	}
+	b.total++
+	if failed {
+		b.errors++
+	}
+
+	var total, errors int64
+	for _, b := range eb.buckets {
+		if sec-b.second < errorBudgetWindow {
+			total += b.total
+			errors += b.errors
+		}
+	}
+	return total >= errorBudgetMinRequests && float64(errors)/float64(total) > errorBudgetMaxErrorRate
+}
+
+// errorBudgetMiddleware 5xxの割合が閾値を超えたらfallbacksのフラグを落とす
+func errorBudgetMiddleware(path string, fallbacks []*featureFlag) echo.MiddlewareFunc {
+	eb := &errorBudget{fallbacks: fallbacks}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+
+			status := c.Response().Status
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			} else if err != nil {
+				status = http.StatusInternalServerError
+			}
+
+			if eb.record(time.Now(), status >= 500) {
+				for _, f := range eb.fallbacks {
+					if f.Enabled() {
+						f.Set(false)
+						c.Logger().Warnf("error budget exceeded on %s, disabled %s", path, f.Name)
+					}
+				}
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// エラーの原因の分類
+const (
+	errorCauseValidation = "validation"
+	errorCauseTimeout    = "timeout"
+	errorCauseDB         = "db"
+	errorCausePanic      = "panic"
+)
+
+// errorPhaseBoundaries /initialize からの経過時間でフェーズを区切る
+// ERROR_PHASE_BOUNDARIES="5s,30s,60s" のように指定する
+var errorPhaseBoundaries = parseErrorPhaseBoundaries(getEnv("ERROR_PHASE_BOUNDARIES", "5s,30s,60s"))
+
+type errorPhaseStat struct {
+	Phase    string           `json:"phase"`
+	Requests int64            `json:"requests"`
+	Errors   map[string]int64 `json:"errors"`
+}
+
+var errorStats []*errorPhaseStat
+var errorStatsStart time.Time
+var errorStatsMutex sync.Mutex
+
+func init() {
+	resetErrorStats()
+}
+
+func parseErrorPhaseBoundaries(s string) []time.Duration {
+	var res []time.Duration
+	for _, v := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+// resetErrorStats /initialize のタイミングで集計を始め直す
+func resetErrorStats() {
+	errorStatsMutex.Lock()
+	defer errorStatsMutex.Unlock()
+
+	errorStatsStart = time.Now()
+	errorStats = make([]*errorPhaseStat, len(errorPhaseBoundaries)+1)
+	from := time.Duration(0)
+	for i := range errorStats {
+		name := from.String() + "-"
+		if i < len(errorPhaseBoundaries) {
+			name += errorPhaseBoundaries[i].String()
+			from = errorPhaseBoundaries[i]
+		}
+		errorStats[i] = &errorPhaseStat{Phase: name, Errors: map[string]int64{}}
+	}
+}
+
+func recordErrorStat(cause string) {
+	errorStatsMutex.Lock()
+	defer errorStatsMutex.Unlock()
+
+	elapsed := time.Since(errorStatsStart)
+	phase := len(errorPhaseBoundaries)
+	for i, b := range errorPhaseBoundaries {
+		if elapsed < b {
+			phase = i
+			break
+		}
+	}
+	st := errorStats[phase]
+	st.Requests++
+	if cause != "" {
+		st.Errors[cause]++
+	}
+}
+
+// errorCause レスポンスからエラーの原因を推定する
+func errorCause(c echo.Context, status int) string {
+	switch {
+	case status == http.StatusGatewayTimeout || c.Request().Context().Err() == context.DeadlineExceeded:
+		if status >= 400 {
+			return errorCauseTimeout
+		}
+	case status >= 500:
+		// ハンドラの500はほぼDBのエラー
+		return errorCauseDB
+	case status >= 400:
+		return errorCauseValidation
+	}
+	return ""
+}
+
+// errorStatsMiddleware フェーズと原因ごとにエラーを数える
+// panicを数えるためにmiddleware.Recoverより内側に置く
+func errorStatsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		defer func() {
+			if r := recover(); r != nil {
+				recordErrorStat(errorCausePanic)
+				panic(r)
+			}
+		}()
+
+		err := next(c)
+
+		status := c.Response().Status
+		if he, ok := err.(*echo.HTTPError); ok {
+			status = he.Code
+		} else if err != nil {
+			status = http.StatusInternalServerError
+		}
+		recordErrorStat(errorCause(c, status))
+
+		return err
+	}
+}
+
+// errorStatsTotals 全フェーズのリクエスト数と原因ごとのエラー数を返す
+func errorStatsTotals() (int64, map[string]int64) {
+	errorStatsMutex.Lock()
+	defer errorStatsMutex.Unlock()
+
+	var requests int64
+	errors := map[string]int64{}
+	for _, st := range errorStats {
+		requests += st.Requests
+		for k, v := range st.Errors {
+			errors[k] += v
+		}
+	}
+	return requests, errors
+}
+
+func getErrorStats(c echo.Context) error {
+	errorStatsMutex.Lock()
+	res := make([]errorPhaseStat, len(errorStats))
+	for i, st := range errorStats {
+		res[i] = errorPhaseStat{Phase: st.Phase, Requests: st.Requests, Errors: map[string]int64{}}
+		for k, v := range st.Errors {
+			res[i].Errors[k] = v
+		}
+	}
+	errorStatsMutex.Unlock()
+
+	return JSON(c, http.StatusOK, res)
+}
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const NazotteLimit = 50
+
+// cachedEstates estate id -> Estate
+var cachedEstates = newLRUCache("ESTATE", 50000, 10*time.Minute)
+
+// Estate 物件
+type Estate struct {
+	ID          int64   `db:"id" json:"id"`
+	Thumbnail   string  `db:"thumbnail" json:"thumbnail"`
+	Name        string  `db:"name" json:"name"`
+	Description string  `db:"description" json:"description"`
+	Latitude    float64 `db:"latitude" json:"latitude"`
+	Longitude   float64 `db:"longitude" json:"longitude"`
+	Address     string  `db:"address" json:"address"`
+	Rent        int64   `db:"rent" json:"rent"`
+	DoorHeight  int64   `db:"door_height" json:"doorHeight"`
+	DoorWidth   int64   `db:"door_width" json:"doorWidth"`
+	Features    string  `db:"features" json:"features"`
+	Popularity  int64   `db:"popularity" json:"-"`
+	WidthLevel  int     `db:"width_level" json:"-"`
+	HeightLevel int     `db:"height_level" json:"-"`
+	RentLevel   int     `db:"rent_level" json:"-"`
+	Prefecture  string  `db:"prefecture" json:"-"`
+	// NegPopularity -popularity の生成列 並び替えにだけ使う
+	NegPopularity int64 `db:"neg_popularity" json:"-"`
+	// Point POINT(latitude, longitude) の生成列 なぞって検索にだけ使う
+	Point []byte `db:"point" json:"-"`
+	// Geohash 位置のgeohash (geohashPrecision 桁)
+	Geohash string `db:"geohash" json:"-"`
+	// CellID 位置のcell_id (cellIDBits ビット)
+	CellID uint64 `db:"cell_id" json:"-"`
+	// DoorMin, DoorMax ドアの幅と高さの小さい方と大きい方 (生成列)
+	DoorMin int64 `db:"door_min" json:"-"`
+	DoorMax int64 `db:"door_max" json:"-"`
+	// fragment キャッシュに入れるときに作るJSON
+	fragment []byte
+}
+
+// EstateSearchResponse estate/searchへのレスポンスの形式
+type EstateSearchResponse struct {
+	Count   int64    `json:"count"`
+	Estates []Estate `json:"estates"`
+	// NextCursor cursorを指定したときに次のページを取得するためのカーソル
+	NextCursor string `json:"nextCursor,omitempty"`
+	// Approximate approxCount=1 でCountが見積もりのときにtrue
+	Approximate bool `json:"approximate,omitempty"`
+}
+
+type EstateListResponse struct {
+	Estates []Estate `json:"estates"`
+}
+
+type Coordinate struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type Coordinates struct {
+	Coordinates []Coordinate `json:"coordinates"`
+}
+
+type BoundingBox struct {
+	// TopLeftCorner 緯度経度が共に最小値になるような点の情報を持っている
+	TopLeftCorner Coordinate
+	// BottomRightCorner 緯度経度が共に最大値になるような点の情報を持っている
+	BottomRightCorner Coordinate
+}
+
+func (s *Server) getEstateDetail(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	// 存在しないidに304を返さないように、ETagを見る前に引く (ほとんどは cachedEstates に載っている)
+	estate, err := s.getEstate(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("getEstateDetail estate id %v not found", id)
+			return notFound(c, "estate not found")
+		}
+		c.Echo().Logger.Errorf("Database Execution error : %v", err)
+		return internalError(c)
+	}
+
+	recordView(itemEstate, int64(id))
+	if notModified(c, estateETag(id)) {
+		return nil
+	}
+	return JSON(c, http.StatusOK, estate)
+}
+
+// getEstate idからestateを取得する
+// cachedEstates になければ持ち主のサーバーに問い合わせ、自分が持ち主なら loadEstate で読み込む
+func (s *Server) getEstate(id int) (Estate, error) {
+	if v, ok := cachedEstates.Get(id); ok {
+		return v.(Estate), nil
+	}
+
+	var estate Estate
+	if ok, err := peerGet(peerKindEstate, id, &estate); err != nil {
+		return estate, err
+	} else if ok {
+		estate = withEstateFragment(estate)
+		cachedEstates.Add(id, estate)
+		return estate, nil
+	}
+	return s.loadEstate(id)
+}
+
+// loadEstate 他のサーバーには問い合わせずに、cachedEstates か共有キャッシュかDBから取得する
+func (s *Server) loadEstate(id int) (Estate, error) {
+	if v, ok := cachedEstates.Get(id); ok {
+		return v.(Estate), nil
+	}
+
+	var estate Estate
+	sharedKey, shared := sharedEstates.key(strconv.Itoa(id))
+	if !shared || !sharedCacheGet(sharedKey, &estate) {
+		var err error
+		if estate, err = s.Estates.EstateByID(context.Background(), id); err != nil {
+			return estate, err
+		}
+		if shared {
+			sharedCacheSet(sharedKey, estate)
+		}
+	}
+
+	estate = withEstateFragment(estate)
+	cachedEstates.Add(id, estate)
+	return estate, nil
+}
+
+func (s *Server) postEstate(c echo.Context) error {
+	ctx := c.Request().Context()
+	header, err := c.FormFile("estates")
+	if err != nil {
+		c.Logger().Errorf("failed to get form file: %v", err)
+		return invalidParam(c, "estates", "csv file is required")
+	}
+	columns := estateCSVColumns()
+	r, f, err := openCSVUpload(header, len(columns))
+	if err != nil {
+		c.Logger().Errorf("failed to open form file: %v", err)
+		return invalidParam(c, "estates", "failed to open csv file")
+	}
+
+	if c.QueryParam("validate") == "1" {
+		defer f.Close()
+		return validateCSVUpload(c, r, columns)
+	}
+
+	if asyncImport(c) {
+		f.Close()
+		return enqueueImport(c, importKindEstate, header)
+	}
+
+	err = s.loadEstateCSV(ctx, func() (*csv.Reader, io.Closer, error) { return openCSVUpload(header, len(columns)) }, r, f, columns)
+	if ie, ok := err.(*csvInputError); ok {
+		c.Logger().Infof("failed to read csv: %v", ie.err)
+		return badRequest(c, ie.message)
+	}
+	if err != nil {
+		c.Logger().Errorf("failed to import estates: %v", err)
+		return internalError(c)
+	}
+
+	return c.NoContent(http.StatusCreated)
+}
+
+// loadEstateCSV rとfのCSVを書き込み、コミットした後にキャッシュを捨てる fは閉じる
+// デッドロックでやり直すときはopenで開き直す CSVの誤りは csvInputError で返す
+func (s *Server) loadEstateCSV(ctx context.Context, open func() (*csv.Reader, io.Closer, error), r *csv.Reader, f io.Closer, columns []csvColumn) error {
+	res, err := s.Estates.ImportEstates(ctx, open, r, f, columns)
+	if err != nil {
+		return err
+	}
+
+	if flagInMemoryNazotte.Enabled() {
+		upsertEstatePoints(res.points)
+	}
+	// 追加しただけのestateは forgetEstates を通らないので、メモリ上の検索インデックスにはここで入れる
+	estateMemIndex.markStale(res.ids...)
+
+	invalidateEstateSearchCaches()
+	invalidateRecommendedEstateIDs()
+	scheduleRecommendedPrecompute()
+
+	// 上書きしたestateは内容が変わっているかもしれない
+	invalidate := res.updated > 0
+	if invalidate {
+		forgetEstates(res.ids...)
+		bumpEstateETagEpoch()
+	}
+	lowPricedEstateMutex.RLock()
+	if lowPricedEstate != nil {
+		invalidate = invalidate || len(lowPricedEstate.Estates) < Limit || res.minRent <= lowPricedEstate.Estates[len(lowPricedEstate.Estates)-1].Rent
+	}
+	lowPricedEstateMutex.RUnlock()
+
+	if invalidate {
+		lowPricedEstateMutex.Lock()
+		clearLowPricedEstate()
+		lowPricedEstateMutex.Unlock()
+		scheduleLowPricedEstateRefresh()
+	}
+
+	// 他のサーバーも追加されたestateを検索インデックスに入れるので、上書きがなくてもidを送る
+	broadcastInvalidation(cacheInvalidation{Kind: peerKindEstate, IDs: res.ids, Search: true, LowPriced: invalidate, Epoch: res.updated > 0})
+	publishEvent(EventItemsImported, ItemsImported{Kind: peerKindEstate, IDs: res.ids, Updated: res.updated})
+
+	return nil
+}
+
+func (s *Server) searchEstates(c echo.Context) error {
+	sc := currentConditions()
+	if flagSearchPageCache.Enabled() && !bypassSearchCaches(c) && serveCachedSearchPage(c, estatePageCache) {
+		return nil
+	}
+	ctx := c.Request().Context()
+
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	var searchQuery, countQuery string
+
+	// levelOnly levelとfeatureだけの条件か
+	levelOnly := true
+	var doorHeight, doorWidth, estateRent []int64
+
+	if c.QueryParam("doorHeightRangeId") != "" {
+		var err error
+		doorHeight, err = getRanges(sc.Estate.DoorHeight, c.QueryParam("doorHeightRangeId"))
+		if err != nil {
+			c.Echo().Logger.Infof("doorHeightRangeID invalid, %v : %v", c.QueryParam("doorHeightRangeId"), err)
+			return invalidParam(c, "doorHeightRangeId", "unknown range id")
+		}
+		cond, args := levelCondition("height_level", doorHeight)
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+	}
+
+	if c.QueryParam("doorWidthRangeId") != "" {
+		var err error
+		doorWidth, err = getRanges(sc.Estate.DoorWidth, c.QueryParam("doorWidthRangeId"))
+		if err != nil {
+			c.Echo().Logger.Infof("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
+			return invalidParam(c, "doorWidthRangeId", "unknown range id")
+		}
+		cond, args := levelCondition("width_level", doorWidth)
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+	}
+
+	if c.QueryParam("rentRangeId") != "" {
+		var err error
+		estateRent, err = getRanges(sc.Estate.Rent, c.QueryParam("rentRangeId"))
+		if err != nil {
+			c.Echo().Logger.Infof("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
+			return invalidParam(c, "rentRangeId", "unknown range id")
+		}
+		cond, args := levelCondition("rent_level", estateRent)
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+	}
+
+	if c.QueryParam("area") != "" {
+		levelOnly = false
+		cond, param := areaCondition(c.QueryParam("area"))
+		conditions = append(conditions, cond)
+		params = append(params, param)
+	}
+
+	if c.QueryParam("q") != "" {
+		against, ok := fulltextQuery(c.QueryParam("q"))
+		if !ok {
+			c.Echo().Logger.Infof("q invalid, %v", c.QueryParam("q"))
+			return invalidParam(c, "q", "no searchable terms")
+		}
+		levelOnly = false
+		conditions = append(conditions, "MATCH (name, description, address) AGAINST (? IN BOOLEAN MODE)")
+		params = append(params, against)
+	}
+
+	// バケットより細かい範囲指定 level の条件と併用してもよい
+	for _, f := range []struct {
+		param string
+		cond  string
+	}{
+		{"rentMin", "rent >= ?"},
+		{"rentMax", "rent <= ?"},
+		{"doorWidthMin", "door_width >= ?"},
+		{"doorHeightMin", "door_height >= ?"},
+	} {
+		if c.QueryParam(f.param) == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(c.QueryParam(f.param), 10, 64)
+		if err != nil || v < 0 {
+			c.Echo().Logger.Infof("%v invalid, %v : %v", f.param, c.QueryParam(f.param), err)
+			return invalidParam(c, f.param, "must be a non-negative integer")
+		}
+		levelOnly = false
+		conditions = append(conditions, f.cond)
+		params = append(params, v)
+	}
+
+	// featureの条件はFROM句のJOINに入るので、WHERE句のパラメータより前に渡す
+	var featureParams []interface{}
+	var featureJoin string
+	searchColumns := "*"
+	var ids []int
+	// estate_search には価格の列がないので、人気順のときだけ使う
+	ranking := searchRanking(c)
+	useSearchTable := flagEstateSearchTable.Enabled() && levelOnly && ranking.popularityOnly()
+	if c.QueryParam("features") != "" {
+		seen := map[string]bool{}
+		for _, f := range strings.Split(c.QueryParam("features"), ",") {
+			if len(f) == 0 || seen[f] {
+				continue
+			}
+			seen[f] = true
+
+			// 存在しないfeatureは何にもマッチさせない
+			id, ok := sc.EstateFeatures[f]
+			if !ok {
+				id = -1
+			}
+			ids = append(ids, id)
+		}
+
+		if len(ids) > 0 && useSearchTable {
+			if mask, ok := estateFeatureMask(ids); ok {
+				conditions = append(conditions, "feature_bits & ? = ?")
+				params = append(params, mask, mask)
+			} else {
+				conditions = append(conditions, "FALSE")
+			}
+		} else if len(ids) > 0 {
+			join, args, err := sqlx.In(" INNER JOIN (SELECT estate_id FROM estate_feature WHERE feature_id IN (?) GROUP BY estate_id HAVING COUNT(*) = ?) TMP ON estate.id = TMP.estate_id", ids, len(ids))
+			if err != nil {
+				c.Logger().Errorf("searchEstates failed to build query : %v", err)
+				return internalError(c)
+			}
+			// JOINした TMP.estate_id を読まないようにカラムを並べる
+			searchColumns = "id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity"
+			featureJoin = join
+			featureParams = args
+		}
+	}
+	params = append(featureParams, params...)
+
+	if useSearchTable {
+		searchQuery = "SELECT id FROM estate_search"
+		countQuery = "SELECT COUNT(*) FROM estate_search"
+	} else {
+		if summaryView(c) {
+			// 要約なら返すカラムだけを読む
+			searchColumns = estateSummaryColumns
+		}
+		searchQuery = "SELECT " + searchColumns + " FROM estate" + featureJoin
+		countQuery = "SELECT COUNT(*) FROM estate" + featureJoin
+	}
+
+	if len(conditions) == 0 && len(featureParams) == 0 {
+		c.Echo().Logger.Infof("searchEstates search condition not found")
+		return badRequest(c, "search condition not found")
+	}
+
+	// cursorが指定されていればOFFSETの代わりに (popularity, id) で続きから取得する
+	// 1ページ目は cursor= を空で指定する
+	_, keyset := c.QueryParams()["cursor"]
+	var cursor *searchCursor
+	if keyset && c.QueryParam("cursor") != "" {
+		sc, err := decodeSearchCursor(c.QueryParam("cursor"))
+		if err != nil {
+			c.Logger().Infof("Invalid format cursor parameter : %v", err)
+			return invalidParam(c, "cursor", "malformed cursor")
+		}
+		cursor = &sc
+	}
+
+	var page int
+	if !keyset {
+		var err error
+		page, err = strconv.Atoi(c.QueryParam("page"))
+		if err != nil {
+			c.Logger().Infof("Invalid format page parameter : %v", err)
+			return invalidParam(c, "page", "must be an integer")
+		}
+	}
+
+	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	if err != nil {
+		c.Logger().Infof("Invalid format perPage parameter : %v", err)
+		return invalidParam(c, "perPage", "must be an integer")
+	}
+	perPage = clampPerPage(c, perPage)
+
+	if flagInMemorySearch.Enabled() && levelOnly && !keyset && ranking.popularityOnly() {
+		q := memQuery{Levels: [memLevelDims][]int64{estateRent, doorHeight, doorWidth, nil}, Features: ids}
+		if ok, err := s.searchEstatesInMemory(c, q, page, perPage); ok {
+			return err
+		}
+	}
+	if s.DB == nil {
+		return notImplemented(c, "only popularity-ranked level and feature searches are available with STORAGE=memory")
+	}
+	// 全文検索とfeatureを2つ以上指定した検索はElasticsearchで答える
+	if flagElasticsearch.Enabled() && !keyset && ranking.popularityOnly() && (c.QueryParam("q") != "" || len(ids) > 1) {
+		q := memQuery{Levels: [memLevelDims][]int64{estateRent, doorHeight, doorWidth, nil}, Features: ids}
+		if ok, err := s.searchEstatesInElasticsearch(c, q, page, perPage); ok {
+			return err
+		}
+	}
+
+	searchCondition := strings.Join(conditions, " AND ")
+	// popularity DESC だと昇順の索引を使えずfilesortになるので neg_popularity で並べる
+	// カーソルは (popularity, id) の並びでしか続きを取れないので、重みに関係なく人気順にする
+	limitOffset := estateRanking.orderBy(ranking) + " LIMIT ? OFFSET ?"
+	if keyset {
+		limitOffset = estateRanking.defaultOrder + " LIMIT ? OFFSET ?"
+	}
+
+	c.Logger().Info(searchQuery + searchCondition + limitOffset)
+	c.Logger().Info(countQuery + searchCondition)
+
+	if len(conditions) > 0 {
+		countQuery += " WHERE "
+	}
+
+	var res EstateSearchResponse
+	// approxCount=1 のとき、levelとfeatureだけの条件なら件数をヒストグラムから見積もる
+	if levelOnly && c.QueryParam("approxCount") == "1" {
+		h, err := loadEstateHistogram()
+		if err != nil {
+			c.Logger().Errorf("searchEstates DB execution error : %v", err)
+			return internalError(c)
+		}
+		res.Count = h.estimate(estateRent, doorHeight, doorWidth, ids)
+		res.Approximate = true
+	} else {
+		res.Count, err = estateCountCache.count(ctx, s.DB, countQuery+searchCondition, params)
+		if err != nil {
+			c.Logger().Errorf("searchEstates DB execution error : %v", err)
+			return internalError(c)
+		}
+	}
+
+	// 件数はカーソルに関係なく条件全体で数える
+	if cursor != nil {
+		cond, args := cursor.condition()
+		conditions = append(conditions, cond)
+		params = append(params, args...)
+		searchCondition = strings.Join(conditions, " AND ")
+	}
+	if len(conditions) > 0 {
+		searchQuery += " WHERE "
+	}
+
+	params = append(params, perPage, page*perPage)
+
+	// 大きいページは行を読みながら書き出し、スライスに溜めない
+	// estate_search を使うときはidから cachedEstates を引くので下でまとめて書き出す
+	streaming := flagStreamLargePages.Enabled() && perPage > StreamPerPageThreshold && !keyset && !wantsProtobuf(c)
+	if streaming && !useSearchTable {
+		rows, err := s.DB.QueryxContext(ctx, searchQuery+searchCondition+limitOffset, params...)
+		if err != nil {
+			c.Logger().Errorf("searchEstates DB execution error : %v", err)
+			return internalError(c)
+		}
+		defer rows.Close()
+		return JSONStreamRows(c, http.StatusOK, res.Count, "estates", rows, &Estate{})
+	}
+
+	estates := getEmptyEstateSlice()
+	defer releaseEstateSlice(estates)
+
+	if useSearchTable {
+		estateIDs := getEmptyIntSlice()
+		defer releaseIntSlice(estateIDs)
+		estateIDs, err = s.selectInts(ctx, estateIDs, searchQuery+searchCondition+limitOffset, params...)
+		if err == nil {
+			estates, err = s.getEstatesByIDs(ctx, estateIDs, estates)
+		}
+	} else {
+		estates, err = s.selectEstates(ctx, estates, searchQuery+searchCondition+limitOffset, params...)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return JSONOrProtobuf(c, http.StatusOK, &EstateSearchResponse{Count: 0, Estates: constEmptyEstates})
+		}
+		c.Logger().Errorf("searchEstates DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	if keyset && len(estates) == perPage && perPage > 0 {
+		last := estates[len(estates)-1]
+		res.NextCursor = searchCursor{Popularity: last.Popularity, ID: last.ID}.encode()
+	}
+
+	if streaming {
+		return JSONStreamList(c, http.StatusOK, res.Count, "estates", len(estates), func(i int) interface{} {
+			return &estates[i]
+		})
+	}
+
+	res.Estates = estates
+
+	return JSONOrProtobuf(c, http.StatusOK, &res)
+}
+
+func (s *Server) searchRecommendedEstateWithChair(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Logger().Infof("Invalid format searchRecommendedEstateWithChair id : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	chair, err := s.getChair(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Logger().Infof("Requested chair id \"%v\" not found", id)
+			return invalidParam(c, "id", "chair not found")
+		}
+		c.Logger().Errorf("Database execution error : %v", err)
+		return internalError(c)
+	}
+
+	useCache := flagRecommendedResponseCache.Enabled()
+	if useCache {
+		if res, ok := getRecommendedEstateResponse(id); ok {
+			return JSON(c, http.StatusOK, res)
+		}
+	}
+	recommendedEstateIDsMutex.RLock()
+	generation := recommendedEstateIDsGeneration
+	recommendedEstateIDsMutex.RUnlock()
+
+	estates := getEmptyEstateSlice()
+	defer releaseEstateSlice(estates)
+
+	estates, err = loadRecommendedEstates(c.Request().Context(), chair, estates)
+	if err != nil {
+		c.Logger().Errorf("Database execution error : %v", err)
+		return internalError(c)
+	}
+	if useCache {
+		setRecommendedEstateResponse(id, recommendKey(chair), estates, generation)
+	}
+	if len(estates) == 0 {
+		return JSONBlob(c, http.StatusOK, emptyEstateListJSON)
+	}
+
+	return JSON(c, http.StatusOK, EstateListResponse{Estates: estates})
+}
+
+func (s *Server) searchEstateNazotte(c echo.Context) error {
+	ctx := c.Request().Context()
+	coordinates := Coordinates{}
+	var err error
+	if flagStrictNazotte.Enabled() {
+		coordinates, err = bindStrictCoordinates(c)
+		if err != nil {
+			c.Echo().Logger.Infof("post search estate nazotte failed : %v", err)
+			return badRequest(c, err.Error())
+		}
+	} else {
+		err = c.Bind(&coordinates)
+		if err != nil {
+			c.Echo().Logger.Infof("post search estate nazotte failed : %v", err)
+			return badRequest(c, "invalid request body")
+		}
+	}
+
+	if len(coordinates.Coordinates) == 0 {
+		return invalidParam(c, "coordinates", "is required")
+	}
+
+	pg, err := parseNazottePage(c)
+	if err != nil {
+		c.Echo().Logger.Infof("post search estate nazotte failed : %v", err)
+		return badRequest(c, err.Error())
+	}
+
+	// Countは多角形に含まれる全件数
+	if flagInMemoryNazotte.Enabled() {
+		ids := getEmptyIntSlice()
+		defer releaseIntSlice(ids)
+		estates := getEmptyEstateSlice()
+		defer releaseEstateSlice(estates)
+
+		ids, count := estateIDsInPolygon(coordinates, pg, ids)
+		estates, err = s.getEstatesByIDs(ctx, ids, estates)
+		if err != nil {
+			c.Logger().Errorf("searchEstateNazotte DB execution error : %v", err)
+			return internalError(c)
+		}
+		return JSONOrProtobuf(c, http.StatusOK, &EstateSearchResponse{Estates: estates, Count: count})
+	}
+
+	if flagCellCoverNazotte.Enabled() {
+		ids := getEmptyIntSlice()
+		defer releaseIntSlice(ids)
+		estates := getEmptyEstateSlice()
+		defer releaseEstateSlice(estates)
+
+		ids, count, err := estateIDsInCellCovering(ctx, coordinates, pg, ids)
+		if err == nil {
+			estates, err = s.getEstatesByIDs(ctx, ids, estates)
+		}
+		if err != nil {
+			c.Logger().Errorf("searchEstateNazotte DB execution error : %v", err)
+			return internalError(c)
+		}
+		return JSONOrProtobuf(c, http.StatusOK, &EstateSearchResponse{Estates: estates, Count: count})
+	}
+
+	if flagSpatialNazotte.Enabled() {
+		estates := getEmptyEstateSlice()
+		defer releaseEstateSlice(estates)
+
+		estates, count, err := searchEstatesInPolygon(ctx, coordinates, pg, estates)
+		if err != nil {
+			c.Logger().Errorf("searchEstateNazotte DB execution error : %v", err)
+			return internalError(c)
+		}
+		return JSONOrProtobuf(c, http.StatusOK, &EstateSearchResponse{Estates: estates, Count: count})
+	}
+
+	b := coordinates.getBoundingBox()
+	estatesInBoundingBox := getEmptyEstateSlice()
+	defer releaseEstateSlice(estatesInBoundingBox)
+
+	estatesInBoundingBox, err = s.Estates.EstatesInBoundingBox(ctx, b, estatesInBoundingBox)
+	if err != nil {
+		c.Echo().Logger.Errorf("database execution error : %v", err)
+		return internalError(c)
+	}
+
+	estatesInPolygonIDs := getEmptyIntSlice()
+	defer releaseIntSlice(estatesInPolygonIDs)
+
+	for i, estate := range estatesInBoundingBox {
+		if i%nazotteCheckInterval == 0 {
+			select {
+			case <-ctx.Done():
+				c.Logger().Infof("searchEstateNazotte cancelled : %v", ctx.Err())
+				return Problem(c, http.StatusGatewayTimeout, problemCode(http.StatusGatewayTimeout), "")
+			default:
+			}
+		}
+		if polygonContains(coordinates.Coordinates, estate.Latitude, estate.Longitude) {
+			estatesInPolygonIDs = append(estatesInPolygonIDs, int(estate.ID))
+		}
+	}
+
+	estatesInPolygon := getEmptyEstateSlice()
+	defer releaseEstateSlice(estatesInPolygon)
+
+	if len(estatesInPolygonIDs) == 0 {
+		return JSONOrProtobuf(c, http.StatusOK, &EstateSearchResponse{Estates: estatesInPolygon, Count: 0})
+	}
+
+	estatesInPolygon, err = s.getEstatesByIDs(ctx, estatesInPolygonIDs, estatesInPolygon)
+	if err != nil {
+		c.Logger().Errorf("searchEstateNazotte DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	sort.Slice(estatesInPolygon, func(i, j int) bool {
+		if estatesInPolygon[i].Popularity == estatesInPolygon[j].Popularity {
+			return estatesInPolygon[i].ID < estatesInPolygon[j].ID
+		}
+		return estatesInPolygon[i].Popularity > estatesInPolygon[j].Popularity
+	})
+
+	var re EstateSearchResponse
+	re.Count = int64(len(estatesInPolygon))
+	if pg.Offset >= len(estatesInPolygon) {
+		re.Estates = constEmptyEstates
+	} else if end := pg.Offset + pg.Limit; end < len(estatesInPolygon) {
+		re.Estates = estatesInPolygon[pg.Offset:end]
+	} else {
+		re.Estates = estatesInPolygon[pg.Offset:]
+	}
+
+	return JSONOrProtobuf(c, http.StatusOK, &re)
+}
+
+func (s *Server) postEstateRequestDocument(c echo.Context) error {
+	m := echo.Map{}
+	if err := c.Bind(&m); err != nil {
+		c.Echo().Logger.Infof("post request document failed : %v", err)
+		return internalError(c)
+	}
+
+	_, ok := m["email"].(string)
+	if !ok {
+		c.Echo().Logger.Info("post request document failed : email not found in request body")
+		return invalidParam(c, "email", "is required")
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("post request document failed : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	_, err = s.getEstate(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return notFound(c, "estate not found")
+		}
+		c.Logger().Errorf("postEstateRequestDocument DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	recordPurchase(itemEstate, int64(id), 1)
+	publishEvent(EventEstateDocRequested, EstateDocRequested{EstateID: int64(id)})
+	return c.NoContent(http.StatusOK)
+}
+
+func getEstateSearchCondition(c echo.Context) error {
+	return JSONBlob(c, http.StatusOK, currentConditions().EstateJSON)
+}
+
+func (cs Coordinates) getBoundingBox() BoundingBox {
+	coordinates := cs.Coordinates
+	boundingBox := BoundingBox{
+		TopLeftCorner: Coordinate{
+			Latitude: coordinates[0].Latitude, Longitude: coordinates[0].Longitude,
+		},
+		BottomRightCorner: Coordinate{
+			Latitude: coordinates[0].Latitude, Longitude: coordinates[0].Longitude,
+		},
+	}
+	for _, coordinate := range coordinates {
+		if boundingBox.TopLeftCorner.Latitude > coordinate.Latitude {
+			boundingBox.TopLeftCorner.Latitude = coordinate.Latitude
+		}
+		if boundingBox.TopLeftCorner.Longitude > coordinate.Longitude {
+			boundingBox.TopLeftCorner.Longitude = coordinate.Longitude
+		}
+
+		if boundingBox.BottomRightCorner.Latitude < coordinate.Latitude {
+			boundingBox.BottomRightCorner.Latitude = coordinate.Latitude
+		}
+		if boundingBox.BottomRightCorner.Longitude < coordinate.Longitude {
+			boundingBox.BottomRightCorner.Longitude = coordinate.Longitude
+		}
+	}
+	return boundingBox
+}
+
+// coordinatesToText WKTのPOLYGONにする 始点と終点が違えば閉じる
+func (cs Coordinates) coordinatesToText() string {
+	points := make([]string, 0, len(cs.Coordinates)+1)
+	for _, c := range cs.Coordinates {
+		points = append(points, fmt.Sprintf("%f %f", c.Latitude, c.Longitude))
+	}
+	if first, last := cs.Coordinates[0], cs.Coordinates[len(cs.Coordinates)-1]; first != last {
+		points = append(points, points[0])
+	}
+	return fmt.Sprintf("POLYGON((%s))", strings.Join(points, ","))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// levelとfeatureだけの検索を estate_search テーブルで絞り込み、行は cachedEstates から埋める
+var flagEstateSearchTable = newFeatureFlag("ESTATE_SEARCH_TABLE", false)
+
+// estate_search の列
+// estate_search はバッファプールに収まるように検索に使う列だけを持つ
+// initialize では 7_estate_search.sql で estate から作り、postEstate では estate と同じトランザクションで更新する
+var estateSearchColumns = []string{"id", "popularity", "rent_level", "height_level", "width_level", "feature_bits"}
+
+// estateFeatureBits featuresのカンマ区切り文字列を feature id のビットの集合にする
+// 知らないfeatureは無視する
+func estateFeatureBits(features string) uint64 {
+	var bits uint64
+	for _, f := range strings.Split(features, ",") {
+		if id, ok := currentConditions().EstateFeatures[f]; ok {
+			bits |= 1 << uint(id)
+		}
+	}
+	return bits
+}
+
+// estateFeatureMask 検索するfeature idの集合 存在しないfeatureがあればfalseを返す
+func estateFeatureMask(ids []int) (uint64, bool) {
+	var mask uint64
+	for _, id := range ids {
+		if id < 0 || id >= 64 {
+			return 0, false
+		}
+		mask |= 1 << uint(id)
+	}
+	return mask, true
+}
+
+// syncEstateSearchLevels rebucket で estate の level を振り直した後に estate_search に反映する
+func syncEstateSearchLevels() (int64, error) {
+	var res sql.Result
+	err := retryWrite(context.Background(), func() error {
+		var err error
+		res, err = db.Exec(`UPDATE estate_search s INNER JOIN estate e ON s.id = e.id SET s.rent_level = e.rent_level, s.height_level = e.height_level, s.width_level = e.width_level`)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/echo"
+)
+
+// CSVの再インポートで行が上書きされるたびに増やし、それまでのETagを全て無効にする
+var chairETagEpoch, estateETagEpoch int64
+
+func bumpChairETagEpoch()  { atomic.AddInt64(&chairETagEpoch, 1) }
+func bumpEstateETagEpoch() { atomic.AddInt64(&estateETagEpoch, 1) }
+
+// chairのETag 在庫が変わると変わる
+func chairETag(id int, stock int64) string {
+	return `"c` + strconv.Itoa(id) + "-" + strconv.FormatInt(stock, 10) + "-" + strconv.FormatInt(atomic.LoadInt64(&chairETagEpoch), 10) + `"`
+}
+
+// estateのETag estateは再インポートされない限り変わらないのでidだけで決まる
+func estateETag(id int) string {
+	return `"e` + strconv.Itoa(id) + "-" + strconv.FormatInt(atomic.LoadInt64(&estateETagEpoch), 10) + `"`
+}
+
+// notModified If-None-Matchがetagに一致すれば304を返す
+// 一致しなければETagヘッダをセットしてfalseを返す
+// GETでしか使わないので "*" は受け付けない (持っていないETagで304を返さない)
+func notModified(c echo.Context, etag string) bool {
+	if inm := c.Request().Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == etag {
+				c.Response().Header().Set("ETag", etag)
+				c.Response().WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+	}
+	c.Response().Header().Set("ETag", etag)
+	return false
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// 購入や資料請求、CSVの取り込みをイベントとして外に流し、分析や通知、検索の同期がMySQLを見に来なくても変更を受け取れるようにする
+// EVENT_SINKS に送り先をカンマ区切りで指定すると有効になる
+// 例: EVENT_SINKS=nats,http,kafka NATS_ADDR=10.0.0.5:4222 EVENT_HTTP_URL=http://10.0.0.6/events KAFKA_REST_URL=http://10.0.0.7:8082
+//
+// 送るのは一度きりで、送り先が落ちていたら捨てる (MySQLが正なので、取りこぼしたら読み直してもらう)
+
+const (
+	EventChairPurchased     = "chair.purchased"
+	EventEstateDocRequested = "estate.doc_requested"
+	EventItemsImported      = "items.imported"
+)
+
+const (
+	// eventBatchSize 1回に送り先へ渡すイベントの最大数
+	eventBatchSize = 100
+)
+
+var (
+	// eventQueueSize 送り待ちのイベントの数 溢れたら捨てる
+	eventQueueSize = parseIntEnv("EVENT_QUEUE_SIZE", 10000)
+	// eventSinkTimeout 送り先1つに1回送るときの待ち時間
+	eventSinkTimeout = parseDurationEnv("EVENT_SINK_TIMEOUT", time.Second)
+)
+
+// Event 送り先に渡す1件
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// ChairPurchased 椅子が購入された
+// イベントは外のシステムに流れるので、メールアドレスなど個人を特定できるものは入れない
+type ChairPurchased struct {
+	ChairID  int64 `json:"chairId"`
+	Quantity int64 `json:"quantity"`
+}
+
+// EstateDocRequested 物件の資料請求があった
+type EstateDocRequested struct {
+	EstateID int64 `json:"estateId"`
+}
+
+// ItemsImported CSVで椅子か物件が登録された
+type ItemsImported struct {
+	// Kind peerKindChair か peerKindEstate
+	Kind string `json:"kind"`
+	IDs  []int  `json:"ids"`
+	// Updated 既存の行を上書きした数
+	Updated int64 `json:"updated"`
+}
+
+// EventSink イベントの送り先
+type EventSink interface {
+	Name() string
+	Publish(events []Event) error
+}
+
+// eventBus イベントを溜めて、dispatchEvents がまとめて全ての送り先に渡す
+type eventBus struct {
+	queue   chan Event
+	sinks   []EventSink
+	dropped int64
+}
+
+var events = newEventBus(getEnv("EVENT_SINKS", ""))
+
+func newEventBus(names string) *eventBus {
+	b := &eventBus{}
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "log":
+			b.sinks = append(b.sinks, logEventSink{})
+		case "http":
+			b.sinks = append(b.sinks, &httpEventSink{
+				url:    getEnv("EVENT_HTTP_URL", ""),
+				client: &http.Client{Timeout: eventSinkTimeout},
+			})
+		case "nats":
+			b.sinks = append(b.sinks, &natsEventSink{
+				addr:   getEnv("NATS_ADDR", "127.0.0.1:4222"),
+				prefix: getEnv("NATS_SUBJECT_PREFIX", "isuumo."),
+			})
+		case "kafka":
+			b.sinks = append(b.sinks, &kafkaEventSink{
+				url:    strings.TrimSuffix(getEnv("KAFKA_REST_URL", "http://127.0.0.1:8082"), "/"),
+				prefix: getEnv("KAFKA_TOPIC_PREFIX", "isuumo."),
+				client: &http.Client{Timeout: eventSinkTimeout},
+			})
+		default:
+			log.Errorf("unknown event sink : %s", name)
+		}
+	}
+	if len(b.sinks) > 0 {
+		b.queue = make(chan Event, eventQueueSize)
+	}
+	return b
+}
+
+func (b *eventBus) enabled() bool {
+	return len(b.sinks) > 0
+}
+
+// publishEvent イベントを送り待ちに入れる 書き込みのレスポンスを待たせないように、溢れたら捨てる
+func publishEvent(typ string, data interface{}) {
+	if !events.enabled() {
+		return
+	}
+	select {
+	case events.queue <- Event{Type: typ, Time: time.Now(), Data: data}:
+	default:
+		atomic.AddInt64(&events.dropped, 1)
+	}
+}
+
+// dispatchEvents 送り待ちのイベントを eventBatchSize 件ずつ全ての送り先に渡す
+func dispatchEvents() {
+	batch := make([]Event, 0, eventBatchSize)
+	for ev := range events.queue {
+		batch = append(batch[:0], ev)
+	fill:
+		for len(batch) < eventBatchSize {
+			select {
+			case ev := <-events.queue:
+				batch = append(batch, ev)
+			default:
+				break fill
+			}
+		}
+
+		for _, s := range events.sinks {
+			if err := s.Publish(batch); err != nil {
+				log.Errorf("dispatchEvents %s : %v", s.Name(), err)
+			}
+		}
+		if n := atomic.SwapInt64(&events.dropped, 0); n > 0 {
+			log.Errorf("dispatchEvents dropped %d events : queue is full", n)
+		}
+	}
+}
+
+// logEventSink ログに書くだけ 手元で流れるイベントを確かめる用
+type logEventSink struct{}
+
+func (logEventSink) Name() string { return "log" }
+
+func (logEventSink) Publish(events []Event) error {
+	for _, ev := range events {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		log.Infof("event %s", b)
+	}
+	return nil
+}
+
+// httpEventSink イベントの配列をJSONでPOSTする
+type httpEventSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpEventSink) Name() string { return "http" }
+
+func (s *httpEventSink) Publish(events []Event) error {
+	if s.url == "" {
+		return fmt.Errorf("EVENT_HTTP_URL is not set")
+	}
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Post(s.url, echo.MIMEApplicationJSON, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s responded %s", s.url, res.Status)
+	}
+	return nil
+}
+
+// natsEventSink NATSに prefix+type のsubjectでPUBする
+// 使うのは CONNECT, PUB, PING だけなので、クライアントライブラリを入れずにプロトコルを直接話す
+// 送った後に PING を送って PONG を待ち、サーバーが受け取ったことを確かめる
+// dispatchEvents からしか呼ばないので接続は1本
+type natsEventSink struct {
+	addr   string
+	prefix string
+	conn   net.Conn
+	r      *bufio.Reader
+}
+
+func (s *natsEventSink) Name() string { return "nats" }
+
+func (s *natsEventSink) Publish(events []Event) error {
+	if err := s.publish(events); err != nil {
+		// 次回は繋ぎ直す
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *natsEventSink) publish(events []Event) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetDeadline(time.Now().Add(eventSinkTimeout))
+
+	var buf bytes.Buffer
+	for _, ev := range events {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "PUB %s%s %d\r\n", s.prefix, ev.Type, len(payload))
+		buf.Write(payload)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("PING\r\n")
+	if _, err := s.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.waitPong()
+}
+
+// connect 繋いで最初に届く INFO を読み、CONNECT を送る
+func (s *natsEventSink) connect() error {
+	c, err := net.DialTimeout("tcp", s.addr, eventSinkTimeout)
+	if err != nil {
+		return err
+	}
+	c.SetDeadline(time.Now().Add(eventSinkTimeout))
+	r := bufio.NewReader(c)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		c.Close()
+		return fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	if _, err := c.Write([]byte("CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"isuumo\"}\r\n")); err != nil {
+		c.Close()
+		return err
+	}
+	s.conn, s.r = c, r
+	return nil
+}
+
+// waitPong PONG が届くまで読む サーバーからの PING には PONG を返す
+func (s *natsEventSink) waitPong() error {
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats: %s", line)
+		}
+		// +OK や INFO は読み飛ばす
+	}
+}
+
+// kafkaEventSink Kafka REST Proxy (v2 API) を通して prefix+type のtopicに送る
+// Kafkaのプロトコルを直接話すには重く (レコードバッチ、CRC32C、パーティションのリーダー探し)、クライアントライブラリも入れられないので、HTTPで受けてもらう
+// topicごとに1回POSTし、どれかのレコードが書けなければエラーにする
+type kafkaEventSink struct {
+	url    string
+	prefix string
+	client *http.Client
+}
+
+const kafkaJSONContentType = "application/vnd.kafka.json.v2+json"
+
+type kafkaRecord struct {
+	Value Event `json:"value"`
+}
+
+type kafkaProduceRequest struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaProduceResponse struct {
+	Offsets []struct {
+		Partition int     `json:"partition"`
+		ErrorCode *int    `json:"error_code"`
+		Error     *string `json:"error"`
+	} `json:"offsets"`
+}
+
+func (s *kafkaEventSink) Name() string { return "kafka" }
+
+func (s *kafkaEventSink) Publish(events []Event) error {
+	// 届いた順を保ったままtopicごとに分ける
+	var topics []string
+	byTopic := map[string][]kafkaRecord{}
+	for _, ev := range events {
+		topic := s.prefix + ev.Type
+		if _, ok := byTopic[topic]; !ok {
+			topics = append(topics, topic)
+		}
+		byTopic[topic] = append(byTopic[topic], kafkaRecord{Value: ev})
+	}
+
+	for _, topic := range topics {
+		if err := s.produce(topic, byTopic[topic]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *kafkaEventSink) produce(topic string, records []kafkaRecord) error {
+	body, err := json.Marshal(kafkaProduceRequest{Records: records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url+"/topics/"+topic, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(echo.HeaderContentType, kafkaJSONContentType)
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("kafka: %s responded %s", topic, res.Status)
+	}
+
+	var produced kafkaProduceResponse
+	if err := json.NewDecoder(res.Body).Decode(&produced); err != nil {
+		return fmt.Errorf("kafka: %s : %v", topic, err)
+	}
+	for _, o := range produced.Offsets {
+		if o.ErrorCode != nil {
+			msg := ""
+			if o.Error != nil {
+				msg = *o.Error
+			}
+			return fmt.Errorf("kafka: %s partition %d error %d : %s", topic, o.Partition, *o.ErrorCode, msg)
+		}
+	}
+	return nil
+}
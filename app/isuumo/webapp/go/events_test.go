@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// イベントは外のシステムに流れるので、メールアドレスを含めない
+func TestEventPayloadsHaveNoEmail(t *testing.T) {
+	tests := []struct {
+		typ  string
+		data interface{}
+	}{
+		{EventChairPurchased, ChairPurchased{ChairID: 1, Quantity: 2}},
+		{EventEstateDocRequested, EstateDocRequested{EstateID: 3}},
+		{EventItemsImported, ItemsImported{Kind: peerKindChair, IDs: []int{1, 2}}},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(Event{Type: tt.typ, Time: time.Now(), Data: tt.data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(strings.ToLower(string(b)), "email") {
+			t.Errorf("%s payload contains an email field: %s", tt.typ, b)
+		}
+	}
+}
+
+func TestKafkaEventSinkPublish(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != kafkaJSONContentType {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		var req kafkaProduceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		topic := strings.TrimPrefix(r.URL.Path, "/topics/")
+		mu.Lock()
+		got[topic] += len(req.Records)
+		mu.Unlock()
+		if topic == "isuumo."+EventItemsImported {
+			w.Write([]byte(`{"offsets":[{"partition":0,"offset":null,"error_code":50301,"error":"not available"}]}`))
+			return
+		}
+		w.Write([]byte(`{"offsets":[{"partition":0,"offset":1,"error_code":null,"error":null}]}`))
+	}))
+	defer ts.Close()
+
+	s := &kafkaEventSink{url: ts.URL, prefix: "isuumo.", client: ts.Client()}
+	err := s.Publish([]Event{
+		{Type: EventChairPurchased, Data: ChairPurchased{ChairID: 1, Quantity: 1}},
+		{Type: EventEstateDocRequested, Data: EstateDocRequested{EstateID: 2}},
+		{Type: EventChairPurchased, Data: ChairPurchased{ChairID: 3, Quantity: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["isuumo."+EventChairPurchased] != 2 || got["isuumo."+EventEstateDocRequested] != 1 {
+		t.Errorf("records by topic = %v", got)
+	}
+
+	// レコードごとのエラーも失敗にする
+	if err := s.Publish([]Event{{Type: EventItemsImported, Data: ItemsImported{Kind: peerKindChair}}}); err == nil {
+		t.Error("Publish succeeded despite a record error")
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// experimentIDHeader 閲覧者を区別するヘッダ なければ閲覧履歴のCookieを使う
+	experimentIDHeader = "X-Experiment-ID"
+	// experimentVariantHeader 割り当てた群をレスポンスに付ける
+	experimentVariantHeader = "X-Experiment-Variant"
+	experimentContextKey    = "experimentVariant"
+)
+
+// ExperimentVariant 実験の1つの群
+// Rankingがnilなら /api/admin/ranking の重みで並べる
+type ExperimentVariant struct {
+	Name    string          `json:"name"`
+	Weight  int             `json:"weight"`
+	Ranking *RankingWeights `json:"ranking,omitempty"`
+}
+
+// Experiment 検索の並び順の実験
+// 閲覧者のidとNameのハッシュをWeightの合計で割った余りで群を決めるので、同じ閲覧者は同じ群になる
+type Experiment struct {
+	Name     string              `json:"name"`
+	Variants []ExperimentVariant `json:"variants"`
+}
+
+func (e Experiment) validate() error {
+	if len(e.Variants) == 0 {
+		return nil
+	}
+	if e.Name == "" {
+		return fmt.Errorf("experiment name is required")
+	}
+	seen := map[string]bool{}
+	for _, v := range e.Variants {
+		if v.Name == "" || seen[v.Name] {
+			return fmt.Errorf("variant names must be unique and non-empty")
+		}
+		seen[v.Name] = true
+		if v.Weight <= 0 {
+			return fmt.Errorf("variant %q weight must be positive", v.Name)
+		}
+		if v.Ranking != nil {
+			if err := v.Ranking.validate(); err != nil {
+				return fmt.Errorf("variant %q: %v", v.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// assign idの群を返す idが空なら先頭の群にする
+func (e Experiment) assign(id string) *ExperimentVariant {
+	if len(e.Variants) == 0 {
+		return nil
+	}
+	if id == "" {
+		return &e.Variants[0]
+	}
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + ":" + id))
+	n := int(h.Sum32() % uint32(total))
+	for i := range e.Variants {
+		if n < e.Variants[i].Weight {
+			return &e.Variants[i]
+		}
+		n -= e.Variants[i].Weight
+	}
+	return &e.Variants[len(e.Variants)-1]
+}
+
+// searchExperiment 実行中の実験 Variantsが空なら実験しない
+var searchExperiment Experiment
+var searchExperimentMutex sync.RWMutex
+
+func currentSearchExperiment() Experiment {
+	searchExperimentMutex.RLock()
+	defer searchExperimentMutex.RUnlock()
+	return searchExperiment
+}
+
+// experimentMiddleware 群を割り当ててcontextとレスポンスヘッダとログに付ける
+// レスポンスキャッシュより前に置く
+func experimentMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		e := currentSearchExperiment()
+		if len(e.Variants) == 0 {
+			return next(c)
+		}
+		id := c.Request().Header.Get(experimentIDHeader)
+		if id == "" {
+			if cookie, err := c.Cookie(historyCookieName); err == nil {
+				id = cookie.Value
+			}
+		}
+		v := e.assign(id)
+		c.Set(experimentContextKey, v)
+		c.Response().Header().Set(experimentVariantHeader, v.Name)
+		c.Logger().Infof("experiment=%s variant=%s %s %s", e.Name, v.Name, c.Request().Method, c.Request().URL.String())
+		return next(c)
+	}
+}
+
+// experimentVariantOf リクエストに割り当てた群 実験していなければnil
+func experimentVariantOf(c echo.Context) *ExperimentVariant {
+	v, _ := c.Get(experimentContextKey).(*ExperimentVariant)
+	return v
+}
+
+// searchRanking リクエストの群の重み 群が重みを持たなければ全体の重みを使う
+func searchRanking(c echo.Context) RankingWeights {
+	if v := experimentVariantOf(c); v != nil && v.Ranking != nil {
+		return *v.Ranking
+	}
+	return currentRankingWeights()
+}
+
+// bypassSearchCaches 群が独自の並び順を持つか、protobufや要約で返すならキャッシュを使わない
+// 要約はカラムを絞って読むので、キャッシュに入れると他のリクエストに欠けたchair/estateを返してしまう
+// キャッシュのキーやプリレンダリングは全体の重みで並べたJSONを前提にしている
+func bypassSearchCaches(c echo.Context) bool {
+	if wantsProtobuf(c) || summaryView(c) {
+		return true
+	}
+	v := experimentVariantOf(c)
+	return v != nil && v.Ranking != nil
+}
+
+// getExperiment 実行中の実験を返す
+func getExperiment(c echo.Context) error {
+	return JSON(c, http.StatusOK, currentSearchExperiment())
+}
+
+// putExperiment 実験を入れ替える variantsを空にすると実験をやめる
+func putExperiment(c echo.Context) error {
+	var e Experiment
+	if err := c.Bind(&e); err != nil {
+		c.Echo().Logger.Infof("put experiment failed : %v", err)
+		return badRequest(c, "invalid request body")
+	}
+	if err := e.validate(); err != nil {
+		c.Echo().Logger.Infof("put experiment failed : %v", err)
+		return badRequest(c, err.Error())
+	}
+
+	searchExperimentMutex.Lock()
+	searchExperiment = e
+	searchExperimentMutex.Unlock()
+
+	return JSON(c, http.StatusOK, e)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/csv"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"unicode"
+
+	"github.com/labstack/echo"
+)
+
+// 匿名化した文字列に使う文字
+var anonymizeKana = []rune("アイウエオカキクケコサシスセソタチツテトナニヌネノハヒフヘホマミムメモヤユヨラリルレロワ")
+var anonymizeLower = []rune("abcdefghijklmnopqrstuvwxyz")
+var anonymizeUpper = []rune("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+var anonymizeDigit = []rune("0123456789")
+
+// anonymize 文字数と文字種を保ったまま決定的に別の文字列へ置き換える
+// 同じ入力からは常に同じ出力になるので、ダンプ間で突き合わせができる
+func anonymize(s string) string {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	seed := h.Sum64()
+
+	rs := []rune(s)
+	for i, r := range rs {
+		// xorshiftで文字ごとに擬似乱数を進める
+		seed ^= seed << 13
+		seed ^= seed >> 7
+		seed ^= seed << 17
+
+		var pool []rune
+		switch {
+		case r >= 'a' && r <= 'z':
+			pool = anonymizeLower
+		case r >= 'A' && r <= 'Z':
+			pool = anonymizeUpper
+		case unicode.IsDigit(r):
+			pool = anonymizeDigit
+		case unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r):
+			continue
+		default:
+			pool = anonymizeKana
+		}
+		rs[i] = pool[seed%uint64(len(pool))]
+	}
+	return string(rs)
+}
+
+// exportChairs chairテーブルをpostChairで読み込める形式のCSVで出力する
+// anonymize=1 のときは名前・説明を匿名化する
+func exportChairs(c echo.Context) error {
+	ctx := c.Request().Context()
+	anon := c.QueryParam("anonymize") == "1"
+
+	rows, err := db.QueryxContext(ctx, "SELECT * FROM chair ORDER BY id")
+	if err != nil {
+		c.Logger().Errorf("exportChairs DB execution error : %v", err)
+		return internalError(c)
+	}
+	defer rows.Close()
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=UTF-8")
+	c.Response().WriteHeader(http.StatusOK)
+	w := csv.NewWriter(c.Response())
+
+	var chair Chair
+	for rows.Next() {
+		if err := rows.StructScan(&chair); err != nil {
+			c.Logger().Errorf("exportChairs scan error : %v", err)
+			return err
+		}
+		if anon {
+			chair.Name = anonymize(chair.Name)
+			chair.Description = anonymize(chair.Description)
+		}
+		w.Write([]string{
+			strconv.FormatInt(chair.ID, 10),
+			chair.Name,
+			chair.Description,
+			chair.Thumbnail,
+			strconv.FormatInt(chair.Price, 10),
+			strconv.FormatInt(chair.Height, 10),
+			strconv.FormatInt(chair.Width, 10),
+			strconv.FormatInt(chair.Depth, 10),
+			chair.Color,
+			chair.Features,
+			chair.Kind,
+			strconv.FormatInt(chair.Popularity, 10),
+			strconv.FormatInt(chair.Stock, 10),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+// exportEstates estateテーブルをpostEstateで読み込める形式のCSVで出力する
+// anonymize=1 のときは名前・説明・住所を匿名化する
+func exportEstates(c echo.Context) error {
+	ctx := c.Request().Context()
+	anon := c.QueryParam("anonymize") == "1"
+
+	rows, err := db.QueryxContext(ctx, "SELECT * FROM estate ORDER BY id")
+	if err != nil {
+		c.Logger().Errorf("exportEstates DB execution error : %v", err)
+		return internalError(c)
+	}
+	defer rows.Close()
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=UTF-8")
+	c.Response().WriteHeader(http.StatusOK)
+	w := csv.NewWriter(c.Response())
+
+	var estate Estate
+	for rows.Next() {
+		if err := rows.StructScan(&estate); err != nil {
+			c.Logger().Errorf("exportEstates scan error : %v", err)
+			return err
+		}
+		if anon {
+			estate.Name = anonymize(estate.Name)
+			estate.Description = anonymize(estate.Description)
+			estate.Address = anonymize(estate.Address)
+		}
+		w.Write([]string{
+			strconv.FormatInt(estate.ID, 10),
+			estate.Name,
+			estate.Description,
+			estate.Thumbnail,
+			estate.Address,
+			strconv.FormatFloat(estate.Latitude, 'f', -1, 64),
+			strconv.FormatFloat(estate.Longitude, 'f', -1, 64),
+			strconv.FormatInt(estate.Rent, 10),
+			strconv.FormatInt(estate.DoorHeight, 10),
+			strconv.FormatInt(estate.DoorWidth, 10),
+			estate.Features,
+			strconv.FormatInt(estate.Popularity, 10),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// fakedb テスト用の database/sql ドライバ
+// 発行されたクエリを記録し、プレースホルダと引数の数が合わなければMySQLと同じように失敗させる
+func init() {
+	sql.Register("fakedb", fakeDriver{})
+}
+
+type fakeQuery struct {
+	Query string
+	Args  []driver.Value
+}
+
+type fakeDB struct {
+	mu      sync.Mutex
+	queries []fakeQuery
+	// result queryの結果を返す nilか、columnsがnilなら SELECT COUNT(*) には0を、それ以外には0行を返す
+	result func(query string, args []driver.Value) (columns []string, rows [][]driver.Value)
+}
+
+var (
+	fakeDBs      = map[string]*fakeDB{}
+	fakeDBsMutex sync.Mutex
+)
+
+// useFakeDB テストの間 db を記録するだけのDBに差し替える
+func useFakeDB(t *testing.T) *fakeDB {
+	f := &fakeDB{}
+	fakeDBsMutex.Lock()
+	fakeDBs[t.Name()] = f
+	fakeDBsMutex.Unlock()
+
+	d, err := sql.Open("fakedb", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := db
+	db = sqlx.NewDb(d, "mysql")
+	t.Cleanup(func() {
+		db = old
+		d.Close()
+		fakeDBsMutex.Lock()
+		delete(fakeDBs, t.Name())
+		fakeDBsMutex.Unlock()
+	})
+	return f
+}
+
+// Queries 記録したクエリ
+func (f *fakeDB) Queries() []fakeQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeQuery(nil), f.queries...)
+}
+
+func (f *fakeDB) query(query string, args []driver.Value) (driver.Rows, error) {
+	f.mu.Lock()
+	f.queries = append(f.queries, fakeQuery{Query: query, Args: args})
+	result := f.result
+	f.mu.Unlock()
+
+	if n := strings.Count(query, "?"); n != len(args) {
+		return nil, fmt.Errorf("fakedb: %d placeholders but %d args: %s", n, len(args), query)
+	}
+	var columns []string
+	var rows [][]driver.Value
+	if result != nil {
+		columns, rows = result(query, args)
+	}
+	if columns == nil && strings.HasPrefix(query, "SELECT COUNT(*)") {
+		columns, rows = []string{"COUNT(*)"}, [][]driver.Value{{int64(0)}}
+	}
+	return &fakeRows{columns: columns, rows: rows}, nil
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMutex.Lock()
+	f, ok := fakeDBs[name]
+	fakeDBsMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("fakedb: unknown db %s", name)
+	}
+	return &fakeConn{db: f}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	rows, err := s.db.query(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return driver.RowsAffected(0), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.db.query(s.query, args)
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
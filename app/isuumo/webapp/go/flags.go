@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// featureFlag 実行中に切り替えられる最適化のフラグ
+// 初期値は環境変数で上書きできる
+type featureFlag struct {
+	Name    string
+	enabled int32
+}
+
+var featureFlags []*featureFlag
+
+func newFeatureFlag(name string, defaultValue bool) *featureFlag {
+	def := "0"
+	if defaultValue {
+		def = "1"
+	}
+	f := &featureFlag{Name: name}
+	if getEnv(name, def) == "1" {
+		f.enabled = 1
+	}
+	featureFlags = append(featureFlags, f)
+	return f
+}
+
+func (f *featureFlag) Enabled() bool {
+	return atomic.LoadInt32(&f.enabled) == 1
+}
+
+func (f *featureFlag) Set(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&f.enabled, v)
+}
+
+// searchChairsで件数と行をウィンドウ関数で1クエリで取得する (MySQL 8.0以降)
+var flagChairSearchWindowCount = newFeatureFlag("CHAIR_SEARCH_WINDOW_COUNT", false)
+
+// 単一条件の検索結果のプリレンダリングを使う
+var flagSearchPageCache = newFeatureFlag("SEARCH_PAGE_CACHE", true)
+
+// 大きなページをストリーミングで返す
+var flagStreamLargePages = newFeatureFlag("STREAM_LARGE_PAGES", true)
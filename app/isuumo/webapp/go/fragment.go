@@ -0,0 +1,24 @@
+package main
+
+// キャッシュに入れるchair/estateはJSONにした結果も一緒に持ち、エンコードのたびに作り直さない
+// 詳細でも一覧でも、myjson はfragmentをそのまま書き出す (writeChair, writeEstate)
+var flagJSONFragment = newFeatureFlag("JSON_FRAGMENT", true)
+
+// withChairFragment キャッシュに入れる前にJSONにしておく
+// 失敗したらfragmentなしでエンコードされるだけなので無視する
+func withChairFragment(chair Chair) Chair {
+	chair.fragment = nil
+	if flagJSONFragment.Enabled() {
+		chair.fragment, _ = myjson.Marshal(&chair)
+	}
+	return chair
+}
+
+// withEstateFragment キャッシュに入れる前にJSONにしておく
+func withEstateFragment(estate Estate) Estate {
+	estate.fragment = nil
+	if flagJSONFragment.Enabled() {
+		estate.fragment, _ = myjson.Marshal(&estate)
+	}
+	return estate
+}
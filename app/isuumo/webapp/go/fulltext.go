@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// 検索語の数の上限
+const fulltextMaxTerms = 8
+
+// fulltextQuery q パラメータをBOOLEAN MODEの検索式にする
+// 空白区切りの語を全て含むものにマッチさせる 各語はフレーズとして扱い演算子は解釈しない
+// マイグレーション estate_fulltext で張るngramインデックスを使う
+func fulltextQuery(q string) (string, bool) {
+	var terms []string
+	for _, t := range strings.FieldsFunc(strings.ReplaceAll(q, `"`, " "), unicode.IsSpace) {
+		terms = append(terms, `+"`+t+`"`)
+	}
+	if len(terms) == 0 || len(terms) > fulltextMaxTerms {
+		return "", false
+	}
+	return strings.Join(terms, " "), true
+}
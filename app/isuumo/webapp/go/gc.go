@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// GCの発生頻度を抑えるためのバラスト
+// 実際にはページが触られないので物理メモリは消費しない
+var ballast []byte
+var ballastMutex sync.Mutex
+
+// ballastRatio オンメモリのインデックスなどを読み込んだ後のヒープに対するバラストの大きさ
+// APP_GC_BALLAST_MB を指定したときはそちらを使う
+var ballastRatio = parseFloatEnv("APP_GC_BALLAST_RATIO", 0)
+
+// gcPercent setupGC で設定したGOGC
+// SetGCPercent は読むだけでも一度書き換えるので、リクエストのたびには呼ばない
+var gcPercent int
+
+type GCStatsResponse struct {
+	NumGC         int64   `json:"numGC"`
+	PauseTotalMs  float64 `json:"pauseTotalMs"`
+	LastPauseMs   float64 `json:"lastPauseMs"`
+	MaxPauseMs    float64 `json:"maxPauseMs"`
+	GCPercent     int     `json:"gcPercent"`
+	MemoryLimitMB int64   `json:"memoryLimitMB"`
+	BallastMB     int     `json:"ballastMB"`
+	HeapAllocMB   uint64  `json:"heapAllocMB"`
+	HeapSysMB     uint64  `json:"heapSysMB"`
+}
+
+// setupGC 環境変数からGC関連の設定を行う
+// GOGC, GOMEMLIMIT はランタイム起動時にも読まれるが、
+// APP_GOGC, APP_GOMEMLIMIT_MB でsystemdのunitを触らずに上書きできるようにする
+// APP_GOMEMLIMIT_MB は Go 1.19 以降でビルドしたときだけ効く
+func setupGC() {
+	// 起動直後でまだリクエストを受けていないので、読むために書き換えても影響しない
+	gcPercent = debug.SetGCPercent(100)
+	debug.SetGCPercent(gcPercent)
+	if v, err := strconv.Atoi(getEnv("APP_GOGC", "")); err == nil {
+		debug.SetGCPercent(v)
+		gcPercent = v
+	}
+	if v, err := strconv.ParseInt(getEnv("APP_GOMEMLIMIT_MB", ""), 10, 64); err == nil && v > 0 {
+		if !setMemoryLimit(v << 20) {
+			log.Warnf("APP_GOMEMLIMIT_MB is ignored : the runtime does not support a memory limit")
+		}
+	}
+	if v, err := strconv.Atoi(getEnv("APP_GC_BALLAST_MB", "0")); err == nil && v > 0 {
+		resizeBallast(v)
+	}
+}
+
+// sizeBallastToHeap オンメモリのインデックスを読み込んだ後に、その時点のヒープの ballastRatio 倍にバラストを作り直す
+// APP_GC_BALLAST_MB で大きさを決めているときと、ballastRatio が0のときは何もしない
+func sizeBallastToHeap() {
+	if ballastRatio <= 0 || getEnv("APP_GC_BALLAST_MB", "") != "" {
+		return
+	}
+	// 読み込みの途中で作ったゴミを除いた、残っているヒープを測る
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	live := int64(mem.HeapAlloc) - int64(ballastSizeMB())<<20
+	if live < 0 {
+		live = 0
+	}
+	resizeBallast(int(float64(live)*ballastRatio) >> 20)
+}
+
+// resizeBallast バラストをmb MBに作り直す
+func resizeBallast(mb int) {
+	ballastMutex.Lock()
+	defer ballastMutex.Unlock()
+
+	if mb <= 0 {
+		ballast = nil
+		return
+	}
+	ballast = make([]byte, mb<<20)
+}
+
+func ballastSizeMB() int {
+	ballastMutex.Lock()
+	defer ballastMutex.Unlock()
+	return len(ballast) >> 20
+}
+
+func getGCStats(c echo.Context) error {
+	var stats debug.GCStats
+	stats.PauseQuantiles = make([]time.Duration, 5)
+	debug.ReadGCStats(&stats)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	res := GCStatsResponse{
+		NumGC:         stats.NumGC,
+		PauseTotalMs:  float64(stats.PauseTotal) / float64(time.Millisecond),
+		MaxPauseMs:    float64(stats.PauseQuantiles[4]) / float64(time.Millisecond),
+		GCPercent:     gcPercent,
+		MemoryLimitMB: memoryLimit() >> 20,
+		BallastMB:     ballastSizeMB(),
+		HeapAllocMB:   mem.HeapAlloc >> 20,
+		HeapSysMB:     mem.HeapSys >> 20,
+	}
+	if len(stats.Pause) > 0 {
+		res.LastPauseMs = float64(stats.Pause[0]) / float64(time.Millisecond)
+	}
+
+	return JSON(c, http.StatusOK, res)
+}
@@ -0,0 +1,18 @@
+// +build go1.19
+
+package main
+
+import (
+	"runtime/debug"
+)
+
+// setMemoryLimit ソフトメモリ上限を設定する (Go 1.19以降)
+func setMemoryLimit(bytes int64) bool {
+	debug.SetMemoryLimit(bytes)
+	return true
+}
+
+// memoryLimit 現在のソフトメモリ上限 設定を変えずに読む
+func memoryLimit() int64 {
+	return debug.SetMemoryLimit(-1)
+}
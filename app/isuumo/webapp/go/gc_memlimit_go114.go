@@ -0,0 +1,17 @@
+// +build !go1.19
+
+package main
+
+import (
+	"math"
+)
+
+// setMemoryLimit Go 1.19より前のランタイムにはソフトメモリ上限がないので何もしない
+func setMemoryLimit(bytes int64) bool {
+	return false
+}
+
+// memoryLimit 上限がないのと同じ値を返す
+func memoryLimit() int64 {
+	return math.MaxInt64
+}
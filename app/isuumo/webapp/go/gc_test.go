@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/debug"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestGetGCStatsReportsGCPercent(t *testing.T) {
+	defer debug.SetGCPercent(debug.SetGCPercent(150))
+	defer func(old int) { gcPercent = old }(gcPercent)
+	gcPercent = 150
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/debug/gc", nil), rec)
+	if err := getGCStats(c); err != nil {
+		t.Fatal(err)
+	}
+	var res GCStatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.GCPercent != 150 {
+		t.Errorf("gcPercent = %d, want 150", res.GCPercent)
+	}
+}
+
+func TestSizeBallastToHeap(t *testing.T) {
+	defer resizeBallast(ballastSizeMB())
+	defer func(old float64) { ballastRatio = old }(ballastRatio)
+
+	// 64MB 生きているデータを持つ
+	live := make([]byte, 64<<20)
+
+	tests := []struct {
+		ratio float64
+		minMB int
+		maxMB int
+	}{
+		{0, 0, 0},
+		{1, 64, 128},
+		{2, 128, 256},
+	}
+	for _, tt := range tests {
+		resizeBallast(0)
+		ballastRatio = tt.ratio
+		sizeBallastToHeap()
+		if mb := ballastSizeMB(); mb < tt.minMB || mb > tt.maxMB {
+			t.Errorf("ratio %v: ballast = %dMB, want %d..%dMB", tt.ratio, mb, tt.minMB, tt.maxMB)
+		}
+	}
+	runtime.KeepAlive(live)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// メモリ上の候補をkd-treeの代わりにgeohashのセルから取り出す
+var flagGeohashIndex = newFeatureFlag("GEOHASH_INDEX", false)
+
+const (
+	// geohashPrecision estate.geohash に保存するgeohashの桁数 (約4.9km x 4.9km)
+	// 9_estate_geohash.sql と同じ値にする
+	geohashPrecision = 5
+	// geohashMaxCells 列挙するセルの数の上限 超えたら全てのセルを調べる
+	geohashMaxCells = 1024
+	// nearbyMaxRadius 半径検索の半径の上限 (m)
+	nearbyMaxRadius = 50000
+	// earthRadius 地球の半径 (m)
+	earthRadius = 6371000
+)
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashEncode 緯度経度をprecision桁のgeohashにする MySQLの ST_GeoHash と同じ結果になる
+func geohashEncode(latitude, longitude float64, precision int) string {
+	v := geohashBits(latitude, longitude, 5*precision)
+	b := make([]byte, precision)
+	for i := precision - 1; i >= 0; i-- {
+		b[i] = geohashBase32[v&31]
+		v >>= 5
+	}
+	return string(b)
+}
+
+// geohashCellSize precision桁のセルの緯度と経度の幅
+func geohashCellSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	return 180 / math.Pow(2, float64(bits/2)), 360 / math.Pow(2, float64((bits+1)/2))
+}
+
+// geohashCovering bを覆うセルを列挙する 上限を超えるならfalseを返す
+func geohashCovering(b BoundingBox, precision int) ([]string, bool) {
+	latSize, lonSize := geohashCellSize(precision)
+	minLat := math.Floor((b.TopLeftCorner.Latitude+90)/latSize)*latSize - 90
+	minLon := math.Floor((b.TopLeftCorner.Longitude+180)/lonSize)*lonSize - 180
+	maxLat := math.Min(b.BottomRightCorner.Latitude, 90)
+	maxLon := math.Min(b.BottomRightCorner.Longitude, 180)
+
+	nLat := int((maxLat-minLat)/latSize) + 1
+	nLon := int((maxLon-minLon)/lonSize) + 1
+	if nLat*nLon > geohashMaxCells {
+		return nil, false
+	}
+
+	cells := make([]string, 0, nLat*nLon)
+	for i := 0; i < nLat; i++ {
+		for j := 0; j < nLon; j++ {
+			lat := minLat + (float64(i)+0.5)*latSize
+			lon := minLon + (float64(j)+0.5)*lonSize
+			cells = append(cells, geohashEncode(lat, lon, precision))
+		}
+	}
+	return cells, true
+}
+
+// buildGeohashCells セル -> estate の位置 を作る
+func buildGeohashCells(points map[int64]estatePoint) map[string][]estatePoint {
+	cells := map[string][]estatePoint{}
+	for _, p := range points {
+		h := geohashEncode(p.Latitude, p.Longitude, geohashPrecision)
+		cells[h] = append(cells[h], p)
+	}
+	return cells
+}
+
+// searchGeohashCells bの中 (境界を含む) にある点をfnに渡す
+// estatePointsMutex をロックした状態で呼ぶ
+func searchGeohashCells(b BoundingBox, fn func(p *estatePoint)) {
+	inBox := func(ps []estatePoint) {
+		for i := range ps {
+			if inBoundingBox(b, ps[i].Latitude, ps[i].Longitude) {
+				fn(&ps[i])
+			}
+		}
+	}
+
+	cells, ok := geohashCovering(b, geohashPrecision)
+	if !ok || len(cells) > len(estateGeohashCells) {
+		for _, ps := range estateGeohashCells {
+			inBox(ps)
+		}
+		return
+	}
+	for _, h := range cells {
+		inBox(estateGeohashCells[h])
+	}
+}
+
+// distance 2点間の大円距離 (m)
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// radiusBoundingBox 中心から半径radiusの円を囲む矩形
+func radiusBoundingBox(latitude, longitude, radius float64) BoundingBox {
+	dLat := radius / earthRadius * 180 / math.Pi
+	dLon := dLat / math.Max(math.Cos(latitude*math.Pi/180), 1e-6)
+	return BoundingBox{
+		TopLeftCorner:     Coordinate{Latitude: latitude - dLat, Longitude: longitude - dLon},
+		BottomRightCorner: Coordinate{Latitude: latitude + dLat, Longitude: longitude + dLon},
+	}
+}
+
+// searchEstatesNearby 中心から半径radius (m) 以内のestateを近い順に返す
+// countは半径内の全件数、estatesは NazotteLimit 件まで
+func searchEstatesNearby(c echo.Context) error {
+	ctx := c.Request().Context()
+	latitude, err := strconv.ParseFloat(c.QueryParam("latitude"), 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		c.Echo().Logger.Infof("latitude invalid, %v : %v", c.QueryParam("latitude"), err)
+		return invalidParam(c, "latitude", "must be a number between -90 and 90")
+	}
+	longitude, err := strconv.ParseFloat(c.QueryParam("longitude"), 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		c.Echo().Logger.Infof("longitude invalid, %v : %v", c.QueryParam("longitude"), err)
+		return invalidParam(c, "longitude", "must be a number between -180 and 180")
+	}
+	radius, err := strconv.ParseFloat(c.QueryParam("radius"), 64)
+	if err != nil || radius <= 0 || radius > nearbyMaxRadius {
+		c.Echo().Logger.Infof("radius invalid, %v : %v", c.QueryParam("radius"), err)
+		return invalidParam(c, "radius", "must be a positive number")
+	}
+
+	b := radiusBoundingBox(latitude, longitude, radius)
+
+	type nearby struct {
+		id       int
+		distance float64
+	}
+	var found []nearby
+	add := func(id int64, lat, lon float64) {
+		if d := distance(latitude, longitude, lat, lon); d <= radius {
+			found = append(found, nearby{int(id), d})
+		}
+	}
+
+	if flagInMemoryNazotte.Enabled() {
+		estatePointsInBox(b, func(p *estatePoint) {
+			add(p.ID, p.Latitude, p.Longitude)
+		})
+	} else {
+		cells, ok := geohashCovering(b, geohashPrecision)
+		if !ok {
+			c.Echo().Logger.Infof("radius too large for geohash covering : %v", radius)
+			return invalidParam(c, "radius", "too large")
+		}
+		query, args, err := sqlx.In(`SELECT id, latitude, longitude FROM estate WHERE geohash IN (?)`, cells)
+		if err != nil {
+			c.Logger().Errorf("searchEstatesNearby failed to build query : %v", err)
+			return internalError(c)
+		}
+		var points []estatePoint
+		if err := db.SelectContext(ctx, &points, query, args...); err != nil && err != sql.ErrNoRows {
+			c.Logger().Errorf("searchEstatesNearby DB execution error : %v", err)
+			return internalError(c)
+		}
+		for _, p := range points {
+			add(p.ID, p.Latitude, p.Longitude)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].distance == found[j].distance {
+			return found[i].id < found[j].id
+		}
+		return found[i].distance < found[j].distance
+	})
+
+	ids := getEmptyIntSlice()
+	defer releaseIntSlice(ids)
+	for i := 0; i < len(found) && i < NazotteLimit; i++ {
+		ids = append(ids, found[i].id)
+	}
+
+	estates := getEmptyEstateSlice()
+	defer releaseEstateSlice(estates)
+	estates, err = srv.getEstatesByIDs(ctx, ids, estates)
+	if err != nil {
+		c.Logger().Errorf("searchEstatesNearby DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	return JSON(c, http.StatusOK, EstateSearchResponse{Count: int64(len(found)), Estates: estates})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// estateLevels estateの rent_level, height_level, width_level の組
+type estateLevels [3]int64
+
+// estateHistogram approxCount=1 のときに件数を見積もるためのestateの件数の分布
+type estateHistogram struct {
+	Total int64
+	// Levels levelの組み合わせごとの件数
+	Levels map[estateLevels]int64
+	// Features featureごとの件数
+	Features map[int]int64
+}
+
+var (
+	estateHistogramMutex sync.RWMutex
+	// estateHistogramData nilなら無効化されている
+	estateHistogramData       *estateHistogram
+	estateHistogramGeneration int64
+	// estateHistogramRebuildMutex 作り直しを1つに絞る
+	estateHistogramRebuildMutex sync.Mutex
+)
+
+// clearEstateHistogram estateが追加されたときに捨てる
+func clearEstateHistogram() {
+	estateHistogramMutex.Lock()
+	defer estateHistogramMutex.Unlock()
+	estateHistogramData = nil
+	estateHistogramGeneration++
+}
+
+// loadEstateHistogram estateHistogramを返す 無効化されていれば作り直す
+func loadEstateHistogram() (*estateHistogram, error) {
+	estateHistogramMutex.RLock()
+	h := estateHistogramData
+	estateHistogramMutex.RUnlock()
+	if h != nil {
+		return h, nil
+	}
+
+	estateHistogramRebuildMutex.Lock()
+	defer estateHistogramRebuildMutex.Unlock()
+
+	estateHistogramMutex.RLock()
+	h = estateHistogramData
+	generation := estateHistogramGeneration
+	estateHistogramMutex.RUnlock()
+	if h != nil {
+		return h, nil
+	}
+
+	h = &estateHistogram{Levels: map[estateLevels]int64{}, Features: map[int]int64{}}
+
+	var levels []struct {
+		RentLevel   int64 `db:"rent_level"`
+		HeightLevel int64 `db:"height_level"`
+		WidthLevel  int64 `db:"width_level"`
+		Count       int64 `db:"count"`
+	}
+	query := `SELECT rent_level, height_level, width_level, COUNT(*) AS count FROM estate GROUP BY rent_level, height_level, width_level`
+	if err := db.Select(&levels, query); err != nil {
+		return nil, err
+	}
+	for _, l := range levels {
+		h.Levels[estateLevels{l.RentLevel, l.HeightLevel, l.WidthLevel}] = l.Count
+		h.Total += l.Count
+	}
+
+	var features []struct {
+		FeatureID int   `db:"feature_id"`
+		Count     int64 `db:"count"`
+	}
+	query = `SELECT feature_id, COUNT(*) AS count FROM estate_feature GROUP BY feature_id`
+	if err := db.Select(&features, query); err != nil {
+		return nil, err
+	}
+	for _, f := range features {
+		h.Features[f.FeatureID] = f.Count
+	}
+
+	estateHistogramMutex.Lock()
+	if estateHistogramGeneration == generation {
+		estateHistogramData = h
+	}
+	estateHistogramMutex.Unlock()
+
+	return h, nil
+}
+
+func containsLevel(levels []int64, level int64) bool {
+	if levels == nil {
+		return true
+	}
+	for _, l := range levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// estimate levelの条件に一致する件数を数え、featureは互いに独立だとみなして割合を掛ける
+// nilのlevelは条件なしとして扱う
+func (h *estateHistogram) estimate(rent, height, width []int64, features []int) int64 {
+	var n int64
+	for l, count := range h.Levels {
+		if containsLevel(rent, l[0]) && containsLevel(height, l[1]) && containsLevel(width, l[2]) {
+			n += count
+		}
+	}
+	if h.Total == 0 {
+		return 0
+	}
+
+	ratio := 1.0
+	for _, f := range features {
+		ratio *= float64(h.Features[f]) / float64(h.Total)
+	}
+	return int64(math.Round(float64(n) * ratio))
+}
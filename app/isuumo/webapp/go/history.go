@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 詳細の閲覧を匿名のCookieごとに記録して GET /api/history で返す
+var flagViewHistory = newFeatureFlag("VIEW_HISTORY", true)
+
+const (
+	// historyCookieName 閲覧者を区別するCookie
+	historyCookieName   = "isuumo_viewer"
+	historyCookieMaxAge = 30 * 24 * time.Hour
+	// historyMaxItems 1人あたりに持っておく閲覧履歴の数
+	historyMaxItems = 20
+	// historyMaxViewers これを超えたら古い方の閲覧者を捨てる
+	historyMaxViewers = 100000
+)
+
+// historyItem 閲覧した椅子か物件
+type historyItem struct {
+	kind string
+	id   int64
+}
+
+// viewHistories 閲覧者 -> 新しい順の閲覧履歴
+// current が historyMaxViewers を超えたら previous にずらし、previous は捨てる
+// 最近見ていない閲覧者から消えるので、LRUを持たずにメモリの上限を決められる
+var viewHistories = struct {
+	sync.Mutex
+	current, previous map[string][]historyItem
+}{current: map[string][]historyItem{}, previous: map[string][]historyItem{}}
+
+func getViewHistory(viewer string) []historyItem {
+	viewHistories.Lock()
+	defer viewHistories.Unlock()
+	if items, ok := viewHistories.current[viewer]; ok {
+		return append([]historyItem(nil), items...)
+	}
+	return append([]historyItem(nil), viewHistories.previous[viewer]...)
+}
+
+// recordViewHistory itemを先頭に移す
+func recordViewHistory(viewer string, item historyItem) {
+	viewHistories.Lock()
+	defer viewHistories.Unlock()
+
+	items, ok := viewHistories.current[viewer]
+	if !ok {
+		items = viewHistories.previous[viewer]
+		delete(viewHistories.previous, viewer)
+	}
+
+	res := make([]historyItem, 1, historyMaxItems)
+	res[0] = item
+	for _, it := range items {
+		if it != item && len(res) < historyMaxItems {
+			res = append(res, it)
+		}
+	}
+
+	if !ok && len(viewHistories.current) >= historyMaxViewers {
+		viewHistories.previous = viewHistories.current
+		viewHistories.current = map[string][]historyItem{}
+	}
+	viewHistories.current[viewer] = res
+}
+
+// resetViewHistories /initialize で閲覧履歴を捨てる
+func resetViewHistories() {
+	viewHistories.Lock()
+	viewHistories.current = map[string][]historyItem{}
+	viewHistories.previous = map[string][]historyItem{}
+	viewHistories.Unlock()
+}
+
+// newRandomID 推測できない32文字の16進数のid
+func newRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// viewerID Cookieの閲覧者を返す なければ作ってCookieを返す
+func viewerID(c echo.Context) (string, error) {
+	if cookie, err := c.Cookie(historyCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return "", err
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     historyCookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(historyCookieMaxAge / time.Second),
+		HttpOnly: true,
+	})
+	return id, nil
+}
+
+// historyMiddleware 詳細を返せたら :id を閲覧履歴に記録する
+// Cookieはレスポンスを書く前に付ける必要があるので、ハンドラより先に閲覧者を決める
+func historyMiddleware(kind string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !flagViewHistory.Enabled() {
+				return next(c)
+			}
+			viewer, err := viewerID(c)
+			if err != nil {
+				c.Logger().Errorf("historyMiddleware failed to create viewer id : %v", err)
+				return next(c)
+			}
+
+			if err := next(c); err != nil {
+				return err
+			}
+
+			status := c.Response().Status
+			if status != http.StatusOK && status != http.StatusNotModified {
+				return nil
+			}
+			id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+			if err != nil {
+				return nil
+			}
+			recordViewHistory(viewer, historyItem{kind: kind, id: id})
+			return nil
+		}
+	}
+}
+
+// HistoryItem 閲覧履歴の1件 typeに応じてchairかestateのどちらかが入る
+type HistoryItem struct {
+	Type   string  `json:"type"`
+	Chair  *Chair  `json:"chair,omitempty"`
+	Estate *Estate `json:"estate,omitempty"`
+}
+
+type HistoryResponse struct {
+	Items []HistoryItem `json:"items"`
+}
+
+// getHistory Cookieの閲覧者が最近見た椅子と物件を新しい順に返す
+// 非表示になった椅子や消えたものは飛ばす
+func getHistory(c echo.Context) error {
+	res := HistoryResponse{Items: []HistoryItem{}}
+	cookie, err := c.Cookie(historyCookieName)
+	if err != nil || cookie.Value == "" {
+		return JSON(c, http.StatusOK, res)
+	}
+	items := getViewHistory(cookie.Value)
+
+	estateIDs := make([]int, 0, len(items))
+	for _, it := range items {
+		if it.kind == itemEstate {
+			estateIDs = append(estateIDs, int(it.id))
+		}
+	}
+	estates := map[int64]Estate{}
+	if len(estateIDs) > 0 {
+		found, err := srv.getEstatesByIDs(c.Request().Context(), estateIDs, nil)
+		if err != nil {
+			c.Logger().Errorf("getHistory DB execution error : %v", err)
+			return internalError(c)
+		}
+		for _, e := range found {
+			estates[e.ID] = e
+		}
+	}
+
+	for _, it := range items {
+		switch it.kind {
+		case itemChair:
+			chair, err := srv.getChair(int(it.id))
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				c.Logger().Errorf("getHistory DB execution error : %v", err)
+				return internalError(c)
+			}
+			if chair.Hidden {
+				continue
+			}
+			res.Items = append(res.Items, HistoryItem{Type: itemChair, Chair: &chair})
+		case itemEstate:
+			if e, ok := estates[it.id]; ok {
+				res.Items = append(res.Items, HistoryItem{Type: itemEstate, Estate: &e})
+			}
+		}
+	}
+
+	return JSON(c, http.StatusOK, res)
+}
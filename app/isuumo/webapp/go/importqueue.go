@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// POST /api/chair, /api/estate のCSVを一時ファイルに書き出してキューに入れ、202を返してワーカーが書き込む
+// 無効なときと sync=1 のときはこれまで通りリクエストの中で書き込んで201を返す
+// ベンチマークは書き込んだ直後に検索するので既定は無効
+var flagAsyncImport = newFeatureFlag("ASYNC_IMPORT", false)
+
+var (
+	// importQueueSize キューに入れておけるジョブの数 溢れたら503で後から送り直してもらう
+	importQueueSize = parseIntEnv("IMPORT_QUEUE_SIZE", 16)
+	// importWorkers 同時に書き込むジョブの数
+	importWorkers = parseIntEnv("IMPORT_WORKERS", 2)
+)
+
+// importStatusLimit 覚えておくジョブの状態の数 古いものから忘れる
+const importStatusLimit = 1000
+
+const (
+	importKindChair  = "chair"
+	importKindEstate = "estate"
+)
+
+const (
+	importQueued  = "queued"
+	importRunning = "running"
+	importDone    = "done"
+	importFailed  = "failed"
+)
+
+type importJob struct {
+	id          string
+	kind        string
+	path        string
+	contentType string
+	filename    string
+}
+
+// ImportStatus GET /api/import/:id で返すジョブの状態
+type ImportStatus struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	// Error 失敗したときの理由 CSVの誤りならその内容
+	Error string `json:"error,omitempty"`
+}
+
+var importQueue = make(chan *importJob, importQueueSize)
+
+var (
+	importSeq         int64
+	importStatuses    = map[string]*ImportStatus{}
+	importStatusOrder []string
+	importStatusMutex sync.Mutex
+)
+
+// asyncImport このリクエストのCSVをキューに入れるか
+func asyncImport(c echo.Context) bool {
+	return flagAsyncImport.Enabled() && c.QueryParam("sync") != "1"
+}
+
+// importWorker importQueue からジョブを取り出して書き込む
+func importWorker() {
+	for job := range importQueue {
+		runImportJob(job)
+	}
+}
+
+// enqueueImport アップロードされたファイルを一時ファイルに書き出してキューに入れる
+// リクエストが終わるとアップロードされたファイルは消されるので、先に書き出しておく
+func enqueueImport(c echo.Context, kind string, header *multipart.FileHeader) error {
+	path, err := spoolUpload(header)
+	if err != nil {
+		c.Logger().Errorf("failed to spool upload: %v", err)
+		return internalError(c)
+	}
+
+	job := &importJob{
+		id:          strconv.FormatInt(atomic.AddInt64(&importSeq, 1), 10),
+		kind:        kind,
+		path:        path,
+		contentType: header.Header.Get("Content-Type"),
+		filename:    header.Filename,
+	}
+	st := setImportStatus(job, importQueued, "")
+	select {
+	case importQueue <- job:
+	default:
+		os.Remove(path)
+		setImportStatus(job, importFailed, "import queue is full")
+		c.Response().Header().Set("Retry-After", "1")
+		return Problem(c, http.StatusServiceUnavailable, problemCode(http.StatusServiceUnavailable), "import queue is full")
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, "/api/import/"+job.id)
+	return JSON(c, http.StatusAccepted, st)
+}
+
+// spoolUpload アップロードされたファイルをそのまま一時ファイルに書き出す
+func spoolUpload(header *multipart.FileHeader) (string, error) {
+	src, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := ioutil.TempFile("", "isuumo-import-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// setImportStatus jobの状態を書き換えて、その写しを返す
+func setImportStatus(job *importJob, status, message string) ImportStatus {
+	importStatusMutex.Lock()
+	defer importStatusMutex.Unlock()
+
+	st, ok := importStatuses[job.id]
+	if !ok {
+		st = &ImportStatus{ID: job.id, Kind: job.kind}
+		importStatuses[job.id] = st
+		importStatusOrder = append(importStatusOrder, job.id)
+		if len(importStatusOrder) > importStatusLimit {
+			delete(importStatuses, importStatusOrder[0])
+			importStatusOrder = importStatusOrder[1:]
+		}
+	}
+	st.Status = status
+	st.Error = message
+	return *st
+}
+
+// runImportJob jobのCSVを書き込む panicしてもワーカーは止めない
+func runImportJob(job *importJob) {
+	defer os.Remove(job.path)
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("import job %s panicked : %v\n%s", job.id, r, debug.Stack())
+			setImportStatus(job, importFailed, "internal error")
+		}
+	}()
+
+	setImportStatus(job, importRunning, "")
+	err := job.load()
+	if ie, ok := err.(*csvInputError); ok {
+		log.Infof("import job %s failed to read csv: %v", job.id, ie.err)
+		setImportStatus(job, importFailed, ie.message)
+		return
+	}
+	if err != nil {
+		log.Errorf("import job %s failed: %v", job.id, err)
+		setImportStatus(job, importFailed, "internal error")
+		return
+	}
+	setImportStatus(job, importDone, "")
+}
+
+func (job *importJob) load() error {
+	columns := chairCSVColumns()
+	if job.kind == importKindEstate {
+		columns = estateCSVColumns()
+	}
+	open := func() (*csv.Reader, io.Closer, error) {
+		f, err := os.Open(job.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return openCSV(f, job.contentType, job.filename, len(columns))
+	}
+	r, f, err := open()
+	if err != nil {
+		return &csvInputError{message: "failed to open csv file", err: err}
+	}
+
+	// リクエストはもう終わっているので、リクエストのcontextには紐付けない
+	if job.kind == importKindEstate {
+		return srv.loadEstateCSV(context.Background(), open, r, f, columns)
+	}
+	return srv.loadChairCSV(context.Background(), open, r, f, columns)
+}
+
+// cancelQueuedImports initialize の前にまだ始まっていないジョブを捨てる
+func cancelQueuedImports() {
+	for {
+		select {
+		case job := <-importQueue:
+			os.Remove(job.path)
+			setImportStatus(job, importFailed, "canceled by initialize")
+		default:
+			return
+		}
+	}
+}
+
+func getImportStatus(c echo.Context) error {
+	importStatusMutex.Lock()
+	st, ok := importStatuses[c.Param("id")]
+	var res ImportStatus
+	if ok {
+		res = *st
+	}
+	importStatusMutex.Unlock()
+	if !ok {
+		return notFound(c, "import not found")
+	}
+	return JSON(c, http.StatusOK, res)
+}
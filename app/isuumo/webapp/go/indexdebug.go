@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// 一度に返すバケット・IDの上限の既定値
+const indexDebugDefaultLimit = 100
+
+type IndexDebugResponse struct {
+	Type    string   `json:"type"`
+	Buckets []string `json:"buckets,omitempty"`
+	Bucket  string   `json:"bucket,omitempty"`
+	Count   int64    `json:"count"`
+	IDs     []int64  `json:"ids,omitempty"`
+}
+
+// pageCacheIDs キャッシュ済みの検索結果のページからIDを人気順のまま取り出す
+func pageCacheIDs(b []byte) (int64, []int64, error) {
+	var page struct {
+		Count  int64 `json:"count"`
+		Chairs []struct {
+			ID int64 `json:"id"`
+		} `json:"chairs"`
+		Estates []struct {
+			ID int64 `json:"id"`
+		} `json:"estates"`
+	}
+	if err := myjson.Unmarshal(b, &page); err != nil {
+		return 0, nil, err
+	}
+	ids := make([]int64, 0, len(page.Chairs)+len(page.Estates))
+	for _, c := range page.Chairs {
+		ids = append(ids, c.ID)
+	}
+	for _, e := range page.Estates {
+		ids = append(ids, e.ID)
+	}
+	return page.Count, ids, nil
+}
+
+func limitStrings(s []string, limit int) []string {
+	sort.Strings(s)
+	if len(s) > limit {
+		return s[:limit]
+	}
+	return s
+}
+
+// getIndexDebug オンメモリのインデックスの中身を確認する
+// type=chair|estate は検索結果のページキャッシュ、type=recommend はおすすめ物件のID
+// bucket を省略するとバケットの一覧を返す
+func getIndexDebug(c echo.Context) error {
+	typ := c.QueryParam("type")
+	bucket := c.QueryParam("bucket")
+	limit := indexDebugDefaultLimit
+	if v, err := strconv.Atoi(c.QueryParam("limit")); err == nil && v > 0 {
+		limit = v
+	}
+
+	res := IndexDebugResponse{Type: typ, Bucket: bucket}
+
+	switch typ {
+	case "chair", "estate":
+		pc := chairPageCache
+		if typ == "estate" {
+			pc = estatePageCache
+		}
+		if bucket == "" {
+			pc.mu.RLock()
+			res.Count = int64(len(pc.pages))
+			for key := range pc.pages {
+				res.Buckets = append(res.Buckets, key)
+			}
+			pc.mu.RUnlock()
+			res.Buckets = limitStrings(res.Buckets, limit)
+			break
+		}
+		b, ok := pc.get(bucket)
+		if !ok {
+			return notFound(c, "bucket not found")
+		}
+		count, ids, err := pageCacheIDs(b)
+		if err != nil {
+			c.Logger().Errorf("getIndexDebug failed to decode page : %v", err)
+			return internalError(c)
+		}
+		res.Count = count
+		res.IDs = ids
+
+	case "recommend":
+		if bucket == "" {
+			recommendedEstateIDsMutex.RLock()
+			res.Count = int64(len(recommendedEstateIDs))
+			for key := range recommendedEstateIDs {
+				res.Buckets = append(res.Buckets, fmt.Sprintf("%d,%d", key[0], key[1]))
+			}
+			recommendedEstateIDsMutex.RUnlock()
+			res.Buckets = limitStrings(res.Buckets, limit)
+			break
+		}
+		var key [2]int64
+		if _, err := fmt.Sscanf(bucket, "%d,%d", &key[0], &key[1]); err != nil {
+			c.Logger().Infof("getIndexDebug invalid bucket : %v", err)
+			return invalidParam(c, "bucket", "must be two integers separated by a comma")
+		}
+		ids, ok := getRecommendedEstateIDs(key)
+		if !ok {
+			return notFound(c, "bucket not found")
+		}
+		res.Count = int64(len(ids))
+		for _, id := range ids {
+			res.IDs = append(res.IDs, int64(id))
+		}
+
+	default:
+		c.Logger().Infof("getIndexDebug unknown type : %v", typ)
+		return invalidParam(c, "type", "unknown index type")
+	}
+
+	if len(res.IDs) > limit {
+		res.IDs = res.IDs[:limit]
+	}
+
+	return JSON(c, http.StatusOK, res)
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"strings"
+)
+
+// csvBatchSize postChair/postEstate で1回のINSERTにまとめる行数
+var csvBatchSize = parseIntEnv("CSV_INSERT_CHUNK_ROWS", 500)
+
+// maxInsertBytes 1回のINSERTのクエリの大きさの上限
+// 起動時に max_allowed_packet から決める
+var maxInsertBytes = 4 << 20
+
+// loadMaxInsertBytes max_allowed_packet を読んで maxInsertBytes を設定する
+// プレースホルダやプロトコルのオーバーヘッドの分だけ余裕を持たせる
+func loadMaxInsertBytes() error {
+	var packet int
+	if err := db.Get(&packet, "SELECT @@max_allowed_packet"); err != nil {
+		return err
+	}
+	maxInsertBytes = packet / 4 * 3
+	return nil
+}
+
+// approxSize 値をクエリに埋め込んだときのおおよそのバイト数
+func approxSize(v interface{}) int {
+	if s, ok := v.(string); ok {
+		return len(s) + 2
+	}
+	return 24
+}
+
+// bulkInserter 行を溜めておき、一定数ごとに複数行のINSERTを実行する
+// keysを指定した場合は同じキーの行を上書きする
+type bulkInserter struct {
+	tx      *sql.Tx
+	table   string
+	columns []string
+	query   string
+	place   string
+	suffix  string
+	size    int
+	args    []interface{}
+	rows    int
+	bytes   int
+
+	// before INSERTの前に実行する削除
+	before *bulkDeleter
+	// loadFile flagLoadDataImport が有効なときに行を書き出す一時ファイル
+	loadFile *loadDataFile
+	// Updated 既存の行を上書きした数
+	Updated int64
+}
+
+func newBulkInserter(tx *sql.Tx, table string, columns []string, keys []string, size int) *bulkInserter {
+	if size < 1 {
+		size = 1
+	}
+
+	var suffix string
+	if len(keys) > 0 {
+		isKey := map[string]bool{}
+		for _, k := range keys {
+			isKey[k] = true
+		}
+		var sets []string
+		for _, col := range columns {
+			if !isKey[col] {
+				sets = append(sets, col+" = VALUES("+col+")")
+			}
+		}
+		// 全てのカラムがキーなら重複を無視するだけ
+		if len(sets) == 0 {
+			sets = append(sets, keys[0]+" = "+keys[0])
+		}
+		suffix = " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	}
+
+	return &bulkInserter{
+		tx:      tx,
+		table:   table,
+		columns: columns,
+		query:   "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES ",
+		place:   "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")",
+		suffix:  suffix,
+		size:    size,
+		args:    make([]interface{}, 0, size*len(columns)),
+	}
+}
+
+// Add 1行追加する 溜まった行数がsizeに達したらINSERTする
+// 追加するとクエリが maxInsertBytes を超える場合は先に溜まっている分をINSERTする
+func (b *bulkInserter) Add(values ...interface{}) error {
+	if flagLoadDataImport.Enabled() || b.loadFile != nil {
+		// LOAD DATA を使うときは全ての行を一時ファイルに書き出して Flush でまとめて読み込む
+		if b.loadFile == nil {
+			lf, err := newLoadDataFile()
+			if err != nil {
+				return err
+			}
+			b.loadFile = lf
+		}
+		b.rows++
+		return b.loadFile.write(values)
+	}
+
+	rowBytes := len(b.place) + 1
+	for _, v := range values {
+		rowBytes += approxSize(v)
+	}
+	if b.rows > 0 && len(b.query)+len(b.suffix)+b.bytes+rowBytes > maxInsertBytes {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+	}
+
+	b.args = append(b.args, values...)
+	b.rows++
+	b.bytes += rowBytes
+	if b.rows >= b.size {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush 溜まっている行をINSERTする
+func (b *bulkInserter) Flush() error {
+	if b.before != nil {
+		if err := b.before.Flush(); err != nil {
+			return err
+		}
+	}
+	if b.rows == 0 {
+		return nil
+	}
+	if b.loadFile != nil {
+		if err := b.load(); err != nil {
+			return err
+		}
+		b.rows = 0
+		return b.loadFile.reset()
+	}
+
+	query := b.query + strings.Repeat(b.place+",", b.rows-1) + b.place + b.suffix
+	res, err := b.tx.Exec(query, b.args...)
+	if err != nil {
+		return err
+	}
+	// ON DUPLICATE KEY UPDATE で上書きした行は2として数えられる
+	if b.suffix != "" {
+		if n, err := res.RowsAffected(); err == nil && n > int64(b.rows) {
+			b.Updated += n - int64(b.rows)
+		}
+	}
+	b.args = b.args[:0]
+	b.rows = 0
+	b.bytes = 0
+	return nil
+}
+
+// bulkDeleter idを溜めておき、一定数ごとに DELETE ... WHERE col IN (...) を実行する
+// 上書きする行に紐づくfeatureを入れ直す前に消すのに使う
+type bulkDeleter struct {
+	tx    *sql.Tx
+	query string
+	size  int
+	ids   []interface{}
+}
+
+func newBulkDeleter(tx *sql.Tx, table, column string, size int) *bulkDeleter {
+	if size < 1 {
+		size = 1
+	}
+	return &bulkDeleter{
+		tx:    tx,
+		query: "DELETE FROM " + table + " WHERE " + column + " IN ",
+		size:  size,
+		ids:   make([]interface{}, 0, size),
+	}
+}
+
+// Add idを追加する 溜まった数がsizeに達したらDELETEする
+func (d *bulkDeleter) Add(id interface{}) error {
+	d.ids = append(d.ids, id)
+	if len(d.ids) >= d.size {
+		return d.Flush()
+	}
+	return nil
+}
+
+// Flush 溜まっているidの行をDELETEする
+func (d *bulkDeleter) Flush() error {
+	if len(d.ids) == 0 {
+		return nil
+	}
+	query := d.query + "(" + strings.TrimSuffix(strings.Repeat("?, ", len(d.ids)), ", ") + ")"
+	if _, err := d.tx.Exec(query, d.ids...); err != nil {
+		return err
+	}
+	d.ids = d.ids[:0]
+	return nil
+}
+
+// chairImport importChairs が書き込んだ椅子 コミットした後にキャッシュを捨てるのに使う
+type chairImport struct {
+	ids, stocks   []int
+	minPrice      int64
+	recommendKeys map[int][2]int64
+	// updated 既存の行を上書きした数
+	updated int64
+}
+
+// importChairs CSVの椅子をtxに書き込む mysqlChairRepository.ImportChairs から呼ぶ CSVの誤りは csvInputError で返す
+func importChairs(tx *sql.Tx, r *csv.Reader, columns []csvColumn) (*chairImport, error) {
+	// CSV全体をメモリに読み込まず、1行ずつ読んで csvBatchSize 行ごとにINSERTする
+	// LOAD_DATA_IMPORT が有効なら一時ファイルに書き出して LOAD DATA LOCAL INFILE でまとめて読み込む
+	// 既にあるidは上書きし、featureは消してから入れ直す
+	cond := currentConditions()
+	chairs := newBulkInserter(tx, "chair", []string{"id", "name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "kind", "popularity", "stock", "width_level", "height_level", "depth_level", "price_level"}, []string{"id"}, csvBatchSize)
+	defer chairs.Close()
+	chairFeatures := newBulkInserter(tx, "chair_feature", []string{"chair_id", "feature_id"}, []string{"chair_id", "feature_id"}, csvBatchSize)
+	defer chairFeatures.Close()
+	oldChairFeatures := newBulkDeleter(tx, "chair_feature", "chair_id", csvBatchSize)
+	chairFeatures.before = oldChairFeatures
+
+	res := &chairImport{minPrice: -1, recommendKeys: map[int][2]int64{}}
+	r.ReuseRecord = true
+	rows := newCSVRows(r, columns)
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*csvHeaderError); ok {
+			return res, &csvInputError{message: "invalid csv", err: err}
+		}
+		if err != nil {
+			return res, err
+		}
+
+		rm := RecordMapper{Record: row}
+		id := rm.NextInt()
+		name := rm.NextString()
+		description := rm.NextString()
+		thumbnail := rm.NextString()
+		price := rm.NextInt()
+		height := rm.NextInt()
+		width := rm.NextInt()
+		depth := rm.NextInt()
+		color := rm.NextString()
+		features := rm.NextString()
+		kind := rm.NextString()
+		popularity := rm.NextInt()
+		stock := rm.NextInt()
+		if err := rm.Err(); err != nil {
+			return res, &csvInputError{message: "invalid csv record", err: err}
+		}
+
+		err = chairs.Add(id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock,
+			cond.Chair.Width.level(int64(width)),
+			cond.Chair.Height.level(int64(height)),
+			cond.Chair.Depth.level(int64(depth)),
+			cond.Chair.Price.level(int64(price)),
+		)
+		if err == nil {
+			err = oldChairFeatures.Add(id)
+		}
+		if err != nil {
+			return res, err
+		}
+
+		// isuumo.chair_featureに追加
+		// 存在しないfeatureを0番として登録すると別のfeatureで検索にヒットしてしまうので飛ばす
+		for _, f := range strings.Split(features, ",") {
+			featureID, ok := cond.ChairFeatures[f]
+			if !ok {
+				continue
+			}
+			if err := chairFeatures.Add(id, featureID); err != nil {
+				return res, err
+			}
+		}
+
+		res.ids = append(res.ids, id)
+		res.stocks = append(res.stocks, stock)
+		x, y := smallestTwo(int64(width), int64(height), int64(depth))
+		res.recommendKeys[id] = [2]int64{x, y}
+		if res.minPrice == -1 || int64(price) < res.minPrice {
+			res.minPrice = int64(price)
+		}
+	}
+	if err := chairs.Flush(); err != nil {
+		return res, err
+	}
+	res.updated = chairs.Updated
+	return res, chairFeatures.Flush()
+}
+
+// estateImport importEstates が書き込んだestate コミットした後にキャッシュを捨てるのに使う
+type estateImport struct {
+	ids     []int
+	points  []estatePoint
+	minRent int64
+	// updated 既存の行を上書きした数
+	updated int64
+}
+
+// importEstates CSVのestateをtxに書き込む mysqlEstateRepository.ImportEstates から呼ぶ CSVの誤りは csvInputError で返す
+func importEstates(tx *sql.Tx, r *csv.Reader, columns []csvColumn) (*estateImport, error) {
+	// CSV全体をメモリに読み込まず、1行ずつ読んで csvBatchSize 行ごとにINSERTする
+	// LOAD_DATA_IMPORT が有効なら一時ファイルに書き出して LOAD DATA LOCAL INFILE でまとめて読み込む
+	// 既にあるidは上書きし、featureは消してから入れ直す
+	cond := currentConditions()
+	estates := newBulkInserter(tx, "estate", []string{"id", "name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "door_height", "door_width", "features", "popularity", "width_level", "height_level", "rent_level", "prefecture", "geohash", "cell_id"}, []string{"id"}, csvBatchSize)
+	defer estates.Close()
+	estateFeatures := newBulkInserter(tx, "estate_feature", []string{"estate_id", "feature_id"}, []string{"estate_id", "feature_id"}, csvBatchSize)
+	defer estateFeatures.Close()
+	oldEstateFeatures := newBulkDeleter(tx, "estate_feature", "estate_id", csvBatchSize)
+	estateFeatures.before = oldEstateFeatures
+	estateSearch := newBulkInserter(tx, "estate_search", estateSearchColumns, []string{"id"}, csvBatchSize)
+	defer estateSearch.Close()
+
+	res := &estateImport{minRent: -1}
+	r.ReuseRecord = true
+	rows := newCSVRows(r, columns)
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*csvHeaderError); ok {
+			return res, &csvInputError{message: "invalid csv", err: err}
+		}
+		if err != nil {
+			return res, err
+		}
+
+		rm := RecordMapper{Record: row}
+		id := rm.NextInt()
+		name := rm.NextString()
+		description := rm.NextString()
+		thumbnail := rm.NextString()
+		address := rm.NextString()
+		latitude := rm.NextFloat()
+		longitude := rm.NextFloat()
+		rent := rm.NextInt()
+		doorHeight := rm.NextInt()
+		doorWidth := rm.NextInt()
+		features := rm.NextString()
+		popularity := rm.NextInt()
+		if err := rm.Err(); err != nil {
+			return res, &csvInputError{message: "invalid csv record", err: err}
+		}
+
+		err = estates.Add(id, name, description, thumbnail, address, latitude, longitude, rent, doorHeight, doorWidth, features, popularity,
+			cond.Estate.DoorWidth.level(int64(doorWidth)),
+			cond.Estate.DoorHeight.level(int64(doorHeight)),
+			cond.Estate.Rent.level(int64(rent)),
+			prefectureOf(address),
+			geohashEncode(latitude, longitude, geohashPrecision),
+			cellID(latitude, longitude),
+		)
+		if err == nil {
+			err = estateSearch.Add(id, popularity,
+				cond.Estate.Rent.level(int64(rent)),
+				cond.Estate.DoorHeight.level(int64(doorHeight)),
+				cond.Estate.DoorWidth.level(int64(doorWidth)),
+				estateFeatureBits(features),
+			)
+		}
+		if err == nil {
+			err = oldEstateFeatures.Add(id)
+		}
+		if err != nil {
+			return res, err
+		}
+
+		// isuumo.estate_featureに追加
+		for _, f := range strings.Split(features, ",") {
+			if len(f) == 0 {
+				continue
+			}
+			if err := estateFeatures.Add(id, cond.EstateFeatures[f]); err != nil {
+				return res, err
+			}
+		}
+
+		res.ids = append(res.ids, id)
+		res.points = append(res.points, estatePoint{ID: int64(id), Latitude: latitude, Longitude: longitude, Popularity: int64(popularity)})
+		if res.minRent == -1 || int64(rent) < res.minRent {
+			res.minRent = int64(rent)
+		}
+	}
+	if err := estates.Flush(); err != nil {
+		return res, err
+	}
+	res.updated = estates.Updated
+	if err := estateFeatures.Flush(); err != nil {
+		return res, err
+	}
+	return res, estateSearch.Flush()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// initSQLFiles initialize がスキーマを作り直した後に順に流すSQLファイル (../mysql/db からの相対パス)
+// テーブルとインデックスは migrations で作るので 0_Schema.sql などは流さない
+var initSQLFiles = []string{
+	"1_DummyEstateData.sql",
+	"2_DummyChairData.sql",
+	"3_estate_feature.sql",
+	"4_chair_feature.sql",
+	"5_estate_prefecture.sql",
+	"7_estate_search.sql",
+	"9_estate_geohash.sql",
+	"10_estate_cell_id.sql",
+}
+
+// runInitSQL データベースを作り直してマイグレーションを適用し、initSQLFiles を multiStatements の接続で順に実行する
+// データベースを消すとその接続のデフォルトのデータベースも外れるので、アプリのコネクションプールとは別の1本の接続で選び直して使う
+func runInitSQL(ctx context.Context) error {
+	idb, err := mySQLConnectionData.ConnectInitDB()
+	if err != nil {
+		return err
+	}
+	defer idb.Close()
+	idb.SetMaxOpenConns(1)
+
+	dbName := "`" + mySQLConnectionData.DBName + "`"
+	for _, q := range []string{"DROP DATABASE IF EXISTS " + dbName, "CREATE DATABASE " + dbName, "USE " + dbName} {
+		if _, err := idb.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	if err := migrateSchema(ctx, idb.DB); err != nil {
+		return err
+	}
+
+	sqlDir := filepath.Join("..", "mysql", "db")
+	for _, name := range initSQLFiles {
+		b, err := ioutil.ReadFile(filepath.Join(sqlDir, name))
+		if err != nil {
+			return err
+		}
+		for _, batch := range batchSQLStatements(splitSQLStatements(string(b)), maxInsertBytes) {
+			if _, err := idb.ExecContext(ctx, batch); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// batchSQLStatements 文を max バイトを超えない範囲でまとめて1回で送る
+// 1文で max を超えるものはそのまま1回で送る
+func batchSQLStatements(stmts []string, max int) []string {
+	var batches []string
+	var sb strings.Builder
+	for _, s := range stmts {
+		if sb.Len() > 0 && sb.Len()+len(s)+1 > max {
+			batches = append(batches, sb.String())
+			sb.Reset()
+		}
+		sb.WriteString(s)
+		sb.WriteByte(';')
+	}
+	if sb.Len() > 0 {
+		batches = append(batches, sb.String())
+	}
+	return batches
+}
+
+// splitSQLStatements SQLファイルを ; で文に分ける
+// 文字列と識別子のクォートの中の ; は区切りとみなさず、コメントは取り除く (DELIMITER には対応しない)
+func splitSQLStatements(src string) []string {
+	var stmts []string
+	var sb strings.Builder
+	flush := func() {
+		if s := strings.TrimSpace(sb.String()); s != "" {
+			stmts = append(stmts, s)
+		}
+		sb.Reset()
+	}
+	for i := 0; i < len(src); i++ {
+		ch := src[i]
+		switch {
+		case ch == '\'' || ch == '"' || ch == '`':
+			j := i + 1
+			for ; j < len(src); j++ {
+				if src[j] == '\\' && ch != '`' {
+					j++
+					continue
+				}
+				if src[j] == ch {
+					// '' のように重ねたクォートはクォートそのもの
+					if j+1 < len(src) && src[j+1] == ch {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			if j >= len(src) {
+				j = len(src) - 1
+			}
+			sb.WriteString(src[i : j+1])
+			i = j
+		case ch == '#' || ch == '-' && (strings.HasPrefix(src[i:], "-- ") || strings.HasPrefix(src[i:], "--\n")):
+			j := strings.IndexByte(src[i:], '\n')
+			if j < 0 {
+				i = len(src)
+			} else {
+				i += j
+				sb.WriteByte('\n')
+			}
+		case ch == '/' && strings.HasPrefix(src[i:], "/*") && !strings.HasPrefix(src[i:], "/*!"):
+			j := strings.Index(src[i+2:], "*/")
+			if j < 0 {
+				i = len(src)
+			} else {
+				i += j + 3
+				sb.WriteByte(' ')
+			}
+		case ch == ';':
+			flush()
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	flush()
+	return stmts
+}
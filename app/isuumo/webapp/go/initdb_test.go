@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"only separators", " ; ;\n", nil},
+		{"two statements", "SELECT 1; SELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"no trailing separator", "SELECT 1;\nSELECT 2\n", []string{"SELECT 1", "SELECT 2"}},
+		{"single quote", "INSERT INTO t VALUES ('a;b'); SELECT 1", []string{"INSERT INTO t VALUES ('a;b')", "SELECT 1"}},
+		{"double quote", `SELECT "a;b";`, []string{`SELECT "a;b"`}},
+		{"backtick", "SELECT `a;b` FROM t;", []string{"SELECT `a;b` FROM t"}},
+		{"backslash escape", `SELECT 'it\'s;'; SELECT 2`, []string{`SELECT 'it\'s;'`, "SELECT 2"}},
+		{"doubled quote", "SELECT 'it''s;'; SELECT 2", []string{"SELECT 'it''s;'", "SELECT 2"}},
+		{"backslash in backtick", "SELECT `a\\`; SELECT 2", []string{"SELECT `a\\`", "SELECT 2"}},
+		{"dash comment", "SELECT 1; -- a; b\nSELECT 2;", []string{"SELECT 1", "SELECT 2"}},
+		{"empty dash comment", "--\nSELECT 1;", []string{"SELECT 1"}},
+		{"hash comment", "# a; b\nSELECT 1;", []string{"SELECT 1"}},
+		{"comment at end", "SELECT 1; -- done", []string{"SELECT 1"}},
+		{"minus is not a comment", "SELECT 1--1;", []string{"SELECT 1--1"}},
+		{"block comment", "SELECT /* a; b */ 1;", []string{"SELECT   1"}},
+		{"unterminated block comment", "SELECT 1; /* a; b", []string{"SELECT 1"}},
+		{"executable comment kept", "/*!40101 SET NAMES utf8mb4 */;", []string{"/*!40101 SET NAMES utf8mb4 */"}},
+		{"comment marker in quote", "SELECT '-- a; # b';", []string{"SELECT '-- a; # b'"}},
+		{"unterminated quote", "SELECT 'a; b", []string{"SELECT 'a; b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitSQLStatements(tt.src); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitSQLStatements(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchSQLStatements(t *testing.T) {
+	tests := []struct {
+		name  string
+		stmts []string
+		max   int
+		want  []string
+	}{
+		{"none", nil, 10, nil},
+		{"all fit", []string{"a", "b", "c"}, 10, []string{"a;b;c;"}},
+		{"exactly max", []string{"aa", "bb"}, 6, []string{"aa;bb;"}},
+		{"split", []string{"aa", "bb", "cc"}, 5, []string{"aa;", "bb;", "cc;"}},
+		{"split in pairs", []string{"a", "b", "c", "d"}, 4, []string{"a;b;", "c;d;"}},
+		{"longer than max", []string{"a", "bbbbbb", "c"}, 4, []string{"a;", "bbbbbb;", "c;"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := batchSQLStatements(tt.stmts, tt.max); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("batchSQLStatements(%q, %d) = %q, want %q", tt.stmts, tt.max, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSplitInitSQLFiles initialize で流すファイルが文の途中で切れずに分けられるかを確かめる
+func TestSplitInitSQLFiles(t *testing.T) {
+	for _, name := range initSQLFiles {
+		b, err := ioutil.ReadFile(filepath.Join("..", "mysql", "db", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts := splitSQLStatements(string(b))
+		if len(stmts) == 0 {
+			t.Errorf("%s: no statements", name)
+		}
+		for _, s := range stmts {
+			switch strings.ToUpper(strings.Fields(s)[0]) {
+			case "INSERT", "UPDATE", "DELETE", "SET", "ALTER", "CREATE":
+			default:
+				t.Errorf("%s: unexpected statement %.60q", name, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/isucon/isucon10-qualify/isuumo/cache"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// ジャーナルに記録する遅いエンドポイントの数
+const journalSlowEndpoints = 10
+
+// runJournalPath /initialize から次の /initialize までの記録を追記するファイル
+var runJournalPath = getEnv("RUN_JOURNAL_PATH", "run_journal.json")
+
+// journalCaches ジャーナルと /internal/cache/stats で見るキャッシュ
+func journalCaches() map[string]*cache.HitCounter {
+	return map[string]*cache.HitCounter{
+		"chairPage":            &chairPageCache.counter,
+		"estatePage":           &estatePageCache.counter,
+		"chairSearchResponse":  &chairSearchResponseCache.counter,
+		"estateSearchResponse": &estateSearchResponseCache.counter,
+		"nazotteResponse":      &nazotteResponseCache.counter,
+		"chair":                cachedChairs.Counter(),
+		"estate":               cachedEstates.Counter(),
+		"chairCount":           chairCountCache.counts.Counter(),
+		"estateCount":          estateCountCache.counts.Counter(),
+		"lowPricedChair":       &lowPricedChairCounter,
+		"lowPricedEstate":      &lowPricedEstateCounter,
+		"recommendedEstateIDs": &recommendedEstateIDsCounter,
+		"recommendedResponse":  &recommendedEstateResponsesCounter,
+	}
+}
+
+// getCacheStats 今の区間のキャッシュごとのヒット数、ミス数、追い出した数を返す
+// 区間は /initialize で始め直す
+func getCacheStats(c echo.Context) error {
+	res := map[string]cache.HitStat{}
+	for name, hc := range journalCaches() {
+		res[name] = hc.Snapshot()
+	}
+	return JSON(c, http.StatusOK, res)
+}
+
+type endpointStat struct {
+	Endpoint string  `json:"endpoint"`
+	Count    int64   `json:"count"`
+	TotalMs  float64 `json:"totalMs"`
+	MaxMs    float64 `json:"maxMs"`
+	AvgMs    float64 `json:"avgMs"`
+
+	// Queries, QueryErrors, QueryMs リクエストが発行したクエリ (SQL_METRICS=1 のときだけ数える)
+	Queries     int64   `json:"queries"`
+	QueryErrors int64   `json:"queryErrors"`
+	QueryMs     float64 `json:"queryMs"`
+}
+
+var endpointStats = map[string]*endpointStat{}
+var endpointStatsMutex sync.Mutex
+
+// endpointStatsMiddleware ルートごとのレイテンシとクエリ数を集計する
+func endpointStatsMiddleware(endpoint string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			rq := &requestQueries{}
+			c.SetRequest(c.Request().WithContext(withRequestQueries(c.Request().Context(), rq)))
+			err := next(c)
+			ms := float64(time.Since(start)) / float64(time.Millisecond)
+
+			endpointStatsMutex.Lock()
+			st, ok := endpointStats[endpoint]
+			if !ok {
+				st = &endpointStat{Endpoint: endpoint}
+				endpointStats[endpoint] = st
+			}
+			st.Count++
+			st.TotalMs += ms
+			if ms > st.MaxMs {
+				st.MaxMs = ms
+			}
+			st.Queries += atomic.LoadInt64(&rq.count)
+			st.QueryErrors += atomic.LoadInt64(&rq.errors)
+			st.QueryMs += float64(atomic.LoadInt64(&rq.nanos)) / float64(time.Millisecond)
+			endpointStatsMutex.Unlock()
+
+			return err
+		}
+	}
+}
+
+// snapshotEndpointStats 集計を残したまま、クエリ数の降順で返す
+func snapshotEndpointStats() []endpointStat {
+	endpointStatsMutex.Lock()
+	res := make([]endpointStat, 0, len(endpointStats))
+	for _, st := range endpointStats {
+		s := *st
+		s.AvgMs = s.TotalMs / float64(s.Count)
+		res = append(res, s)
+	}
+	endpointStatsMutex.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Queries != res[j].Queries {
+			return res[i].Queries > res[j].Queries
+		}
+		return res[i].Endpoint < res[j].Endpoint
+	})
+	return res
+}
+
+// resetEndpointStats 合計時間の降順で上位n件を返して集計を始め直す
+func resetEndpointStats(n int) []endpointStat {
+	endpointStatsMutex.Lock()
+	res := make([]endpointStat, 0, len(endpointStats))
+	for _, st := range endpointStats {
+		s := *st
+		s.AvgMs = s.TotalMs / float64(s.Count)
+		res = append(res, s)
+	}
+	endpointStats = map[string]*endpointStat{}
+	endpointStatsMutex.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].TotalMs > res[j].TotalMs
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+// runRecord /initialize から次の /initialize までの記録
+type runRecord struct {
+	StartedAt     time.Time                `json:"startedAt"`
+	EndedAt       time.Time                `json:"endedAt"`
+	Flags         map[string]bool          `json:"flags"`
+	Caches        map[string]cache.HitStat `json:"caches"`
+	SlowEndpoints []endpointStat           `json:"slowEndpoints"`
+	Requests      int64                    `json:"requests"`
+	Errors        map[string]int64         `json:"errors"`
+}
+
+var runStartedAt = time.Now()
+var runJournalMutex sync.Mutex
+
+// closeRun 今の区間の記録を作って集計を始め直す
+// resetErrorStats より前に呼ぶ
+func closeRun() runRecord {
+	now := time.Now()
+	rec := runRecord{
+		StartedAt:     runStartedAt,
+		EndedAt:       now,
+		Flags:         map[string]bool{},
+		Caches:        map[string]cache.HitStat{},
+		SlowEndpoints: resetEndpointStats(journalSlowEndpoints),
+	}
+	runStartedAt = now
+
+	for _, f := range featureFlags {
+		rec.Flags[f.Name] = f.Enabled()
+	}
+	for name, hc := range journalCaches() {
+		rec.Caches[name] = hc.Reset()
+	}
+	rec.Requests, rec.Errors = errorStatsTotals()
+
+	return rec
+}
+
+// readRunJournal 記録済みの区間を古い順に返す
+func readRunJournal() ([]runRecord, error) {
+	b, err := ioutil.ReadFile(runJournalPath)
+	if os.IsNotExist(err) {
+		return []runRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runs []runRecord
+	if err := json.Unmarshal(b, &runs); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// appendRunJournal ファイルに区間の記録を追記する
+// 書きかけのファイルを読まないように別名で書いてから置き換える
+func appendRunJournal(rec runRecord) error {
+	runJournalMutex.Lock()
+	defer runJournalMutex.Unlock()
+
+	runs, err := readRunJournal()
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(append(runs, rec), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := runJournalPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, runJournalPath)
+}
+
+// rotateRunJournal /initialize で呼ばれ、前の区間をバックグラウンドで書き出す
+func rotateRunJournal() {
+	rec := closeRun()
+	// リクエストのなかった区間は記録しない
+	if rec.Requests == 0 {
+		return
+	}
+	tasks.Go("appendRunJournal", func() {
+		if err := appendRunJournal(rec); err != nil {
+			log.Errorf("appendRunJournal error : %v", err)
+		}
+	})
+}
+
+// getRuns 記録済みの区間を返す
+func getRuns(c echo.Context) error {
+	runJournalMutex.Lock()
+	runs, err := readRunJournal()
+	runJournalMutex.Unlock()
+	if err != nil {
+		c.Logger().Errorf("getRuns failed to read journal : %v", err)
+		return internalError(c)
+	}
+	return JSON(c, http.StatusOK, runs)
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"sync"
+
+	"github.com/jmoiron/sqlx"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/labstack/echo"
 )
@@ -10,9 +13,131 @@ var myjson = jsoniter.Config{
 	ObjectFieldMustBeSimpleString: true,
 }.Froze()
 
+// jsonStreamPool JSON() でエンコードに使うバッファ付きのStreamのプール
+var jsonStreamPool = sync.Pool{New: func() interface{} {
+	return jsoniter.NewStream(myjson, nil, jsonBufferSize)
+}}
+
+const (
+	jsonBufferSize = 4 << 10
+	// jsonBufferPoolMax これより大きくなったバッファはプールに戻さない
+	// 大きいページを返した後に、大きなバッファを持ち続けないようにする
+	jsonBufferPoolMax = 1 << 20
+)
+
 // json json-iterator使用
+// プールしたバッファにエンコードしてからまとめて書き込むので、失敗したときは何も書かずにエラーを返す
 func JSON(c echo.Context, code int, i interface{}) error {
-	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
-	c.Response().WriteHeader(code)
-	return myjson.NewEncoder(c.Response()).Encode(i)
+	stream := jsonStreamPool.Get().(*jsoniter.Stream)
+	stream.Reset(nil)
+	stream.Error = nil
+	stream.Attachment = nil
+	if fs := sparseFieldsOf(c); fs != nil {
+		stream.Attachment = fs
+	}
+	defer func() {
+		if cap(stream.Buffer()) <= jsonBufferPoolMax {
+			jsonStreamPool.Put(stream)
+		}
+	}()
+
+	stream.WriteVal(i)
+	stream.WriteRaw("\n")
+	if stream.Error != nil {
+		return stream.Error
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	res.WriteHeader(code)
+	_, err := res.Write(stream.Buffer())
+	return err
+}
+
+// perPageがこれを超える検索結果はストリーミングで返す
+const StreamPerPageThreshold = 100
+
+// ストリーミング時に何件ごとにフラッシュするか
+const streamFlushChunk = 20
+
+// JSONStreamList {"count": count, key: [item(0), ..., item(n-1)]} の形で
+// 要素をチャンクごとにフラッシュしながら返す
+func JSONStreamList(c echo.Context, code int, count int64, key string, n int, item func(i int) interface{}) error {
+	i := 0
+	return jsonStream(c, code, count, key, func() (interface{}, bool, error) {
+		if i >= n {
+			return nil, false, nil
+		}
+		i++
+		return item(i - 1), true, nil
+	})
+}
+
+// JSONStreamRows rowsを1行ずつdestに読み込みながら JSONStreamList と同じ形で返す
+// 結果をスライスに溜めないので、ページが大きくてもメモリは1行分で済む
+// destは読み込むたびに上書きされるので、書き出した後に使い回してよい
+func JSONStreamRows(c echo.Context, code int, count int64, key string, rows *sqlx.Rows, dest interface{}) error {
+	return jsonStream(c, code, count, key, func() (interface{}, bool, error) {
+		if !rows.Next() {
+			return nil, false, rows.Err()
+		}
+		if err := rows.StructScan(dest); err != nil {
+			return nil, false, err
+		}
+		return dest, true, nil
+	})
+}
+
+// jsonStream nextが返す要素を順に書き出す
+// ヘッダを書いた後のエラーはステータスコードを変えられないので、途中で打ち切って返すだけにする
+func jsonStream(c echo.Context, code int, count int64, key string, next func() (interface{}, bool, error)) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	res.WriteHeader(code)
+
+	stream := myjson.BorrowStream(res)
+	defer myjson.ReturnStream(stream)
+	if fs := sparseFieldsOf(c); fs != nil {
+		stream.Attachment = fs
+	}
+
+	stream.WriteObjectStart()
+	stream.WriteObjectField("count")
+	stream.WriteInt64(count)
+	stream.WriteMore()
+	stream.WriteObjectField(key)
+	stream.WriteArrayStart()
+	if err := stream.Flush(); err != nil {
+		return err
+	}
+	res.Flush()
+
+	for i := 0; ; i++ {
+		v, ok, err := next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+		if i > 0 {
+			stream.WriteMore()
+		}
+		stream.WriteVal(v)
+		if stream.Error != nil {
+			return stream.Error
+		}
+
+		if (i+1)%streamFlushChunk == 0 {
+			if err := stream.Flush(); err != nil {
+				return err
+			}
+			res.Flush()
+		}
+	}
+
+	stream.WriteArrayEnd()
+	stream.WriteObjectEnd()
+	stream.WriteRaw("\n")
+	return stream.Flush()
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"unsafe"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// よく返す構造体はリフレクションを使わずにフィールドを直接書き出す (easyjsonが生成するものと同じ形)
+// コード生成のツールは使えないので手で書いているが、フィールドを変えたらここも合わせて変える
+// ずれたら jsonenc_test.go が encoding/json の結果と比べて落とす
+// JSON() などの myjson を通すエンコードは全てこれを使う
+
+func init() {
+	jsoniter.RegisterTypeEncoderFunc("main.Chair", func(ptr unsafe.Pointer, stream *jsoniter.Stream) {
+		writeChair(stream, (*Chair)(ptr))
+	}, nil)
+	jsoniter.RegisterTypeEncoderFunc("main.Estate", func(ptr unsafe.Pointer, stream *jsoniter.Stream) {
+		writeEstate(stream, (*Estate)(ptr))
+	}, nil)
+	jsoniter.RegisterTypeEncoderFunc("main.ChairSearchResponse", func(ptr unsafe.Pointer, stream *jsoniter.Stream) {
+		res := (*ChairSearchResponse)(ptr)
+		stream.WriteRaw(`{"count":`)
+		stream.WriteInt64(res.Count)
+		stream.WriteRaw(`,"chairs":`)
+		writeChairs(stream, res.Chairs)
+		stream.WriteRaw(`}`)
+	}, nil)
+	jsoniter.RegisterTypeEncoderFunc("main.ChairListResponse", func(ptr unsafe.Pointer, stream *jsoniter.Stream) {
+		stream.WriteRaw(`{"chairs":`)
+		writeChairs(stream, (*ChairListResponse)(ptr).Chairs)
+		stream.WriteRaw(`}`)
+	}, nil)
+	jsoniter.RegisterTypeEncoderFunc("main.EstateSearchResponse", func(ptr unsafe.Pointer, stream *jsoniter.Stream) {
+		res := (*EstateSearchResponse)(ptr)
+		stream.WriteRaw(`{"count":`)
+		stream.WriteInt64(res.Count)
+		stream.WriteRaw(`,"estates":`)
+		writeEstates(stream, res.Estates)
+		if res.NextCursor != "" {
+			stream.WriteRaw(`,"nextCursor":`)
+			stream.WriteString(res.NextCursor)
+		}
+		if res.Approximate {
+			stream.WriteRaw(`,"approximate":true`)
+		}
+		stream.WriteRaw(`}`)
+	}, nil)
+	jsoniter.RegisterTypeEncoderFunc("main.EstateListResponse", func(ptr unsafe.Pointer, stream *jsoniter.Stream) {
+		stream.WriteRaw(`{"estates":`)
+		writeEstates(stream, (*EstateListResponse)(ptr).Estates)
+		stream.WriteRaw(`}`)
+	}, nil)
+}
+
+// writeChair fragmentがあればそのまま、なければフィールドを書き出す
+// StreamのAttachmentに fieldSet があればそのキーだけを書き出す
+func writeChair(stream *jsoniter.Stream, chair *Chair) {
+	if fs, ok := stream.Attachment.(fieldSet); ok {
+		writeSparseChair(stream, chair, fs)
+		return
+	}
+	if chair.fragment != nil {
+		stream.Write(chair.fragment)
+		return
+	}
+	stream.WriteRaw(`{"id":`)
+	stream.WriteInt64(chair.ID)
+	stream.WriteRaw(`,"name":`)
+	stream.WriteString(chair.Name)
+	stream.WriteRaw(`,"description":`)
+	stream.WriteString(chair.Description)
+	stream.WriteRaw(`,"thumbnail":`)
+	stream.WriteString(chair.Thumbnail)
+	stream.WriteRaw(`,"price":`)
+	stream.WriteInt64(chair.Price)
+	stream.WriteRaw(`,"height":`)
+	stream.WriteInt64(chair.Height)
+	stream.WriteRaw(`,"width":`)
+	stream.WriteInt64(chair.Width)
+	stream.WriteRaw(`,"depth":`)
+	stream.WriteInt64(chair.Depth)
+	stream.WriteRaw(`,"color":`)
+	stream.WriteString(chair.Color)
+	stream.WriteRaw(`,"features":`)
+	stream.WriteString(chair.Features)
+	stream.WriteRaw(`,"kind":`)
+	stream.WriteString(chair.Kind)
+	stream.WriteRaw(`}`)
+}
+
+// writeEstate fragmentがあればそのまま、なければフィールドを書き出す
+// StreamのAttachmentに fieldSet があればそのキーだけを書き出す
+func writeEstate(stream *jsoniter.Stream, estate *Estate) {
+	if fs, ok := stream.Attachment.(fieldSet); ok {
+		writeSparseEstate(stream, estate, fs)
+		return
+	}
+	if estate.fragment != nil {
+		stream.Write(estate.fragment)
+		return
+	}
+	stream.WriteRaw(`{"id":`)
+	stream.WriteInt64(estate.ID)
+	stream.WriteRaw(`,"thumbnail":`)
+	stream.WriteString(estate.Thumbnail)
+	stream.WriteRaw(`,"name":`)
+	stream.WriteString(estate.Name)
+	stream.WriteRaw(`,"description":`)
+	stream.WriteString(estate.Description)
+	stream.WriteRaw(`,"latitude":`)
+	stream.WriteFloat64(estate.Latitude)
+	stream.WriteRaw(`,"longitude":`)
+	stream.WriteFloat64(estate.Longitude)
+	stream.WriteRaw(`,"address":`)
+	stream.WriteString(estate.Address)
+	stream.WriteRaw(`,"rent":`)
+	stream.WriteInt64(estate.Rent)
+	stream.WriteRaw(`,"doorHeight":`)
+	stream.WriteInt64(estate.DoorHeight)
+	stream.WriteRaw(`,"doorWidth":`)
+	stream.WriteInt64(estate.DoorWidth)
+	stream.WriteRaw(`,"features":`)
+	stream.WriteString(estate.Features)
+	stream.WriteRaw(`}`)
+}
+
+// writeChairs nilのスライスはリフレクションでエンコードしたときと同じくnullにする
+func writeChairs(stream *jsoniter.Stream, chairs []Chair) {
+	if chairs == nil {
+		stream.WriteNil()
+		return
+	}
+	stream.WriteArrayStart()
+	for i := range chairs {
+		if i > 0 {
+			stream.WriteMore()
+		}
+		writeChair(stream, &chairs[i])
+	}
+	stream.WriteArrayEnd()
+}
+
+func writeEstates(stream *jsoniter.Stream, estates []Estate) {
+	if estates == nil {
+		stream.WriteNil()
+		return
+	}
+	stream.WriteArrayStart()
+	for i := range estates {
+		if i > 0 {
+			stream.WriteMore()
+		}
+		writeEstate(stream, &estates[i])
+	}
+	stream.WriteArrayEnd()
+}
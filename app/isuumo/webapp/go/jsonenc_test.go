@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// fillAllFields 公開されているフィールドを全てゼロ値以外の別々の値で埋める
+// 知らない型のフィールドが増えたらテストを落とし、ここと jsonenc.go を合わせて直させる
+func fillAllFields(t *testing.T, v interface{}) {
+	t.Helper()
+	rv := reflect.ValueOf(v).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		sf := rv.Type().Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		f := rv.Field(i)
+		switch f.Kind() {
+		case reflect.Int, reflect.Int64:
+			f.SetInt(int64(i+1) * 1001)
+		case reflect.Uint64:
+			f.SetUint(uint64(i+1) * 1003)
+		case reflect.Float64:
+			f.SetFloat(float64(i+1) + 0.123456789)
+		case reflect.String:
+			f.SetString(fmt.Sprintf("%s \"<&>\\ 椅子\n%d", sf.Name, i))
+		case reflect.Bool:
+			f.SetBool(true)
+		case reflect.Slice:
+			if f.Type().Elem().Kind() != reflect.Uint8 {
+				t.Fatalf("%s.%s: unsupported field type %s", rv.Type().Name(), sf.Name, f.Type())
+			}
+			f.SetBytes([]byte(sf.Name))
+		default:
+			t.Fatalf("%s.%s: unsupported field type %s", rv.Type().Name(), sf.Name, f.Type())
+		}
+	}
+}
+
+// stdJSON encoding/json でエンコードする myjson と同じくHTMLはエスケープしない
+func stdJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+func TestJSONEncodersMatchEncodingJSON(t *testing.T) {
+	var chair Chair
+	fillAllFields(t, &chair)
+	var estate Estate
+	fillAllFields(t, &estate)
+
+	cases := []struct {
+		name string
+		v    interface{}
+	}{
+		{"Chair", &chair},
+		{"Estate", &estate},
+		{"ChairSearchResponse", &ChairSearchResponse{Count: 3, Chairs: []Chair{chair, chair}}},
+		{"ChairSearchResponse nil", &ChairSearchResponse{}},
+		{"ChairListResponse", &ChairListResponse{Chairs: []Chair{chair}}},
+		{"ChairListResponse empty", &ChairListResponse{Chairs: []Chair{}}},
+		{"EstateSearchResponse", &EstateSearchResponse{Count: 3, Estates: []Estate{estate, estate}, NextCursor: "abc", Approximate: true}},
+		{"EstateSearchResponse omitempty", &EstateSearchResponse{Count: 1, Estates: []Estate{estate}}},
+		{"EstateSearchResponse nil", &EstateSearchResponse{}},
+		{"EstateListResponse", &EstateListResponse{Estates: []Estate{estate}}},
+		{"EstateListResponse empty", &EstateListResponse{Estates: []Estate{}}},
+	}
+	for _, tc := range cases {
+		got, err := myjson.Marshal(tc.v)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if want := stdJSON(t, tc.v); !bytes.Equal(got, want) {
+			t.Errorf("%s:\n got  %s\n want %s", tc.name, got, want)
+		}
+	}
+}
+
+// static.go の変数は jsonenc.go の init() より先に作られる
+// そこで登録する型を myjson でエンコードすると、リフレクションのエンコーダーがキャッシュされて登録が効かなくなる
+// fragmentがそのまま書き出されるかで、登録したエンコーダーが使われていることを確かめる
+func TestJSONEncodersRegisteredBeforeUse(t *testing.T) {
+	fragment := []byte(`{"fragment":true}`)
+	chair := Chair{ID: 1, fragment: fragment}
+	estate := Estate{ID: 1, fragment: fragment}
+
+	cases := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{"Chair", &chair, `{"fragment":true}`},
+		{"Estate", &estate, `{"fragment":true}`},
+		{"ChairSearchResponse", &ChairSearchResponse{Count: 1, Chairs: []Chair{chair}}, `{"count":1,"chairs":[{"fragment":true}]}`},
+		{"ChairListResponse", &ChairListResponse{Chairs: []Chair{chair}}, `{"chairs":[{"fragment":true}]}`},
+		{"EstateSearchResponse", &EstateSearchResponse{Count: 1, Estates: []Estate{estate}}, `{"count":1,"estates":[{"fragment":true}]}`},
+		{"EstateListResponse", &EstateListResponse{Estates: []Estate{estate}}, `{"estates":[{"fragment":true}]}`},
+	}
+	for _, tc := range cases {
+		got, err := myjson.Marshal(tc.v)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %s, want %s (encoder registered after first use?)", tc.name, got, tc.want)
+		}
+	}
+
+	// 書き下したバイト列がエンコードしたものと一致する
+	want := append(stdJSON(t, EstateListResponse{Estates: []Estate{}}), '\n')
+	if !bytes.Equal(emptyEstateListJSON, want) {
+		t.Errorf("emptyEstateListJSON = %q, want %q", emptyEstateListJSON, want)
+	}
+	want = append(stdJSON(t, InitializeResponse{Language: "go"}), '\n')
+	if !bytes.Equal(initializeResponseJSON, want) {
+		t.Errorf("initializeResponseJSON = %q, want %q", initializeResponseJSON, want)
+	}
+}
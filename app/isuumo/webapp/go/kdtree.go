@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// なぞって検索の候補をメモリ上のkd-treeから取り出し、DBに問い合わせない
+// SPATIAL_NAZOTTE より優先する
+var flagInMemoryNazotte = newFeatureFlag("IN_MEMORY_NAZOTTE", false)
+
+// estatePoint なぞって検索に必要なestateの位置と並び順
+type estatePoint struct {
+	ID         int64   `db:"id"`
+	Latitude   float64 `db:"latitude"`
+	Longitude  float64 `db:"longitude"`
+	Popularity int64   `db:"popularity"`
+}
+
+// kdTree 2次元のkd-tree
+// points を中央値で再帰的に分割した順に並べ、深さが偶数なら緯度、奇数なら経度で分ける
+type kdTree struct {
+	points []estatePoint
+}
+
+func buildKDTree(points []estatePoint) *kdTree {
+	t := &kdTree{points: points}
+	t.build(0, len(points), 0)
+	return t
+}
+
+func (t *kdTree) build(lo, hi, depth int) {
+	if hi-lo <= 1 {
+		return
+	}
+	ps := t.points[lo:hi]
+	if depth%2 == 0 {
+		sort.Slice(ps, func(i, j int) bool { return ps[i].Latitude < ps[j].Latitude })
+	} else {
+		sort.Slice(ps, func(i, j int) bool { return ps[i].Longitude < ps[j].Longitude })
+	}
+	mid := (lo + hi) / 2
+	t.build(lo, mid, depth+1)
+	t.build(mid+1, hi, depth+1)
+}
+
+// searchBox bの中 (境界を含む) にある点をfnに渡す
+func (t *kdTree) searchBox(b BoundingBox, fn func(p *estatePoint)) {
+	t.search(0, len(t.points), 0, b, fn)
+}
+
+func (t *kdTree) search(lo, hi, depth int, b BoundingBox, fn func(p *estatePoint)) {
+	if lo >= hi {
+		return
+	}
+	mid := (lo + hi) / 2
+	p := &t.points[mid]
+	if b.TopLeftCorner.Latitude <= p.Latitude && p.Latitude <= b.BottomRightCorner.Latitude &&
+		b.TopLeftCorner.Longitude <= p.Longitude && p.Longitude <= b.BottomRightCorner.Longitude {
+		fn(p)
+	}
+
+	v, min, max := p.Latitude, b.TopLeftCorner.Latitude, b.BottomRightCorner.Latitude
+	if depth%2 == 1 {
+		v, min, max = p.Longitude, b.TopLeftCorner.Longitude, b.BottomRightCorner.Longitude
+	}
+	if min <= v {
+		t.search(lo, mid, depth+1, b, fn)
+	}
+	if v <= max {
+		t.search(mid+1, hi, depth+1, b, fn)
+	}
+}
+
+var (
+	estatePointsMutex sync.RWMutex
+	// estatePoints id -> 位置 postEstateで上書きされることがあるのでidで持つ
+	estatePoints = map[int64]estatePoint{}
+	estateKDTree = buildKDTree(nil)
+	// estateGeohashCells GEOHASH_INDEX のときに使うセル -> 位置
+	estateGeohashCells = map[string][]estatePoint{}
+)
+
+// loadEstatePoints DBから全てのestateの位置を読み込んでkd-treeを作り直す
+func loadEstatePoints() error {
+	var rows []estatePoint
+	if err := db.Select(&rows, "SELECT id, latitude, longitude, popularity FROM estate"); err != nil {
+		return err
+	}
+
+	points := make(map[int64]estatePoint, len(rows))
+	for _, p := range rows {
+		points[p.ID] = p
+	}
+	tree := buildKDTree(rows)
+	cells := buildGeohashCells(points)
+
+	estatePointsMutex.Lock()
+	estatePoints = points
+	estateKDTree = tree
+	estateGeohashCells = cells
+	estatePointsMutex.Unlock()
+	return nil
+}
+
+// upsertEstatePoints postEstateで追加・上書きしたestateを反映する
+// postEstateは頻繁には呼ばれないので、差分を入れずに全体を作り直す
+func upsertEstatePoints(ps []estatePoint) {
+	estatePointsMutex.Lock()
+	defer estatePointsMutex.Unlock()
+
+	for _, p := range ps {
+		estatePoints[p.ID] = p
+	}
+	all := make([]estatePoint, 0, len(estatePoints))
+	for _, p := range estatePoints {
+		all = append(all, p)
+	}
+	estateKDTree = buildKDTree(all)
+	estateGeohashCells = buildGeohashCells(estatePoints)
+}
+
+// estatePointsInBox bの中にある点をfnに渡す
+func estatePointsInBox(b BoundingBox, fn func(p *estatePoint)) {
+	estatePointsMutex.RLock()
+	defer estatePointsMutex.RUnlock()
+	if flagGeohashIndex.Enabled() {
+		searchGeohashCells(b, fn)
+		return
+	}
+	estateKDTree.searchBox(b, fn)
+}
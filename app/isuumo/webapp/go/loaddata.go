@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// CSVのインポートで複数行INSERTの代わりに LOAD DATA LOCAL INFILE を使う
+// MySQL側で local_infile を有効にしておく必要がある
+var flagLoadDataImport = newFeatureFlag("LOAD_DATA_IMPORT", false)
+
+// LOAD DATA の既定の書式 (タブ区切り、\ でエスケープ) に合わせて値をエスケープする
+var loadDataEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`, "\x00", `\0`)
+
+// loadDataFile bulkInserterの行を書き出す一時ファイル
+type loadDataFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func newLoadDataFile() (*loadDataFile, error) {
+	f, err := ioutil.TempFile("", "isuumo-import-*.tsv")
+	if err != nil {
+		return nil, err
+	}
+	return &loadDataFile{f: f, w: bufio.NewWriterSize(f, 1<<20)}, nil
+}
+
+// reset 読み込み終わった行を捨てる
+func (lf *loadDataFile) reset() error {
+	if err := lf.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := lf.f.Seek(0, 0); err != nil {
+		return err
+	}
+	lf.w.Reset(lf.f)
+	return nil
+}
+
+// write 1行をタブ区切りで書き出す
+func (lf *loadDataFile) write(values []interface{}) error {
+	for i, v := range values {
+		if i > 0 {
+			lf.w.WriteByte('\t')
+		}
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = loadDataEscaper.Replace(v)
+		case int:
+			s = strconv.Itoa(v)
+		case int64:
+			s = strconv.FormatInt(v, 10)
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			s = "0"
+			if v {
+				s = "1"
+			}
+		default:
+			s = `\N`
+		}
+		if _, err := lf.w.WriteString(s); err != nil {
+			return err
+		}
+	}
+	return lf.w.WriteByte('\n')
+}
+
+// load 書き出した行を一時テーブルに LOAD DATA で読み込んでから、INSERT ... SELECT で本来のテーブルに入れる
+// 一時テーブルを経由するので ON DUPLICATE KEY UPDATE による上書きも複数行INSERTと同じように動く
+func (b *bulkInserter) load() error {
+	lf := b.loadFile
+	if err := lf.w.Flush(); err != nil {
+		return err
+	}
+
+	path := lf.f.Name()
+	mysql.RegisterLocalFile(path)
+	defer mysql.DeregisterLocalFile(path)
+
+	columns := strings.Join(b.columns, ", ")
+	staging := b.table + "_import"
+	if _, err := b.tx.Exec("CREATE TEMPORARY TABLE IF NOT EXISTS " + staging + " LIKE " + b.table); err != nil {
+		return err
+	}
+	if _, err := b.tx.Exec("DELETE FROM " + staging); err != nil {
+		return err
+	}
+	if _, err := b.tx.Exec("LOAD DATA LOCAL INFILE '" + path + "' INTO TABLE " + staging + " CHARACTER SET utf8mb4 (" + columns + ")"); err != nil {
+		return err
+	}
+	res, err := b.tx.Exec("INSERT INTO " + b.table + " (" + columns + ") SELECT " + columns + " FROM " + staging + b.suffix)
+	if err != nil {
+		return err
+	}
+	if b.suffix != "" {
+		if n, err := res.RowsAffected(); err == nil && n > int64(b.rows) {
+			b.Updated += n - int64(b.rows)
+		}
+	}
+	return nil
+}
+
+// Close 一時ファイルを使っていれば消す
+func (b *bulkInserter) Close() {
+	if b.loadFile != nil {
+		b.loadFile.f.Close()
+		os.Remove(b.loadFile.f.Name())
+	}
+}
@@ -0,0 +1,240 @@
+// buychair 少ない在庫の椅子に並行して購入リクエストを送り、
+// 最終的な在庫 = 初期在庫 - 購入に成功した数 が成り立つかを確認する
+//
+// トランザクションで購入する経路と、在庫をメモリで持つ経路の両方で実行する:
+//
+//	IN_MEMORY_STOCK=0 ./isuumo & go run ./loadgen/buychair -ids 1,2,3
+//	IN_MEMORY_STOCK=1 ./isuumo & go run ./loadgen/buychair -ids 1,2,3
+//
+// 在庫の設定は管理用のAPIなので、isuumo と同じ ADMIN_TOKEN を環境変数か -token で渡す
+//
+// -procs を指定すると自分自身を複数プロセスで起動して購入させる
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon10-qualify/isuumo/client"
+)
+
+var (
+	baseURL     = flag.String("url", "http://localhost:1323", "isuumo のURL")
+	token       = flag.String("token", os.Getenv("ADMIN_TOKEN"), "在庫を設定する管理用APIのトークン")
+	idsFlag     = flag.String("ids", "1", "購入する椅子のid (カンマ区切り)")
+	stock       = flag.Int64("stock", 10, "開始前に設定する在庫")
+	concurrency = flag.Int("concurrency", 32, "プロセスあたりの並列数")
+	requests    = flag.Int("requests", 100, "椅子ごと・プロセスあたりの購入リクエスト数")
+	procs       = flag.Int("procs", 1, "購入するプロセス数")
+	settle      = flag.Duration("settle", time.Second, "購入後に在庫を確認するまでの待ち時間")
+	worker      = flag.Bool("worker", false, "購入だけを行い成功数をJSONで出力する (内部用)")
+)
+
+var api = &client.Client{HTTPClient: &http.Client{Timeout: 10 * time.Second}}
+
+// workerResult -worker で起動したプロセスの出力
+type workerResult struct {
+	Succeeded map[int64]int64 `json:"succeeded"`
+	Errors    int64           `json:"errors"`
+}
+
+type stockResponse struct {
+	ID    int64 `json:"id"`
+	Stock int64 `json:"stock"`
+}
+
+func main() {
+	flag.Parse()
+	api.BaseURL, api.Token = *baseURL, *token
+
+	ids, err := parseIDs(*idsFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *worker {
+		succeeded, errors := buy(ids)
+		json.NewEncoder(os.Stdout).Encode(workerResult{Succeeded: succeeded, Errors: errors})
+		return
+	}
+
+	initial := map[int64]int64{}
+	for _, id := range ids {
+		s, err := restock(id, `{"stock":`+strconv.FormatInt(*stock, 10)+`}`)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to set stock of %d : %v\n", id, err)
+			os.Exit(2)
+		}
+		initial[id] = s
+	}
+
+	start := time.Now()
+	succeeded := map[int64]int64{}
+	var errors int64
+	if *procs <= 1 {
+		succeeded, errors = buy(ids)
+	} else {
+		succeeded, errors, err = buyInProcesses(*procs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	elapsed := time.Since(start)
+
+	time.Sleep(*settle)
+
+	ok := errors == 0
+	for _, id := range ids {
+		final, err := restock(id, `{"delta":0}`)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get stock of %d : %v\n", id, err)
+			os.Exit(2)
+		}
+		expected := initial[id] - succeeded[id]
+		status := "ok"
+		if final != expected || final < 0 {
+			status = "NG"
+			ok = false
+		}
+		fmt.Printf("chair %d: initial=%d succeeded=%d final=%d expected=%d %s\n", id, initial[id], succeeded[id], final, expected, status)
+	}
+	fmt.Printf("elapsed=%v unexpected=%d\n", elapsed, errors)
+
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func parseIDs(s string) ([]int64, error) {
+	var ids []int64
+	for _, v := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q : %v", v, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// restock PUT /admin/chair/:id/stock を呼び出して変更後の在庫を返す
+func restock(id int64, body string) (int64, error) {
+	res, err := api.PutAdminChairByIDStock(context.Background(), strconv.FormatInt(id, 10), nil, strings.NewReader(body), "application/json")
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", res.StatusCode)
+	}
+	var s stockResponse
+	if err := json.NewDecoder(res.Body).Decode(&s); err != nil {
+		return 0, err
+	}
+	return s.Stock, nil
+}
+
+// buy 全ての椅子に requests 回ずつ並行して購入リクエストを送る
+// 200を成功、404を売り切れとして数え、それ以外は想定外として数える
+func buy(ids []int64) (map[int64]int64, int64) {
+	type job struct{ id int64 }
+	jobs := make(chan job)
+	go func() {
+		for i := 0; i < *requests; i++ {
+			for _, id := range ids {
+				jobs <- job{id}
+			}
+		}
+		close(jobs)
+	}()
+
+	var mu sync.Mutex
+	succeeded := map[int64]int64{}
+	var errors int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				code, err := postBuy(j.id)
+				mu.Lock()
+				switch {
+				case err == nil && code == http.StatusOK:
+					succeeded[j.id]++
+				case err == nil && code == http.StatusNotFound:
+				default:
+					errors++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return succeeded, errors
+}
+
+func postBuy(id int64) (int, error) {
+	res, err := api.PostChairBuyByID(context.Background(), strconv.FormatInt(id, 10), nil, strings.NewReader(`{"email":"loadgen@example.com"}`), "application/json")
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// buyInProcesses 自分自身を -worker 付きで n 個起動して成功数を合計する
+func buyInProcesses(n int) (map[int64]int64, int64, error) {
+	args := []string{
+		"-worker",
+		"-url", *baseURL,
+		"-ids", *idsFlag,
+		"-concurrency", strconv.Itoa(*concurrency),
+		"-requests", strconv.Itoa(*requests),
+	}
+
+	outs := make([]bytes.Buffer, n)
+	cmds := make([]*exec.Cmd, n)
+	for i := range cmds {
+		cmds[i] = exec.Command(os.Args[0], args...)
+		cmds[i].Stdout = &outs[i]
+		cmds[i].Stderr = os.Stderr
+		if err := cmds[i].Start(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	succeeded := map[int64]int64{}
+	var errors int64
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			return nil, 0, fmt.Errorf("worker %d failed : %v", i, err)
+		}
+		var res workerResult
+		if err := json.Unmarshal(outs[i].Bytes(), &res); err != nil {
+			return nil, 0, fmt.Errorf("worker %d output : %v", i, err)
+		}
+		for id, n := range res.Succeeded {
+			succeeded[id] += n
+		}
+		errors += res.Errors
+	}
+	return succeeded, errors, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseIDs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int64
+		wantErr bool
+	}{
+		{"1", []int64{1}, false},
+		{"1,2,3", []int64{1, 2, 3}, false},
+		{" 1 , 2 ", []int64{1, 2}, false},
+		{"", nil, true},
+		{"1,,2", nil, true},
+		{"a", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseIDs(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseIDs(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIDs(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// fakeStockServer 在庫だけを持つ isuumo の代わり
+func fakeStockServer(t *testing.T, stocks map[int64]int64) *httptest.Server {
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/api/chair/buy/"):
+			id, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/chair/buy/"), 10, 64)
+			if stocks[id] <= 0 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			stocks[id]--
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/admin/chair/") && strings.HasSuffix(r.URL.Path, "/stock"):
+			if r.Header.Get("Authorization") != "Bearer "+*token {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			id, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/chair/"), "/stock"), 10, 64)
+			var body struct {
+				Stock *int64 `json:"stock"`
+				Delta int64  `json:"delta"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body.Stock != nil {
+				stocks[id] = *body.Stock
+			}
+			stocks[id] += body.Delta
+			json.NewEncoder(w).Encode(stockResponse{ID: id, Stock: stocks[id]})
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBuyKeepsStockInvariant(t *testing.T) {
+	defer func(u string, c, r int) { *baseURL, *concurrency, *requests = u, c, r }(*baseURL, *concurrency, *requests)
+	defer func(old string) { *token = old }(*token)
+	*token = "secret"
+
+	tests := []struct {
+		name     string
+		stock    int64
+		requests int
+	}{
+		{"sold out", 5, 20},
+		{"enough stock", 50, 10},
+		{"no stock", 0, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeStockServer(t, map[int64]int64{})
+			*baseURL, *concurrency, *requests = srv.URL, 8, tt.requests
+			api.BaseURL, api.Token = *baseURL, *token
+
+			ids := []int64{1, 2}
+			initial := map[int64]int64{}
+			for _, id := range ids {
+				s, err := restock(id, `{"stock":`+strconv.FormatInt(tt.stock, 10)+`}`)
+				if err != nil {
+					t.Fatal(err)
+				}
+				initial[id] = s
+			}
+
+			succeeded, errors := buy(ids)
+			if errors != 0 {
+				t.Fatalf("unexpected errors = %d", errors)
+			}
+			for _, id := range ids {
+				final, err := restock(id, `{"delta":0}`)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if final != initial[id]-succeeded[id] || final < 0 {
+					t.Errorf("chair %d: initial=%d succeeded=%d final=%d", id, initial[id], succeeded[id], final)
+				}
+			}
+		})
+	}
+}
+
+func TestBuyCountsUnexpectedStatus(t *testing.T) {
+	defer func(u string, c, r int) { *baseURL, *concurrency, *requests = u, c, r }(*baseURL, *concurrency, *requests)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	*baseURL, *concurrency, *requests = srv.URL, 4, 3
+	api.BaseURL = *baseURL
+
+	succeeded, errors := buy([]int64{1, 2})
+	if len(succeeded) != 0 || errors != 6 {
+		t.Errorf("succeeded = %v, errors = %d, want none and 6", succeeded, errors)
+	}
+}
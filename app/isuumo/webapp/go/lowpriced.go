@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/isucon/isucon10-qualify/isuumo/cache"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+var lowPricedChair *ChairListResponse
+
+var lowPricedChairMutex sync.RWMutex
+
+var lowPricedEstate *EstateListResponse
+
+var lowPricedEstateMutex sync.RWMutex
+
+// 無効化された直後にバックグラウンドで作り直す
+var flagLowPricedRefresh = newFeatureFlag("LOW_PRICED_BACKGROUND_REFRESH", true)
+
+// low_priced の共有キャッシュのキー
+const (
+	sharedLowPricedChairKey  = "low_priced:chair"
+	sharedLowPricedEstateKey = "low_priced:estate"
+)
+
+// lowPricedChairCounter, lowPricedEstateCounter 作り直さずに返せたか
+var lowPricedChairCounter, lowPricedEstateCounter cache.HitCounter
+
+// lowPricedChairGeneration 無効化のたびに増やす
+// 作り直している間に無効化されたら古い結果を保存しない
+var lowPricedChairGeneration int64
+
+// lowPricedChairRebuildMutex 作り直しを1つに絞る
+var lowPricedChairRebuildMutex sync.Mutex
+
+// clearLowPricedChair lowPricedChairMutex をロックした状態で呼ぶ
+// 共有キャッシュも捨てる
+func clearLowPricedChair() {
+	lowPricedChair = nil
+	lowPricedChairGeneration++
+	sharedCacheDelete(sharedLowPricedChairKey)
+}
+
+// decrementLowPricedChairStock 1つ購入された椅子が安い順に入っていれば在庫を1つ減らす 売り切れたら作り直す
+func decrementLowPricedChairStock(id int) {
+	target := -1
+	lowPricedChairMutex.RLock()
+	if lowPricedChair != nil {
+		for i, chair := range lowPricedChair.Chairs {
+			if chair.ID == int64(id) {
+				target = i
+				break
+			}
+		}
+	}
+	lowPricedChairMutex.RUnlock()
+	if target < 0 {
+		return
+	}
+
+	lowPricedChairMutex.Lock()
+	// ロックを取り直す間に作り直されているかもしれない
+	if lowPricedChair != nil && target < len(lowPricedChair.Chairs) && lowPricedChair.Chairs[target].ID == int64(id) {
+		lowPricedChair.Chairs[target].Stock--
+		if lowPricedChair.Chairs[target].Stock == 0 {
+			clearLowPricedChair()
+		}
+	}
+	lowPricedChairMutex.Unlock()
+	scheduleLowPricedChairRefresh()
+}
+
+// loadLowPricedChair lowPricedChairを返す
+// 無効化されていれば作り直すが、同時に呼ばれても問い合わせは1回だけにする
+func loadLowPricedChair() (*ChairListResponse, error) {
+	lowPricedChairMutex.RLock()
+	res := lowPricedChair
+	lowPricedChairMutex.RUnlock()
+	if res != nil {
+		lowPricedChairCounter.Hit()
+		return res, nil
+	}
+	lowPricedChairCounter.Miss()
+
+	lowPricedChairRebuildMutex.Lock()
+	defer lowPricedChairRebuildMutex.Unlock()
+
+	// 待っている間に他の誰かが作り直したかもしれない
+	lowPricedChairMutex.RLock()
+	res = lowPricedChair
+	generation := lowPricedChairGeneration
+	lowPricedChairMutex.RUnlock()
+	if res != nil {
+		return res, nil
+	}
+
+	res = &ChairListResponse{}
+	shared := sharedCacheGet(sharedLowPricedChairKey, res)
+	if !shared {
+		chairs, err := srv.Chairs.LowPricedChairs(context.Background(), Limit)
+		if err != nil {
+			return nil, err
+		}
+		res.Chairs = chairs
+	} else if res.Chairs == nil {
+		// gobは空のスライスをnilにする
+		res.Chairs = []Chair{}
+	}
+
+	lowPricedChairMutex.Lock()
+	stored := lowPricedChairGeneration == generation
+	if stored {
+		lowPricedChair = res
+	}
+	lowPricedChairMutex.Unlock()
+	// 無効化された後に古い結果を共有しないように、保存できたときだけ共有する
+	if stored && !shared {
+		sharedCacheSet(sharedLowPricedChairKey, res)
+	}
+
+	return res, nil
+}
+
+// scheduleLowPricedChairRefresh 無効化されていればバックグラウンドで作り直す
+func scheduleLowPricedChairRefresh() {
+	if !flagLowPricedRefresh.Enabled() {
+		return
+	}
+
+	lowPricedChairMutex.RLock()
+	cleared := lowPricedChair == nil
+	lowPricedChairMutex.RUnlock()
+	if !cleared {
+		return
+	}
+
+	tasks.Go("refreshLowPricedChair", func() {
+		if _, err := loadLowPricedChair(); err != nil {
+			log.Errorf("refreshLowPricedChair DB execution error : %v", err)
+		}
+	})
+}
+
+// lowPricedEstateGeneration 無効化のたびに増やす
+var lowPricedEstateGeneration int64
+
+// lowPricedEstateRebuildMutex 作り直しを1つに絞る
+var lowPricedEstateRebuildMutex sync.Mutex
+
+// clearLowPricedEstate lowPricedEstateMutex をロックした状態で呼ぶ
+// 共有キャッシュも捨てる
+func clearLowPricedEstate() {
+	lowPricedEstate = nil
+	lowPricedEstateGeneration++
+	sharedCacheDelete(sharedLowPricedEstateKey)
+}
+
+// loadLowPricedEstate lowPricedEstateを返す
+// estateは追加されるだけなので postEstate で無効化されるまで使い回す
+func loadLowPricedEstate() (*EstateListResponse, error) {
+	lowPricedEstateMutex.RLock()
+	res := lowPricedEstate
+	lowPricedEstateMutex.RUnlock()
+	if res != nil {
+		lowPricedEstateCounter.Hit()
+		return res, nil
+	}
+	lowPricedEstateCounter.Miss()
+
+	lowPricedEstateRebuildMutex.Lock()
+	defer lowPricedEstateRebuildMutex.Unlock()
+
+	lowPricedEstateMutex.RLock()
+	res = lowPricedEstate
+	generation := lowPricedEstateGeneration
+	lowPricedEstateMutex.RUnlock()
+	if res != nil {
+		return res, nil
+	}
+
+	res = &EstateListResponse{}
+	shared := sharedCacheGet(sharedLowPricedEstateKey, res)
+	if !shared {
+		estates, err := srv.Estates.LowPricedEstates(context.Background(), Limit)
+		if err != nil {
+			return nil, err
+		}
+		res.Estates = estates
+	} else if res.Estates == nil {
+		// gobは空のスライスをnilにする
+		res.Estates = []Estate{}
+	}
+
+	lowPricedEstateMutex.Lock()
+	stored := lowPricedEstateGeneration == generation
+	if stored {
+		lowPricedEstate = res
+	}
+	lowPricedEstateMutex.Unlock()
+	// 無効化された後に古い結果を共有しないように、保存できたときだけ共有する
+	if stored && !shared {
+		sharedCacheSet(sharedLowPricedEstateKey, res)
+	}
+
+	return res, nil
+}
+
+// scheduleLowPricedEstateRefresh 無効化されていればバックグラウンドで作り直す
+func scheduleLowPricedEstateRefresh() {
+	if !flagLowPricedRefresh.Enabled() {
+		return
+	}
+
+	lowPricedEstateMutex.RLock()
+	cleared := lowPricedEstate == nil
+	lowPricedEstateMutex.RUnlock()
+	if !cleared {
+		return
+	}
+
+	tasks.Go("refreshLowPricedEstate", func() {
+		if _, err := loadLowPricedEstate(); err != nil {
+			log.Errorf("refreshLowPricedEstate DB execution error : %v", err)
+		}
+	})
+}
+
+func getLowPricedChair(c echo.Context) error {
+	res, err := loadLowPricedChair()
+	if err != nil {
+		c.Logger().Errorf("getLowPricedChair DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	// buyChairが在庫を書き換えるのでロックしたまま返す
+	lowPricedChairMutex.RLock()
+	defer lowPricedChairMutex.RUnlock()
+	return JSON(c, http.StatusOK, res)
+}
+
+func getLowPricedEstate(c echo.Context) error {
+	res, err := loadLowPricedEstate()
+	if err != nil {
+		c.Logger().Errorf("getLowPricedEstate DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	return JSON(c, http.StatusOK, res)
+}
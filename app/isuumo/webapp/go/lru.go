@@ -0,0 +1,14 @@
+package main
+
+import (
+	"time"
+
+	"github.com/isucon/isucon10-qualify/isuumo/cache"
+)
+
+// newLRUCache LRU_CACHE_SIZE_<name>, LRU_CACHE_TTL_<name> で上限とTTLを変えられる
+func newLRUCache(name string, defaultMaxEntries int, defaultTTL time.Duration) *cache.LRU {
+	return cache.NewLRU(name,
+		parseIntEnv("LRU_CACHE_SIZE_"+name, defaultMaxEntries),
+		parseDurationEnv("LRU_CACHE_TTL_"+name, defaultTTL))
+}
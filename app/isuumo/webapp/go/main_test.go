@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+)
+
+func TestRestockChairInMemoryStock(t *testing.T) {
+	defer flagInMemoryStock.Set(flagInMemoryStock.Enabled())
+	defer flagLowPricedRefresh.Set(flagLowPricedRefresh.Enabled())
+	flagInMemoryStock.Set(true)
+	flagLowPricedRefresh.Set(false)
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		stock  int64
+	}{
+		{"delta only", `{"delta":3}`, http.StatusOK, 3},
+		{"stock only", `{"stock":5}`, http.StatusOK, 5},
+		{"negative", `{"delta":-10}`, http.StatusBadRequest, 0},
+		{"neither", `{}`, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addStock(1, 0)
+			lowPricedChairMutex.Lock()
+			lowPricedChair = &ChairListResponse{}
+			lowPricedChairMutex.Unlock()
+
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodPost, "/api/chair/1/restock", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues("1")
+
+			if err := (&Server{}).restockChair(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if stock, _ := currentStock(1); stock != tt.stock {
+				t.Errorf("stock = %d, want %d", stock, tt.stock)
+			}
+			lowPricedChairMutex.RLock()
+			cleared := lowPricedChair == nil
+			lowPricedChairMutex.RUnlock()
+			if tt.status == http.StatusOK && !cleared {
+				t.Errorf("low priced chairs were not invalidated")
+			}
+		})
+	}
+}
+
+func TestSearchEstatesSummaryWithFeatures(t *testing.T) {
+	fdb := useFakeDB(t)
+	for _, f := range []*featureFlag{flagSearchPageCache, flagEstateSearchTable, flagInMemorySearch, flagElasticsearch} {
+		defer f.Set(f.Enabled())
+		f.Set(false)
+	}
+	var feature string
+	for f := range currentConditions().EstateFeatures {
+		feature = f
+		break
+	}
+
+	for _, view := range []string{"", viewSummary} {
+		t.Run("view="+view, func(t *testing.T) {
+			e := echo.New()
+			q := url.Values{"features": {feature}, "page": {"0"}, "perPage": {"25"}, viewParam: {view}}
+			req := httptest.NewRequest(http.MethodGet, "/api/estate/search?"+q.Encode(), nil)
+			rec := httptest.NewRecorder()
+			if err := NewServer(db).searchEstates(e.NewContext(req, rec)); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+			}
+			var joined int
+			for _, q := range fdb.Queries() {
+				if strings.Contains(q.Query, "estate_feature") {
+					joined++
+				}
+			}
+			if joined < 2 {
+				t.Errorf("count and search queries must join estate_feature: %v", fdb.Queries())
+			}
+		})
+	}
+}
+
+func TestSearchChairsFeatures(t *testing.T) {
+	for _, f := range []*featureFlag{flagSearchPageCache, flagInMemorySearch, flagElasticsearch, flagChairSearchWindowCount} {
+		defer f.Set(f.Enabled())
+		f.Set(false)
+	}
+	var feature string
+	for f := range currentConditions().ChairFeatures {
+		feature = f
+		break
+	}
+
+	tests := []struct {
+		name     string
+		features string
+		extra    url.Values
+		status   int
+		joined   bool
+	}{
+		{"only separators", ",", nil, http.StatusBadRequest, false},
+		{"only separators with other condition", ",,", url.Values{"kind": {"ゲーミングチェア"}}, http.StatusOK, false},
+		{"empty items skipped", "," + feature + ",", nil, http.StatusOK, true},
+		{"unknown feature", "no-such-feature", nil, http.StatusOK, true},
+		{"duplicates", feature + "," + feature, nil, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fdb := useFakeDB(t)
+			e := echo.New()
+			q := url.Values{"features": {tt.features}, "page": {"0"}, "perPage": {"25"}}
+			for k, v := range tt.extra {
+				q[k] = v
+			}
+			req := httptest.NewRequest(http.MethodGet, "/api/chair/search?"+q.Encode(), nil)
+			rec := httptest.NewRecorder()
+			if err := NewServer(db).searchChairs(e.NewContext(req, rec)); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			for _, q := range fdb.Queries() {
+				if strings.Contains(q.Query, "chair_feature") != tt.joined {
+					t.Errorf("unexpected join in %s", q.Query)
+				}
+			}
+		})
+	}
+}
+
+func TestGetEstateDetailIfNoneMatch(t *testing.T) {
+	s := &Server{Estates: &memEstateRepository{estates: map[int]Estate{9001: {ID: 9001, Name: "test"}}}}
+	defer cachedEstates.Purge()
+
+	tests := []struct {
+		name        string
+		id          string
+		ifNoneMatch string
+		status      int
+	}{
+		{"matching etag", "9001", estateETag(9001), http.StatusNotModified},
+		{"weak etag", "9001", "W/" + estateETag(9001), http.StatusNotModified},
+		{"other etag", "9001", estateETag(9002), http.StatusOK},
+		{"wildcard", "9001", "*", http.StatusOK},
+		{"missing with etag", "9002", estateETag(9002), http.StatusNotFound},
+		{"missing with wildcard", "9002", "*", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/estate/"+tt.id, nil)
+			req.Header.Set("If-None-Match", tt.ifNoneMatch)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tt.id)
+
+			if err := s.getEstateDetail(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestMySQLInterpolateParams(t *testing.T) {
+	tests := []struct {
+		env  string
+		want bool
+	}{
+		{"", false},
+		{"0", false},
+		{"1", true},
+		{"true", false},
+	}
+	for _, tt := range tests {
+		t.Run("MYSQL_INTERPOLATE_PARAMS="+tt.env, func(t *testing.T) {
+			t.Setenv("MYSQL_INTERPOLATE_PARAMS", tt.env)
+			t.Setenv("MYSQL_UNIX_DOMAIN_SOCKET", "0")
+
+			mc := NewMySQLConnectionEnv()
+			if mc.InterpolateParams != tt.want {
+				t.Fatalf("InterpolateParams = %v, want %v", mc.InterpolateParams, tt.want)
+			}
+			cfg, err := mysql.ParseDSN(mc.dsn(mc.connectParams()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.InterpolateParams != tt.want {
+				t.Errorf("dsn interpolateParams = %v, want %v", cfg.InterpolateParams, tt.want)
+			}
+			if cfg.MultiStatements {
+				t.Errorf("ConnectDB must not enable multiStatements")
+			}
+		})
+	}
+}
+
+func TestBuyChairInMemoryStock(t *testing.T) {
+	defer flagInMemoryStock.Set(flagInMemoryStock.Enabled())
+	defer flagLowPricedRefresh.Set(flagLowPricedRefresh.Enabled())
+	flagInMemoryStock.Set(true)
+	flagLowPricedRefresh.Set(false)
+	defer func(old *Server) { srv = old }(srv)
+
+	tests := []struct {
+		name      string
+		id        int
+		err       error
+		stock     int64
+		status    int
+		wantStock int64
+		// lowPriced 購入後の安い順の椅子の在庫 nilなら捨てられている
+		lowPriced *int64
+	}{
+		{"in stock", 1, nil, 2, http.StatusOK, 1, func() *int64 { v := int64(1); return &v }()},
+		{"sold out", 1, nil, 1, http.StatusOK, 0, nil},
+		{"no stock", 1, nil, 0, http.StatusNotFound, 0, func() *int64 { v := int64(0); return &v }()},
+		{"hidden", 2, nil, 1, http.StatusNotFound, 1, func() *int64 { v := int64(1); return &v }()},
+		{"lookup error", 1, errors.New("connection refused"), 1, http.StatusInternalServerError, 1, func() *int64 { v := int64(1); return &v }()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cachedChairs.Purge()
+			defer cachedChairs.Purge()
+			srv = &Server{Chairs: &fakeChairRepository{chairs: map[int]Chair{
+				1: {ID: 1, Stock: tt.stock},
+				2: {ID: 2, Stock: tt.stock, Hidden: true},
+			}, err: tt.err}}
+			addStock(int64(tt.id), tt.stock)
+			lowPricedChairMutex.Lock()
+			lowPricedChair = &ChairListResponse{Chairs: []Chair{{ID: int64(tt.id), Stock: tt.stock}}}
+			lowPricedChairMutex.Unlock()
+			generation := chairSearchResponseCache.generation
+
+			req := httptest.NewRequest(http.MethodPost, "/api/chair/buy/"+strconv.Itoa(tt.id), strings.NewReader(`{"email":"a@example.com"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(strconv.Itoa(tt.id))
+			if err := srv.buyChair(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if stock, _ := currentStock(int64(tt.id)); stock != tt.wantStock {
+				t.Errorf("stock = %d, want %d", stock, tt.wantStock)
+			}
+
+			lowPricedChairMutex.RLock()
+			got := lowPricedChair
+			lowPricedChairMutex.RUnlock()
+			switch {
+			case tt.lowPriced == nil && got != nil:
+				t.Errorf("low priced chairs were not invalidated")
+			case tt.lowPriced != nil && (got == nil || got.Chairs[0].Stock != *tt.lowPriced):
+				t.Errorf("low priced chairs = %+v, want stock %d", got, *tt.lowPriced)
+			}
+			if invalidated := chairSearchResponseCache.generation != generation; invalidated != (tt.lowPriced == nil) {
+				t.Errorf("search caches invalidated = %v", invalidated)
+			}
+		})
+	}
+	resetPurchases()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// mapClusterGrid タイル1枚の幅をこの数に分けたマスごとにまとめる
+	mapClusterGrid = 8
+	mapMaxZoom     = 22
+)
+
+// MapCluster 地図上の1つのマーカー
+// 1件だけのときはそのestateのidと位置、それ以外は重心と件数を返す
+type MapCluster struct {
+	ID        int64   `json:"id,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Count     int64   `json:"count"`
+}
+
+type MapResponse struct {
+	Clusters []MapCluster `json:"clusters"`
+}
+
+// parseBoundingBox minLatitude,minLongitude,maxLatitude,maxLongitude の形式の矩形を読む
+func parseBoundingBox(s string) (BoundingBox, error) {
+	var b BoundingBox
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return b, fmt.Errorf("bbox must have 4 values")
+	}
+	var vs [4]float64
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return b, fmt.Errorf("invalid bbox value %q", p)
+		}
+		vs[i] = v
+	}
+	b.TopLeftCorner = Coordinate{Latitude: vs[0], Longitude: vs[1]}
+	b.BottomRightCorner = Coordinate{Latitude: vs[2], Longitude: vs[3]}
+	if vs[0] > vs[2] || vs[1] > vs[3] {
+		return b, fmt.Errorf("bbox min must not exceed max")
+	}
+	return b, nil
+}
+
+// getEstateMap 表示範囲のestateをズームに応じたマスごとにまとめて返す
+func getEstateMap(c echo.Context) error {
+	ctx := c.Request().Context()
+	b, err := parseBoundingBox(c.QueryParam("bbox"))
+	if err != nil {
+		c.Echo().Logger.Infof("bbox invalid, %v : %v", c.QueryParam("bbox"), err)
+		return invalidParam(c, "bbox", "must be four numbers separated by commas")
+	}
+	zoom, err := strconv.Atoi(c.QueryParam("zoom"))
+	if err != nil || zoom < 0 || zoom > mapMaxZoom {
+		c.Echo().Logger.Infof("zoom invalid, %v : %v", c.QueryParam("zoom"), err)
+		return invalidParam(c, "zoom", "out of range")
+	}
+
+	var points []estatePoint
+	if flagInMemoryNazotte.Enabled() {
+		estatePointsInBox(b, func(p *estatePoint) {
+			points = append(points, *p)
+		})
+	} else {
+		query := `SELECT id, latitude, longitude, popularity FROM estate WHERE latitude <= ? AND latitude >= ? AND longitude <= ? AND longitude >= ?`
+		err := db.SelectContext(ctx, &points, query, b.BottomRightCorner.Latitude, b.TopLeftCorner.Latitude, b.BottomRightCorner.Longitude, b.TopLeftCorner.Longitude)
+		if err != nil {
+			c.Logger().Errorf("getEstateMap DB execution error : %v", err)
+			return internalError(c)
+		}
+	}
+
+	res := MapResponse{Clusters: clusterEstatePoints(points, zoom)}
+	return JSON(c, http.StatusOK, res)
+}
+
+// clusterEstatePoints 点をズームに応じた大きさのマスに分けて、マスごとに重心と件数を求める
+func clusterEstatePoints(points []estatePoint, zoom int) []MapCluster {
+	size := 360 / math.Pow(2, float64(zoom)) / mapClusterGrid
+
+	type key struct{ lat, lon int64 }
+	type acc struct {
+		id       int64
+		lat, lon float64
+		count    int64
+	}
+	cells := map[key]*acc{}
+	var order []key
+	for _, p := range points {
+		k := key{int64(math.Floor(p.Latitude / size)), int64(math.Floor(p.Longitude / size))}
+		a, ok := cells[k]
+		if !ok {
+			a = &acc{id: p.ID}
+			cells[k] = a
+			order = append(order, k)
+		}
+		a.lat += p.Latitude
+		a.lon += p.Longitude
+		a.count++
+	}
+
+	clusters := make([]MapCluster, 0, len(order))
+	for _, k := range order {
+		a := cells[k]
+		cl := MapCluster{Latitude: a.lat / float64(a.count), Longitude: a.lon / float64(a.count), Count: a.count}
+		if a.count == 1 {
+			cl.ID = a.id
+		}
+		clusters = append(clusters, cl)
+	}
+	return clusters
+}
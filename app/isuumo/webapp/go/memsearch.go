@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+// levelとfeatureとkind/colorだけの人気順の検索を、メモリ上のインデックスから答えてDBに問い合わせない
+// インデックスは initialize で読み込み、書き換わった行はキャッシュを捨てるときに印を付けて次の検索の前に読み直す
+var flagInMemorySearch = newFeatureFlag("IN_MEMORY_SEARCH", false)
+
+// memLevelDims インデックスが持つlevelの数
+// chairは price, height, width, depth estateは rent, door_height, door_width の順
+const memLevelDims = 4
+
+// memEntry 検索に使う1行分の属性
+type memEntry struct {
+	ID         int64
+	Popularity int64
+	Levels     [memLevelDims]int64
+	Kind       string
+	Color      string
+	// FeatureIDs 昇順
+	FeatureIDs []int
+	Stock      int64
+	Hidden     bool
+}
+
+// memQuery 検索条件 Levels のnilの次元は絞り込まない
+type memQuery struct {
+	Levels [memLevelDims][]int64
+	Kind   string
+	Color  string
+	// Features 全てを持つものに絞り込むfeature id 存在しないfeatureは-1
+	Features []int
+}
+
+// memKey 並び順 popularity DESC, id ASC
+type memKey struct {
+	Popularity int64
+	ID         int64
+}
+
+func (k memKey) before(o memKey) bool {
+	if k.Popularity != o.Popularity {
+		return k.Popularity > o.Popularity
+	}
+	return k.ID < o.ID
+}
+
+// memList 並び順に並べたキー
+type memList []memKey
+
+// search kより前にないキーの最初の位置
+func (l memList) search(k memKey) int {
+	return sort.Search(len(l), func(i int) bool { return !l[i].before(k) })
+}
+
+func (l memList) insert(k memKey) memList {
+	i := l.search(k)
+	l = append(l, memKey{})
+	copy(l[i+1:], l[i:])
+	l[i] = k
+	return l
+}
+
+func (l memList) remove(k memKey) memList {
+	i := l.search(k)
+	if i < len(l) && l[i] == k {
+		l = append(l[:i], l[i+1:]...)
+	}
+	return l
+}
+
+// memSearchIndex 全ての行のリストと、(levelの次元, level) と feature id と kind と color ごとのリスト (転置インデックス)
+// どのリストも並び順に並べたまま、書き換わった行だけを入れ直す
+type memSearchIndex struct {
+	// load idsの行を読む idsがnilなら全ての行を読む
+	load func(ids []int64) ([]memEntry, error)
+
+	mutex    sync.RWMutex
+	loaded   bool
+	entries  map[int64]*memEntry
+	all      memList
+	buckets  [memLevelDims]map[int64]memList
+	postings map[int]memList
+	kinds    map[string]memList
+	colors   map[string]memList
+
+	// counts 条件ごとの件数 行に印が付いたら捨てる
+	// countGeneration は捨てるたびに増やし、数えている間に捨てられた件数を保存しない
+	countMutex      sync.Mutex
+	counts          map[string]int64
+	countGeneration int64
+
+	// refreshMutex 読み直しを直列化する
+	refreshMutex sync.Mutex
+	staleMutex   sync.Mutex
+	stale        map[int64]bool
+}
+
+// 読み込むときの srv のリポジトリから読む
+var chairMemIndex = &memSearchIndex{load: func(ids []int64) ([]memEntry, error) { return srv.loadChairMemEntries(ids) }}
+var estateMemIndex = &memSearchIndex{load: func(ids []int64) ([]memEntry, error) { return srv.loadEstateMemEntries(ids) }}
+
+// loadMemSearchIndexes initialize と rebucket の後に全ての行を読み直す
+func loadMemSearchIndexes() error {
+	if err := chairMemIndex.reload(); err != nil {
+		return err
+	}
+	return estateMemIndex.reload()
+}
+
+func (x *memSearchIndex) reload() error {
+	x.staleMutex.Lock()
+	x.stale = map[int64]bool{}
+	x.staleMutex.Unlock()
+
+	entries, err := x.load(nil)
+	if err != nil {
+		return err
+	}
+	x.mutex.Lock()
+	x.build(entries)
+	x.loaded = true
+	x.mutex.Unlock()
+	return nil
+}
+
+// build 全てのリストを作り直す mutexを取って呼ぶ
+// 1件ずつ入れると遅いので、末尾に足してからまとめて並べる
+func (x *memSearchIndex) build(entries []memEntry) {
+	x.entries = make(map[int64]*memEntry, len(entries))
+	x.all = make(memList, 0, len(entries))
+	for d := range x.buckets {
+		x.buckets[d] = map[int64]memList{}
+	}
+	x.postings = map[int]memList{}
+	x.kinds = map[string]memList{}
+	x.colors = map[string]memList{}
+	for i := range entries {
+		e := &entries[i]
+		k := memKey{e.Popularity, e.ID}
+		x.entries[e.ID] = e
+		x.all = append(x.all, k)
+		for d, l := range e.Levels {
+			x.buckets[d][l] = append(x.buckets[d][l], k)
+		}
+		for _, f := range e.FeatureIDs {
+			x.postings[f] = append(x.postings[f], k)
+		}
+		if e.Kind != "" {
+			x.kinds[e.Kind] = append(x.kinds[e.Kind], k)
+		}
+		if e.Color != "" {
+			x.colors[e.Color] = append(x.colors[e.Color], k)
+		}
+	}
+	sortMemList(x.all)
+	for d := range x.buckets {
+		for _, l := range x.buckets[d] {
+			sortMemList(l)
+		}
+	}
+	for _, l := range x.postings {
+		sortMemList(l)
+	}
+	for _, l := range x.kinds {
+		sortMemList(l)
+	}
+	for _, l := range x.colors {
+		sortMemList(l)
+	}
+	x.clearCounts()
+}
+
+func sortMemList(l memList) {
+	sort.Slice(l, func(i, j int) bool { return l[i].before(l[j]) })
+}
+
+// add eをリストに入れる mutexを取って呼ぶ
+func (x *memSearchIndex) add(e *memEntry) {
+	k := memKey{e.Popularity, e.ID}
+	x.entries[e.ID] = e
+	x.all = x.all.insert(k)
+	for d, l := range e.Levels {
+		x.buckets[d][l] = x.buckets[d][l].insert(k)
+	}
+	for _, f := range e.FeatureIDs {
+		x.postings[f] = x.postings[f].insert(k)
+	}
+	if e.Kind != "" {
+		x.kinds[e.Kind] = x.kinds[e.Kind].insert(k)
+	}
+	if e.Color != "" {
+		x.colors[e.Color] = x.colors[e.Color].insert(k)
+	}
+}
+
+// drop eをリストから抜く mutexを取って呼ぶ
+func (x *memSearchIndex) drop(e *memEntry) {
+	k := memKey{e.Popularity, e.ID}
+	delete(x.entries, e.ID)
+	x.all = x.all.remove(k)
+	for d, l := range e.Levels {
+		x.buckets[d][l] = x.buckets[d][l].remove(k)
+	}
+	for _, f := range e.FeatureIDs {
+		x.postings[f] = x.postings[f].remove(k)
+	}
+	if e.Kind != "" {
+		x.kinds[e.Kind] = x.kinds[e.Kind].remove(k)
+	}
+	if e.Color != "" {
+		x.colors[e.Color] = x.colors[e.Color].remove(k)
+	}
+}
+
+// markStale idsの行が書き換わったので次の検索の前に読み直す
+func (x *memSearchIndex) markStale(ids ...int) {
+	x.mutex.RLock()
+	loaded := x.loaded
+	x.mutex.RUnlock()
+	if !loaded {
+		return
+	}
+	x.staleMutex.Lock()
+	for _, id := range ids {
+		x.stale[int64(id)] = true
+	}
+	x.staleMutex.Unlock()
+	x.clearCounts()
+}
+
+// clearCounts 保存した件数を捨てる
+func (x *memSearchIndex) clearCounts() {
+	x.countMutex.Lock()
+	x.counts = map[string]int64{}
+	x.countGeneration++
+	x.countMutex.Unlock()
+}
+
+// countKey 件数を保存するときの条件のキー
+func (q memQuery) countKey() string {
+	return fmt.Sprint(q.Levels, q.Kind, q.Color, q.Features)
+}
+
+// refresh 印の付いた行を読み直す
+// 在庫や非表示だけが変わったならその場で書き換え、並び順やlevelやfeatureが変わった行はリストから抜いて入れ直す
+func (x *memSearchIndex) refresh() error {
+	x.refreshMutex.Lock()
+	defer x.refreshMutex.Unlock()
+
+	x.staleMutex.Lock()
+	stale := x.stale
+	x.stale = map[int64]bool{}
+	x.staleMutex.Unlock()
+	if len(stale) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(stale))
+	for id := range stale {
+		ids = append(ids, id)
+	}
+	rows, err := x.load(ids)
+	if err != nil {
+		// 次の検索でもう一度読み直す
+		x.staleMutex.Lock()
+		for id := range stale {
+			x.stale[id] = true
+		}
+		x.staleMutex.Unlock()
+		return err
+	}
+	loaded := make(map[int64]*memEntry, len(rows))
+	for i := range rows {
+		loaded[rows[i].ID] = &rows[i]
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	for _, id := range ids {
+		e, found := loaded[id]
+		old, exists := x.entries[id]
+		if exists && found && old.Popularity == e.Popularity && old.Levels == e.Levels && old.Kind == e.Kind && old.Color == e.Color && equalInts(old.FeatureIDs, e.FeatureIDs) {
+			old.Stock = e.Stock
+			old.Hidden = e.Hidden
+			continue
+		}
+		if exists {
+			x.drop(old)
+		}
+		if found {
+			x.add(e)
+		}
+	}
+	return nil
+}
+
+// search qに一致する行を並び順に数え、offsetからlimit件のidを返す
+// 読み込む前ならokがfalseで、呼び出し元はDBで検索する
+// stockは在庫を返す 在庫が0以下か非表示の行は一致しない
+// 同じ条件の件数を数えてあれば、offset+limit件見つけたところで止める
+func (x *memSearchIndex) search(q memQuery, offset, limit int, stock func(e *memEntry) int64) (ids []int64, count int64, ok bool, err error) {
+	// 読み直す前に世代を読むので、読み直しと入れ違いに数えた件数は保存しない
+	key := q.countKey()
+	x.countMutex.Lock()
+	cachedCount, cached := x.counts[key]
+	generation := x.countGeneration
+	x.countMutex.Unlock()
+
+	if err := x.refresh(); err != nil {
+		return nil, 0, true, err
+	}
+
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	if !x.loaded {
+		return nil, 0, false, nil
+	}
+
+	// 条件ごとに並び順のリストを用意し、1つでも空なら何にもマッチしない
+	lists := make([]memList, 0, memLevelDims+len(q.Features))
+	for d, levels := range q.Levels {
+		if levels == nil {
+			continue
+		}
+		lists = append(lists, x.levelList(d, levels))
+	}
+	for _, f := range q.Features {
+		lists = append(lists, x.postings[f])
+	}
+	if q.Kind != "" {
+		lists = append(lists, x.kinds[q.Kind])
+	}
+	if q.Color != "" {
+		lists = append(lists, x.colors[q.Color])
+	}
+	if len(lists) == 0 {
+		lists = append(lists, x.all)
+	}
+	for _, l := range lists {
+		if len(l) == 0 {
+			return nil, 0, true, nil
+		}
+	}
+
+	eachMemListIntersection(lists, func(k memKey) bool {
+		e := x.entries[k.ID]
+		if e.Hidden || stock(e) <= 0 {
+			return true
+		}
+		if count >= int64(offset) && len(ids) < limit {
+			ids = append(ids, e.ID)
+		}
+		count++
+		return !cached || len(ids) < limit
+	})
+	if cached {
+		return ids, cachedCount, true, nil
+	}
+
+	x.countMutex.Lock()
+	if x.countGeneration == generation {
+		x.counts[key] = count
+	}
+	x.countMutex.Unlock()
+	return ids, count, true, nil
+}
+
+// levelList 次元dのlevelsのいずれかに一致する行のリスト
+// levelが1つならそのまま返し、複数なら並び順を保ったまま併合する
+func (x *memSearchIndex) levelList(d int, levels []int64) memList {
+	if len(levels) == 1 {
+		return x.buckets[d][levels[0]]
+	}
+	var merged memList
+	for _, l := range levels {
+		merged = mergeMemLists(merged, x.buckets[d][l])
+	}
+	return merged
+}
+
+// mergeMemLists 並び順のリストa, bの和
+func mergeMemLists(a, b memList) memList {
+	res := make(memList, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].before(b[j]) {
+			res = append(res, a[i])
+			i++
+		} else {
+			res = append(res, b[j])
+			j++
+		}
+	}
+	res = append(res, a[i:]...)
+	return append(res, b[j:]...)
+}
+
+// intersectMemLists 並び順のリストの積
+func intersectMemLists(lists []memList) memList {
+	res := memList{}
+	eachMemListIntersection(lists, func(k memKey) bool {
+		res = append(res, k)
+		return true
+	})
+	return res
+}
+
+// eachMemListIntersection 並び順のリストの積を並び順にfnへ渡す fnがfalseを返したら止める
+// 一番短いリストを先頭から読み、他のリストは前回の位置から二分探索で進める
+func eachMemListIntersection(lists []memList, fn func(k memKey) bool) {
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	pos := make([]int, len(lists))
+	for _, k := range lists[0] {
+		found := true
+		for i := 1; i < len(lists); i++ {
+			l := lists[i][pos[i]:]
+			pos[i] += l.search(k)
+			if pos[i] >= len(lists[i]) {
+				return
+			}
+			if lists[i][pos[i]] != k {
+				found = false
+				break
+			}
+		}
+		if found && !fn(k) {
+			return
+		}
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// featureIDs カンマ区切りのfeatureをidの昇順にする
+func featureIDs(features string, featureMap map[string]int) []int {
+	var ids []int
+	seen := map[int]bool{}
+	for _, f := range strings.Split(features, ",") {
+		if id, ok := featureMap[f]; ok && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// loadChairMemEntries idsの椅子を読む idsがnilなら全ての椅子を読む
+func (s *Server) loadChairMemEntries(ids []int64) ([]memEntry, error) {
+	rows, err := s.Chairs.IndexChairs(context.Background(), ids)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]memEntry, len(rows))
+	for i, r := range rows {
+		entries[i] = memEntry{
+			ID:         r.ID,
+			Popularity: r.Popularity,
+			Levels:     [memLevelDims]int64{int64(r.PriceLevel), int64(r.HeightLevel), int64(r.WidthLevel), int64(r.DepthLevel)},
+			Kind:       r.Kind,
+			Color:      r.Color,
+			FeatureIDs: featureIDs(r.Features, currentConditions().ChairFeatures),
+			Stock:      r.Stock,
+			Hidden:     r.Hidden,
+		}
+	}
+	return entries, nil
+}
+
+func (s *Server) loadEstateMemEntries(ids []int64) ([]memEntry, error) {
+	rows, err := s.Estates.IndexEstates(context.Background(), ids)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]memEntry, len(rows))
+	for i, r := range rows {
+		entries[i] = memEntry{
+			ID:         r.ID,
+			Popularity: r.Popularity,
+			// 使わない4つ目の次元は全て同じlevelにしておく
+			Levels:     [memLevelDims]int64{int64(r.RentLevel), int64(r.HeightLevel), int64(r.WidthLevel), 0},
+			FeatureIDs: featureIDs(r.Features, currentConditions().EstateFeatures),
+			Stock:      1,
+		}
+	}
+	return entries, nil
+}
+
+// memChairStock IN_MEMORY_STOCK ならメモリ上の在庫を、そうでなければ読み込んだときの在庫を使う
+func memChairStock(e *memEntry) int64 {
+	if flagInMemoryStock.Enabled() {
+		if stock, ok := currentStock(e.ID); ok {
+			return stock
+		}
+	}
+	return e.Stock
+}
+
+func memEstateStock(e *memEntry) int64 {
+	return e.Stock
+}
+
+// searchChairsInMemory chairMemIndex で検索する 読み込む前ならfalseを返し、DBで検索させる
+func (s *Server) searchChairsInMemory(c echo.Context, q memQuery, page, perPage int) (bool, error) {
+	ids, count, ok, err := chairMemIndex.search(q, page*perPage, perPage, memChairStock)
+	if !ok {
+		return false, nil
+	}
+	if err != nil {
+		c.Logger().Errorf("searchChairs in-memory index error : %v", err)
+		return true, internalError(c)
+	}
+	return true, s.respondChairIDs(c, ids, count)
+}
+
+// respondChairIDs 検索で見つけたidの椅子を、検索結果として返す
+func (s *Server) respondChairIDs(c echo.Context, ids []int64, count int64) error {
+	chairs := getEmptyChairSlice()
+	defer releaseChairSlice(chairs)
+	for _, id := range ids {
+		chair, err := s.getChair(int(id))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return internalError(c)
+		}
+		if flagInMemoryStock.Enabled() {
+			if stock, ok := currentStock(chair.ID); ok {
+				chair.Stock = stock
+			}
+		}
+		chairs = append(chairs, chair)
+	}
+	return JSONOrProtobuf(c, http.StatusOK, &ChairSearchResponse{Count: count, Chairs: chairs})
+}
+
+// searchEstatesInMemory estateMemIndex で検索する 読み込む前ならfalseを返し、DBで検索させる
+func (s *Server) searchEstatesInMemory(c echo.Context, q memQuery, page, perPage int) (bool, error) {
+	ids, count, ok, err := estateMemIndex.search(q, page*perPage, perPage, memEstateStock)
+	if !ok {
+		return false, nil
+	}
+	if err != nil {
+		c.Logger().Errorf("searchEstates in-memory index error : %v", err)
+		return true, internalError(c)
+	}
+	return true, s.respondEstateIDs(c, ids, count)
+}
+
+// respondEstateIDs 検索で見つけたidの物件を、検索結果として返す
+func (s *Server) respondEstateIDs(c echo.Context, ids []int64, count int64) error {
+	estateIDs := getEmptyIntSlice()
+	defer releaseIntSlice(estateIDs)
+	for _, id := range ids {
+		estateIDs = append(estateIDs, int(id))
+	}
+	estates := getEmptyEstateSlice()
+	defer releaseEstateSlice(estates)
+	estates, err := s.getEstatesByIDs(c.Request().Context(), estateIDs, estates)
+	if err != nil {
+		c.Logger().Errorf("searchEstates DB execution error : %v", err)
+		return internalError(c)
+	}
+	return JSONOrProtobuf(c, http.StatusOK, &EstateSearchResponse{Count: count, Estates: estates})
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fakeMemRows memSearchIndex.load の代わりに行を返す
+type fakeMemRows struct {
+	rows map[int64]memEntry
+	err  error
+}
+
+func (f *fakeMemRows) load(ids []int64) ([]memEntry, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var res []memEntry
+	if ids == nil {
+		for _, e := range f.rows {
+			res = append(res, e)
+		}
+		return res, nil
+	}
+	for _, id := range ids {
+		if e, ok := f.rows[id]; ok {
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+func newTestMemIndex(t *testing.T, rows ...memEntry) (*memSearchIndex, *fakeMemRows) {
+	f := &fakeMemRows{rows: map[int64]memEntry{}}
+	for _, e := range rows {
+		f.rows[e.ID] = e
+	}
+	x := &memSearchIndex{load: f.load}
+	if err := x.reload(); err != nil {
+		t.Fatal(err)
+	}
+	return x, f
+}
+
+func entryStock(e *memEntry) int64 {
+	return e.Stock
+}
+
+func TestMemSearchIndexRefresh(t *testing.T) {
+	base := []memEntry{
+		{ID: 1, Popularity: 30, Levels: [memLevelDims]int64{0, 1, 0, 0}, Stock: 1},
+		{ID: 2, Popularity: 20, Levels: [memLevelDims]int64{0, 1, 0, 0}, Stock: 1},
+		{ID: 3, Popularity: 10, Levels: [memLevelDims]int64{1, 1, 0, 0}, Stock: 1},
+	}
+	level0 := memQuery{Levels: [memLevelDims][]int64{{0}}}
+
+	tests := []struct {
+		name   string
+		update func(f *fakeMemRows)
+		stale  []int
+		q      memQuery
+		want   []int64
+	}{
+		{
+			name:   "not marked",
+			update: func(f *fakeMemRows) { f.rows[1] = memEntry{ID: 1, Popularity: 30, Stock: 0} },
+			q:      level0,
+			want:   []int64{1, 2},
+		},
+		{
+			name:   "sold out in place",
+			update: func(f *fakeMemRows) { e := f.rows[1]; e.Stock = 0; f.rows[1] = e },
+			stale:  []int{1},
+			q:      level0,
+			want:   []int64{2},
+		},
+		{
+			name:   "hidden in place",
+			update: func(f *fakeMemRows) { e := f.rows[2]; e.Hidden = true; f.rows[2] = e },
+			stale:  []int{2},
+			q:      level0,
+			want:   []int64{1},
+		},
+		{
+			name:   "popularity reorders",
+			update: func(f *fakeMemRows) { e := f.rows[2]; e.Popularity = 40; f.rows[2] = e },
+			stale:  []int{2},
+			q:      level0,
+			want:   []int64{2, 1},
+		},
+		{
+			name:   "level moves bucket",
+			update: func(f *fakeMemRows) { e := f.rows[3]; e.Levels[0] = 0; f.rows[3] = e },
+			stale:  []int{3},
+			q:      level0,
+			want:   []int64{1, 2, 3},
+		},
+		{
+			name:   "deleted",
+			update: func(f *fakeMemRows) { delete(f.rows, 1) },
+			stale:  []int{1},
+			q:      memQuery{},
+			want:   []int64{2, 3},
+		},
+		{
+			name:   "inserted",
+			update: func(f *fakeMemRows) { f.rows[4] = memEntry{ID: 4, Popularity: 25, Stock: 1} },
+			stale:  []int{4},
+			q:      memQuery{},
+			want:   []int64{1, 4, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, f := newTestMemIndex(t, base...)
+			tt.update(f)
+			x.markStale(tt.stale...)
+
+			ids, count, ok, err := x.search(tt.q, 0, 10, entryStock)
+			if err != nil || !ok {
+				t.Fatalf("search ok = %v, err = %v", ok, err)
+			}
+			if !reflect.DeepEqual(ids, tt.want) || count != int64(len(tt.want)) {
+				t.Errorf("search = %v (count %d), want %v", ids, count, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemSearchIndexRefreshRetriesAfterError(t *testing.T) {
+	x, f := newTestMemIndex(t, memEntry{ID: 1, Popularity: 1, Stock: 1})
+	e := f.rows[1]
+	e.Stock = 0
+	f.rows[1] = e
+	f.err = errors.New("load failed")
+	x.markStale(1)
+
+	if _, _, _, err := x.search(memQuery{}, 0, 10, entryStock); err == nil {
+		t.Fatal("search must return the load error")
+	}
+	f.err = nil
+	ids, _, _, err := x.search(memQuery{}, 0, 10, entryStock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("stale row was not reloaded after the error: %v", ids)
+	}
+}
+
+func TestMemSearchIndexNotLoaded(t *testing.T) {
+	x := &memSearchIndex{load: (&fakeMemRows{}).load}
+	x.markStale(1)
+	if _, _, ok, err := x.search(memQuery{}, 0, 10, entryStock); ok || err != nil {
+		t.Errorf("search before reload: ok = %v, err = %v", ok, err)
+	}
+}
+
+func TestMemSearchIndexPaging(t *testing.T) {
+	var rows []memEntry
+	for i := int64(1); i <= 10; i++ {
+		rows = append(rows, memEntry{ID: i, Popularity: 100 - i, Kind: []string{"a", "b"}[i%2], Stock: 1})
+	}
+	x, _ := newTestMemIndex(t, rows...)
+
+	tests := []struct {
+		name          string
+		q             memQuery
+		offset, limit int
+		want          []int64
+		count         int64
+	}{
+		{"first page", memQuery{}, 0, 3, []int64{1, 2, 3}, 10},
+		{"last page", memQuery{}, 9, 3, []int64{10}, 10},
+		{"past the end", memQuery{}, 10, 3, nil, 10},
+		{"kind", memQuery{Kind: "a"}, 1, 2, []int64{4, 6}, 5},
+		{"empty bucket", memQuery{Levels: [memLevelDims][]int64{{5}}}, 0, 3, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, count, _, err := x.search(tt.q, tt.offset, tt.limit, entryStock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, tt.want) || count != tt.count {
+				t.Errorf("search = %v (count %d), want %v (count %d)", ids, count, tt.want, tt.count)
+			}
+		})
+	}
+}
+
+func TestFeatureIDs(t *testing.T) {
+	featureMap := map[string]int{"a": 0, "b": 1, "c": 2}
+	tests := []struct {
+		features string
+		want     []int
+	}{
+		{"", nil},
+		{"a", []int{0}},
+		{"c,a", []int{0, 2}},
+		{"b,b,a,b", []int{0, 1}},
+		{"a,,c,", []int{0, 2}},
+		{"x,b", []int{1}},
+	}
+	for _, tt := range tests {
+		if got := featureIDs(tt.features, featureMap); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("featureIDs(%q) = %v, want %v", tt.features, got, tt.want)
+		}
+	}
+}
+
+func TestMemSearchIndexFeatures(t *testing.T) {
+	x, f := newTestMemIndex(t,
+		memEntry{ID: 1, Popularity: 40, FeatureIDs: []int{0, 1}, Stock: 1},
+		memEntry{ID: 2, Popularity: 30, FeatureIDs: []int{1}, Stock: 1},
+		memEntry{ID: 3, Popularity: 20, Levels: [memLevelDims]int64{1}, FeatureIDs: []int{0, 1, 2}, Stock: 1},
+		memEntry{ID: 4, Popularity: 10, Stock: 1},
+	)
+
+	tests := []struct {
+		name string
+		q    memQuery
+		want []int64
+	}{
+		{"one feature", memQuery{Features: []int{1}}, []int64{1, 2, 3}},
+		{"all features", memQuery{Features: []int{0, 1}}, []int64{1, 3}},
+		{"no row has all", memQuery{Features: []int{2, 3}}, nil},
+		{"unknown feature", memQuery{Features: []int{-1}}, nil},
+		{"feature and level", memQuery{Levels: [memLevelDims][]int64{{0}}, Features: []int{0}}, []int64{1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, count, _, err := x.search(tt.q, 0, 10, entryStock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, tt.want) || count != int64(len(tt.want)) {
+				t.Errorf("search = %v (count %d), want %v", ids, count, tt.want)
+			}
+		})
+	}
+
+	// featureが変わった行は転置インデックスを入れ直す
+	e := f.rows[2]
+	e.FeatureIDs = []int{2}
+	f.rows[2] = e
+	x.markStale(2)
+	for _, c := range []struct {
+		features []int
+		want     []int64
+	}{{[]int{1}, []int64{1, 3}}, {[]int{2}, []int64{2, 3}}} {
+		ids, _, _, err := x.search(memQuery{Features: c.features}, 0, 10, entryStock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("after refresh features %v = %v, want %v", c.features, ids, c.want)
+		}
+	}
+}
+
+func TestMemSearchIndexKindColor(t *testing.T) {
+	x, f := newTestMemIndex(t,
+		memEntry{ID: 1, Popularity: 30, Kind: "座椅子", Color: "黒", Stock: 1},
+		memEntry{ID: 2, Popularity: 20, Kind: "座椅子", Color: "白", Stock: 1},
+		memEntry{ID: 3, Popularity: 10, Kind: "ソファー", Color: "黒", Stock: 1},
+	)
+
+	search := func(q memQuery) []int64 {
+		ids, _, _, err := x.search(q, 0, 10, entryStock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	if got := search(memQuery{Kind: "座椅子", Color: "黒"}); !reflect.DeepEqual(got, []int64{1}) {
+		t.Errorf("kind and color = %v, want [1]", got)
+	}
+	if got := search(memQuery{Color: "赤"}); got != nil {
+		t.Errorf("unknown color = %v, want none", got)
+	}
+
+	// 色が変わった行はリストを入れ直す
+	e := f.rows[2]
+	e.Color = "黒"
+	f.rows[2] = e
+	x.markStale(2)
+	if got := search(memQuery{Color: "黒"}); !reflect.DeepEqual(got, []int64{1, 2, 3}) {
+		t.Errorf("after refresh color = %v, want [1 2 3]", got)
+	}
+	if got := search(memQuery{Color: "白"}); got != nil {
+		t.Errorf("after refresh old color = %v, want none", got)
+	}
+}
+
+// 2回目からは件数を数え直さず、ページの分だけ読んで止める
+func TestMemSearchIndexCountCache(t *testing.T) {
+	var rows []memEntry
+	for i := int64(1); i <= 100; i++ {
+		rows = append(rows, memEntry{ID: i, Popularity: 1000 - i, Stock: 1})
+	}
+	x, f := newTestMemIndex(t, rows...)
+
+	read := 0
+	countingStock := func(e *memEntry) int64 {
+		read++
+		return e.Stock
+	}
+	search := func() ([]int64, int64) {
+		read = 0
+		ids, count, _, err := x.search(memQuery{}, 10, 5, countingStock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids, count
+	}
+
+	if ids, count := search(); count != 100 || !reflect.DeepEqual(ids, []int64{11, 12, 13, 14, 15}) || read != 100 {
+		t.Errorf("first search = %v (count %d, read %d)", ids, count, read)
+	}
+	if ids, count := search(); count != 100 || !reflect.DeepEqual(ids, []int64{11, 12, 13, 14, 15}) || read != 15 {
+		t.Errorf("cached search = %v (count %d, read %d), want 15 rows read", ids, count, read)
+	}
+
+	// 印が付いたら数え直す
+	e := f.rows[1]
+	e.Stock = 0
+	f.rows[1] = e
+	x.markStale(1)
+	if ids, count := search(); count != 99 || !reflect.DeepEqual(ids, []int64{12, 13, 14, 15, 16}) {
+		t.Errorf("after markStale = %v (count %d), want count 99", ids, count)
+	}
+}
+
+// keys 人気度を id の逆順にしたキーを並び順に作る
+func keys(ids ...int64) memList {
+	l := make(memList, len(ids))
+	for i, id := range ids {
+		l[i] = memKey{Popularity: 100 - id, ID: id}
+	}
+	return l
+}
+
+func TestMergeMemLists(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b memList
+		want memList
+	}{
+		{"both empty", nil, nil, memList{}},
+		{"a empty", nil, keys(1, 2), keys(1, 2)},
+		{"b empty", keys(1, 2), nil, keys(1, 2)},
+		{"interleaved", keys(1, 3, 5), keys(2, 4, 6), keys(1, 2, 3, 4, 5, 6)},
+		{"a before b", keys(1, 2), keys(3, 4), keys(1, 2, 3, 4)},
+		{"b before a", keys(3, 4), keys(1, 2), keys(1, 2, 3, 4)},
+		{"same popularity by id", memList{{5, 2}}, memList{{5, 1}, {5, 3}}, memList{{5, 1}, {5, 2}, {5, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeMemLists(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeMemLists = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntersectMemLists(t *testing.T) {
+	tests := []struct {
+		name  string
+		lists []memList
+		want  memList
+	}{
+		{"single", []memList{keys(1, 2)}, keys(1, 2)},
+		{"same", []memList{keys(1, 2, 3), keys(1, 2, 3)}, keys(1, 2, 3)},
+		{"disjoint", []memList{keys(1, 3), keys(2, 4)}, memList{}},
+		{"one empty", []memList{keys(1, 2), {}}, memList{}},
+		{"subset", []memList{keys(1, 2, 3, 4, 5), keys(2, 4)}, keys(2, 4)},
+		{"three lists", []memList{keys(1, 2, 3, 4, 5, 6), keys(2, 3, 5, 6), keys(1, 3, 6)}, keys(3, 6)},
+		{"shorter list runs out", []memList{keys(1, 2, 9), keys(2, 3)}, keys(2)},
+		{"last element", []memList{keys(1, 2, 9), keys(9)}, keys(9)},
+		{"same popularity by id", []memList{{{5, 1}, {5, 2}, {5, 3}}, {{5, 2}, {5, 3}}}, memList{{5, 2}, {5, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := intersectMemLists(tt.lists); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("intersectMemLists = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestIntersectMemListsMatchesSets 部分集合の組み合わせで、集合の積と和に一致するかを確かめる
+func TestIntersectMemListsMatchesSets(t *testing.T) {
+	const n = 8
+	subset := func(mask int) memList {
+		var ids []int64
+		for i := 0; i < n; i++ {
+			if mask&(1<<i) != 0 {
+				ids = append(ids, int64(i))
+			}
+		}
+		return keys(ids...)
+	}
+	for a := 0; a < 1<<n; a += 7 {
+		for b := 0; b < 1<<n; b += 5 {
+			for _, c := range []int{a | b, 0xff, 0x55} {
+				got := intersectMemLists([]memList{subset(a), subset(b), subset(c)})
+				want := subset(a & b & c)
+				if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+					t.Fatalf("intersect %08b %08b %08b = %v, want %v", a, b, c, got, want)
+				}
+			}
+			if a|b != 0 {
+				if got, want := mergeMemLists(subset(a&^b), subset(b)), subset(a|b); !reflect.DeepEqual(got, want) {
+					t.Fatalf("merge %08b %08b = %v, want %v", a&^b, b, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// STORAGE=memory にすると、MySQLに接続せずに MEMORY_CHAIRS_CSV, MEMORY_ESTATES_CSV を読み込んだメモリ上のリポジトリを使う
+// CSVは POST /api/chair, /api/estate と同じ形式なので、SQLファイルを流し込まずに手元で検索や購入を試せる
+// 検索は IN_MEMORY_SEARCH のインデックスで答えるので、人気順でlevelとfeatureとkind/colorだけの条件に限る
+// それ以外の検索と、Route.MySQLOnly のエンドポイントは 501 を返す
+// 書き込んだ内容は再起動や /initialize でCSVの内容に戻る
+var storageMode = getEnv("STORAGE", "mysql")
+
+// mysqlOnlyFlags MySQLを読み書きする最適化 STORAGE=memory では切る
+var mysqlOnlyFlags = []*featureFlag{
+	flagInMemoryStock, flagInMemoryNazotte, flagCellCoverNazotte, flagSpatialNazotte,
+	flagElasticsearch, flagEstateSearchTable, flagChairSearchWindowCount,
+	flagPrecomputeRecommended, flagLoadDataImport, flagMigrateOnStart, flagWarmup,
+}
+
+// useMemoryStorageFlags STORAGE=memory で使えるようにフラグを切り替える
+func useMemoryStorageFlags() {
+	for _, f := range mysqlOnlyFlags {
+		f.Set(false)
+	}
+	flagInMemorySearch.Set(true)
+}
+
+// mysqlOnlyMiddleware Route.MySQLOnly のルートで、DBを持たない Server なら 501 を返す
+func mysqlOnlyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if srv.DB == nil {
+			return notImplemented(c, "not available with STORAGE=memory")
+		}
+		return next(c)
+	}
+}
+
+// memChairRepository, memEstateRepository 読み込んだ行を id で引くmap
+type memChairRepository struct {
+	mutex  sync.RWMutex
+	chairs map[int]Chair
+}
+
+func (r *memChairRepository) ChairByID(ctx context.Context, id int) (Chair, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	chair, ok := r.chairs[id]
+	if !ok {
+		return Chair{}, sql.ErrNoRows
+	}
+	return chair, nil
+}
+
+func (r *memChairRepository) IndexChairs(ctx context.Context, ids []int64) ([]Chair, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if ids == nil {
+		rows := make([]Chair, 0, len(r.chairs))
+		for _, chair := range r.chairs {
+			rows = append(rows, chair)
+		}
+		return rows, nil
+	}
+	rows := make([]Chair, 0, len(ids))
+	for _, id := range ids {
+		if chair, ok := r.chairs[int(id)]; ok {
+			rows = append(rows, chair)
+		}
+	}
+	return rows, nil
+}
+
+func (r *memChairRepository) BuyChair(ctx context.Context, id int) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	chair, ok := r.chairs[id]
+	if !ok || chair.Stock <= 0 || chair.Hidden {
+		return 0, sql.ErrNoRows
+	}
+	chair.Stock--
+	r.chairs[id] = chair
+	return chair.Stock, nil
+}
+
+func (r *memChairRepository) BuyChairs(ctx context.Context, ids []int64, quantities map[int64]int64) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, id := range ids {
+		chair, ok := r.chairs[int(id)]
+		if !ok || chair.Hidden {
+			return false, errChairNotFound
+		}
+		if chair.Stock < quantities[id] {
+			return false, errOutOfStock
+		}
+	}
+	soldOut := false
+	for _, id := range ids {
+		chair := r.chairs[int(id)]
+		chair.Stock -= quantities[id]
+		soldOut = soldOut || chair.Stock == 0
+		r.chairs[int(id)] = chair
+	}
+	return soldOut, nil
+}
+
+func (r *memChairRepository) RestockChair(ctx context.Context, id int, fn func(stock int64) int64) (before, after int64, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	chair, ok := r.chairs[id]
+	if !ok {
+		return 0, 0, sql.ErrNoRows
+	}
+	before = chair.Stock
+	after = fn(before)
+	if after < 0 {
+		return before, after, errNegativeStock
+	}
+	chair.Stock = after
+	r.chairs[id] = chair
+	return before, after, nil
+}
+
+// addStock 取り置きを解放したときに在庫を戻す
+func (r *memChairRepository) addStock(id int64, n int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if chair, ok := r.chairs[int(id)]; ok {
+		chair.Stock += n
+		r.chairs[int(id)] = chair
+	}
+}
+
+func (r *memChairRepository) SetChairHidden(ctx context.Context, id int, hidden bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	chair, ok := r.chairs[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	chair.Hidden = hidden
+	r.chairs[id] = chair
+	return nil
+}
+
+// ImportChairs 全ての行を読めてから書き込むので、CSVに誤りがあれば何も変えない
+func (r *memChairRepository) ImportChairs(ctx context.Context, open func() (*csv.Reader, io.Closer, error), cr *csv.Reader, f io.Closer, columns []csvColumn) (*chairImport, error) {
+	defer f.Close()
+
+	cond := currentConditions()
+	res := &chairImport{minPrice: -1, recommendKeys: map[int][2]int64{}}
+	var chairs []Chair
+	err := readCSVRows(cr, columns, func(rm *RecordMapper) error {
+		chair := chairFromRecord(rm, cond)
+		if err := rm.Err(); err != nil {
+			return &csvInputError{message: "invalid csv record", err: err}
+		}
+		chairs = append(chairs, chair)
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, chair := range chairs {
+		id := int(chair.ID)
+		if _, ok := r.chairs[id]; ok {
+			res.updated++
+		}
+		r.chairs[id] = chair
+
+		res.ids = append(res.ids, id)
+		res.stocks = append(res.stocks, int(chair.Stock))
+		x, y := smallestTwo(chair.Width, chair.Height, chair.Depth)
+		res.recommendKeys[id] = [2]int64{x, y}
+		if res.minPrice == -1 || chair.Price < res.minPrice {
+			res.minPrice = chair.Price
+		}
+	}
+	return res, nil
+}
+
+func (r *memChairRepository) LowPricedChairs(ctx context.Context, limit int) ([]Chair, error) {
+	r.mutex.RLock()
+	chairs := make([]Chair, 0, len(r.chairs))
+	for _, chair := range r.chairs {
+		if chair.Stock > 0 && !chair.Hidden {
+			chairs = append(chairs, chair)
+		}
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(chairs, func(i, j int) bool {
+		if chairs[i].Price != chairs[j].Price {
+			return chairs[i].Price < chairs[j].Price
+		}
+		return chairs[i].ID < chairs[j].ID
+	})
+	if len(chairs) > limit {
+		chairs = chairs[:limit]
+	}
+	return chairs, nil
+}
+
+// replace initialize でCSVの内容に戻す
+func (r *memChairRepository) replace(chairs map[int]Chair) {
+	r.mutex.Lock()
+	r.chairs = chairs
+	r.mutex.Unlock()
+}
+
+type memEstateRepository struct {
+	mutex   sync.RWMutex
+	estates map[int]Estate
+}
+
+func (r *memEstateRepository) EstateByID(ctx context.Context, id int) (Estate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	estate, ok := r.estates[id]
+	if !ok {
+		return Estate{}, sql.ErrNoRows
+	}
+	return estate, nil
+}
+
+func (r *memEstateRepository) EstatesByIDs(ctx context.Context, ids []int, dst []Estate) ([]Estate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, id := range ids {
+		if estate, ok := r.estates[id]; ok {
+			dst = append(dst, estate)
+		}
+	}
+	return dst, nil
+}
+
+func (r *memEstateRepository) IndexEstates(ctx context.Context, ids []int64) ([]Estate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if ids == nil {
+		rows := make([]Estate, 0, len(r.estates))
+		for _, estate := range r.estates {
+			rows = append(rows, estate)
+		}
+		return rows, nil
+	}
+	rows := make([]Estate, 0, len(ids))
+	for _, id := range ids {
+		if estate, ok := r.estates[int(id)]; ok {
+			rows = append(rows, estate)
+		}
+	}
+	return rows, nil
+}
+
+// ImportEstates ImportChairs と同じく、CSVに誤りがあれば何も変えない
+func (r *memEstateRepository) ImportEstates(ctx context.Context, open func() (*csv.Reader, io.Closer, error), cr *csv.Reader, f io.Closer, columns []csvColumn) (*estateImport, error) {
+	defer f.Close()
+
+	cond := currentConditions()
+	res := &estateImport{minRent: -1}
+	var estates []Estate
+	err := readCSVRows(cr, columns, func(rm *RecordMapper) error {
+		estate := estateFromRecord(rm, cond)
+		if err := rm.Err(); err != nil {
+			return &csvInputError{message: "invalid csv record", err: err}
+		}
+		estates = append(estates, estate)
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, estate := range estates {
+		id := int(estate.ID)
+		if _, ok := r.estates[id]; ok {
+			res.updated++
+		}
+		r.estates[id] = estate
+
+		res.ids = append(res.ids, id)
+		res.points = append(res.points, estatePoint{ID: estate.ID, Latitude: estate.Latitude, Longitude: estate.Longitude, Popularity: estate.Popularity})
+		if res.minRent == -1 || estate.Rent < res.minRent {
+			res.minRent = estate.Rent
+		}
+	}
+	return res, nil
+}
+
+func (r *memEstateRepository) LowPricedEstates(ctx context.Context, limit int) ([]Estate, error) {
+	estates := r.filter(func(e *Estate) bool { return true })
+	sort.Slice(estates, func(i, j int) bool {
+		if estates[i].Rent != estates[j].Rent {
+			return estates[i].Rent < estates[j].Rent
+		}
+		return estates[i].ID < estates[j].ID
+	})
+	if len(estates) > limit {
+		estates = estates[:limit]
+	}
+	return estates, nil
+}
+
+func (r *memEstateRepository) EstatesForChair(ctx context.Context, chair Chair, limit int, dst []Estate) ([]Estate, error) {
+	estates := r.filter(func(e *Estate) bool {
+		return fitsThroughDoor(chair.Width, chair.Height, chair.Depth, e.DoorWidth, e.DoorHeight)
+	})
+	sort.Slice(estates, func(i, j int) bool {
+		if estates[i].Popularity != estates[j].Popularity {
+			return estates[i].Popularity > estates[j].Popularity
+		}
+		return estates[i].ID < estates[j].ID
+	})
+	if len(estates) > limit {
+		estates = estates[:limit]
+	}
+	return append(dst, estates...), nil
+}
+
+func (r *memEstateRepository) EstatesInBoundingBox(ctx context.Context, b BoundingBox, dst []Estate) ([]Estate, error) {
+	estates := r.filter(func(e *Estate) bool {
+		return e.Latitude <= b.BottomRightCorner.Latitude && e.Latitude >= b.TopLeftCorner.Latitude &&
+			e.Longitude <= b.BottomRightCorner.Longitude && e.Longitude >= b.TopLeftCorner.Longitude
+	})
+	for _, e := range estates {
+		dst = append(dst, Estate{ID: e.ID, Latitude: e.Latitude, Longitude: e.Longitude})
+	}
+	return dst, nil
+}
+
+// filter fnがtrueを返す物件を順不同で返す
+func (r *memEstateRepository) filter(fn func(e *Estate) bool) []Estate {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var estates []Estate
+	for _, estate := range r.estates {
+		if fn(&estate) {
+			estates = append(estates, estate)
+		}
+	}
+	return estates
+}
+
+func (r *memEstateRepository) replace(estates map[int]Estate) {
+	r.mutex.Lock()
+	r.estates = estates
+	r.mutex.Unlock()
+}
+
+// memReservation 取り置きの1件
+type memReservation struct {
+	chairID   int64
+	email     string
+	token     string
+	status    string
+	expiresAt time.Time
+}
+
+// memReservationRepository 取り置きを持ち、在庫は chairs を書き換える
+type memReservationRepository struct {
+	chairs *memChairRepository
+
+	mutex        sync.Mutex
+	reservations map[int64]*memReservation
+	lastID       int64
+}
+
+func (r *memReservationRepository) Reserve(ctx context.Context, chairID int, email, token string, minutes int) (id, stock int64, err error) {
+	after, err := r.chairs.BuyChair(ctx, chairID)
+	if err != nil {
+		return 0, 0, err
+	}
+	id, err = r.Insert(ctx, chairID, email, token, minutes)
+	return id, after + 1, err
+}
+
+func (r *memReservationRepository) Insert(ctx context.Context, chairID int, email, token string, minutes int) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lastID++
+	r.reservations[r.lastID] = &memReservation{
+		chairID:   int64(chairID),
+		email:     email,
+		token:     token,
+		status:    reservationActive,
+		expiresAt: time.Now().Add(time.Duration(minutes) * time.Minute),
+	}
+	return r.lastID, nil
+}
+
+func (r *memReservationRepository) Confirm(ctx context.Context, id int64, token string) (chairID int64, email string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res, ok := r.reservations[id]
+	if !ok || res.token != token || res.status != reservationActive || time.Now().After(res.expiresAt) {
+		return 0, "", sql.ErrNoRows
+	}
+	res.status = reservationConfirmed
+	return res.chairID, res.email, nil
+}
+
+func (r *memReservationRepository) Owned(ctx context.Context, id int64, token string) (bool, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res, ok := r.reservations[id]
+	return ok && res.token == token, nil
+}
+
+func (r *memReservationRepository) Release(ctx context.Context, ids []int64, status string, restock bool) ([]int64, error) {
+	sorted := append([]int64(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	r.mutex.Lock()
+	var chairIDs []int64
+	for _, id := range sorted {
+		res, ok := r.reservations[id]
+		if !ok || res.status != reservationActive {
+			continue
+		}
+		res.status = status
+		chairIDs = append(chairIDs, res.chairID)
+	}
+	r.mutex.Unlock()
+
+	if restock {
+		for chairID, n := range countIDs(chairIDs) {
+			r.chairs.addStock(chairID, n)
+		}
+	}
+	return chairIDs, nil
+}
+
+func (r *memReservationRepository) Expired(ctx context.Context) ([]int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	var ids []int64
+	for id, res := range r.reservations {
+		if res.status == reservationActive && now.After(res.expiresAt) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r *memReservationRepository) reset() {
+	r.mutex.Lock()
+	r.reservations = map[int64]*memReservation{}
+	r.lastID = 0
+	r.mutex.Unlock()
+}
+
+// NewMemoryServer chairsPath, estatesPath のCSVを読み込んだリポジトリを使う Server を作る
+// パスが空ならそのリポジトリは空になる DB はnil
+func NewMemoryServer(chairsPath, estatesPath string) (*Server, error) {
+	chairs, estates, err := readMemoryCSV(chairsPath, estatesPath)
+	if err != nil {
+		return nil, err
+	}
+	chairRepo := &memChairRepository{chairs: chairs}
+	return &Server{
+		Chairs:       chairRepo,
+		Estates:      &memEstateRepository{estates: estates},
+		Reservations: &memReservationRepository{chairs: chairRepo, reservations: map[int64]*memReservation{}},
+	}, nil
+}
+
+// resetMemoryStorage initialize でCSVを読み込み直し、取り置きを消す
+func (s *Server) resetMemoryStorage(chairsPath, estatesPath string) error {
+	chairs, estates, err := readMemoryCSV(chairsPath, estatesPath)
+	if err != nil {
+		return err
+	}
+	s.Chairs.(*memChairRepository).replace(chairs)
+	s.Estates.(*memEstateRepository).replace(estates)
+	s.Reservations.(*memReservationRepository).reset()
+	return nil
+}
+
+func readMemoryCSV(chairsPath, estatesPath string) (map[int]Chair, map[int]Estate, error) {
+	cond := currentConditions()
+	chairs := map[int]Chair{}
+	err := readCSVFile(chairsPath, chairCSVColumns(), func(rm *RecordMapper) {
+		chair := chairFromRecord(rm, cond)
+		chairs[int(chair.ID)] = chair
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", chairsPath, err)
+	}
+
+	estates := map[int]Estate{}
+	err = readCSVFile(estatesPath, estateCSVColumns(), func(rm *RecordMapper) {
+		estate := estateFromRecord(rm, cond)
+		estates[int(estate.ID)] = estate
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", estatesPath, err)
+	}
+	return chairs, estates, nil
+}
+
+// chairFromRecord CSVの1行を椅子にする 生成列とlevelも埋める
+func chairFromRecord(rm *RecordMapper, cond *searchConditions) Chair {
+	chair := Chair{
+		ID:          int64(rm.NextInt()),
+		Name:        rm.NextString(),
+		Description: rm.NextString(),
+		Thumbnail:   rm.NextString(),
+		Price:       int64(rm.NextInt()),
+		Height:      int64(rm.NextInt()),
+		Width:       int64(rm.NextInt()),
+		Depth:       int64(rm.NextInt()),
+		Color:       rm.NextString(),
+		Features:    rm.NextString(),
+		Kind:        rm.NextString(),
+		Popularity:  int64(rm.NextInt()),
+		Stock:       int64(rm.NextInt()),
+	}
+	chair.WidthLevel = cond.Chair.Width.level(chair.Width)
+	chair.HeightLevel = cond.Chair.Height.level(chair.Height)
+	chair.DepthLevel = cond.Chair.Depth.level(chair.Depth)
+	chair.PriceLevel = cond.Chair.Price.level(chair.Price)
+	chair.LenMin, chair.LenMid = smallestTwo(chair.Width, chair.Height, chair.Depth)
+	return chair
+}
+
+// estateFromRecord CSVの1行を物件にする 生成列とlevelも埋める
+func estateFromRecord(rm *RecordMapper, cond *searchConditions) Estate {
+	estate := Estate{
+		ID:          int64(rm.NextInt()),
+		Name:        rm.NextString(),
+		Description: rm.NextString(),
+		Thumbnail:   rm.NextString(),
+		Address:     rm.NextString(),
+		Latitude:    rm.NextFloat(),
+		Longitude:   rm.NextFloat(),
+		Rent:        int64(rm.NextInt()),
+		DoorHeight:  int64(rm.NextInt()),
+		DoorWidth:   int64(rm.NextInt()),
+		Features:    rm.NextString(),
+		Popularity:  int64(rm.NextInt()),
+	}
+	estate.RentLevel = cond.Estate.Rent.level(estate.Rent)
+	estate.HeightLevel = cond.Estate.DoorHeight.level(estate.DoorHeight)
+	estate.WidthLevel = cond.Estate.DoorWidth.level(estate.DoorWidth)
+	estate.Prefecture = prefectureOf(estate.Address)
+	estate.NegPopularity = -estate.Popularity
+	estate.Geohash = geohashEncode(estate.Latitude, estate.Longitude, geohashPrecision)
+	estate.CellID = cellID(estate.Latitude, estate.Longitude)
+	estate.DoorMin, estate.DoorMax = estate.DoorWidth, estate.DoorHeight
+	if estate.DoorMin > estate.DoorMax {
+		estate.DoorMin, estate.DoorMax = estate.DoorMax, estate.DoorMin
+	}
+	return estate
+}
+
+// readCSVFile pathのCSVを1行ずつfnに渡す ヘッダ行があればカラム名で並べ替える
+func readCSVFile(path string, columns []csvColumn, fn func(rm *RecordMapper)) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = len(columns)
+	line := 0
+	return readCSVRows(r, columns, func(rm *RecordMapper) error {
+		line++
+		fn(rm)
+		if err := rm.Err(); err != nil {
+			return fmt.Errorf("record %d: %w", line, err)
+		}
+		return nil
+	})
+}
+
+// readCSVRows rの行を1行ずつfnに渡す ヘッダ行の誤りは csvInputError で返す
+func readCSVRows(r *csv.Reader, columns []csvColumn, fn func(rm *RecordMapper) error) error {
+	rows := newCSVRows(r, columns)
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if _, ok := err.(*csvHeaderError); ok {
+			return &csvInputError{message: "invalid csv", err: err}
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(&RecordMapper{Record: row}); err != nil {
+			return err
+		}
+	}
+}
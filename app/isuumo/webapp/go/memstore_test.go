@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+func writeTestCSV(t *testing.T, name, body string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNewMemoryServer(t *testing.T) {
+	if err := loadConditions(); err != nil {
+		t.Fatal(err)
+	}
+	chairs := writeTestCSV(t, "chairs.csv",
+		"id,name,description,thumbnail,price,height,width,depth,color,features,kind,popularity,stock\n"+
+			"1,椅子1,説明,/images/chair/1.png,5000,90,60,50,黒,ヘッドレスト付き,ゲーミングチェア,100,3\n"+
+			"2,椅子2,説明,/images/chair/2.png,20000,120,100,70,白,,座椅子,50,0\n")
+	// ヘッダなしでも読める
+	estates := writeTestCSV(t, "estates.csv",
+		"10,物件10,説明,/images/estate/10.png,東京都千代田区,35.68,139.76,60000,200,100,最上階,300\n"+
+			"11,物件11,説明,/images/estate/11.png,大阪府大阪市,34.69,135.50,120000,180,90,,200\n")
+
+	s, err := NewMemoryServer(chairs, estates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	chairTests := []struct {
+		id    int
+		err   error
+		price int64
+		stock int64
+	}{
+		{1, nil, 5000, 3},
+		{2, nil, 20000, 0},
+		{3, sql.ErrNoRows, 0, 0},
+	}
+	for _, tt := range chairTests {
+		chair, err := s.Chairs.ChairByID(ctx, tt.id)
+		if err != tt.err {
+			t.Errorf("ChairByID(%d) err = %v, want %v", tt.id, err, tt.err)
+			continue
+		}
+		if chair.Price != tt.price || chair.Stock != tt.stock {
+			t.Errorf("ChairByID(%d) = price %d stock %d, want %d %d", tt.id, chair.Price, chair.Stock, tt.price, tt.stock)
+		}
+	}
+	if chair, _ := s.Chairs.ChairByID(ctx, 1); chair.PriceLevel != currentConditions().Chair.Price.level(5000) {
+		t.Errorf("PriceLevel = %d, want %d", chair.PriceLevel, currentConditions().Chair.Price.level(5000))
+	}
+
+	estate, err := s.Estates.EstateByID(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estate.Rent != 60000 || estate.Features != "最上階" || estate.Prefecture != prefectureOf("東京都千代田区") {
+		t.Errorf("EstateByID(10) = %+v", estate)
+	}
+	if _, err := s.Estates.EstateByID(ctx, 12); err != sql.ErrNoRows {
+		t.Errorf("EstateByID(12) err = %v, want sql.ErrNoRows", err)
+	}
+
+	got, err := s.Estates.EstatesByIDs(ctx, []int{11, 12, 10}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, e := range got {
+		ids = append(ids, int(e.ID))
+	}
+	sort.Ints(ids)
+	if len(ids) != 2 || ids[0] != 10 || ids[1] != 11 {
+		t.Errorf("EstatesByIDs = %v, want [10 11]", ids)
+	}
+}
+
+func TestNewMemoryServerBadCSV(t *testing.T) {
+	path := writeTestCSV(t, "chairs.csv", "1,椅子1,説明,/images/chair/1.png,高い,90,60,50,黒,,座椅子,100,3\n")
+	if _, err := NewMemoryServer(path, ""); err == nil {
+		t.Error("NewMemoryServer accepted a non-integer price")
+	}
+}
+
+// 詳細ページはMySQLなしで返せる
+func TestMemoryServerDetail(t *testing.T) {
+	estates := writeTestCSV(t, "estates.csv",
+		"20,物件20,説明,/images/estate/20.png,東京都千代田区,35.68,139.76,60000,200,100,,300\n")
+	s, err := NewMemoryServer("", estates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cachedEstates.Purge()
+
+	for _, tt := range []struct {
+		id     string
+		status int
+	}{
+		{"20", http.StatusOK},
+		{"21", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/estate/"+tt.id, nil), rec)
+		c.SetParamNames("id")
+		c.SetParamValues(tt.id)
+		if err := s.getEstateDetail(c); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tt.status {
+			t.Errorf("GET /api/estate/%s = %d, want %d", tt.id, rec.Code, tt.status)
+		}
+	}
+}
+
+const memTestChairsCSV = "id,name,description,thumbnail,price,height,width,depth,color,features,kind,popularity,stock\n" +
+	"1,椅子1,説明,/images/chair/1.png,5000,90,60,50,黒,,座椅子,100,3\n" +
+	"2,椅子2,説明,/images/chair/2.png,3000,90,60,50,黒,,座椅子,200,0\n" +
+	"3,椅子3,説明,/images/chair/3.png,4000,90,60,50,白,,座椅子,50,1\n"
+
+// 購入と取り置きはMySQLなしでメモリ上の在庫を減らし、解放すると戻す
+func TestMemoryServerBuyAndReserve(t *testing.T) {
+	if err := loadConditions(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewMemoryServer(writeTestCSV(t, "chairs.csv", memTestChairsCSV), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if stock, err := s.Chairs.BuyChair(ctx, 1); err != nil || stock != 2 {
+		t.Fatalf("BuyChair(1) = %d, %v, want 2", stock, err)
+	}
+	if _, err := s.Chairs.BuyChair(ctx, 2); err != sql.ErrNoRows {
+		t.Errorf("BuyChair(2) err = %v, want sql.ErrNoRows", err)
+	}
+	if _, err := s.Chairs.BuyChairs(ctx, []int64{1, 3}, map[int64]int64{1: 1, 3: 2}); err != errOutOfStock {
+		t.Errorf("BuyChairs err = %v, want errOutOfStock", err)
+	}
+	if chair, _ := s.Chairs.ChairByID(ctx, 1); chair.Stock != 2 {
+		t.Errorf("stock after a failed BuyChairs = %d, want 2", chair.Stock)
+	}
+
+	id, stock, err := s.Reservations.Reserve(ctx, 3, "a@example.com", "token", 10)
+	if err != nil || stock != 1 {
+		t.Fatalf("Reserve(3) = %d, %d, %v", id, stock, err)
+	}
+	if _, _, err := s.Reservations.Reserve(ctx, 3, "b@example.com", "other", 10); err != sql.ErrNoRows {
+		t.Errorf("Reserve on a sold out chair err = %v, want sql.ErrNoRows", err)
+	}
+	if _, _, err := s.Reservations.Confirm(ctx, id, "wrong"); err != sql.ErrNoRows {
+		t.Errorf("Confirm with a wrong token err = %v, want sql.ErrNoRows", err)
+	}
+	released, err := s.Reservations.Release(ctx, []int64{id}, reservationCancelled, true)
+	if err != nil || len(released) != 1 || released[0] != 3 {
+		t.Fatalf("Release = %v, %v, want [3]", released, err)
+	}
+	if chair, _ := s.Chairs.ChairByID(ctx, 3); chair.Stock != 1 {
+		t.Errorf("stock after Release = %d, want 1", chair.Stock)
+	}
+	if _, _, err := s.Reservations.Confirm(ctx, id, "token"); err != sql.ErrNoRows {
+		t.Errorf("Confirm after Release err = %v, want sql.ErrNoRows", err)
+	}
+
+	low, err := s.Chairs.LowPricedChairs(ctx, 1)
+	if err != nil || len(low) != 1 || low[0].ID != 3 {
+		t.Errorf("LowPricedChairs = %v, %v, want chair 3", low, err)
+	}
+}
+
+// CSVに誤りがあれば1行も書き込まない
+func TestMemoryServerImportChairs(t *testing.T) {
+	if err := loadConditions(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewMemoryServer(writeTestCSV(t, "chairs.csv", memTestChairsCSV), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	columns := chairCSVColumns()
+	importCSV := func(body string) (*chairImport, error) {
+		r := csv.NewReader(strings.NewReader(body))
+		return s.Chairs.ImportChairs(ctx, nil, r, ioutil.NopCloser(nil), columns)
+	}
+
+	_, err = importCSV("4,椅子4,説明,/images/chair/4.png,1000,90,60,50,黒,,座椅子,10,1\n" +
+		"5,椅子5,説明,/images/chair/5.png,高い,90,60,50,黒,,座椅子,10,1\n")
+	if _, ok := err.(*csvInputError); !ok {
+		t.Fatalf("ImportChairs err = %v, want csvInputError", err)
+	}
+	if _, err := s.Chairs.ChairByID(ctx, 4); err != sql.ErrNoRows {
+		t.Errorf("ChairByID(4) after a failed import err = %v, want sql.ErrNoRows", err)
+	}
+
+	res, err := importCSV("1,椅子1,説明,/images/chair/1.png,800,90,60,50,黒,,座椅子,100,3\n" +
+		"4,椅子4,説明,/images/chair/4.png,1000,90,60,50,黒,,座椅子,10,1\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.updated != 1 || len(res.ids) != 2 || res.minPrice != 800 {
+		t.Errorf("ImportChairs = %+v, want 1 updated of 2 with minPrice 800", res)
+	}
+	if chair, _ := s.Chairs.ChairByID(ctx, 1); chair.Price != 800 {
+		t.Errorf("price of the overwritten chair = %d, want 800", chair.Price)
+	}
+}
+
+// 人気順の検索はメモリ上のインデックスで答え、答えられない検索は 501 を返す
+func TestMemoryServerSearch(t *testing.T) {
+	if err := loadConditions(); err != nil {
+		t.Fatal(err)
+	}
+	defer flagInMemorySearch.Set(flagInMemorySearch.Enabled())
+	defer func(old *Server) { srv = old }(srv)
+	defer cachedChairs.Purge()
+	defer cachedEstates.Purge()
+
+	var err error
+	srv, err = NewMemoryServer(writeTestCSV(t, "chairs.csv", memTestChairsCSV),
+		writeTestCSV(t, "estates.csv", "10,物件10,説明,/images/estate/10.png,東京都千代田区,35.68,139.76,60000,200,100,,300\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flagInMemorySearch.Set(true)
+	if err := loadMemSearchIndexes(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		count  string
+	}{
+		{"chair kind", "/api/chair/search?kind=座椅子&page=0&perPage=10", http.StatusOK, `"count":2`},
+		{"estate rent", "/api/estate/search?rentRangeId=1&page=0&perPage=10", http.StatusOK, `"count":1`},
+		{"estate area", "/api/estate/search?area=東京都&page=0&perPage=10", http.StatusNotImplemented, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, tt.path, nil), rec)
+			h := srv.searchChairs
+			if strings.HasPrefix(tt.path, "/api/estate") {
+				h = srv.searchEstates
+			}
+			if err := h(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.count) {
+				t.Errorf("GET %s = %d %s, want %d %s", tt.path, rec.Code, rec.Body.String(), tt.status, tt.count)
+			}
+		})
+	}
+}
+
+func TestMySQLOnlyMiddleware(t *testing.T) {
+	defer func(old *Server) { srv = old }(srv)
+	h := mysqlOnlyMiddleware(func(c echo.Context) error { return c.NoContent(http.StatusOK) })
+
+	for _, tt := range []struct {
+		name   string
+		server *Server
+		status int
+	}{
+		{"memory", &Server{}, http.StatusNotImplemented},
+		{"mysql", NewServer(sqlx.NewDb(nil, "mysql")), http.StatusOK},
+	} {
+		srv = tt.server
+		rec := httptest.NewRecorder()
+		if err := h(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/admin/export/chair", nil), rec)); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+		}
+	}
+}
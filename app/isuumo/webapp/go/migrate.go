@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 起動時に未適用のマイグレーションを適用する
+// 無効なら /initialize でデータベースを作り直すときだけ適用する
+var flagMigrateOnStart = newFeatureFlag("MIGRATE_ON_START", false)
+
+// migrationLockName 複数のサーバーが同時に起動しても1台ずつ適用する
+const migrationLockName = "isuumo.schema_migrations"
+
+// migrationLockTimeout GET_LOCKで待つ秒数
+var migrationLockTimeout = parseIntEnv("MIGRATION_LOCK_TIMEOUT", 60)
+
+// migration スキーマの変更1つ 適用済みのものは書き換えず、変更は新しいversionで足す
+type migration struct {
+	version int
+	name    string
+	up      string
+}
+
+// migrations versionの順に並べる
+// スキーマの定義はここだけに書く ../mysql/db/0_Schema.sql は schemaSQL で生成する (go run . schema)
+var migrations = []migration{
+	{1, "create_tables", `
+CREATE TABLE IF NOT EXISTS estate
+(
+    id          INTEGER             NOT NULL PRIMARY KEY,
+    name        VARCHAR(64)         NOT NULL,
+    description VARCHAR(4096)       NOT NULL,
+    thumbnail   VARCHAR(128)        NOT NULL,
+    address     VARCHAR(128)        NOT NULL,
+    latitude    DOUBLE PRECISION    NOT NULL,
+    longitude   DOUBLE PRECISION    NOT NULL,
+    rent        INTEGER             NOT NULL,
+    door_height INTEGER             NOT NULL,
+    door_width  INTEGER             NOT NULL,
+    features    VARCHAR(64)         NOT NULL,
+    popularity  INTEGER             NOT NULL,
+    width_level  INTEGER NOT NULL DEFAULT -1,
+    height_level INTEGER NOT NULL DEFAULT -1,
+    rent_level   INTEGER NOT NULL DEFAULT -1,
+    prefecture   VARCHAR(8) NOT NULL DEFAULT '',
+    neg_popularity INTEGER AS (-popularity) STORED NOT NULL,
+    point        POINT AS (POINT(latitude, longitude)) STORED NOT NULL,
+    geohash      CHAR(5) NOT NULL DEFAULT '',
+    cell_id      BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    door_min     INTEGER AS (LEAST(door_width, door_height)) STORED NOT NULL,
+    door_max     INTEGER AS (GREATEST(door_width, door_height)) STORED NOT NULL,
+    INDEX estate1 (door_width, door_height, neg_popularity, id),
+    INDEX estate2 (rent, id),
+    INDEX estate3 (rent, neg_popularity, id),
+    INDEX estate4 (latitude, longitude, neg_popularity, id),
+    INDEX estate5 (id, popularity),
+    INDEX estate6 (height_level, width_level, neg_popularity, id),
+    INDEX estate7 (prefecture, neg_popularity, id),
+    INDEX estate8 (geohash),
+    INDEX estate9 (cell_id),
+    INDEX estate10 (door_min, door_max, neg_popularity, id)
+);
+
+CREATE TABLE IF NOT EXISTS chair
+(
+    id          INTEGER         NOT NULL PRIMARY KEY,
+    name        VARCHAR(64)     NOT NULL,
+    description VARCHAR(4096)   NOT NULL,
+    thumbnail   VARCHAR(128)    NOT NULL,
+    price       INTEGER         NOT NULL,
+    height      INTEGER         NOT NULL,
+    width       INTEGER         NOT NULL,
+    depth       INTEGER         NOT NULL,
+    color       VARCHAR(64)     NOT NULL,
+    features    VARCHAR(64)     NOT NULL,
+    kind        VARCHAR(64)     NOT NULL,
+    popularity  INTEGER         NOT NULL,
+    stock       INTEGER         NOT NULL,
+    width_level  INTEGER NOT NULL DEFAULT -1,
+    height_level INTEGER NOT NULL DEFAULT -1,
+    depth_level   INTEGER NOT NULL DEFAULT -1,
+    price_level   INTEGER NOT NULL DEFAULT -1,
+    hidden        BOOLEAN NOT NULL DEFAULT FALSE,
+    len_min       INTEGER AS (LEAST(width, height, depth)) STORED NOT NULL,
+    len_mid       INTEGER AS (width + height + depth - LEAST(width, height, depth) - GREATEST(width, height, depth)) STORED NOT NULL,
+    INDEX chair1 (stock, price, id),
+    INDEX chair2 (price, stock),
+    INDEX chair3 (kind, stock),
+    INDEX chair4 (price, stock, popularity, id)
+);
+
+CREATE TABLE IF NOT EXISTS chair_feature
+(
+    chair_id         INTEGER         NOT NULL,
+    feature_id       INTEGER         NOT NULL,
+    PRIMARY KEY (chair_id, feature_id),
+    INDEX chair_feature1 (feature_id, chair_id)
+);
+
+CREATE TABLE IF NOT EXISTS estate_feature
+(
+    estate_id        INTEGER         NOT NULL,
+    feature_id       INTEGER         NOT NULL,
+    PRIMARY KEY (estate_id, feature_id)
+);
+
+CREATE TABLE IF NOT EXISTS estate_search
+(
+    id           INTEGER         NOT NULL PRIMARY KEY,
+    popularity   INTEGER         NOT NULL,
+    rent_level   INTEGER         NOT NULL,
+    height_level INTEGER         NOT NULL,
+    width_level  INTEGER         NOT NULL,
+    feature_bits BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    neg_popularity INTEGER AS (-popularity) STORED NOT NULL,
+    INDEX estate_search1 (rent_level, height_level, width_level, neg_popularity, id, feature_bits),
+    INDEX estate_search2 (height_level, width_level, neg_popularity, id, feature_bits),
+    INDEX estate_search3 (width_level, neg_popularity, id, feature_bits),
+    INDEX estate_search4 (neg_popularity, id, feature_bits)
+);
+
+CREATE TABLE IF NOT EXISTS reservation
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id    INTEGER         NOT NULL,
+    email       VARCHAR(128)    NOT NULL,
+    status      VARCHAR(16)     NOT NULL,
+    expires_at  DATETIME        NOT NULL,
+    created_at  DATETIME        NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX reservation_status_expires (status, expires_at)
+);
+
+CREATE TABLE IF NOT EXISTS purchase
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    email       VARCHAR(128)    NOT NULL,
+    chair_id    INTEGER         NOT NULL,
+    quantity    INTEGER         NOT NULL,
+    created_at  DATETIME        NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX purchase_email_chair (email, chair_id)
+);
+`},
+	{2, "estate_fulltext", `
+ALTER TABLE estate ADD FULLTEXT INDEX estate_fulltext (name, description, address) WITH PARSER ngram;
+`},
+	{3, "estate_point", `
+ALTER TABLE estate ADD SPATIAL INDEX estate_point (point);
+`},
+	{4, "reservation_token", `
+ALTER TABLE reservation ADD COLUMN token CHAR(32) NOT NULL DEFAULT '' AFTER email;
+`},
+}
+
+const schemaMigrationsTable = `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version     INTEGER         NOT NULL PRIMARY KEY,
+    name        VARCHAR(128)    NOT NULL,
+    applied_at  DATETIME        NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+// migrateSchema 未適用のマイグレーションをversionの順に適用し、schema_migrations に記録する
+// DDLはトランザクションで巻き戻せないので、1つ適用するごとに記録する
+func migrateSchema(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrationLockName, migrationLockTimeout).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return fmt.Errorf("migrate: failed to get lock %s", migrationLockName)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLockName)
+
+	if _, err := conn.ExecContext(ctx, schemaMigrationsTable); err != nil {
+		return err
+	}
+
+	applied := map[int]bool{}
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[v] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		for _, stmt := range splitSQLStatements(m.up) {
+			if err := execMigrationStatement(ctx, conn, stmt); err != nil {
+				return fmt.Errorf("migrate %d_%s: %w", m.version, m.name, err)
+			}
+		}
+		if _, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name); err != nil {
+			return fmt.Errorf("migrate %d_%s: %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+var (
+	createTableIfNotExistsRe = regexp.MustCompile("(?is)^CREATE TABLE IF NOT EXISTS\\s+`?(\\w+)`?")
+	autoIncrementRe          = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+)
+
+// execMigrationStatement stmtを実行する
+// CREATE TABLE IF NOT EXISTS のテーブルが既にあれば、黙って飛ばさずに同じ定義かを確かめ、違えばエラーにする
+// 0_Schema.sql や手で作ったテーブルが migrations とずれたまま動き出さないようにする
+func execMigrationStatement(ctx context.Context, conn *sql.Conn, stmt string) error {
+	m := createTableIfNotExistsRe.FindStringSubmatchIndex(stmt)
+	if m == nil {
+		_, err := conn.ExecContext(ctx, stmt)
+		return err
+	}
+	table := stmt[m[2]:m[3]]
+
+	var exists int
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?", table).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		_, err := conn.ExecContext(ctx, stmt)
+		return err
+	}
+
+	// 同じ定義で別名のテーブルを作り、SHOW CREATE TABLE を比べる
+	check := "_migrate_check_" + table
+	if _, err := conn.ExecContext(ctx, "DROP TABLE IF EXISTS "+check); err != nil {
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE "+check+stmt[m[1]:]); err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), "DROP TABLE IF EXISTS "+check)
+
+	want, err := showCreateTable(ctx, conn, check)
+	if err != nil {
+		return err
+	}
+	got, err := showCreateTable(ctx, conn, table)
+	if err != nil {
+		return err
+	}
+	if strings.Replace(want, "`"+check+"`", "`"+table+"`", 1) != got {
+		return fmt.Errorf("table %s already exists with a different definition:\n%s\nwant:\n%s", table, got, want)
+	}
+	return nil
+}
+
+// showCreateTable AUTO_INCREMENT の現在値を除いたテーブルの定義
+func showCreateTable(ctx context.Context, conn *sql.Conn, table string) (string, error) {
+	var name, ddl string
+	if err := conn.QueryRowContext(ctx, "SHOW CREATE TABLE `"+table+"`").Scan(&name, &ddl); err != nil {
+		return "", err
+	}
+	return autoIncrementRe.ReplaceAllString(ddl, ""), nil
+}
+
+// schemaSQL migrations を全て適用したのと同じ状態にするSQL
+// migrateSchema を使わない実装 (他言語の initialize や init.sh) が流す 0_Schema.sql はこれで生成する
+func schemaSQL(dbName string) string {
+	var sb strings.Builder
+	sb.WriteString("-- go/migrate.go の migrations から生成している 直接編集せずに go/ で go run . schema > ../mysql/db/0_Schema.sql する\n")
+	fmt.Fprintf(&sb, "DROP DATABASE IF EXISTS %s;\nCREATE DATABASE %s;\nUSE %s;\n\n", dbName, dbName, dbName)
+	sb.WriteString(schemaMigrationsTable)
+	sb.WriteString(";\n")
+	for _, m := range migrations {
+		fmt.Fprintf(&sb, "\n-- %d_%s\n", m.version, m.name)
+		for _, stmt := range splitSQLStatements(m.up) {
+			sb.WriteString(stmt)
+			sb.WriteString(";\n")
+		}
+		fmt.Fprintf(&sb, "INSERT INTO schema_migrations (version, name) VALUES (%d, '%s');\n", m.version, m.name)
+	}
+	return sb.String()
+}
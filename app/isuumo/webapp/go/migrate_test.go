@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchemaSQLUpToDate(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join("..", "mysql", "db", "0_Schema.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != schemaSQL("isuumo") {
+		t.Error("0_Schema.sql is out of date : run go run . schema > ../mysql/db/0_Schema.sql")
+	}
+}
+
+func TestMigrateSchemaExistingTables(t *testing.T) {
+	const checkDDL = "CREATE TABLE `_migrate_check_estate` (\n  `id` int NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB"
+
+	tests := []struct {
+		name string
+		// existing 既にあるestateの定義 空ならestateはない
+		existing string
+		err      string
+		created  bool
+	}{
+		{"fresh", "", "", true},
+		{"same definition", "CREATE TABLE `estate` (\n  `id` int NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB AUTO_INCREMENT=42", "", false},
+		{"different definition", "CREATE TABLE `estate` (\n  `id` int NOT NULL\n) ENGINE=InnoDB", "already exists with a different definition", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fdb := useFakeDB(t)
+			fdb.result = func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+				switch {
+				case strings.HasPrefix(query, "SELECT GET_LOCK"):
+					return []string{"l"}, [][]driver.Value{{int64(1)}}
+				case strings.HasPrefix(query, "SELECT version"):
+					return []string{"version"}, nil
+				case strings.Contains(query, "information_schema.TABLES"):
+					if tt.existing != "" && args[0] == "estate" {
+						return []string{"n"}, [][]driver.Value{{int64(1)}}
+					}
+				case query == "SHOW CREATE TABLE `_migrate_check_estate`":
+					return []string{"Table", "Create Table"}, [][]driver.Value{{"_migrate_check_estate", checkDDL}}
+				case query == "SHOW CREATE TABLE `estate`":
+					return []string{"Table", "Create Table"}, [][]driver.Value{{"estate", tt.existing}}
+				}
+				return nil, nil
+			}
+
+			err := migrateSchema(context.Background(), db.DB)
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("err = %v, want %q", err, tt.err)
+			}
+
+			var created bool
+			for _, q := range fdb.Queries() {
+				if strings.HasPrefix(q.Query, "CREATE TABLE IF NOT EXISTS estate\n") {
+					created = true
+				}
+			}
+			if created != tt.created {
+				t.Errorf("created estate = %v, want %v", created, tt.created)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type MySQLConnectionEnv struct {
+	Host     string
+	Port     string
+	User     string
+	DBName   string
+	Password string
+
+	// MaxOpenConns, MaxIdleConns, ConnMaxLifetime コネクションプールの設定
+	// 負荷がかかったときに繋ぎ直さないように、待機させておく数は開く数と同じにする
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// InterpolateParams プレースホルダの値をドライバがクエリに埋め込んで送る
+	// サーバー側のプリペアとクローズの往復がなくなる エスケープはドライバが接続の文字コードに合わせて行う
+	InterpolateParams bool
+}
+
+func NewMySQLConnectionEnv() *MySQLConnectionEnv {
+	maxOpen := parseIntEnv("MYSQL_MAX_OPEN", 10)
+	return &MySQLConnectionEnv{
+		Host:     getEnv("MYSQL_HOST", "127.0.0.1"),
+		Port:     getEnv("MYSQL_PORT", "3306"),
+		User:     getEnv("MYSQL_USER", "isucon"),
+		DBName:   getEnv("MYSQL_DBNAME", "isuumo"),
+		Password: getEnv("MYSQL_PASS", "isucon"),
+
+		MaxOpenConns: maxOpen,
+		MaxIdleConns: parseIntEnv("MYSQL_MAX_IDLE", maxOpen),
+		// 0なら期限なしで使い回す
+		ConnMaxLifetime: parseDurationEnv("MYSQL_CONN_LIFETIME", 0),
+
+		InterpolateParams: getEnv("MYSQL_INTERPOLATE_PARAMS", "0") == "1",
+	}
+}
+
+// ConfigurePool コネクションプールの設定をdbに反映する
+func (mc *MySQLConnectionEnv) ConfigurePool(db *sqlx.DB) {
+	db.SetMaxOpenConns(mc.MaxOpenConns)
+	db.SetMaxIdleConns(mc.MaxIdleConns)
+	db.SetConnMaxLifetime(mc.ConnMaxLifetime)
+}
+
+// dsn isuumoデータベースに接続するためのDSN paramsはクエリ文字列として付ける
+func (mc *MySQLConnectionEnv) dsn(params string) string {
+	dsn := ""
+	if getEnv("MYSQL_UNIX_DOMAIN_SOCKET", "0") == "1" {
+		dsn = fmt.Sprintf("%v:%v@unix(/var/run/mysqld/mysqld.sock)/%v", mc.User, mc.Password, mc.DBName)
+	} else {
+		dsn = fmt.Sprintf("%v:%v@tcp(%v:%v)/%v", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
+	}
+	if params != "" {
+		dsn += "?" + params
+	}
+	return dsn
+}
+
+// connectParams ConnectDB のDSNに付けるパラメータ
+func (mc *MySQLConnectionEnv) connectParams() string {
+	if mc.InterpolateParams {
+		return "interpolateParams=true"
+	}
+	return ""
+}
+
+// ConnectDB isuumoデータベースに接続する
+func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
+	params := mc.connectParams()
+	if getEnv("SQL_METRICS", "0") == "1" {
+		return sqlx.Open(metricsDriverName, mc.dsn(params))
+	}
+	return sqlx.Open("mysql", mc.dsn(params))
+}
+
+// ConnectInitDB initialize でSQLファイルを流すための接続 1回のExecで複数の文を送れる
+func (mc *MySQLConnectionEnv) ConnectInitDB() (*sqlx.DB, error) {
+	return sqlx.Open("mysql", mc.dsn("multiStatements=true"))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+// なぞって検索をMySQLの空間インデックスで1回の問い合わせにする
+var flagSpatialNazotte = newFeatureFlag("SPATIAL_NAZOTTE", true)
+
+// nazottePage なぞって検索の結果のうち返す範囲
+type nazottePage struct {
+	Offset int
+	Limit  int
+}
+
+// parseNazottePage page と perPage を読む 指定がなければ先頭から NazotteLimit 件にする
+func parseNazottePage(c echo.Context) (nazottePage, error) {
+	pg := nazottePage{Limit: NazotteLimit}
+	if c.QueryParam("perPage") != "" {
+		perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+		if err != nil || perPage <= 0 {
+			return pg, fmt.Errorf("invalid perPage %q", c.QueryParam("perPage"))
+		}
+		pg.Limit = perPage
+	}
+	if c.QueryParam("page") != "" {
+		page, err := strconv.Atoi(c.QueryParam("page"))
+		if err != nil || page < 0 {
+			return pg, fmt.Errorf("invalid page %q", c.QueryParam("page"))
+		}
+		pg.Offset = page * pg.Limit
+	}
+	return pg, nil
+}
+
+// pageEstatePoints pointsを人気順に並べて、pgの範囲のidをdstに入れる
+func pageEstatePoints(points []estatePoint, pg nazottePage, dst []int) []int {
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].Popularity == points[j].Popularity {
+			return points[i].ID < points[j].ID
+		}
+		return points[i].Popularity > points[j].Popularity
+	})
+	for i := pg.Offset; i < len(points) && i < pg.Offset+pg.Limit; i++ {
+		dst = append(dst, int(points[i].ID))
+	}
+	return dst
+}
+
+// nazotteCheckInterval 多角形に含まれるかを何件調べるごとにリクエストが終わっていないかを見る
+// 取り消されたリクエストのために残りを調べ続けない
+const nazotteCheckInterval = 1024
+
+// searchEstatesInPolygon 多角形に含まれるestateを人気順にpgの範囲だけ返す 2つ目の値は全件数
+// point は POINT(latitude, longitude) の生成列で、マイグレーション estate_point でSPATIAL INDEXを張っている
+func searchEstatesInPolygon(ctx context.Context, cs Coordinates, pg nazottePage, dst []Estate) ([]Estate, int64, error) {
+	// 3点未満では多角形にならず、何も含まない
+	if len(cs.Coordinates) < 3 {
+		return dst, 0, nil
+	}
+	polygon := cs.coordinatesToText()
+
+	var count int64
+	if err := db.GetContext(ctx, &count, `SELECT COUNT(*) FROM estate WHERE ST_Contains(ST_PolygonFromText(?), point)`, polygon); err != nil {
+		return dst, 0, err
+	}
+	if count <= int64(pg.Offset) {
+		return dst, count, nil
+	}
+
+	query := `SELECT * FROM estate WHERE ST_Contains(ST_PolygonFromText(?), point) ORDER BY neg_popularity ASC, id ASC LIMIT ? OFFSET ?`
+	err := db.SelectContext(ctx, &dst, query, polygon, pg.Limit, pg.Offset)
+	return dst, count, err
+}
+
+// estateIDsInPolygon 多角形に含まれるestateのidをkd-treeから人気順にpgの範囲だけ返す 2つ目の値は全件数
+func estateIDsInPolygon(cs Coordinates, pg nazottePage, dst []int) ([]int, int64) {
+	var points []estatePoint
+	estatePointsInBox(cs.getBoundingBox(), func(p *estatePoint) {
+		if polygonContains(cs.Coordinates, p.Latitude, p.Longitude) {
+			points = append(points, *p)
+		}
+	})
+	return pageEstatePoints(points, pg, dst), int64(len(points))
+}
+
+// nazotteCacheKey 座標の並びを正規化してレスポンスキャッシュのキーにする
+// JSONの書き方の違いや、閉じるための終点の有無で別のキーにならないようにする
+func nazotteCacheKey(body []byte) ([]byte, bool) {
+	var cs Coordinates
+	if err := json.Unmarshal(body, &cs); err != nil || len(cs.Coordinates) == 0 {
+		return nil, false
+	}
+
+	points := cs.Coordinates
+	if len(points) > 1 && points[0] == points[len(points)-1] {
+		points = points[:len(points)-1]
+	}
+	key := make([]byte, 0, len(points)*40)
+	for _, p := range points {
+		key = strconv.AppendFloat(key, p.Latitude, 'g', -1, 64)
+		key = append(key, ' ')
+		key = strconv.AppendFloat(key, p.Longitude, 'g', -1, 64)
+		key = append(key, ',')
+	}
+	return key, true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// 詳細のキャッシュをアプリケーションサーバー間で分け持つ (groupcacheと同じ考え方)
+// idごとに持ち主のサーバーを決め、手元にないときは持ち主に問い合わせる
+// PEERS に全てのサーバーのURLを、PEER_SELF に自分のURLを指定すると有効になる
+// 例: PEERS=http://10.0.0.1:1323,http://10.0.0.2:1323,http://10.0.0.3:1323
+
+const (
+	peerKindChair  = "chair"
+	peerKindEstate = "estate"
+	// peerRingReplicas 1つのサーバーをハッシュ環に置く数
+	peerRingReplicas = 64
+)
+
+// peerRing 一貫性ハッシュの環
+type peerRing struct {
+	self   string
+	nodes  []string
+	hashes []uint32
+	owners map[uint32]string
+}
+
+var peers = newPeerRing(getEnv("PEERS", ""), getEnv("PEER_SELF", ""))
+
+var peerClient = &http.Client{
+	Timeout:   parseDurationEnv("PEER_TIMEOUT", 200*time.Millisecond),
+	Transport: peerTransport{base: http.DefaultTransport},
+}
+
+func newPeerRing(list, self string) *peerRing {
+	r := &peerRing{self: strings.TrimSuffix(self, "/"), owners: map[uint32]string{}}
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSuffix(strings.TrimSpace(p), "/")
+		if p == "" {
+			continue
+		}
+		r.nodes = append(r.nodes, p)
+		for i := 0; i < peerRingReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + p))
+			r.hashes = append(r.hashes, h)
+			r.owners[h] = p
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// owner keyの持ち主 自分が持ち主か、分け持っていなければ空を返す
+func (r *peerRing) owner(key string) string {
+	if len(r.hashes) == 0 || r.self == "" {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	if o := r.owners[r.hashes[i]]; o != r.self {
+		return o
+	}
+	return ""
+}
+
+// others 自分以外のサーバー 分け持っていなければ空を返す
+func (r *peerRing) others() []string {
+	if r.self == "" {
+		return nil
+	}
+	res := make([]string, 0, len(r.nodes))
+	for _, p := range r.nodes {
+		if p != r.self {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// ownersOf kindのidsの持ち主のうち、自分以外のサーバー
+func (r *peerRing) ownersOf(kind string, ids []int) []string {
+	seen := map[string]bool{}
+	var res []string
+	for _, id := range ids {
+		if o := r.owner(peerKey(kind, id)); o != "" && !seen[o] {
+			seen[o] = true
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+func peerKey(kind string, id int) string {
+	return kind + "/" + strconv.Itoa(id)
+}
+
+// peerGet 持ち主からkindのidをvに読み込む
+// 自分が持ち主か問い合わせに失敗したら false を返すので、呼び出し側が自分で読み込む
+// 持ち主にもなければ sql.ErrNoRows を返す
+func peerGet(kind string, id int, v interface{}) (bool, error) {
+	owner := peers.owner(peerKey(kind, id))
+	if owner == "" {
+		return false, nil
+	}
+	res, err := peerClient.Get(owner + "/internal/peer/" + peerKey(kind, id))
+	if err != nil {
+		log.Errorf("peerGet %v : %v", owner, err)
+		return false, nil
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, sql.ErrNoRows
+	default:
+		log.Errorf("peerGet %v : status %v", owner, res.StatusCode)
+		return false, nil
+	}
+	if err := gob.NewDecoder(res.Body).Decode(v); err != nil {
+		log.Errorf("peerGet %v decode error : %v", owner, err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// getPeerObject 他のサーバーからの問い合わせに、自分のキャッシュかDBから答える
+// 持ち主が食い違っていても問い合わせが往復しないように、ここでは他のサーバーに問い合わせない
+func getPeerObject(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	var v interface{}
+	switch c.Param("kind") {
+	case peerKindChair:
+		v, err = srv.loadChair(id)
+	case peerKindEstate:
+		v, err = srv.loadEstate(id)
+	default:
+		return notFound(c, "unknown kind")
+	}
+	if err == sql.ErrNoRows {
+		return notFound(c, "object not found")
+	}
+	if err != nil {
+		c.Logger().Errorf("getPeerObject DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		c.Logger().Errorf("getPeerObject encode error : %v", err)
+		return internalError(c)
+	}
+	return c.Blob(http.StatusOK, echo.MIMEOctetStream, buf.Bytes())
+}
+
+// forgetChairs 椅子が書き換わったときに、手元と共有キャッシュから捨てる
+// 持ち主のサーバーには、呼び出し元が続けて送る broadcastInvalidation で知らせる
+func forgetChairs(ids ...int) {
+	for _, id := range ids {
+		cachedChairs.Remove(id)
+	}
+	chairMemIndex.markStale(ids...)
+	esSyncLater(esChairIndex, ids)
+	sharedChairs.delete(idKeys(ids)...)
+}
+
+// forgetEstates 物件が上書きされたときに、手元と共有キャッシュから捨てる
+// 持ち主のサーバーには、呼び出し元が続けて送る broadcastInvalidation で知らせる
+func forgetEstates(ids ...int) {
+	for _, id := range ids {
+		cachedEstates.Remove(id)
+	}
+	estateMemIndex.markStale(ids...)
+	esSyncLater(esEstateIndex, ids)
+	sharedEstates.delete(idKeys(ids)...)
+}
@@ -0,0 +1,55 @@
+package main
+
+import "math"
+
+// polygonContains 多角形polyが点を含むかをレイキャスティングで判定する
+// golang-geo の Polygon.Contains と同じ判定を、点ごとに *geo.Point を確保せずに行う
+func polygonContains(poly []Coordinate, latitude, longitude float64) bool {
+	if len(poly) < 3 {
+		return false
+	}
+
+	contains := raycastIntersects(latitude, longitude, poly[len(poly)-1], poly[0])
+	for i := 1; i < len(poly); i++ {
+		if raycastIntersects(latitude, longitude, poly[i-1], poly[i]) {
+			contains = !contains
+		}
+	}
+	return contains
+}
+
+// raycastIntersects 点から緯度の正の向きに伸ばした半直線が辺 start-end と交わるか
+func raycastIntersects(latitude, longitude float64, start, end Coordinate) bool {
+	if start.Longitude > end.Longitude {
+		start, end = end, start
+	}
+
+	// 頂点をちょうど通らないように経度をずらす
+	for longitude == start.Longitude || longitude == end.Longitude {
+		longitude = math.Nextafter(longitude, math.Inf(1))
+	}
+
+	if longitude < start.Longitude || longitude > end.Longitude {
+		return false
+	}
+
+	if start.Latitude > end.Latitude {
+		if latitude > start.Latitude {
+			return false
+		}
+		if latitude < end.Latitude {
+			return true
+		}
+	} else {
+		if latitude > end.Latitude {
+			return false
+		}
+		if latitude < start.Latitude {
+			return true
+		}
+	}
+
+	raySlope := (longitude - start.Longitude) / (latitude - start.Latitude)
+	diagSlope := (end.Longitude - start.Longitude) / (end.Latitude - start.Latitude)
+	return raySlope >= diagSlope
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"sync"
-
-	geo "github.com/kellydunn/golang-geo"
 )
 
 // 変更禁止
@@ -36,19 +34,6 @@ func releaseChairSlice(s []Chair) {
 	chairSlicePool.Put(s[:0])
 }
 
-// []*geo.Pointのプール
-var geoPointsPool = sync.Pool{New: func() interface{} {
-	return []*geo.Point{}
-}}
-
-func getEmptyGeoPointSlice() []*geo.Point {
-	return geoPointsPool.Get().([]*geo.Point)
-}
-
-func releaseGeoPointSlice(s []*geo.Point) {
-	geoPointsPool.Put(s[:0])
-}
-
 // []int64のプール
 var intPool = sync.Pool{New: func() interface{} {
 	return []int{}
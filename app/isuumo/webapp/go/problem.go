@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// 失敗したときは空のボディではなく application/problem+json (RFC 7807) で理由を返す
+// codeを見ればパラメータの誤りかサーバーの障害かを区別できる
+const mimeProblemJSON = "application/problem+json"
+
+// problemCodeInvalidParam パラメータの誤り それ以外の code はステータスから決める (problemCode)
+const problemCodeInvalidParam = "invalid_parameter"
+
+// ProblemFieldError どのパラメータがなぜ誤っているか
+type ProblemFieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ProblemResponse エラーのときに返すボディ
+type ProblemResponse struct {
+	Title   string              `json:"title"`
+	Status  int                 `json:"status"`
+	Code    string              `json:"code"`
+	Message string              `json:"message,omitempty"`
+	Errors  []ProblemFieldError `json:"errors,omitempty"`
+}
+
+// Problem statusでエラーを返す エンコードに失敗したらボディなしで返す
+func Problem(c echo.Context, status int, code, message string, fieldErrors ...ProblemFieldError) error {
+	b, err := myjson.Marshal(ProblemResponse{
+		Title:   http.StatusText(status),
+		Status:  status,
+		Code:    code,
+		Message: message,
+		Errors:  fieldErrors,
+	})
+	if err != nil {
+		return c.NoContent(status)
+	}
+	return c.Blob(status, mimeProblemJSON, append(b, '\n'))
+}
+
+// problemCode ステータスの名前をスネークケースにしたもの (bad_request, not_found, internal_server_error など)
+func problemCode(status int) string {
+	return strings.ToLower(strings.Replace(http.StatusText(status), " ", "_", -1))
+}
+
+// badRequest 特定のパラメータによらない誤り
+func badRequest(c echo.Context, message string) error {
+	return Problem(c, http.StatusBadRequest, problemCode(http.StatusBadRequest), message)
+}
+
+// invalidParam fieldの値が誤っている
+func invalidParam(c echo.Context, field, message string) error {
+	return Problem(c, http.StatusBadRequest, problemCodeInvalidParam, "invalid parameter", ProblemFieldError{Field: field, Message: message})
+}
+
+func notFound(c echo.Context, message string) error {
+	return Problem(c, http.StatusNotFound, problemCode(http.StatusNotFound), message)
+}
+
+func conflict(c echo.Context, message string) error {
+	return Problem(c, http.StatusConflict, problemCode(http.StatusConflict), message)
+}
+
+// notImplemented STORAGE=memory では答えられない
+func notImplemented(c echo.Context, message string) error {
+	return Problem(c, http.StatusNotImplemented, problemCode(http.StatusNotImplemented), message)
+}
+
+// internalError 原因はログに出すので、クライアントには詳しく返さない
+func internalError(c echo.Context) error {
+	return Problem(c, http.StatusInternalServerError, problemCode(http.StatusInternalServerError), "")
+}
+
+// problemErrorHandler ルートが見つからないなど、echoのミドルウェアが返すエラーも同じ形にする
+func problemErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	status := http.StatusInternalServerError
+	message := ""
+	if he, ok := err.(*echo.HTTPError); ok {
+		status = he.Code
+		if m, ok := he.Message.(string); ok {
+			message = m
+		}
+	}
+	if status >= http.StatusInternalServerError {
+		// 原因はログに出すので、クライアントには返さない
+		c.Logger().Error(err)
+		message = ""
+	}
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = Problem(c, status, problemCode(status), message)
+	}
+	if err != nil {
+		c.Logger().Error(err)
+	}
+}
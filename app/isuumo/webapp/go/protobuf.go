@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// 検索系のエンドポイントで Accept: application/x-protobuf ならprotobufで返す
+// メッセージの定義は ../proto/isuumo.proto
+var flagProtobufResponse = newFeatureFlag("PROTOBUF_RESPONSE", true)
+
+const mimeProtobuf = "application/x-protobuf"
+
+// protobufのワイヤータイプ
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// protoMessage protobufにエンコードできるレスポンス
+// 依存を増やさないように isuumo.proto と同じ形を手で書き出す
+type protoMessage interface {
+	appendProto(b []byte) []byte
+}
+
+// wantsProtobuf クライアントがprotobufを受け取れるか
+func wantsProtobuf(c echo.Context) bool {
+	return flagProtobufResponse.Enabled() && strings.Contains(c.Request().Header.Get(echo.HeaderAccept), mimeProtobuf)
+}
+
+// Protobuf mをprotobufにして返す
+func Protobuf(c echo.Context, code int, m protoMessage) error {
+	return c.Blob(code, mimeProtobuf, m.appendProto(nil))
+}
+
+// JSONOrProtobuf Acceptに合わせてJSONかprotobufで返す
+func JSONOrProtobuf(c echo.Context, code int, m protoMessage) error {
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+	if wantsProtobuf(c) {
+		return Protobuf(c, code, m)
+	}
+	return JSON(c, code, m)
+}
+
+func appendProtoTag(b []byte, field, wireType int) []byte {
+	return appendProtoVarint(b, uint64(field<<3|wireType))
+}
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendProtoInt64 proto3なので0は省略する
+func appendProtoInt64(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoVarint)
+	return appendProtoVarint(b, uint64(v))
+}
+
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = appendProtoTag(b, field, protoVarint)
+	return append(b, 1)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoTag(b, field, protoFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+func appendProtoString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendProtoVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// appendProtoMessage 長さを先に書くので、mを一度別に書き出してからつなげる
+func appendProtoMessage(b []byte, field int, m protoMessage) []byte {
+	body := m.appendProto(nil)
+	b = appendProtoTag(b, field, protoBytes)
+	b = appendProtoVarint(b, uint64(len(body)))
+	return append(b, body...)
+}
+
+func (chair *Chair) appendProto(b []byte) []byte {
+	b = appendProtoInt64(b, 1, chair.ID)
+	b = appendProtoString(b, 2, chair.Name)
+	b = appendProtoString(b, 3, chair.Description)
+	b = appendProtoString(b, 4, chair.Thumbnail)
+	b = appendProtoInt64(b, 5, chair.Price)
+	b = appendProtoInt64(b, 6, chair.Height)
+	b = appendProtoInt64(b, 7, chair.Width)
+	b = appendProtoInt64(b, 8, chair.Depth)
+	b = appendProtoString(b, 9, chair.Color)
+	b = appendProtoString(b, 10, chair.Features)
+	b = appendProtoString(b, 11, chair.Kind)
+	return b
+}
+
+func (estate *Estate) appendProto(b []byte) []byte {
+	b = appendProtoInt64(b, 1, estate.ID)
+	b = appendProtoString(b, 2, estate.Thumbnail)
+	b = appendProtoString(b, 3, estate.Name)
+	b = appendProtoString(b, 4, estate.Description)
+	b = appendProtoDouble(b, 5, estate.Latitude)
+	b = appendProtoDouble(b, 6, estate.Longitude)
+	b = appendProtoString(b, 7, estate.Address)
+	b = appendProtoInt64(b, 8, estate.Rent)
+	b = appendProtoInt64(b, 9, estate.DoorHeight)
+	b = appendProtoInt64(b, 10, estate.DoorWidth)
+	b = appendProtoString(b, 11, estate.Features)
+	return b
+}
+
+func (res *ChairSearchResponse) appendProto(b []byte) []byte {
+	b = appendProtoInt64(b, 1, res.Count)
+	for i := range res.Chairs {
+		b = appendProtoMessage(b, 2, &res.Chairs[i])
+	}
+	return b
+}
+
+func (res *EstateSearchResponse) appendProto(b []byte) []byte {
+	b = appendProtoInt64(b, 1, res.Count)
+	for i := range res.Estates {
+		b = appendProtoMessage(b, 2, &res.Estates[i])
+	}
+	b = appendProtoString(b, 3, res.NextCursor)
+	b = appendProtoBool(b, 4, res.Approximate)
+	return b
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// purchaseFlushInterval 購入履歴をDBに書き出す間隔
+	purchaseFlushInterval = time.Second
+	// alsoBoughtRefreshInterval 一緒に買われた椅子を作り直す間隔
+	alsoBoughtRefreshInterval = 30 * time.Second
+	// alsoBoughtMaxChairsPerBuyer これより多くの種類を買った人は組の数が増えすぎるので数えない
+	alsoBoughtMaxChairsPerBuyer = 100
+	// alsoBoughtMaxCandidates 1つの椅子について持っておく候補の数
+	// 非表示や売り切れを飛ばしても Limit 件残るように多めに持つ
+	alsoBoughtMaxCandidates = 3 * Limit
+)
+
+// purchase 購入履歴の1行
+type purchase struct {
+	Email    string `db:"email"`
+	ChairID  int64  `db:"chair_id"`
+	Quantity int64  `db:"quantity"`
+}
+
+// purchasePending まだDBに書き出していない購入履歴
+// 購入のレスポンスを待たせないように syncPurchases がまとめて書き出す
+var purchasePending []purchase
+var purchasePendingMutex sync.Mutex
+
+// recordChairPurchase 椅子の購入が成功したときに呼ぶ
+func recordChairPurchase(email string, chairID, quantity int64) {
+	purchasePendingMutex.Lock()
+	purchasePending = append(purchasePending, purchase{Email: email, ChairID: chairID, Quantity: quantity})
+	purchasePendingMutex.Unlock()
+	publishEvent(EventChairPurchased, ChairPurchased{ChairID: chairID, Quantity: quantity})
+}
+
+// flushPurchases 溜まっている購入履歴を csvBatchSize 行ずつINSERTする
+func flushPurchases() error {
+	purchasePendingMutex.Lock()
+	pending := purchasePending
+	purchasePending = nil
+	purchasePendingMutex.Unlock()
+	// STORAGE=memory では書き出す先がないので捨てる
+	if db == nil {
+		return nil
+	}
+
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > csvBatchSize {
+			n = csvBatchSize
+		}
+		args := make([]interface{}, 0, 3*n)
+		for _, p := range pending[:n] {
+			args = append(args, p.Email, p.ChairID, p.Quantity)
+		}
+		query := "INSERT INTO purchase (email, chair_id, quantity) VALUES " + strings.TrimSuffix(strings.Repeat("(?, ?, ?),", n), ",")
+		err := retryWrite(context.Background(), func() error {
+			_, err := db.Exec(query, args...)
+			return err
+		})
+		if err != nil {
+			// 次回に書き出せるように戻しておく
+			purchasePendingMutex.Lock()
+			purchasePending = append(pending, purchasePending...)
+			purchasePendingMutex.Unlock()
+			return err
+		}
+		pending = pending[n:]
+	}
+	return nil
+}
+
+// syncPurchases 定期的に購入履歴をDBに書き出す
+func syncPurchases() {
+	ticker := time.NewTicker(purchaseFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := flushPurchases(); err != nil {
+			log.Errorf("syncPurchases DB execution error : %v", err)
+		}
+	}
+}
+
+// alsoBought chair id -> 同じ人に一緒に買われた回数の多い順の chair id
+var alsoBought = map[int64][]int64{}
+var alsoBoughtMutex sync.RWMutex
+
+// resetPurchases /initialize で購入履歴と一緒に買われた椅子を捨てる
+func resetPurchases() {
+	purchasePendingMutex.Lock()
+	purchasePending = nil
+	purchasePendingMutex.Unlock()
+
+	alsoBoughtMutex.Lock()
+	alsoBought = map[int64][]int64{}
+	alsoBoughtMutex.Unlock()
+}
+
+// loadAlsoBought purchase テーブルから、同じメールアドレスで買われた椅子の組を数えて作り直す
+func loadAlsoBought() error {
+	var rows []purchase
+	if err := db.Select(&rows, "SELECT DISTINCT email, chair_id FROM purchase ORDER BY email"); err != nil {
+		return err
+	}
+
+	counts := map[int64]map[int64]int64{}
+	count := func(chairs []int64) {
+		if len(chairs) > alsoBoughtMaxChairsPerBuyer {
+			return
+		}
+		for _, a := range chairs {
+			for _, b := range chairs {
+				if a == b {
+					continue
+				}
+				m, ok := counts[a]
+				if !ok {
+					m = map[int64]int64{}
+					counts[a] = m
+				}
+				m[b]++
+			}
+		}
+	}
+	var chairs []int64
+	for i, r := range rows {
+		if i > 0 && rows[i-1].Email != r.Email {
+			count(chairs)
+			chairs = chairs[:0]
+		}
+		chairs = append(chairs, r.ChairID)
+	}
+	count(chairs)
+
+	res := make(map[int64][]int64, len(counts))
+	for id, m := range counts {
+		ids := make([]int64, 0, len(m))
+		for other := range m {
+			ids = append(ids, other)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			if m[ids[i]] != m[ids[j]] {
+				return m[ids[i]] > m[ids[j]]
+			}
+			return ids[i] < ids[j]
+		})
+		if len(ids) > alsoBoughtMaxCandidates {
+			ids = ids[:alsoBoughtMaxCandidates]
+		}
+		res[id] = ids
+	}
+
+	alsoBoughtMutex.Lock()
+	alsoBought = res
+	alsoBoughtMutex.Unlock()
+	return nil
+}
+
+// refreshAlsoBought 定期的に一緒に買われた椅子を作り直す
+func refreshAlsoBought() {
+	ticker := time.NewTicker(alsoBoughtRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := loadAlsoBought(); err != nil {
+			log.Errorf("refreshAlsoBought DB execution error : %v", err)
+		}
+	}
+}
+
+// getAlsoBoughtChairs この椅子を買った人が他に買った椅子を回数の多い順に返す
+// 非表示や売り切れの椅子は飛ばす
+func getAlsoBoughtChairs(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	if _, err := srv.getChair(id); err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("requested id's chair not found : %v", id)
+			return notFound(c, "chair not found")
+		}
+		c.Logger().Errorf("getAlsoBoughtChairs DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	alsoBoughtMutex.RLock()
+	ids := alsoBought[int64(id)]
+	alsoBoughtMutex.RUnlock()
+
+	chairs := make([]Chair, 0, Limit)
+	for _, other := range ids {
+		if len(chairs) >= Limit {
+			break
+		}
+		chair, err := srv.getChair(int(other))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			c.Logger().Errorf("getAlsoBoughtChairs DB execution error : %v", err)
+			return internalError(c)
+		}
+		if flagInMemoryStock.Enabled() {
+			if stock, ok := currentStock(other); ok {
+				chair.Stock = stock
+			}
+		}
+		if chair.Hidden || chair.Stock <= 0 {
+			continue
+		}
+		chairs = append(chairs, chair)
+	}
+
+	return JSON(c, http.StatusOK, ChairListResponse{Chairs: chairs})
+}
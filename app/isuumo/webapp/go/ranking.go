@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+// RankingWeights 検索結果の並び順の重み
+// score = popularity * Popularity - 価格 * Price + id * Recency の大きい順に並べる
+// idが大きいほど新しく追加されたものなので、idを新しさとして使う
+type RankingWeights struct {
+	Popularity float64 `json:"popularity"`
+	Price      float64 `json:"price"`
+	Recency    float64 `json:"recency"`
+}
+
+// defaultRankingWeights 人気順 索引で並べられるのはこのときだけ
+var defaultRankingWeights = RankingWeights{Popularity: 1}
+
+var rankingWeights = defaultRankingWeights
+var rankingWeightsMutex sync.RWMutex
+
+func (w RankingWeights) validate() error {
+	for _, v := range []float64{w.Popularity, w.Price, w.Recency} {
+		if math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+			return fmt.Errorf("weights must be finite and non-negative")
+		}
+	}
+	if w.Popularity == 0 && w.Price == 0 && w.Recency == 0 {
+		return fmt.Errorf("at least one weight must be positive")
+	}
+	return nil
+}
+
+// popularityOnly 人気だけで並べるなら既定の並びと同じになる
+func (w RankingWeights) popularityOnly() bool {
+	return w.Price == 0 && w.Recency == 0
+}
+
+// rankingTarget 並べるテーブルの列
+type rankingTarget struct {
+	// defaultOrder 人気順のときの ORDER BY 索引に合わせてテーブルごとに決める
+	defaultOrder string
+	price        string
+}
+
+var (
+	chairRanking  = rankingTarget{defaultOrder: " ORDER BY popularity DESC, id ASC", price: "price"}
+	estateRanking = rankingTarget{defaultOrder: " ORDER BY neg_popularity ASC, id ASC", price: "rent"}
+)
+
+// orderBy wで並べる ORDER BY 句
+// 重みは検証済みの数値なので、プレースホルダを使わずに埋め込む
+func (t rankingTarget) orderBy(w RankingWeights) string {
+	if w.popularityOnly() {
+		return t.defaultOrder
+	}
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	return " ORDER BY (popularity * " + f(w.Popularity) + " - " + t.price + " * " + f(w.Price) + " + id * " + f(w.Recency) + ") DESC, id ASC"
+}
+
+func currentRankingWeights() RankingWeights {
+	rankingWeightsMutex.RLock()
+	defer rankingWeightsMutex.RUnlock()
+	return rankingWeights
+}
+
+// getRanking 今の重みを返す
+func getRanking(c echo.Context) error {
+	return JSON(c, http.StatusOK, currentRankingWeights())
+}
+
+// putRanking 重みを変えて、並び順が変わるので検索結果のキャッシュを捨てる
+func putRanking(c echo.Context) error {
+	var w RankingWeights
+	if err := c.Bind(&w); err != nil {
+		c.Echo().Logger.Infof("put ranking failed : %v", err)
+		return badRequest(c, "invalid request body")
+	}
+	if err := w.validate(); err != nil {
+		c.Echo().Logger.Infof("put ranking failed : %v", err)
+		return badRequest(c, err.Error())
+	}
+
+	rankingWeightsMutex.Lock()
+	rankingWeights = w
+	rankingWeightsMutex.Unlock()
+
+	invalidateChairSearchCaches()
+	invalidateEstateSearchCaches()
+	tasks.Go("prerenderSearchPages", prerenderSearchPages)
+
+	return JSON(c, http.StatusOK, w)
+}
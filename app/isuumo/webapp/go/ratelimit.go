@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// rateLimiter 1秒あたり rate 件、最大 burst 件まで続けて通すトークンバケット
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow nowの時点でトークンがあれば1つ使ってtrueを返す
+// 足りなければ、次の1つが貯まるまでの時間を返す
+func (l *rateLimiter) allow(now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// rateLimiters RateLimitClass ごとのリミッター
+// RATE_LIMIT_<CLASS> (1秒あたりの件数) を設定した分類だけを制限し、超えた分は429を返す
+// 同じ分類のルートは1つのバケットを共有するので、サーバー全体でその分類に使える量の上限になる
+var rateLimiters = map[RateLimitClass]*rateLimiter{}
+
+func init() {
+	for _, class := range []RateLimitClass{RateLimitRead, RateLimitWrite, RateLimitSearch} {
+		key := "RATE_LIMIT_" + strings.ToUpper(string(class))
+		if rate := parseFloatEnv(key, 0); rate > 0 {
+			rateLimiters[class] = newRateLimiter(rate, parseIntEnv(key+"_BURST", 0))
+		}
+	}
+}
+
+// rateLimitMiddleware lを超えたリクエストはハンドラを呼ばずに429を返す
+func rateLimitMiddleware(l *rateLimiter) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ok, wait := l.allow(time.Now())
+			if !ok {
+				c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				return Problem(c, http.StatusTooManyRequests, problemCode(http.StatusTooManyRequests), "rate limit exceeded")
+			}
+			return next(c)
+		}
+	}
+}
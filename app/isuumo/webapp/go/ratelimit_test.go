@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	l := newRateLimiter(2, 3)
+
+	tests := []struct {
+		at   time.Duration
+		want bool
+	}{
+		// 最初は burst 分だけ続けて通す
+		{0, true},
+		{0, true},
+		{0, true},
+		{0, false},
+		// 1秒に2件ずつ貯まる
+		{250 * time.Millisecond, false},
+		{500 * time.Millisecond, true},
+		{500 * time.Millisecond, false},
+		// 長く空いても burst を超えては貯まらない
+		{10 * time.Second, true},
+		{10 * time.Second, true},
+		{10 * time.Second, true},
+		{10 * time.Second, false},
+	}
+	for i, tt := range tests {
+		if got, _ := l.allow(start.Add(tt.at)); got != tt.want {
+			t.Errorf("#%d allow at %v = %v, want %v", i, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	e := echo.New()
+	e.HTTPErrorHandler = problemErrorHandler
+	h := rateLimitMiddleware(newRateLimiter(1, 1))(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rec := httptest.NewRecorder()
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		if err := h(c); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != want {
+			t.Errorf("#%d status = %d, want %d", i, rec.Code, want)
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("Retry-After = %q", rec.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/echo"
+)
+
+// 一度のUPDATEで更新する行のidの幅
+const rebucketBatchSize = 10000
+
+// level vが属するRangeのIDを返す どこにも属さなければ-1
+// minは含み、maxは含まない。-1は上限・下限なしを表す
+func (cond RangeCondition) level(v int64) int {
+	for _, r := range cond.Ranges {
+		if r.Min != -1 && v < r.Min {
+			continue
+		}
+		if r.Max != -1 && v >= r.Max {
+			continue
+		}
+		return int(r.ID)
+	}
+	return -1
+}
+
+// caseExpr level と同じ分類をするSQLのCASE式を返す
+func (cond RangeCondition) caseExpr(col string) (string, []interface{}) {
+	var sb strings.Builder
+	args := make([]interface{}, 0, len(cond.Ranges)*3)
+
+	sb.WriteString("CASE")
+	for _, r := range cond.Ranges {
+		var preds []string
+		if r.Min != -1 {
+			preds = append(preds, col+" >= ?")
+			args = append(args, r.Min)
+		}
+		if r.Max != -1 {
+			preds = append(preds, col+" < ?")
+			args = append(args, r.Max)
+		}
+		if len(preds) == 0 {
+			preds = append(preds, "TRUE")
+		}
+		sb.WriteString(" WHEN " + strings.Join(preds, " AND ") + " THEN ?")
+		args = append(args, r.ID)
+	}
+	sb.WriteString(" ELSE -1 END")
+
+	return sb.String(), args
+}
+
+// searchConditions fixtureから読み込んだ検索条件と、そこから作るもの
+// rebucket がリクエストを受けながら読み直すので、書き換えずに丸ごと差し替える
+type searchConditions struct {
+	Chair ChairSearchCondition
+	// ChairFeatures chairのfeature -> feature id
+	ChairFeatures map[string]int
+	// ChairJSON GET /api/chair/search/condition のレスポンス
+	ChairJSON []byte
+
+	Estate EstateSearchCondition
+	// EstateFeatures estateのfeature -> feature id
+	EstateFeatures map[string]int
+	// EstateJSON GET /api/estate/search/condition のレスポンス
+	EstateJSON []byte
+}
+
+var searchConditionsValue atomic.Value
+
+// currentConditions 今の検索条件 1つのリクエストや取り込みの中では、一度取り出したものを使い続ける
+func currentConditions() *searchConditions {
+	if sc, ok := searchConditionsValue.Load().(*searchConditions); ok {
+		return sc
+	}
+	return &searchConditions{}
+}
+
+func loadConditions() error {
+	var chairCond ChairSearchCondition
+	jsonText, err := ioutil.ReadFile("../fixture/chair_condition.json")
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(jsonText, &chairCond); err != nil {
+		return err
+	}
+
+	var estateCond EstateSearchCondition
+	jsonText, err = ioutil.ReadFile("../fixture/estate_condition.json")
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(jsonText, &estateCond); err != nil {
+		return err
+	}
+
+	chairFeatures := map[string]int{}
+	for i, s := range chairCond.Feature.List {
+		chairFeatures[s] = i
+	}
+	estateFeatures := map[string]int{}
+	for i, s := range estateCond.Feature.List {
+		estateFeatures[s] = i
+	}
+
+	searchConditionsValue.Store(&searchConditions{
+		Chair:          chairCond,
+		ChairFeatures:  chairFeatures,
+		ChairJSON:      staticJSON(chairCond),
+		Estate:         estateCond,
+		EstateFeatures: estateFeatures,
+		EstateJSON:     staticJSON(estateCond),
+	})
+
+	return nil
+}
+
+// rebucketTable tableの各levelsカラムをcolsの値とcondsに従って振り直す
+// テーブル全体をロックしないようにidの範囲ごとにUPDATEする
+func rebucketTable(table string, cols, levels []string, conds []RangeCondition) (int64, error) {
+	var maxID int64
+	if err := db.Get(&maxID, "SELECT COALESCE(MAX(id), 0) FROM "+table); err != nil {
+		return 0, err
+	}
+
+	sets := make([]string, len(cols))
+	var setArgs []interface{}
+	for i, col := range cols {
+		expr, args := conds[i].caseExpr(col)
+		sets[i] = levels[i] + " = " + expr
+		setArgs = append(setArgs, args...)
+	}
+	query := "UPDATE " + table + " SET " + strings.Join(sets, ", ") + " WHERE id >= ? AND id < ?"
+
+	var updated int64
+	for from := int64(0); from <= maxID; from += rebucketBatchSize {
+		args := append(setArgs[:len(setArgs):len(setArgs)], from, from+rebucketBatchSize)
+		var res sql.Result
+		err := retryWrite(context.Background(), func() error {
+			var err error
+			res, err = db.Exec(query, args...)
+			return err
+		})
+		if err != nil {
+			return updated, err
+		}
+		n, _ := res.RowsAffected()
+		updated += n
+	}
+	return updated, nil
+}
+
+// rebucket fixtureを読み直して全行の*_levelカラムを再計算する
+func rebucket(c echo.Context) error {
+	if err := loadConditions(); err != nil {
+		c.Logger().Errorf("rebucket failed to load conditions : %v", err)
+		return internalError(c)
+	}
+
+	cond := currentConditions()
+	chairs, err := rebucketTable("chair",
+		[]string{"width", "height", "depth", "price"},
+		[]string{"width_level", "height_level", "depth_level", "price_level"},
+		[]RangeCondition{cond.Chair.Width, cond.Chair.Height, cond.Chair.Depth, cond.Chair.Price},
+	)
+	if err != nil {
+		c.Logger().Errorf("rebucket chair DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	estates, err := rebucketTable("estate",
+		[]string{"door_width", "door_height", "rent"},
+		[]string{"width_level", "height_level", "rent_level"},
+		[]RangeCondition{cond.Estate.DoorWidth, cond.Estate.DoorHeight, cond.Estate.Rent},
+	)
+	if err != nil {
+		c.Logger().Errorf("rebucket estate DB execution error : %v", err)
+		return internalError(c)
+	}
+	if _, err := syncEstateSearchLevels(); err != nil {
+		c.Logger().Errorf("rebucket estate_search DB execution error : %v", err)
+		return internalError(c)
+	}
+	if flagInMemorySearch.Enabled() {
+		if err := loadMemSearchIndexes(); err != nil {
+			c.Logger().Errorf("rebucket in-memory index error : %v", err)
+			return internalError(c)
+		}
+	}
+	scheduleElasticsearchReindex()
+
+	return JSON(c, http.StatusOK, echo.Map{
+		"chairs":  chairs,
+		"estates": estates,
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// rebucket がリクエストを受けながら検索条件を読み直しても、読む側は揃った組を見る
+func TestLoadConditionsConcurrentReads(t *testing.T) {
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				sc := currentConditions()
+				if len(sc.ChairFeatures) != len(sc.Chair.Feature.List) || len(sc.EstateFeatures) != len(sc.Estate.Feature.List) {
+					t.Error("feature maps do not match the conditions")
+					return
+				}
+				sc.Chair.Price.level(5000)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		if err := loadConditions(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestRangeConditionLevel(t *testing.T) {
+	cond := RangeCondition{Ranges: []*Range{
+		{ID: 0, Min: -1, Max: 80},
+		{ID: 1, Min: 80, Max: 110},
+		{ID: 2, Min: 110, Max: -1},
+	}}
+	gap := RangeCondition{Ranges: []*Range{
+		{ID: 0, Min: 0, Max: 10},
+		{ID: 1, Min: 20, Max: 30},
+	}}
+
+	tests := []struct {
+		name string
+		cond RangeCondition
+		v    int64
+		want int
+	}{
+		{"no lower bound", cond, -100, 0},
+		{"below max", cond, 79, 0},
+		{"max is exclusive", cond, 80, 1},
+		{"inside", cond, 100, 1},
+		{"min is inclusive", cond, 110, 2},
+		{"no upper bound", cond, 1 << 40, 2},
+		{"below first", gap, -1, -1},
+		{"between ranges", gap, 15, -1},
+		{"above last", gap, 30, -1},
+		{"no ranges", RangeCondition{}, 0, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cond.level(tt.v); got != tt.want {
+				t.Errorf("level(%d) = %d, want %d", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeConditionCaseExpr(t *testing.T) {
+	tests := []struct {
+		name  string
+		cond  RangeCondition
+		query string
+		args  []interface{}
+	}{
+		{
+			"bounded and open",
+			RangeCondition{Ranges: []*Range{{ID: 0, Min: -1, Max: 80}, {ID: 1, Min: 80, Max: 110}, {ID: 2, Min: 110, Max: -1}}},
+			"CASE WHEN w < ? THEN ? WHEN w >= ? AND w < ? THEN ? WHEN w >= ? THEN ? ELSE -1 END",
+			[]interface{}{int64(80), int64(0), int64(80), int64(110), int64(1), int64(110), int64(2)},
+		},
+		{
+			"unbounded",
+			RangeCondition{Ranges: []*Range{{ID: 3, Min: -1, Max: -1}}},
+			"CASE WHEN TRUE THEN ? ELSE -1 END",
+			[]interface{}{int64(3)},
+		},
+		{"no ranges", RangeCondition{}, "CASE ELSE -1 END", []interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := tt.cond.caseExpr("w")
+			if query != tt.query {
+				t.Errorf("query = %s, want %s", query, tt.query)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %v, want %v", args, tt.args)
+			}
+		})
+	}
+}
+
+// fixtureの区間は隙間なく並んでいるので、0以上の値は必ずどれかのlevelに入る
+func TestFixtureRangeConditionsCoverValues(t *testing.T) {
+	sc := currentConditions()
+	conds := map[string]RangeCondition{
+		"chair price":        sc.Chair.Price,
+		"chair height":       sc.Chair.Height,
+		"chair width":        sc.Chair.Width,
+		"chair depth":        sc.Chair.Depth,
+		"estate rent":        sc.Estate.Rent,
+		"estate door height": sc.Estate.DoorHeight,
+		"estate door width":  sc.Estate.DoorWidth,
+	}
+	for name, cond := range conds {
+		for _, r := range cond.Ranges {
+			for _, v := range []int64{r.Min, r.Max - 1} {
+				if v < 0 {
+					continue
+				}
+				if got := cond.level(v); got != int(r.ID) {
+					t.Errorf("%s: level(%d) = %d, want %d", name, v, got, r.ID)
+				}
+			}
+			if r.Max != -1 && cond.level(r.Max) == -1 {
+				t.Errorf("%s: level(%d) has no range", name, r.Max)
+			}
+		}
+	}
+}
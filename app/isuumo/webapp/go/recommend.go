@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/isucon/isucon10-qualify/isuumo/cache"
+	"github.com/labstack/gommon/log"
+)
+
+// initialize と postEstate の後に、全ての椅子の2辺についておすすめ物件を作っておく
+var flagPrecomputeRecommended = newFeatureFlag("PRECOMPUTE_RECOMMENDED", true)
+
+// recommendedEstateIDs 椅子の小さい方から2辺 -> おすすめ物件のIDのキャッシュ
+// 物件が通るかどうかは小さい2辺だけで決まるので、同じ2辺を持つ椅子で共有できる
+var recommendedEstateIDs = map[[2]int64][]int{}
+var recommendedEstateIDsMutex sync.RWMutex
+
+// recommendedEstateIDsGeneration 無効化のたびに増やす
+var recommendedEstateIDsGeneration int64
+
+// recommendedPrecomputeMutex 作り直しを1つずつにする
+var recommendedPrecomputeMutex sync.Mutex
+
+// smallestTwo 3辺のうち小さい方から2辺を x <= y の順で返す
+func smallestTwo(w, h, d int64) (int64, int64) {
+	dims := []int64{w, h, d}
+	sort.Slice(dims, func(i, j int) bool { return dims[i] < dims[j] })
+	return dims[0], dims[1]
+}
+
+// doorFitPairs 椅子がドアを通るための (ドアの幅, ドアの高さ) の下限の組
+// 6通りの向きのうち、小さい2辺 x <= y を使う (x, y) と (y, x) 以外は
+// どちらかに包含されるので、この2つを満たすかだけを見れば良い
+func doorFitPairs(w, h, d int64) [2][2]int64 {
+	x, y := smallestTwo(w, h, d)
+	return [2][2]int64{{x, y}, {y, x}}
+}
+
+// fitsThroughDoor 幅w, 高さh, 奥行きdの椅子が doorW x doorH のドアを通るか
+// ちょうど同じ大きさなら通る
+func fitsThroughDoor(w, h, d, doorW, doorH int64) bool {
+	for _, p := range doorFitPairs(w, h, d) {
+		if doorW >= p[0] && doorH >= p[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// doorFitCondition fitsThroughDoor と同じ判定をするSQLの条件
+// (幅, 高さ) が (x, y) か (y, x) 以上というのは、小さい方が x 以上かつ大きい方が y 以上と同じなので
+// door_min, door_max の生成列と1つの複合インデックスで絞り込める
+func doorFitCondition(w, h, d int64) (string, []interface{}) {
+	x, y := smallestTwo(w, h, d)
+	return "door_min >= ? AND door_max >= ?", []interface{}{x, y}
+}
+
+// recommendKey 椅子の3辺のうち小さい方から2辺を返す
+func recommendKey(chair Chair) [2]int64 {
+	x, y := smallestTwo(chair.Width, chair.Height, chair.Depth)
+	return [2]int64{x, y}
+}
+
+// recommendedEstateIDsCounter, recommendedEstateResponsesCounter 保存済みの結果を使えたか
+var recommendedEstateIDsCounter, recommendedEstateResponsesCounter cache.HitCounter
+
+func getRecommendedEstateIDs(key [2]int64) ([]int, bool) {
+	recommendedEstateIDsMutex.RLock()
+	ids, ok := recommendedEstateIDs[key]
+	recommendedEstateIDsMutex.RUnlock()
+	if ok {
+		recommendedEstateIDsCounter.Hit()
+	} else {
+		recommendedEstateIDsCounter.Miss()
+	}
+	return ids, ok
+}
+
+func setRecommendedEstateIDs(key [2]int64, estates []Estate) {
+	ids := make([]int, len(estates))
+	for i, e := range estates {
+		ids[i] = int(e.ID)
+	}
+
+	recommendedEstateIDsMutex.Lock()
+	recommendedEstateIDs[key] = ids
+	recommendedEstateIDsMutex.Unlock()
+}
+
+// loadRecommendedEstates chairが通る物件を人気順に Limit 件dstへ追加して返す
+// recommendedEstateIDs にあればそれを使い、なければリポジトリから求めて保存する
+func loadRecommendedEstates(ctx context.Context, chair Chair, dst []Estate) ([]Estate, error) {
+	key := recommendKey(chair)
+	if ids, ok := getRecommendedEstateIDs(key); ok {
+		return srv.getEstatesByIDs(ctx, ids, dst)
+	}
+
+	n := len(dst)
+	dst, err := srv.Estates.EstatesForChair(ctx, chair, Limit, dst)
+	if err != nil {
+		return dst, err
+	}
+
+	cacheEstates(dst[n:])
+	setRecommendedEstateIDs(key, dst[n:])
+	return dst, nil
+}
+
+// invalidateRecommendedEstateIDs 物件が追加されたら捨てる
+func invalidateRecommendedEstateIDs() {
+	recommendedEstateIDsMutex.Lock()
+	recommendedEstateIDs = map[[2]int64][]int{}
+	recommendedEstateResponses = map[int]recommendedEstateResponse{}
+	recommendedEstateIDsGeneration++
+	recommendedEstateIDsMutex.Unlock()
+}
+
+// 椅子のid -> おすすめ物件のレスポンス をキャッシュし、同じ椅子では物件を並べ直さない
+var flagRecommendedResponseCache = newFeatureFlag("RECOMMENDED_RESPONSE_CACHE", true)
+
+// recommendedEstateResponse 作ったときの椅子の2辺とレスポンス
+type recommendedEstateResponse struct {
+	key [2]int64
+	res *EstateListResponse
+}
+
+// recommendedEstateResponses 椅子のid -> おすすめ物件のレスポンス
+// recommendedEstateIDs と一緒に recommendedEstateIDsMutex で守り、一緒に捨てる
+var recommendedEstateResponses = map[int]recommendedEstateResponse{}
+
+func getRecommendedEstateResponse(id int) (*EstateListResponse, bool) {
+	recommendedEstateIDsMutex.RLock()
+	r, ok := recommendedEstateResponses[id]
+	recommendedEstateIDsMutex.RUnlock()
+	if ok {
+		recommendedEstateResponsesCounter.Hit()
+	} else {
+		recommendedEstateResponsesCounter.Miss()
+	}
+	return r.res, ok
+}
+
+// setRecommendedEstateResponse generationの後に無効化されていれば保存しない
+func setRecommendedEstateResponse(id int, key [2]int64, estates []Estate, generation int64) {
+	res := &EstateListResponse{Estates: constEmptyEstates}
+	if len(estates) > 0 {
+		res.Estates = append([]Estate(nil), estates...)
+	}
+
+	recommendedEstateIDsMutex.Lock()
+	if recommendedEstateIDsGeneration == generation {
+		recommendedEstateResponses[id] = recommendedEstateResponse{key: key, res: res}
+	}
+	recommendedEstateIDsMutex.Unlock()
+}
+
+// invalidateRecommendedEstateResponses postChairで上書きした椅子のうち、2辺が変わったものを捨てる
+// 2辺が同じならおすすめ物件も同じなので残す
+func invalidateRecommendedEstateResponses(keys map[int][2]int64) {
+	recommendedEstateIDsMutex.Lock()
+	for id, key := range keys {
+		if r, ok := recommendedEstateResponses[id]; ok && r.key != key {
+			delete(recommendedEstateResponses, id)
+		}
+	}
+	recommendedEstateIDsMutex.Unlock()
+}
+
+// doorEstate おすすめ物件を選ぶのに必要な物件の情報
+type doorEstate struct {
+	ID         int   `db:"id"`
+	DoorWidth  int64 `db:"door_width"`
+	DoorHeight int64 `db:"door_height"`
+}
+
+// precomputeRecommendedEstateIDs 椅子にある全ての2辺について、人気順に Limit 件のおすすめ物件を求める
+// 物件を人気順に1度だけ読み込み、2辺ごとに先頭から通るものを拾う
+func precomputeRecommendedEstateIDs() error {
+	recommendedPrecomputeMutex.Lock()
+	defer recommendedPrecomputeMutex.Unlock()
+
+	recommendedEstateIDsMutex.RLock()
+	generation := recommendedEstateIDsGeneration
+	recommendedEstateIDsMutex.RUnlock()
+
+	var estates []doorEstate
+	if err := db.Select(&estates, "SELECT id, door_width, door_height FROM estate ORDER BY neg_popularity ASC, id ASC"); err != nil {
+		return err
+	}
+	var dims []struct {
+		Width  int64 `db:"width"`
+		Height int64 `db:"height"`
+		Depth  int64 `db:"depth"`
+	}
+	if err := db.Select(&dims, "SELECT DISTINCT width, height, depth FROM chair"); err != nil {
+		return err
+	}
+
+	res := map[[2]int64][]int{}
+	for _, d := range dims {
+		x, y := smallestTwo(d.Width, d.Height, d.Depth)
+		key := [2]int64{x, y}
+		if _, ok := res[key]; ok {
+			continue
+		}
+		ids := make([]int, 0, Limit)
+		for _, e := range estates {
+			if fitsThroughDoor(d.Width, d.Height, d.Depth, e.DoorWidth, e.DoorHeight) {
+				ids = append(ids, e.ID)
+				if len(ids) == Limit {
+					break
+				}
+			}
+		}
+		res[key] = ids
+	}
+
+	recommendedEstateIDsMutex.Lock()
+	if recommendedEstateIDsGeneration == generation {
+		for key, ids := range res {
+			recommendedEstateIDs[key] = ids
+		}
+	}
+	recommendedEstateIDsMutex.Unlock()
+	return nil
+}
+
+// scheduleRecommendedPrecompute バックグラウンドでおすすめ物件を作り直す
+func scheduleRecommendedPrecompute() {
+	if !flagPrecomputeRecommended.Enabled() {
+		return
+	}
+	tasks.Go("precomputeRecommendedEstateIDs", func() {
+		if err := precomputeRecommendedEstateIDs(); err != nil {
+			log.Errorf("precomputeRecommendedEstateIDs DB execution error : %v", err)
+		}
+	})
+}
+
+// cacheEstates estatesを cachedEstates に登録する
+func cacheEstates(estates []Estate) {
+	for _, estate := range estates {
+		cachedEstates.Add(int(estate.ID), withEstateFragment(estate))
+	}
+}
+
+// getEstatesByIDs idsの物件をidsの順にdstへ追加して返す
+// cachedEstates にないものだけ s.Estates からまとめて取得する
+// 取得した直後に追い出されることがあるので、結果はキャッシュを引き直さずに組み立てる
+func (s *Server) getEstatesByIDs(ctx context.Context, ids []int, dst []Estate) ([]Estate, error) {
+	missingIDs := getEmptyIntSlice()
+	defer releaseIntSlice(missingIDs)
+
+	found := make(map[int]Estate, len(ids))
+	for _, id := range ids {
+		if v, ok := cachedEstates.Get(id); ok {
+			found[id] = v.(Estate)
+		} else {
+			missingIDs = append(missingIDs, id)
+		}
+	}
+
+	if len(missingIDs) > 0 {
+		missingEstates, err := s.Estates.EstatesByIDs(ctx, missingIDs, getEmptyEstateSlice())
+		defer releaseEstateSlice(missingEstates)
+		if err != nil {
+			return dst, err
+		}
+		cacheEstates(missingEstates)
+		for _, estate := range missingEstates {
+			found[int(estate.ID)] = estate
+		}
+	}
+
+	for _, id := range ids {
+		if estate, ok := found[id]; ok {
+			dst = append(dst, estate)
+		}
+	}
+
+	return dst, nil
+}
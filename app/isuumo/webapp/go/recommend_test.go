@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+// fitsThroughDoorBrute 椅子の6通りの向きを全て試す
+func fitsThroughDoorBrute(w, h, d, doorW, doorH int64) bool {
+	dims := []int64{w, h, d}
+	for i := range dims {
+		for j := range dims {
+			if i != j && doorW >= dims[i] && doorH >= dims[j] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestFitsThroughDoorExhaustive(t *testing.T) {
+	const n = 7
+	for w := int64(0); w < n; w++ {
+		for h := int64(0); h < n; h++ {
+			for d := int64(0); d < n; d++ {
+				x, y := smallestTwo(w, h, d)
+				query, args := doorFitCondition(w, h, d)
+				if query != "door_min >= ? AND door_max >= ?" || args[0] != x || args[1] != y {
+					t.Fatalf("doorFitCondition(%d, %d, %d) = %s %v", w, h, d, query, args)
+				}
+				for doorW := int64(0); doorW < n; doorW++ {
+					for doorH := int64(0); doorH < n; doorH++ {
+						want := fitsThroughDoorBrute(w, h, d, doorW, doorH)
+						if got := fitsThroughDoor(w, h, d, doorW, doorH); got != want {
+							t.Errorf("fitsThroughDoor(%d, %d, %d, %d, %d) = %v, want %v", w, h, d, doorW, doorH, got, want)
+						}
+						// 3辺の並びを入れ替えても、ドアの幅と高さを入れ替えても変わらない
+						for _, p := range [][3]int64{{w, d, h}, {h, w, d}, {h, d, w}, {d, w, h}, {d, h, w}} {
+							if got := fitsThroughDoor(p[0], p[1], p[2], doorH, doorW); got != want {
+								t.Errorf("fitsThroughDoor(%d, %d, %d, %d, %d) = %v, want %v", p[0], p[1], p[2], doorH, doorW, got, want)
+							}
+						}
+						// door_min, door_max の生成列に対する条件でも同じ結果になる
+						doorMin, doorMax := doorW, doorH
+						if doorMin > doorMax {
+							doorMin, doorMax = doorMax, doorMin
+						}
+						if got := doorMin >= x && doorMax >= y; got != want {
+							t.Errorf("doorFitCondition(%d, %d, %d) on %dx%d = %v, want %v", w, h, d, doorW, doorH, got, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRecommendKey(t *testing.T) {
+	tests := []struct {
+		chair Chair
+		want  [2]int64
+	}{
+		{Chair{Width: 50, Height: 100, Depth: 70}, [2]int64{50, 70}},
+		{Chair{Width: 100, Height: 70, Depth: 50}, [2]int64{50, 70}},
+		{Chair{Width: 60, Height: 60, Depth: 60}, [2]int64{60, 60}},
+		{Chair{Width: 10, Height: 10, Depth: 200}, [2]int64{10, 10}},
+	}
+	for _, tt := range tests {
+		if got := recommendKey(tt.chair); got != tt.want {
+			t.Errorf("recommendKey(%d, %d, %d) = %v, want %v", tt.chair.Width, tt.chair.Height, tt.chair.Depth, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisCache Redisを使う Cache
+// 使うコマンドは GET, SET, DEL だけなので、クライアントライブラリを入れずにRESPを直接話す
+type redisCache struct {
+	addr    string
+	timeout time.Duration
+	// conns 使い終わった接続 溢れたら閉じる
+	conns chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// errRedisNil キーがない
+var errRedisNil = errors.New("redis: nil")
+
+func newRedisCache(addr string, poolSize int, timeout time.Duration) *redisCache {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "6379")
+	}
+	return &redisCache{addr: addr, timeout: timeout, conns: make(chan *redisConn, poolSize)}
+}
+
+func (rc *redisCache) conn() (*redisConn, error) {
+	select {
+	case c := <-rc.conns:
+		return c, nil
+	default:
+	}
+	c, err := net.DialTimeout("tcp", rc.addr, rc.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &redisConn{Conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}, nil
+}
+
+func (rc *redisCache) release(c *redisConn) {
+	select {
+	case rc.conns <- c:
+	default:
+		c.Close()
+	}
+}
+
+// do コマンドを送って応答を返す 応答は []byte (nilなら errRedisNil), int64, string のどれか
+func (rc *redisCache) do(args ...[]byte) (interface{}, error) {
+	c, err := rc.conn()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(rc.timeout))
+
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n", len(a))
+		c.w.Write(a)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	res, err := readRedisReply(c.r)
+	if err != nil && err != errRedisNil {
+		// エラー応答以外では接続の状態がわからないので捨てる
+		if _, ok := err.(redisError); !ok {
+			c.Close()
+			return nil, err
+		}
+	}
+	rc.release(c)
+	return res, err
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+	return nil, fmt.Errorf("redis: unsupported reply %q", line)
+}
+
+func (rc *redisCache) Get(key string) ([]byte, bool, error) {
+	res, err := rc.do([]byte("GET"), []byte(key))
+	if err == errRedisNil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	b, ok := res.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("redis: unexpected reply %v", res)
+	}
+	return b, true, nil
+}
+
+func (rc *redisCache) Set(key string, value []byte, ttl time.Duration) error {
+	args := [][]byte{[]byte("SET"), []byte(key), value}
+	if ttl > 0 {
+		args = append(args, []byte("PX"), []byte(strconv.FormatInt(int64(ttl/time.Millisecond), 10)))
+	}
+	_, err := rc.do(args...)
+	return err
+}
+
+func (rc *redisCache) Delete(keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	args := make([][]byte, 0, len(keys)+1)
+	args = append(args, []byte("DEL"))
+	for _, k := range keys {
+		args = append(args, []byte(k))
+	}
+	_, err := rc.do(args...)
+	return err
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ChairRepository, EstateRepository, ReservationRepository ハンドラが元のデータを読み書きする先
+// メモリ上のインデックスやレプリカに振り分ける実装に差し替えられるように、DBを直接読む箇所をここに集める
+// 使う実装は Server が持つ
+// Chair, Estate に appendProto やキャッシュ用の fragment がついているので、キャッシュ (cache パッケージ) と違って main から分けていない
+type ChairRepository interface {
+	// ChairByID 見つからなければ sql.ErrNoRows を返す
+	ChairByID(ctx context.Context, id int) (Chair, error)
+	// IndexChairs 検索インデックスに入れる列だけを読む idsがnilなら全ての椅子を読む
+	IndexChairs(ctx context.Context, ids []int64) ([]Chair, error)
+	// BuyChair 在庫があって非表示でなければ1つ減らし、減らした後の在庫を返す 買えなければ sql.ErrNoRows を返す
+	BuyChair(ctx context.Context, id int) (int64, error)
+	// BuyChairs quantitiesの数だけまとめて減らし、売り切れた椅子があればtrueを返す 1つでも足りなければ何も減らさない
+	// idsはquantitiesのidの昇順 見つからないか非表示なら errChairNotFound、在庫が足りなければ errOutOfStock を返す
+	BuyChairs(ctx context.Context, ids []int64, quantities map[int64]int64) (bool, error)
+	// RestockChair 在庫をfnが返す値にして、前後の在庫を返す
+	// 見つからなければ sql.ErrNoRows、負になるなら errNegativeStock を返す
+	RestockChair(ctx context.Context, id int, fn func(stock int64) int64) (before, after int64, err error)
+	// SetChairHidden 見つからなければ sql.ErrNoRows を返す
+	SetChairHidden(ctx context.Context, id int, hidden bool) error
+	// ImportChairs rのCSVの椅子を書き込む fは書き込んだ後に閉じる
+	// やり直すときはopenで開き直す CSVの誤りは csvInputError で返す
+	ImportChairs(ctx context.Context, open func() (*csv.Reader, io.Closer, error), r *csv.Reader, f io.Closer, columns []csvColumn) (*chairImport, error)
+	// LowPricedChairs 在庫があって非表示でない椅子を安い順にlimit件読む
+	LowPricedChairs(ctx context.Context, limit int) ([]Chair, error)
+}
+
+type EstateRepository interface {
+	// EstateByID 見つからなければ sql.ErrNoRows を返す
+	EstateByID(ctx context.Context, id int) (Estate, error)
+	// EstatesByIDs idsの物件を順不同でdstに追加する 見つからないidは飛ばす
+	EstatesByIDs(ctx context.Context, ids []int, dst []Estate) ([]Estate, error)
+	// IndexEstates 検索インデックスに入れる列だけを読む idsがnilなら全ての物件を読む
+	IndexEstates(ctx context.Context, ids []int64) ([]Estate, error)
+	// ImportEstates ImportChairs の物件版
+	ImportEstates(ctx context.Context, open func() (*csv.Reader, io.Closer, error), r *csv.Reader, f io.Closer, columns []csvColumn) (*estateImport, error)
+	// LowPricedEstates 賃料の安い順にlimit件読む
+	LowPricedEstates(ctx context.Context, limit int) ([]Estate, error)
+	// EstatesForChair chairがドアを通る物件を人気順にlimit件dstへ追加する
+	EstatesForChair(ctx context.Context, chair Chair, limit int, dst []Estate) ([]Estate, error)
+	// EstatesInBoundingBox bの中の物件の id, latitude, longitude だけをdstへ追加する
+	EstatesInBoundingBox(ctx context.Context, b BoundingBox, dst []Estate) ([]Estate, error)
+}
+
+// ReservationRepository 取り置き
+// 在庫を減らすのは Reserve だけで、IN_MEMORY_STOCK のときは在庫をメモリ上で減らしてから Insert する
+type ReservationRepository interface {
+	// Reserve 在庫があって非表示でない椅子の在庫を1つ減らして取り置きを作り、取り置きのidと減らす前の在庫を返す
+	// 取り置きできなければ sql.ErrNoRows を返す
+	Reserve(ctx context.Context, chairID int, email, token string, minutes int) (id, stock int64, err error)
+	// Insert 在庫には触れずに取り置きを作る
+	Insert(ctx context.Context, chairID int, email, token string, minutes int) (int64, error)
+	// Confirm 期限内でtokenが一致する有効な取り置きを確定し、椅子とemailを返す なければ sql.ErrNoRows を返す
+	Confirm(ctx context.Context, id int64, token string) (chairID int64, email string, err error)
+	// Owned idの取り置きのtokenがtokenか
+	Owned(ctx context.Context, id int64, token string) (bool, error)
+	// Release idsのうち有効な取り置きをstatusにして、その椅子のidを返す restockなら在庫も戻す
+	Release(ctx context.Context, ids []int64, status string, restock bool) ([]int64, error)
+	// Expired 期限切れの有効な取り置きのid
+	Expired(ctx context.Context) ([]int64, error)
+}
+
+// selectByIDs idsがnilならqueryの全ての行を、そうでなければidsの行を読む
+func selectByIDs(ctx context.Context, db *sqlx.DB, dst interface{}, query string, ids []int64) error {
+	if ids == nil {
+		return db.SelectContext(ctx, dst, query)
+	}
+	q, args, err := sqlx.In(query+" WHERE id IN (?)", ids)
+	if err != nil {
+		return err
+	}
+	return db.SelectContext(ctx, dst, db.Rebind(q), args...)
+}
+
+// mysqlChairRepository, mysqlEstateRepository, mysqlReservationRepository dbを読み書きする
+type mysqlChairRepository struct {
+	db *sqlx.DB
+}
+
+func (r mysqlChairRepository) ChairByID(ctx context.Context, id int) (Chair, error) {
+	var chair Chair
+	err := r.db.GetContext(ctx, &chair, "SELECT * FROM chair WHERE id = ?", id)
+	return chair, err
+}
+
+func (r mysqlChairRepository) IndexChairs(ctx context.Context, ids []int64) ([]Chair, error) {
+	var rows []Chair
+	err := selectByIDs(ctx, r.db, &rows, "SELECT id, popularity, price_level, height_level, width_level, depth_level, kind, color, features, stock, hidden FROM chair", ids)
+	return rows, err
+}
+
+func (r mysqlChairRepository) BuyChair(ctx context.Context, id int) (int64, error) {
+	// 行ロックを取らずに在庫がある場合だけ1つ減らす
+	// LAST_INSERT_ID(expr) で減らした後の在庫を同じ往復で受け取る
+	var res sql.Result
+	err := retryWrite(ctx, func() error {
+		var err error
+		res, err = r.db.ExecContext(ctx, "UPDATE chair SET stock = LAST_INSERT_ID(stock - 1) WHERE id = ? AND stock > 0 AND hidden = 0", id)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, sql.ErrNoRows
+	}
+	return res.LastInsertId()
+}
+
+func (r mysqlChairRepository) BuyChairs(ctx context.Context, ids []int64, quantities map[int64]int64) (bool, error) {
+	var soldOut bool
+	err := runInTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		var rows []struct {
+			ID    int64 `db:"id"`
+			Stock int64 `db:"stock"`
+		}
+		// デッドロックを避けるためにidの昇順でロックする
+		query, args, err := sqlx.In("SELECT id, stock FROM chair WHERE id IN (?) AND hidden = 0 ORDER BY id FOR UPDATE", ids)
+		if err != nil {
+			return err
+		}
+		if err := tx.SelectContext(ctx, &rows, tx.Rebind(query), args...); err != nil {
+			return err
+		}
+		if len(rows) != len(ids) {
+			return errChairNotFound
+		}
+
+		soldOut = false
+		cases := make([]string, 0, len(rows))
+		updateArgs := make([]interface{}, 0, len(rows)*2+len(ids))
+		for _, row := range rows {
+			q := quantities[row.ID]
+			if row.Stock < q {
+				return errOutOfStock
+			}
+			if row.Stock == q {
+				soldOut = true
+			}
+			cases = append(cases, "WHEN ? THEN ?")
+			updateArgs = append(updateArgs, row.ID, q)
+		}
+
+		query, args, err = sqlx.In("UPDATE chair SET stock = stock - CASE id "+strings.Join(cases, " ")+" END WHERE id IN (?)", append(updateArgs, ids)...)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, tx.Rebind(query), args...)
+		return err
+	})
+	return soldOut, err
+}
+
+func (r mysqlChairRepository) RestockChair(ctx context.Context, id int, fn func(stock int64) int64) (before, after int64, err error) {
+	err = runInTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &before, "SELECT stock FROM chair WHERE id = ? FOR UPDATE", id); err != nil {
+			return err
+		}
+		after = fn(before)
+		if after < 0 {
+			return errNegativeStock
+		}
+		_, err := tx.ExecContext(ctx, "UPDATE chair SET stock = ? WHERE id = ?", after, id)
+		return err
+	})
+	return before, after, err
+}
+
+func (r mysqlChairRepository) SetChairHidden(ctx context.Context, id int, hidden bool) error {
+	var exists bool
+	if err := r.db.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM chair WHERE id = ?)", id); err != nil {
+		return err
+	}
+	if !exists {
+		return sql.ErrNoRows
+	}
+	return retryWrite(ctx, func() error {
+		_, err := r.db.ExecContext(ctx, "UPDATE chair SET hidden = ? WHERE id = ?", hidden, id)
+		return err
+	})
+}
+
+func (r mysqlChairRepository) ImportChairs(ctx context.Context, open func() (*csv.Reader, io.Closer, error), cr *csv.Reader, f io.Closer, columns []csvColumn) (*chairImport, error) {
+	defer func() { f.Close() }()
+
+	var res *chairImport
+	attempt := 0
+	err := runInTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		attempt++
+		if attempt > 1 {
+			nr, nf, err := open()
+			if err != nil {
+				return err
+			}
+			f.Close()
+			cr, f = nr, nf
+		}
+		imp, err := importChairs(tx.Tx, cr, columns)
+		res = imp
+		return err
+	})
+	return res, err
+}
+
+func (r mysqlChairRepository) LowPricedChairs(ctx context.Context, limit int) ([]Chair, error) {
+	chairs := make([]Chair, 0, limit)
+	err := r.db.SelectContext(ctx, &chairs, "SELECT * FROM chair WHERE stock > 0 AND hidden = 0 ORDER BY price ASC, id ASC LIMIT ?", limit)
+	return chairs, err
+}
+
+type mysqlEstateRepository struct {
+	db *sqlx.DB
+}
+
+func (r mysqlEstateRepository) EstateByID(ctx context.Context, id int) (Estate, error) {
+	var estate Estate
+	err := r.db.GetContext(ctx, &estate, "SELECT * FROM estate WHERE id = ?", id)
+	return estate, err
+}
+
+func (r mysqlEstateRepository) EstatesByIDs(ctx context.Context, ids []int, dst []Estate) ([]Estate, error) {
+	query, args, err := sqlx.In("SELECT * FROM estate WHERE id IN (?)", ids)
+	if err != nil {
+		return dst, err
+	}
+	var rows []Estate
+	if err := r.db.SelectContext(ctx, &rows, r.db.Rebind(query), args...); err != nil {
+		return dst, err
+	}
+	return append(dst, rows...), nil
+}
+
+func (r mysqlEstateRepository) IndexEstates(ctx context.Context, ids []int64) ([]Estate, error) {
+	var rows []Estate
+	err := selectByIDs(ctx, r.db, &rows, "SELECT id, name, description, address, prefecture, rent, door_height, door_width, features, popularity, rent_level, height_level, width_level FROM estate", ids)
+	return rows, err
+}
+
+func (r mysqlEstateRepository) ImportEstates(ctx context.Context, open func() (*csv.Reader, io.Closer, error), cr *csv.Reader, f io.Closer, columns []csvColumn) (*estateImport, error) {
+	defer func() { f.Close() }()
+
+	var res *estateImport
+	attempt := 0
+	err := runInTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		attempt++
+		if attempt > 1 {
+			nr, nf, err := open()
+			if err != nil {
+				return err
+			}
+			f.Close()
+			cr, f = nr, nf
+		}
+		imp, err := importEstates(tx.Tx, cr, columns)
+		res = imp
+		return err
+	})
+	return res, err
+}
+
+func (r mysqlEstateRepository) LowPricedEstates(ctx context.Context, limit int) ([]Estate, error) {
+	estates := make([]Estate, 0, limit)
+	err := r.db.SelectContext(ctx, &estates, "SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT ?", limit)
+	return estates, err
+}
+
+func (r mysqlEstateRepository) EstatesForChair(ctx context.Context, chair Chair, limit int, dst []Estate) ([]Estate, error) {
+	cond, params := doorFitCondition(chair.Width, chair.Height, chair.Depth)
+	query := `SELECT * FROM estate WHERE ` + cond + ` ORDER BY neg_popularity ASC, id ASC LIMIT ?`
+	if err := r.db.SelectContext(ctx, &dst, query, append(params, limit)...); err != nil && err != sql.ErrNoRows {
+		return dst, err
+	}
+	return dst, nil
+}
+
+func (r mysqlEstateRepository) EstatesInBoundingBox(ctx context.Context, b BoundingBox, dst []Estate) ([]Estate, error) {
+	query := `SELECT id, latitude, longitude FROM estate WHERE latitude <= ? AND latitude >= ? AND longitude <= ? AND longitude >= ?`
+	if err := r.db.SelectContext(ctx, &dst, query, b.BottomRightCorner.Latitude, b.TopLeftCorner.Latitude, b.BottomRightCorner.Longitude, b.TopLeftCorner.Longitude); err != nil && err != sql.ErrNoRows {
+		return dst, err
+	}
+	return dst, nil
+}
+
+type mysqlReservationRepository struct {
+	db *sqlx.DB
+}
+
+const insertReservationQuery = "INSERT INTO reservation (chair_id, email, token, status, expires_at) VALUES (?, ?, ?, ?, DATE_ADD(NOW(), INTERVAL ? MINUTE))"
+
+func (r mysqlReservationRepository) Reserve(ctx context.Context, chairID int, email, token string, minutes int) (id, stock int64, err error) {
+	err = runInTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &stock, "SELECT stock FROM chair WHERE id = ? AND stock > 0 AND hidden = 0 FOR UPDATE", chairID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock - 1 WHERE id = ?", chairID); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, insertReservationQuery, chairID, email, token, reservationActive, minutes)
+		if err != nil {
+			return err
+		}
+		id, err = res.LastInsertId()
+		return err
+	})
+	return id, stock, err
+}
+
+func (r mysqlReservationRepository) Insert(ctx context.Context, chairID int, email, token string, minutes int) (int64, error) {
+	var res sql.Result
+	err := retryWrite(ctx, func() error {
+		var err error
+		res, err = r.db.ExecContext(ctx, insertReservationQuery, chairID, email, token, reservationActive, minutes)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func (r mysqlReservationRepository) Confirm(ctx context.Context, id int64, token string) (chairID int64, email string, err error) {
+	var reservation struct {
+		ChairID int64  `db:"chair_id"`
+		Email   string `db:"email"`
+	}
+	err = runInTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &reservation, "SELECT chair_id, email FROM reservation WHERE id = ? AND token = ? AND status = ? AND expires_at >= NOW() FOR UPDATE",
+			id, token, reservationActive)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE reservation SET status = ? WHERE id = ?", reservationConfirmed, id)
+		return err
+	})
+	return reservation.ChairID, reservation.Email, err
+}
+
+func (r mysqlReservationRepository) Owned(ctx context.Context, id int64, token string) (bool, error) {
+	var owned bool
+	err := r.db.GetContext(ctx, &owned, "SELECT EXISTS(SELECT 1 FROM reservation WHERE id = ? AND token = ?)", id, token)
+	return owned, err
+}
+
+func (r mysqlReservationRepository) Release(ctx context.Context, ids []int64, status string, restock bool) ([]int64, error) {
+	var chairIDs []int64
+	err := runInTx(ctx, r.db, func(tx *sqlx.Tx) error {
+		chairIDs = nil
+		query, args, err := sqlx.In("SELECT chair_id FROM reservation WHERE id IN (?) AND status = ? ORDER BY id FOR UPDATE", ids, reservationActive)
+		if err != nil {
+			return err
+		}
+		if err := tx.SelectContext(ctx, &chairIDs, tx.Rebind(query), args...); err != nil {
+			return err
+		}
+		if len(chairIDs) == 0 {
+			return nil
+		}
+
+		query, args, err = sqlx.In("UPDATE reservation SET status = ? WHERE id IN (?) AND status = ?", status, ids, reservationActive)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return err
+		}
+		if !restock {
+			return nil
+		}
+		for chairID, n := range countIDs(chairIDs) {
+			if _, err := tx.ExecContext(ctx, "UPDATE chair SET stock = stock + ? WHERE id = ?", n, chairID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chairIDs, nil
+}
+
+func (r mysqlReservationRepository) Expired(ctx context.Context) ([]int64, error) {
+	var ids []int64
+	err := r.db.SelectContext(ctx, &ids, "SELECT id FROM reservation WHERE status = ? AND expires_at < NOW()", reservationActive)
+	return ids, err
+}
+
+// countIDs idごとの出現回数
+func countIDs(ids []int64) map[int64]int64 {
+	counts := make(map[int64]int64, len(ids))
+	for _, id := range ids {
+		counts[id]++
+	}
+	return counts
+}
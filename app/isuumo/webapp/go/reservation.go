@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// 取り置きの期間の既定値と上限(分)
+	defaultReservationMinutes = 10
+	maxReservationMinutes     = 60
+
+	// 期限切れの取り置きを解放する間隔
+	reservationExpireInterval = 10 * time.Second
+)
+
+// 取り置きは作成時に在庫を1つ減らし、キャンセル・期限切れで戻す
+// こうしておけば検索や購入の在庫判定はそのままで取り置きを考慮できる
+// idは連番なので、確定と取り消しには作成時に返す token が必要
+const (
+	reservationActive    = "active"
+	reservationConfirmed = "confirmed"
+	reservationCancelled = "cancelled"
+	reservationExpired   = "expired"
+)
+
+type ReserveRequest struct {
+	Email   string `json:"email"`
+	Minutes int    `json:"minutes"`
+}
+
+// ReservationActionRequest 確定と取り消しのリクエスト
+type ReservationActionRequest struct {
+	Token string `json:"token"`
+}
+
+type ReservationResponse struct {
+	ID      int64  `json:"id"`
+	ChairID int64  `json:"chairId"`
+	Status  string `json:"status"`
+	// Token 取り置きを作成したときだけ返す
+	Token     string     `json:"token,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+func (s *Server) reserveChair(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("reserve chair failed : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	var req ReserveRequest
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("reserve chair failed : %v", err)
+		return badRequest(c, "invalid request body")
+	}
+	if req.Email == "" {
+		c.Echo().Logger.Info("reserve chair failed : email not found in request body")
+		return invalidParam(c, "email", "is required")
+	}
+	if req.Minutes == 0 {
+		req.Minutes = defaultReservationMinutes
+	}
+	if req.Minutes < 0 || req.Minutes > maxReservationMinutes {
+		c.Echo().Logger.Infof("reserve chair failed : invalid minutes %v", req.Minutes)
+		return invalidParam(c, "minutes", "out of range")
+	}
+
+	token, err := newRandomID()
+	if err != nil {
+		c.Echo().Logger.Errorf("reserveChair failed to generate a token : %v", err)
+		return internalError(c)
+	}
+
+	if flagInMemoryStock.Enabled() {
+		return s.reserveChairInMemory(c, id, req, token)
+	}
+
+	reservationID, stock, err := s.Reservations.Reserve(ctx, id, req.Email, token, req.Minutes)
+	if err == sql.ErrNoRows {
+		c.Echo().Logger.Infof("reserveChair chair id \"%v\" not found", id)
+		return notFound(c, "chair not found")
+	}
+	if err != nil {
+		c.Echo().Logger.Errorf("reserveChair DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	invalidateChairStock(id, stock == 1)
+
+	expiresAt := time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+	return JSON(c, http.StatusCreated, ReservationResponse{
+		ID:        reservationID,
+		ChairID:   int64(id),
+		Status:    reservationActive,
+		Token:     token,
+		ExpiresAt: &expiresAt,
+	})
+}
+
+// reserveChairInMemory 在庫をメモリ上で減らしてから取り置きを作成する
+func (s *Server) reserveChairInMemory(c echo.Context, id int, req ReserveRequest, token string) error {
+	ctx := c.Request().Context()
+	// 非表示はメモリ上の在庫に表れないので、DBの場合の hidden = 0 の代わりに椅子を引いて確かめる
+	chair, err := s.getChair(id)
+	if err != nil && err != sql.ErrNoRows {
+		c.Echo().Logger.Errorf("reserveChair DB execution error : %v", err)
+		return internalError(c)
+	}
+	if err == sql.ErrNoRows || chair.Hidden {
+		c.Echo().Logger.Infof("reserveChair chair id \"%v\" not found", id)
+		return notFound(c, "chair not found")
+	}
+	if _, ok, _ := adjustStock(int64(id), -1); !ok {
+		c.Echo().Logger.Infof("reserveChair chair id \"%v\" not found", id)
+		return notFound(c, "chair not found")
+	}
+
+	reservationID, err := s.Reservations.Insert(ctx, id, req.Email, token, req.Minutes)
+	if err != nil {
+		adjustStock(int64(id), 1)
+		c.Echo().Logger.Errorf("reservation insert failed : %v", err)
+		return internalError(c)
+	}
+
+	expiresAt := time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+	return JSON(c, http.StatusCreated, ReservationResponse{
+		ID:        reservationID,
+		ChairID:   int64(id),
+		Status:    reservationActive,
+		Token:     token,
+		ExpiresAt: &expiresAt,
+	})
+}
+
+// bindReservationAction idとtokenを読む 読めなければエラーのレスポンスを返してokがfalse
+func bindReservationAction(c echo.Context, action string) (id int64, token string, ok bool, err error) {
+	id, err = strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.Echo().Logger.Infof("%s reservation failed : %v", action, err)
+		return 0, "", false, invalidParam(c, "id", "must be an integer")
+	}
+	var req ReservationActionRequest
+	if err := c.Bind(&req); err != nil {
+		c.Echo().Logger.Infof("%s reservation failed : %v", action, err)
+		return 0, "", false, badRequest(c, "invalid request body")
+	}
+	if req.Token == "" {
+		c.Echo().Logger.Infof("%s reservation failed : token not found in request body", action)
+		return 0, "", false, invalidParam(c, "token", "is required")
+	}
+	return id, req.Token, true, nil
+}
+
+// confirmReservation 期限内の取り置きを購入として確定する
+// 在庫は取り置きのときに減らしてあるので、購入の記録だけを残す
+func (s *Server) confirmReservation(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, token, ok, err := bindReservationAction(c, "confirm")
+	if !ok {
+		return err
+	}
+
+	chairID, email, err := s.Reservations.Confirm(ctx, id, token)
+	if err == sql.ErrNoRows {
+		c.Echo().Logger.Infof("confirmReservation reservation id \"%v\" not active", id)
+		return notFound(c, "reservation not found")
+	}
+	if err != nil {
+		c.Echo().Logger.Errorf("reservation update failed : %v", err)
+		return internalError(c)
+	}
+
+	recordPurchase(itemChair, chairID, 1)
+	recordChairPurchase(email, chairID, 1)
+
+	return JSON(c, http.StatusOK, ReservationResponse{ID: id, ChairID: chairID, Status: reservationConfirmed})
+}
+
+// cancelReservation 取り置きを取り消して在庫を戻す
+func (s *Server) cancelReservation(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, token, ok, err := bindReservationAction(c, "cancel")
+	if !ok {
+		return err
+	}
+
+	// tokenが一致しなければ、存在しない取り置きと同じように返す
+	owned, err := s.Reservations.Owned(ctx, id, token)
+	if err != nil {
+		c.Echo().Logger.Errorf("cancel reservation failed : %v", err)
+		return internalError(c)
+	}
+	if !owned {
+		c.Echo().Logger.Infof("cancelReservation reservation id \"%v\" not found", id)
+		return notFound(c, "reservation not found")
+	}
+
+	released, err := s.releaseReservations(ctx, []int64{id}, reservationCancelled)
+	if err != nil {
+		c.Echo().Logger.Errorf("cancel reservation failed : %v", err)
+		return internalError(c)
+	}
+	if len(released) == 0 {
+		c.Echo().Logger.Infof("cancelReservation reservation id \"%v\" not active", id)
+		return notFound(c, "reservation not found")
+	}
+
+	return JSON(c, http.StatusOK, ReservationResponse{ID: id, ChairID: released[0], Status: reservationCancelled})
+}
+
+// releaseReservations activeな取り置きをstatusにして在庫を戻す
+// 解放した取り置きの椅子のIDを返す
+func (s *Server) releaseReservations(ctx context.Context, ids []int64, status string) ([]int64, error) {
+	// 在庫がメモリ上にあるときはコミットした後に戻す
+	chairIDs, err := s.Reservations.Release(ctx, ids, status, !flagInMemoryStock.Enabled())
+	if err != nil || len(chairIDs) == 0 {
+		return nil, err
+	}
+
+	counts := countIDs(chairIDs)
+	if flagInMemoryStock.Enabled() {
+		for chairID, n := range counts {
+			adjustStock(chairID, n)
+		}
+		return chairIDs, nil
+	}
+
+	// 在庫が0から戻った可能性があるので検索結果も捨てる
+	for chairID := range counts {
+		invalidateChairStock(int(chairID), true)
+	}
+
+	return chairIDs, nil
+}
+
+// expireReservations 期限切れの取り置きを定期的に解放する
+func (s *Server) expireReservations() {
+	ticker := time.NewTicker(reservationExpireInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ids, err := s.Reservations.Expired(context.Background())
+		if err != nil {
+			log.Errorf("expireReservations DB execution error : %v", err)
+			continue
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		if _, err := s.releaseReservations(context.Background(), ids, reservationExpired); err != nil {
+			log.Errorf("expireReservations failed : %v", err)
+		}
+	}
+}
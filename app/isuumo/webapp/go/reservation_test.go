@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func reservationContext(method, path, id, body string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+	return c, rec
+}
+
+// fakeReservation id 7, token "secret" の有効な取り置きだけがあるDB
+func fakeReservation(query string, args []driver.Value) ([]string, [][]driver.Value) {
+	owned := len(args) >= 2 && args[0] == int64(7) && args[1] == "secret"
+	switch {
+	case strings.HasPrefix(query, "SELECT chair_id, email FROM reservation") && owned:
+		return []string{"chair_id", "email"}, [][]driver.Value{{int64(3), "buyer@example.com"}}
+	case strings.HasPrefix(query, "SELECT EXISTS"):
+		return []string{"owned"}, [][]driver.Value{{owned}}
+	}
+	return nil, nil
+}
+
+func TestConfirmReservation(t *testing.T) {
+	tests := []struct {
+		name      string
+		id        string
+		body      string
+		status    int
+		purchased bool
+	}{
+		{"owner", "7", `{"token":"secret"}`, http.StatusOK, true},
+		{"wrong token", "7", `{"token":"guess"}`, http.StatusNotFound, false},
+		{"other reservation", "8", `{"token":"secret"}`, http.StatusNotFound, false},
+		{"missing token", "7", `{}`, http.StatusBadRequest, false},
+		{"invalid id", "x", `{"token":"secret"}`, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fdb := useFakeDB(t)
+			fdb.result = fakeReservation
+			resetPurchases()
+			defer resetPurchases()
+
+			c, rec := reservationContext(http.MethodPost, "/api/reservation/"+tt.id+"/confirm", tt.id, tt.body)
+			if err := NewServer(db).confirmReservation(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+
+			var updated bool
+			for _, q := range fdb.Queries() {
+				if strings.HasPrefix(q.Query, "UPDATE reservation") {
+					updated = true
+				}
+			}
+			if updated != tt.purchased {
+				t.Errorf("reservation updated = %v, want %v", updated, tt.purchased)
+			}
+			purchasePendingMutex.Lock()
+			pending := append([]purchase(nil), purchasePending...)
+			purchasePendingMutex.Unlock()
+			if tt.purchased {
+				if len(pending) != 1 || pending[0] != (purchase{Email: "buyer@example.com", ChairID: 3, Quantity: 1}) {
+					t.Errorf("recorded purchases = %v", pending)
+				}
+			} else if len(pending) != 0 {
+				t.Errorf("recorded purchases = %v, want none", pending)
+			}
+		})
+	}
+}
+
+func TestCancelReservationRequiresToken(t *testing.T) {
+	fdb := useFakeDB(t)
+	fdb.result = fakeReservation
+
+	c, rec := reservationContext(http.MethodPost, "/api/reservation/7/cancel", "7", `{"token":"guess"}`)
+	if err := NewServer(db).cancelReservation(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	for _, q := range fdb.Queries() {
+		if strings.Contains(q.Query, "UPDATE") {
+			t.Errorf("cancel with a wrong token must not update: %s", q.Query)
+		}
+	}
+}
+
+func TestReserveChairSkipsHidden(t *testing.T) {
+	defer flagInMemoryStock.Set(flagInMemoryStock.Enabled())
+	flagInMemoryStock.Set(false)
+	fdb := useFakeDB(t)
+
+	c, rec := reservationContext(http.MethodPost, "/api/chair/1/reserve", "1", `{"email":"a@example.com"}`)
+	if err := NewServer(db).reserveChair(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if q := fdb.Queries(); len(q) == 0 || !strings.Contains(q[0].Query, "hidden = 0") {
+		t.Errorf("reserve must not lock hidden chairs: %v", q)
+	}
+}
+
+func TestReservationResponseToken(t *testing.T) {
+	b, _ := json.Marshal(ReservationResponse{ID: 1, Status: reservationConfirmed})
+	if strings.Contains(string(b), "token") {
+		t.Errorf("token must only be returned when the reservation is created: %s", b)
+	}
+}
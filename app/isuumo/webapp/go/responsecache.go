@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/isucon/isucon10-qualify/isuumo/cache"
+	"github.com/labstack/echo"
+)
+
+// 1つのキャッシュに保持するエントリ数の上限
+const responseCacheMaxEntries = 10000
+
+// 検索系のレスポンスをTTL付きでキャッシュする
+var flagSearchResponseCache = newFeatureFlag("SEARCH_RESPONSE_CACHE", true)
+
+// XFetchの係数 大きいほど早めに再計算する
+const responseCacheBeta = 1.0
+
+type responseCacheEntry struct {
+	body        []byte
+	contentType string
+	// delta 再計算にかかった時間
+	delta  time.Duration
+	expiry time.Time
+}
+
+// responseCache ルート単位のTTL付きレスポンスキャッシュ
+// 期限切れの直前に確率的に1つのgoroutineだけが再計算する (XFetch)
+// 書き込みがあったときは invalidate で全て捨てる
+type responseCache struct {
+	Name string
+	ttl  time.Duration
+
+	mu         sync.Mutex
+	entries    map[string]*responseCacheEntry
+	refreshing map[string]bool
+	generation int64
+	counter    cache.HitCounter
+
+	// bodyKey nilでなければボディをこれで正規化してからキーにする
+	// falseを返したリクエストはキャッシュしない
+	bodyKey func(body []byte) ([]byte, bool)
+}
+
+func newResponseCache(name string, defaultTTL time.Duration) *responseCache {
+	ttl, err := time.ParseDuration(getEnv("RESPONSE_CACHE_TTL_"+name, defaultTTL.String()))
+	if err != nil {
+		ttl = defaultTTL
+	}
+	return &responseCache{
+		Name:       name,
+		ttl:        ttl,
+		entries:    map[string]*responseCacheEntry{},
+		refreshing: map[string]bool{},
+	}
+}
+
+var chairSearchResponseCache = newResponseCache("CHAIR_SEARCH", 3*time.Second)
+var estateSearchResponseCache = newResponseCache("ESTATE_SEARCH", 3*time.Second)
+
+// なぞって検索の結果は postEstate でしか変わらず、そのときに捨てるのでTTLを長くする
+var nazotteResponseCache = newResponseCache("NAZOTTE", time.Minute).withBodyKey(nazotteCacheKey)
+
+func (rc *responseCache) withBodyKey(f func(body []byte) ([]byte, bool)) *responseCache {
+	rc.bodyKey = f
+	return rc
+}
+
+// shouldRefreshEarly XFetch: now - delta * beta * log(rand) >= expiry なら再計算する
+func (e *responseCacheEntry) shouldRefreshEarly(now time.Time) bool {
+	r := rand.Float64()
+	if r == 0 {
+		return true
+	}
+	early := time.Duration(-float64(e.delta) * responseCacheBeta * math.Log(r))
+	return !now.Add(early).Before(e.expiry)
+}
+
+// lookup エントリを返す 期限前に再計算すべきならrefreshがtrueになる
+// refreshがtrueになるのはキーごとに1つの呼び出しだけ
+func (rc *responseCache) lookup(key string) (e *responseCacheEntry, refresh bool, generation int64) {
+	now := time.Now()
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	generation = rc.generation
+	e, ok := rc.entries[key]
+	if ok && !now.Before(e.expiry) {
+		delete(rc.entries, key)
+		rc.counter.Evict()
+	}
+	if !ok || !now.Before(e.expiry) {
+		rc.counter.Miss()
+		return nil, false, generation
+	}
+	rc.counter.Hit()
+	if !rc.refreshing[key] && e.shouldRefreshEarly(now) {
+		rc.refreshing[key] = true
+		return e, true, generation
+	}
+	return e, false, generation
+}
+
+// store 取得開始時のgenerationから変わっていなければ保存する
+func (rc *responseCache) store(key string, e *responseCacheEntry, generation int64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.generation != generation {
+		return
+	}
+	if _, ok := rc.entries[key]; !ok && len(rc.entries) >= responseCacheMaxEntries {
+		return
+	}
+	rc.entries[key] = e
+}
+
+func (rc *responseCache) doneRefresh(key string) {
+	rc.mu.Lock()
+	delete(rc.refreshing, key)
+	rc.mu.Unlock()
+}
+
+// invalidate 書き込みがあったときに全て捨てる
+func (rc *responseCache) invalidate() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.generation++
+	rc.entries = map[string]*responseCacheEntry{}
+	rc.refreshing = map[string]bool{}
+}
+
+// responseCacheKey メソッド・パス・正規化したクエリ・実験の群・ボディのハッシュからキーを作る
+// 群ごとに並び順が違うので、群が違えば別のエントリにする
+func responseCacheKey(method, path, query, variant string, body []byte) string {
+	key := method + " " + path + "?" + query
+	if variant != "" {
+		key += "@" + variant
+	}
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		key += "#" + hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// responseRecorder ハンドラが書き込んだレスポンスを記録しつつクライアントにも返す
+type responseRecorder struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	w.buf.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// responseCacheMiddleware 200のレスポンスをrcにキャッシュする
+// 大きなページはメモリに載せないようにストリーミングで返すので (StreamPerPageThreshold)、キャッシュもしない
+func responseCacheMiddleware(rc *responseCache) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !flagSearchResponseCache.Enabled() || rc.ttl <= 0 || bypassSearchCaches(c) {
+				return next(c)
+			}
+			if perPage, err := strconv.Atoi(c.QueryParam("perPage")); err == nil && perPage > StreamPerPageThreshold {
+				return next(c)
+			}
+
+			req := c.Request()
+			var body []byte
+			if req.Body != nil {
+				b, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					return badRequest(c, "failed to read request body")
+				}
+				body = b
+				req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+			query := c.QueryParams().Encode()
+			keyBody := body
+			if rc.bodyKey != nil {
+				b, ok := rc.bodyKey(body)
+				if !ok {
+					return next(c)
+				}
+				keyBody = b
+			}
+			variant := experimentVariantOf(c)
+			variantName := ""
+			if variant != nil {
+				variantName = variant.Name
+			}
+			key := responseCacheKey(req.Method, req.URL.Path, query, variantName, keyBody)
+
+			e, refresh, generation := rc.lookup(key)
+			if e != nil {
+				if refresh {
+					method, path, header := req.Method, req.URL.Path, req.Header.Clone()
+					echoInstance := c.Echo()
+					tasks.Go("responseCacheRefresh", func() {
+						defer rc.doneRefresh(key)
+						r := httptest.NewRequest(method, path+"?"+query, bytes.NewReader(body))
+						r.Header = header
+						rec := httptest.NewRecorder()
+						rctx := echoInstance.NewContext(r, rec)
+						// 作り直しでも元のリクエストと同じ群の並び順にする
+						if variant != nil {
+							rctx.Set(experimentContextKey, variant)
+						}
+						start := time.Now()
+						if err := next(rctx); err != nil || rec.Code != http.StatusOK || rec.Header().Get(perPageClampedHeader) != "" {
+							return
+						}
+						rc.store(key, &responseCacheEntry{
+							body:        rec.Body.Bytes(),
+							contentType: rec.Header().Get(echo.HeaderContentType),
+							delta:       time.Since(start),
+							expiry:      time.Now().Add(rc.ttl),
+						}, generation)
+					})
+				}
+				return c.Blob(http.StatusOK, e.contentType, e.body)
+			}
+
+			rw := &responseRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = rw
+			start := time.Now()
+			err := next(c)
+			c.Response().Writer = rw.ResponseWriter
+			if err != nil || c.Response().Status != http.StatusOK {
+				return err
+			}
+			// perPageを制限したレスポンスは過負荷が収まった後に返さないようにする
+			if c.Response().Header().Get(perPageClampedHeader) != "" {
+				return nil
+			}
+			rc.store(key, &responseCacheEntry{
+				body:        rw.buf.Bytes(),
+				contentType: c.Response().Header().Get(echo.HeaderContentType),
+				delta:       time.Since(start),
+				expiry:      time.Now().Add(rc.ttl),
+			}, generation)
+			return nil
+		}
+	}
+}
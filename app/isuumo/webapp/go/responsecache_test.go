@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// variantHandler 呼ばれた回数と、割り当てられた群を返すハンドラ
+func variantHandler(calls *int64, seen chan<- string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		atomic.AddInt64(calls, 1)
+		name := ""
+		if v := experimentVariantOf(c); v != nil {
+			name = v.Name
+		}
+		if seen != nil {
+			seen <- name
+		}
+		return c.String(http.StatusOK, "variant="+name)
+	}
+}
+
+func serveCached(h echo.HandlerFunc, target string, variant *ExperimentVariant) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+	if variant != nil {
+		c.Set(experimentContextKey, variant)
+	}
+	h(c)
+	return rec
+}
+
+func TestResponseCacheSkipsStreamedPages(t *testing.T) {
+	defer flagSearchResponseCache.Set(flagSearchResponseCache.Enabled())
+	flagSearchResponseCache.Set(true)
+
+	tests := []struct {
+		perPage string
+		calls   int64
+	}{
+		{"25", 1},
+		{"100", 1},
+		{"101", 2},
+		{"1000", 2},
+	}
+	for _, tt := range tests {
+		t.Run("perPage="+tt.perPage, func(t *testing.T) {
+			var calls int64
+			rc := newResponseCache("TEST", time.Minute)
+			h := responseCacheMiddleware(rc)(variantHandler(&calls, nil))
+			for i := 0; i < 2; i++ {
+				serveCached(h, "/api/chair/search?perPage="+tt.perPage, nil)
+			}
+			if calls != tt.calls {
+				t.Errorf("handler calls = %d, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestResponseCacheKeysByVariant(t *testing.T) {
+	defer flagSearchResponseCache.Set(flagSearchResponseCache.Enabled())
+	flagSearchResponseCache.Set(true)
+
+	var calls int64
+	seen := make(chan string, 10)
+	rc := newResponseCache("TEST", time.Minute)
+	h := responseCacheMiddleware(rc)(variantHandler(&calls, seen))
+	a, b := &ExperimentVariant{Name: "a"}, &ExperimentVariant{Name: "b"}
+
+	for _, v := range []*ExperimentVariant{a, b, a, b} {
+		if body := serveCached(h, "/api/chair/search?perPage=25", v).Body.String(); body != "variant="+v.Name {
+			t.Errorf("variant %s got %q", v.Name, body)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler calls = %d, want one per variant", calls)
+	}
+	for i := 0; i < 2; i++ {
+		<-seen
+	}
+
+	// 期限前の作り直しでも同じ群で作り直す
+	rc.mu.Lock()
+	for _, e := range rc.entries {
+		e.delta = 1000 * time.Hour
+	}
+	rc.mu.Unlock()
+	serveCached(h, "/api/chair/search?perPage=25", b)
+	select {
+	case name := <-seen:
+		if name != "b" {
+			t.Errorf("refresh ran with variant %q, want b", name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("refresh did not run")
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		rc.mu.Lock()
+		refreshing := len(rc.refreshing)
+		rc.mu.Unlock()
+		if refreshing == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refresh did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if body := serveCached(h, "/api/chair/search?perPage=25", b).Body.String(); !strings.HasSuffix(body, "=b") {
+		t.Errorf("refreshed entry for b = %q", body)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// RateLimitClass ルートごとのレートリミットの分類
+type RateLimitClass string
+
+const (
+	RateLimitNone   RateLimitClass = ""
+	RateLimitRead   RateLimitClass = "read"
+	RateLimitWrite  RateLimitClass = "write"
+	RateLimitSearch RateLimitClass = "search"
+)
+
+// Route ルーティングとその横断的な設定
+type Route struct {
+	Method  string
+	Path    string
+	Handler echo.HandlerFunc
+
+	// Cacheable 0より大きければCache-Controlでその秒数キャッシュを許可する
+	Cacheable time.Duration
+	// Timeout 0より大きければリクエストのcontextにデッドラインを設定する
+	Timeout time.Duration
+	// RateLimit RATE_LIMIT_<CLASS> が設定されていれば、同じ分類のルートで1つの上限を共有する (rateLimiters)
+	RateLimit RateLimitClass
+	// AuthRequired 管理用など認証が必要なエンドポイント ADMIN_TOKEN が必要になる (authMiddleware)
+	AuthRequired bool
+	// Fallbacks エラー率が上がったときに無効化する最適化
+	Fallbacks []*featureFlag
+	// ResponseCache 200のレスポンスをTTL付きでキャッシュする
+	ResponseCache *responseCache
+	// History 空でなければ詳細の閲覧をこの種類で閲覧履歴に記録する
+	History string
+	// Experiment 検索の並び順の実験の群を割り当てる
+	Experiment bool
+	// SparseFields ?fields= で返すchair/estateのキーを絞り込めるようにする
+	SparseFields bool
+	// MySQLOnly リポジトリを通さずにMySQLを読むので、STORAGE=memory では 501 を返す (mysqlOnlyMiddleware)
+	MySQLOnly bool
+}
+
+// routes 全エンドポイントの定義
+// 新しいエンドポイントはここに追加すれば registerRoutes で共通の設定が適用される
+// openapi.json と client/client.go もここから生成する (apigen.go)
+var routes = []Route{
+	// Initialize
+	// ベンチマーカーはトークンを送れないので認証しない
+	{Method: echo.POST, Path: "/initialize", Handler: initialize, Timeout: 60 * time.Second},
+
+	// Chair Handler
+	{Method: echo.GET, Path: "/api/chair/:id", Handler: serverHandler((*Server).getChairDetail), Timeout: 2 * time.Second, RateLimit: RateLimitRead, History: itemChair},
+	{Method: echo.GET, Path: "/api/chair/:id/similar", Handler: getSimilarChairs, Timeout: 2 * time.Second, RateLimit: RateLimitRead, SparseFields: true, MySQLOnly: true},
+	{Method: echo.GET, Path: "/api/chair/:id/also_bought", Handler: getAlsoBoughtChairs, Timeout: 2 * time.Second, RateLimit: RateLimitRead, SparseFields: true, MySQLOnly: true},
+	{Method: echo.POST, Path: "/api/chair", Handler: serverHandler((*Server).postChair), Timeout: 10 * time.Second, RateLimit: RateLimitWrite},
+	{Method: echo.GET, Path: "/api/chair/search", Handler: serverHandler((*Server).searchChairs), Timeout: 5 * time.Second, RateLimit: RateLimitSearch,
+		Fallbacks: []*featureFlag{flagChairSearchWindowCount, flagSearchPageCache, flagStreamLargePages, flagSearchResponseCache, flagAdaptivePerPage}, ResponseCache: chairSearchResponseCache, Experiment: true, SparseFields: true},
+	{Method: echo.GET, Path: "/api/chair/low_priced", Handler: getLowPricedChair, Timeout: 2 * time.Second, RateLimit: RateLimitRead, SparseFields: true},
+	{Method: echo.GET, Path: "/api/chair/search/condition", Handler: getChairSearchCondition, Cacheable: time.Hour},
+	{Method: echo.POST, Path: "/api/chair/buy/:id", Handler: serverHandler((*Server).buyChair), Timeout: 2 * time.Second, RateLimit: RateLimitWrite},
+	{Method: echo.POST, Path: "/api/chair/buy", Handler: serverHandler((*Server).buyChairs), Timeout: 5 * time.Second, RateLimit: RateLimitWrite},
+	{Method: echo.POST, Path: "/api/chair/:id/reserve", Handler: serverHandler((*Server).reserveChair), Timeout: 2 * time.Second, RateLimit: RateLimitWrite},
+	{Method: echo.POST, Path: "/api/reservation/:id/confirm", Handler: serverHandler((*Server).confirmReservation), Timeout: 2 * time.Second, RateLimit: RateLimitWrite},
+	{Method: echo.POST, Path: "/api/reservation/:id/cancel", Handler: serverHandler((*Server).cancelReservation), Timeout: 2 * time.Second, RateLimit: RateLimitWrite},
+	// 出品の取り下げは管理操作なので、対になる unhide と同じく認証する
+	{Method: echo.DELETE, Path: "/api/chair/:id", Handler: serverHandler((*Server).deleteChair), Timeout: 2 * time.Second, RateLimit: RateLimitWrite, AuthRequired: true},
+
+	// Estate Handler
+	{Method: echo.GET, Path: "/api/estate/:id", Handler: serverHandler((*Server).getEstateDetail), Timeout: 2 * time.Second, RateLimit: RateLimitRead, History: itemEstate},
+	{Method: echo.POST, Path: "/api/estate", Handler: serverHandler((*Server).postEstate), Timeout: 10 * time.Second, RateLimit: RateLimitWrite},
+	{Method: echo.GET, Path: "/api/import/:id", Handler: getImportStatus, Timeout: 2 * time.Second, RateLimit: RateLimitRead},
+	{Method: echo.GET, Path: "/api/estate/search", Handler: serverHandler((*Server).searchEstates), Timeout: 5 * time.Second, RateLimit: RateLimitSearch,
+		Fallbacks: []*featureFlag{flagSearchPageCache, flagStreamLargePages, flagSearchResponseCache, flagAdaptivePerPage}, ResponseCache: estateSearchResponseCache, Experiment: true, SparseFields: true},
+	{Method: echo.GET, Path: "/api/estate/low_priced", Handler: getLowPricedEstate, Timeout: 2 * time.Second, RateLimit: RateLimitRead, SparseFields: true},
+	{Method: echo.POST, Path: "/api/estate/req_doc/:id", Handler: serverHandler((*Server).postEstateRequestDocument), Timeout: 2 * time.Second, RateLimit: RateLimitWrite},
+	{Method: echo.POST, Path: "/api/estate/nazotte", Handler: serverHandler((*Server).searchEstateNazotte), Timeout: 5 * time.Second, RateLimit: RateLimitSearch,
+		Fallbacks: []*featureFlag{flagSearchResponseCache}, ResponseCache: nazotteResponseCache, SparseFields: true},
+	{Method: echo.GET, Path: "/api/estate/map", Handler: getEstateMap, Timeout: 5 * time.Second, RateLimit: RateLimitSearch, MySQLOnly: true},
+	{Method: echo.GET, Path: "/api/estate/nearby", Handler: searchEstatesNearby, Timeout: 5 * time.Second, RateLimit: RateLimitSearch, SparseFields: true, MySQLOnly: true},
+	{Method: echo.GET, Path: "/api/estate/search/condition", Handler: getEstateSearchCondition, Cacheable: time.Hour},
+	{Method: echo.GET, Path: "/api/recommended_estate/:id", Handler: serverHandler((*Server).searchRecommendedEstateWithChair), Timeout: 2 * time.Second, RateLimit: RateLimitSearch, SparseFields: true},
+	{Method: echo.GET, Path: "/api/recommended_bundle", Handler: getRecommendedBundle, Timeout: 2 * time.Second, RateLimit: RateLimitSearch, SparseFields: true},
+	{Method: echo.GET, Path: "/api/trending", Handler: getTrending, Timeout: 2 * time.Second, RateLimit: RateLimitRead, SparseFields: true},
+	{Method: echo.GET, Path: "/api/history", Handler: getHistory, Timeout: 2 * time.Second, RateLimit: RateLimitRead, SparseFields: true},
+
+	// Admin
+	{Method: echo.GET, Path: "/admin/export/chair", Handler: exportChairs, AuthRequired: true, MySQLOnly: true},
+	{Method: echo.GET, Path: "/admin/export/estate", Handler: exportEstates, AuthRequired: true, MySQLOnly: true},
+	{Method: echo.GET, Path: "/admin/stats/errors", Handler: getErrorStats, AuthRequired: true},
+	{Method: echo.GET, Path: "/admin/runs", Handler: getRuns, AuthRequired: true},
+	{Method: echo.GET, Path: "/api/admin/index/debug", Handler: getIndexDebug, AuthRequired: true},
+	{Method: echo.GET, Path: "/api/admin/ranking", Handler: getRanking, AuthRequired: true},
+	{Method: echo.PUT, Path: "/api/admin/ranking", Handler: putRanking, AuthRequired: true},
+	{Method: echo.GET, Path: "/api/admin/experiment", Handler: getExperiment, AuthRequired: true},
+	{Method: echo.PUT, Path: "/api/admin/experiment", Handler: putExperiment, AuthRequired: true},
+	{Method: echo.POST, Path: "/admin/chair/:id/unhide", Handler: serverHandler((*Server).unhideChair), Timeout: 2 * time.Second, AuthRequired: true},
+	{Method: echo.PUT, Path: "/admin/chair/:id/stock", Handler: serverHandler((*Server).restockChair), Timeout: 2 * time.Second, AuthRequired: true},
+	{Method: echo.POST, Path: "/admin/rebucket", Handler: rebucket, Timeout: 5 * time.Minute, AuthRequired: true, MySQLOnly: true},
+
+	// Peer
+	{Method: echo.GET, Path: "/internal/peer/:kind/:id", Handler: getPeerObject, Timeout: 2 * time.Second, AuthRequired: true},
+	{Method: echo.POST, Path: "/internal/invalidate", Handler: postInvalidation, Timeout: 5 * time.Second, AuthRequired: true},
+	{Method: echo.POST, Path: "/internal/warmup", Handler: postWarmup, Timeout: 60 * time.Second, AuthRequired: true, MySQLOnly: true},
+
+	// Runtime
+	{Method: echo.GET, Path: "/debug/gc", Handler: getGCStats, AuthRequired: true},
+	{Method: echo.GET, Path: "/debug/sql", Handler: getSQLStats, AuthRequired: true},
+	{Method: echo.GET, Path: "/debug/tasks", Handler: getTaskStats, AuthRequired: true},
+	{Method: echo.GET, Path: "/internal/cache/stats", Handler: getCacheStats, AuthRequired: true},
+	{Method: echo.GET, Path: "/internal/db/stats", Handler: getDBStats, AuthRequired: true, MySQLOnly: true},
+	{Method: echo.DELETE, Path: "/debug/sql", Handler: resetSQLStats, AuthRequired: true},
+}
+
+// registerRoutes routes を登録する
+func registerRoutes(e *echo.Echo) {
+	if adminToken == "" {
+		e.Logger.Warn("ADMIN_TOKEN is not set : admin, internal and debug routes reject every request")
+	}
+	for _, r := range routes {
+		e.Add(r.Method, r.Path, r.Handler, routeMiddlewares(r)...)
+	}
+}
+
+// routeMiddlewares ルートの設定から適用するミドルウェアを組み立てる
+func routeMiddlewares(r Route) []echo.MiddlewareFunc {
+	mws := make([]echo.MiddlewareFunc, 0, 10)
+
+	mws = append(mws, endpointStatsMiddleware(r.Method+" "+r.Path))
+
+	if r.AuthRequired {
+		mws = append(mws, authMiddleware)
+	}
+
+	if r.MySQLOnly {
+		mws = append(mws, mysqlOnlyMiddleware)
+	}
+
+	if l := rateLimiters[r.RateLimit]; l != nil {
+		mws = append(mws, rateLimitMiddleware(l))
+	}
+
+	if r.RateLimit == RateLimitSearch {
+		mws = append(mws, latencyMiddleware(searchLatency))
+	}
+
+	if len(r.Fallbacks) > 0 {
+		mws = append(mws, errorBudgetMiddleware(r.Path, r.Fallbacks))
+	}
+
+	if r.Timeout > 0 {
+		timeout := r.Timeout
+		mws = append(mws, func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				ctx, cancel := context.WithTimeout(c.Request().Context(), timeout)
+				defer cancel()
+				c.SetRequest(c.Request().WithContext(ctx))
+				return next(c)
+			}
+		})
+	}
+
+	if r.Cacheable > 0 {
+		cacheControl := "public, max-age=" + strconv.Itoa(int(r.Cacheable/time.Second))
+		mws = append(mws, func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Response().Header().Set("Cache-Control", cacheControl)
+				return next(c)
+			}
+		})
+	}
+
+	if r.Experiment {
+		mws = append(mws, experimentMiddleware)
+	}
+
+	if r.ResponseCache != nil {
+		mws = append(mws, responseCacheMiddleware(r.ResponseCache))
+	}
+
+	// レスポンスキャッシュの作り直しでも絞り込むように、キャッシュより内側に置く
+	if r.SparseFields {
+		mws = append(mws, sparseFieldsMiddleware)
+	}
+
+	if r.History != "" {
+		mws = append(mws, historyMiddleware(r.History))
+	}
+
+	return mws
+}
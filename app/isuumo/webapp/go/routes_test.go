@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestAuthRequired(t *testing.T) {
+	defer func(old string) { adminToken = old }(adminToken)
+
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		status        int
+	}{
+		{"no token configured", "", "", http.StatusForbidden},
+		{"no token configured with empty bearer", "", "Bearer ", http.StatusForbidden},
+		{"missing header", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer nope", http.StatusUnauthorized},
+		{"without scheme", "secret", "secret", http.StatusOK},
+		{"correct token", "secret", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adminToken = tt.token
+			e := echo.New()
+			e.HTTPErrorHandler = problemErrorHandler
+			r := Route{Method: echo.GET, Path: "/admin/test", AuthRequired: true, Handler: func(c echo.Context) error {
+				return c.NoContent(http.StatusOK)
+			}}
+			e.Add(r.Method, r.Path, r.Handler, routeMiddlewares(r)...)
+
+			req := httptest.NewRequest(http.MethodGet, "/admin/test", nil)
+			if tt.authorization != "" {
+				req.Header.Set(echo.HeaderAuthorization, tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestAdminRoutesRequireAuth(t *testing.T) {
+	for _, r := range routes {
+		admin := strings.HasPrefix(r.Path, "/admin/") || strings.HasPrefix(r.Path, "/api/admin/") ||
+			strings.HasPrefix(r.Path, "/internal/") || strings.HasPrefix(r.Path, "/debug/")
+		if admin && !r.AuthRequired {
+			t.Errorf("%s %s must require auth", r.Method, r.Path)
+		}
+	}
+}
+
+// 在庫や表示を書き換える管理操作は、/api の下にあっても認証する
+func TestChairAdminMutationsRequireAuth(t *testing.T) {
+	handlers := map[string]bool{
+		"DELETE /api/chair/:id":        false,
+		"POST /admin/chair/:id/unhide": false,
+		"PUT /admin/chair/:id/stock":   false,
+	}
+	for _, r := range routes {
+		key := r.Method + " " + r.Path
+		if _, ok := handlers[key]; ok {
+			handlers[key] = r.AuthRequired
+		}
+	}
+	for key, auth := range handlers {
+		if !auth {
+			t.Errorf("%s must be registered with AuthRequired", key)
+		}
+	}
+}
+
+func TestPeerTransportAddsToken(t *testing.T) {
+	defer func(old string) { adminToken = old }(adminToken)
+	adminToken = "secret"
+
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(echo.HeaderAuthorization)
+	}))
+	defer ts.Close()
+
+	res, err := peerClient.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got != "Bearer secret" {
+		t.Errorf("Authorization = %q", got)
+	}
+}
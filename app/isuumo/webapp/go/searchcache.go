@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/isucon/isucon10-qualify/isuumo/cache"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// ウォームアップでプリレンダリングするページのperPage (フロントエンドと同じ値)
+const prerenderPerPage = 20
+
+// searchPageCache 検索結果のレスポンスボディのキャッシュ
+// キーは "chair?" / "estate?" + 正規化したクエリ文字列
+type searchPageCache struct {
+	mu         sync.RWMutex
+	pages      map[string][]byte
+	generation int64
+	counter    cache.HitCounter
+}
+
+var chairPageCache = &searchPageCache{pages: map[string][]byte{}}
+var estatePageCache = &searchPageCache{pages: map[string][]byte{}}
+
+func (pc *searchPageCache) get(key string) ([]byte, bool) {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	b, ok := pc.pages[key]
+	return b, ok
+}
+
+// put 取得開始時のgenerationから変わっていなければ保存する
+func (pc *searchPageCache) put(key string, b []byte, generation int64) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.generation != generation {
+		return
+	}
+	pc.pages[key] = b
+}
+
+func (pc *searchPageCache) currentGeneration() int64 {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	return pc.generation
+}
+
+// invalidate 書き込みがあったときに全て捨てる
+func (pc *searchPageCache) invalidate() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.generation++
+	pc.pages = map[string][]byte{}
+}
+
+// searchPageKey クエリパラメータをキー順に並べて正規化する
+func searchPageKey(params url.Values) string {
+	return params.Encode()
+}
+
+// serveCachedSearchPage キャッシュにあればそれを返してtrueを返す
+func serveCachedSearchPage(c echo.Context, pc *searchPageCache) bool {
+	b, ok := pc.get(searchPageKey(c.QueryParams()))
+	if !ok {
+		pc.counter.Miss()
+		return false
+	}
+	pc.counter.Hit()
+	c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, b)
+	return true
+}
+
+// prerenderSearchPage handlerを直接呼び出して結果をキャッシュする
+func prerenderSearchPage(e *echo.Echo, pc *searchPageCache, path string, handler echo.HandlerFunc, params url.Values) {
+	params.Set("page", "0")
+	params.Set("perPage", strconv.Itoa(prerenderPerPage))
+	key := searchPageKey(params)
+	if _, ok := pc.get(key); ok {
+		return
+	}
+
+	generation := pc.currentGeneration()
+	req := httptest.NewRequest(http.MethodGet, path+"?"+key, nil)
+	rec := httptest.NewRecorder()
+	if err := handler(e.NewContext(req, rec)); err != nil || rec.Code != http.StatusOK {
+		return
+	}
+	pc.put(key, rec.Body.Bytes(), generation)
+}
+
+// singleConditions RangeConditionとListConditionから単一条件の検索パラメータを列挙する
+func singleConditions(ranges map[string]RangeCondition, lists map[string]ListCondition) []url.Values {
+	var res []url.Values
+	for param, cond := range ranges {
+		for _, r := range cond.Ranges {
+			res = append(res, url.Values{param: {strconv.FormatInt(r.ID, 10)}})
+		}
+	}
+	for param, cond := range lists {
+		for _, v := range cond.List {
+			res = append(res, url.Values{param: {v}})
+		}
+	}
+	return res
+}
+
+// prerenderSearchPages 単一条件の検索の1ページ目を全てプリレンダリングする
+func prerenderSearchPages() {
+	e := echo.New()
+	cond := currentConditions()
+
+	chairConds := singleConditions(map[string]RangeCondition{
+		"priceRangeId":  cond.Chair.Price,
+		"heightRangeId": cond.Chair.Height,
+		"widthRangeId":  cond.Chair.Width,
+		"depthRangeId":  cond.Chair.Depth,
+	}, map[string]ListCondition{
+		"kind":     cond.Chair.Kind,
+		"color":    cond.Chair.Color,
+		"features": cond.Chair.Feature,
+	})
+	for _, params := range chairConds {
+		prerenderSearchPage(e, chairPageCache, "/api/chair/search", serverHandler((*Server).searchChairs), params)
+	}
+
+	estateConds := singleConditions(map[string]RangeCondition{
+		"doorHeightRangeId": cond.Estate.DoorHeight,
+		"doorWidthRangeId":  cond.Estate.DoorWidth,
+		"rentRangeId":       cond.Estate.Rent,
+	}, map[string]ListCondition{
+		"features": cond.Estate.Feature,
+	})
+	for _, params := range estateConds {
+		prerenderSearchPage(e, estatePageCache, "/api/estate/search", serverHandler((*Server).searchEstates), params)
+	}
+}
+
+// searchCountCache 検索条件ごとのCOUNT(*)の結果のキャッシュ
+// ページングで同じ条件が何度も数えられるのを防ぐ
+// mu は世代を見てから保存するまでの間に invalidate されないようにする
+type searchCountCache struct {
+	mu         sync.RWMutex
+	counts     *cache.LRU
+	generation int64
+	// shared 他のサーバーと共有する件数
+	shared sharedNamespace
+}
+
+var chairCountCache = &searchCountCache{counts: newLRUCache("CHAIR_COUNT", 10000, 0), shared: sharedChairCount}
+var estateCountCache = &searchCountCache{counts: newLRUCache("ESTATE_COUNT", 10000, 0), shared: sharedEstateCount}
+
+// count queryをparamsで実行した件数を返す キャッシュになければdbに問い合わせる
+func (cc *searchCountCache) count(ctx context.Context, db *sqlx.DB, query string, params []interface{}) (int64, error) {
+	key := queryKey(query, params)
+
+	cc.mu.RLock()
+	v, ok := cc.counts.Get(key)
+	generation := cc.generation
+	cc.mu.RUnlock()
+	if ok {
+		return v.(int64), nil
+	}
+
+	var n int64
+	sum := sha256.Sum256([]byte(key))
+	sharedKey, shared := cc.shared.key(hex.EncodeToString(sum[:]))
+	if !shared || !sharedCacheGet(sharedKey, &n) {
+		var err error
+		if n, err = getCount(ctx, db, query, params...); err != nil {
+			return 0, err
+		}
+		if shared {
+			sharedCacheSet(sharedKey, n)
+		}
+	}
+
+	cc.mu.Lock()
+	if cc.generation == generation {
+		cc.counts.Add(key, n)
+	}
+	cc.mu.Unlock()
+
+	return n, nil
+}
+
+// invalidate 書き込みがあったときに全て捨てる
+func (cc *searchCountCache) invalidate() {
+	cc.mu.Lock()
+	cc.generation++
+	cc.counts.Purge()
+	cc.mu.Unlock()
+
+	cc.shared.invalidate()
+}
+
+// invalidateChairSearchCaches chairの検索結果に関するキャッシュを全て捨てる
+func invalidateChairSearchCaches() {
+	chairPageCache.invalidate()
+	chairCountCache.invalidate()
+	chairSearchResponseCache.invalidate()
+}
+
+// invalidateEstateSearchCaches estateの検索結果に関するキャッシュを全て捨てる
+func invalidateEstateSearchCaches() {
+	estatePageCache.invalidate()
+	estateCountCache.invalidate()
+	estateSearchResponseCache.invalidate()
+	nazotteResponseCache.invalidate()
+	clearEstateHistogram()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// Server ハンドラやキャッシュがDBを読むときに使う依存
+// main() がDBに接続した後に NewServer で作り、テストではフェイクのリポジトリを入れた Server に差し替える
+// 詳細、検索、購入、取り置き、CSVの登録のハンドラと、そこから呼ぶ getChair, getEstate などは Server のメソッドで、db と srv を直接は読まない
+// 行の読み書きはリポジトリを通し、DB は検索のSQLのようにリポジトリに切り出していない問い合わせにだけ使う
+// STORAGE=memory では DB はnilで、DBが要る検索は 501 を返す
+type Server struct {
+	DB           *sqlx.DB
+	Chairs       ChairRepository
+	Estates      EstateRepository
+	Reservations ReservationRepository
+}
+
+// srv リクエストを処理する Server
+var srv = &Server{}
+
+// NewServer dbから読むリポジトリを使う Server を作る
+func NewServer(db *sqlx.DB) *Server {
+	return &Server{
+		DB:           db,
+		Chairs:       mysqlChairRepository{db: db},
+		Estates:      mysqlEstateRepository{db: db},
+		Reservations: mysqlReservationRepository{db: db},
+	}
+}
+
+// serverHandler Server のメソッドをハンドラにする
+// routes は main() が srv を作る前に評価されるので、呼ばれたときの srv を使う
+func serverHandler(h func(*Server, echo.Context) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return h(srv, c)
+	}
+}
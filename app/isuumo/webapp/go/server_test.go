@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// fakeChairRepository 決まった椅子を返し、呼ばれた回数を数える
+// ChairByID 以外は実装していないので、呼ばれるとnilの ChairRepository を呼んでpanicする
+type fakeChairRepository struct {
+	ChairRepository
+	chairs map[int]Chair
+	err    error
+	calls  int
+}
+
+func (r *fakeChairRepository) ChairByID(ctx context.Context, id int) (Chair, error) {
+	r.calls++
+	if r.err != nil {
+		return Chair{}, r.err
+	}
+	chair, ok := r.chairs[id]
+	if !ok {
+		return Chair{}, sql.ErrNoRows
+	}
+	return chair, nil
+}
+
+func TestServerGetChairDetail(t *testing.T) {
+	defer flagInMemoryStock.Set(flagInMemoryStock.Enabled())
+	flagInMemoryStock.Set(false)
+
+	tests := []struct {
+		name   string
+		id     string
+		err    error
+		status int
+	}{
+		{"found", "1", nil, http.StatusOK},
+		{"hidden", "2", nil, http.StatusNotFound},
+		{"sold out", "3", nil, http.StatusNotFound},
+		{"missing", "4", nil, http.StatusNotFound},
+		{"repository error", "1", errors.New("connection refused"), http.StatusInternalServerError},
+		{"bad id", "x", nil, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cachedChairs.Purge()
+			defer cachedChairs.Purge()
+			repo := &fakeChairRepository{chairs: map[int]Chair{
+				1: {ID: 1, Name: "椅子", Stock: 3},
+				2: {ID: 2, Stock: 3, Hidden: true},
+				3: {ID: 3, Stock: 0},
+			}, err: tt.err}
+			s := &Server{Chairs: repo}
+
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/api/chair/"+tt.id, nil), rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tt.id)
+			if err := s.getChairDetail(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestServerGetChairCaches(t *testing.T) {
+	cachedChairs.Purge()
+	defer cachedChairs.Purge()
+	repo := &fakeChairRepository{chairs: map[int]Chair{1: {ID: 1, Stock: 1}}}
+	s := &Server{Chairs: repo}
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.getChair(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if repo.calls != 1 {
+		t.Errorf("repository called %d times, want 1", repo.calls)
+	}
+}
+
+func TestServerHandlerUsesCurrentServer(t *testing.T) {
+	defer func(old *Server) { srv = old }(srv)
+	h := serverHandler(func(s *Server, c echo.Context) error {
+		if s != srv {
+			t.Error("handler did not get the current srv")
+		}
+		return nil
+	})
+	// routes を評価した後に差し替えても新しい srv が使われる
+	srv = &Server{}
+	if err := h(echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fakeBuyRepository BuyChair が決まった結果を返す
+type fakeBuyRepository struct {
+	fakeChairRepository
+	stock  int64
+	err    error
+	bought []int
+}
+
+func (r *fakeBuyRepository) BuyChair(ctx context.Context, id int) (int64, error) {
+	r.bought = append(r.bought, id)
+	return r.stock, r.err
+}
+
+func TestServerBuyChair(t *testing.T) {
+	defer flagInMemoryStock.Set(flagInMemoryStock.Enabled())
+	flagInMemoryStock.Set(false)
+	defer resetPurchases()
+
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"bought", nil, http.StatusOK},
+		{"sold out", sql.ErrNoRows, http.StatusNotFound},
+		{"repository error", errors.New("connection refused"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cachedChairs.Purge()
+			repo := &fakeBuyRepository{stock: 2, err: tt.err}
+			s := &Server{Chairs: repo}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/chair/buy/5", strings.NewReader(`{"email":"a@example.com"}`))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues("5")
+			if err := s.buyChair(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if len(repo.bought) != 1 || repo.bought[0] != 5 {
+				t.Errorf("BuyChair calls = %v, want [5]", repo.bought)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// shutdownTimeout SIGINT/SIGTERMを受けてから処理中のリクエストを待つ時間
+var shutdownTimeout = parseDurationEnv("SHUTDOWN_TIMEOUT", 10*time.Second)
+
+// shutdownOnSignal シグナルを受けたら新しいリクエストを受け付けず、処理中のリクエストが終わるのを待って止める
+// 止まった後に main() が flushWriteBehind で溜めた書き込みを書き出す
+func shutdownOnSignal(e *echo.Echo) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Errorf("shutdown error : %v", err)
+	}
+}
+
+// flushWriteBehind メモリ上に溜めている在庫の差分と購入履歴をDBに書き出す
+func flushWriteBehind() {
+	if flagInMemoryStock.Enabled() {
+		if err := flushStocks(); err != nil {
+			log.Errorf("flushStocks DB execution error : %v", err)
+		}
+	}
+	if err := flushPurchases(); err != nil {
+		log.Errorf("flushPurchases DB execution error : %v", err)
+	}
+}
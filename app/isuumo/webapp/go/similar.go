@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// getSimilarChairs 同じkindで、colorが同じかfeatureが1つ以上重なる椅子を人気順に返す
+// featureの重なりは chair_feature1 (feature_id, chair_id) で引く
+func getSimilarChairs(c echo.Context) error {
+	ctx := c.Request().Context()
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return invalidParam(c, "id", "must be an integer")
+	}
+
+	chair, err := srv.getChair(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("requested id's chair not found : %v", id)
+			return notFound(c, "chair not found")
+		}
+		c.Echo().Logger.Errorf("getSimilarChairs DB execution error : %v", err)
+		return internalError(c)
+	}
+	if chair.Hidden {
+		c.Echo().Logger.Infof("requested id's chair is hidden : %v", id)
+		return notFound(c, "chair not found")
+	}
+
+	var featureIDs []int
+	for _, f := range strings.Split(chair.Features, ",") {
+		if fid, ok := currentConditions().ChairFeatures[f]; ok {
+			featureIDs = append(featureIDs, fid)
+		}
+	}
+
+	match := "color = ?"
+	params := []interface{}{id, chair.Kind, chair.Color}
+	if len(featureIDs) > 0 {
+		match = "(color = ? OR id IN (SELECT chair_id FROM chair_feature WHERE feature_id IN (?)))"
+		params = append(params, featureIDs)
+	}
+	query, args, err := sqlx.In(`SELECT * FROM chair WHERE id != ? AND kind = ? AND `+match+` AND stock > 0 AND hidden = 0 ORDER BY popularity DESC, id ASC LIMIT ?`, append(params, Limit)...)
+	if err != nil {
+		c.Logger().Errorf("getSimilarChairs failed to build query : %v", err)
+		return internalError(c)
+	}
+
+	chairs := getEmptyChairSlice()
+	defer releaseChairSlice(chairs)
+	if err := db.SelectContext(ctx, &chairs, query, args...); err != nil && err != sql.ErrNoRows {
+		c.Logger().Errorf("getSimilarChairs DB execution error : %v", err)
+		return internalError(c)
+	}
+
+	return JSON(c, http.StatusOK, ChairListResponse{Chairs: chairs})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+// 同じクエリが同時に来たら1回だけDBに問い合わせて結果を分け合う
+var flagSingleflight = newFeatureFlag("SINGLEFLIGHT", true)
+
+// singleflightGroup golang.org/x/sync/singleflight と同じ動きをする
+// 依存を増やさないように必要な Do だけを持ち、待つ側はcontextで諦められるようにしている
+// fnがpanicしたら、x/sync と違ってプロセスを落とさずにエラーとして返す
+type singleflightGroup struct {
+	mu sync.Mutex
+	m  map[string]*singleflightCall
+}
+
+type singleflightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// Do keyの呼び出しが実行中ならその結果を待ち、なければfnを実行する
+// 結果は呼び出し側で共有されるので、書き換えずにコピーして使う
+// ctxが終わったら結果を待たずに戻るが、fnは他の呼び出しと共有されるので止めない
+func (g *singleflightGroup) Do(ctx context.Context, key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = map[string]*singleflightCall{}
+	}
+	c, ok := g.m[key]
+	if !ok {
+		c = &singleflightCall{done: make(chan struct{})}
+		g.m[key] = c
+		go func() {
+			defer func() {
+				// このgoroutineには Recover ミドルウェアが効かないので、panicはエラーにして待っている全員に返す
+				if r := recover(); r != nil {
+					log.Errorf("singleflight %q panicked : %v\n%s", key, r, debug.Stack())
+					c.val, c.err = nil, fmt.Errorf("singleflight: panic: %v", r)
+				}
+				g.mu.Lock()
+				delete(g.m, key)
+				g.mu.Unlock()
+				close(c.done)
+			}()
+			c.val, c.err = fn()
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// queryFlight 検索と件数のクエリの singleflightGroup
+var queryFlight singleflightGroup
+
+// queryKey クエリとパラメータをキーにする
+// パラメータは型と値で書き、文字列は長さを前に付けて区切り文字を含んでいても他のキーと重ならないようにする
+func queryKey(query string, params []interface{}) string {
+	var b strings.Builder
+	b.WriteString(query)
+	for _, p := range params {
+		b.WriteByte(0)
+		switch v := p.(type) {
+		case nil:
+			b.WriteString("n")
+		case int:
+			b.WriteString("i" + strconv.Itoa(v))
+		case int64:
+			b.WriteString("i" + strconv.FormatInt(v, 10))
+		case float64:
+			b.WriteString("f" + strconv.FormatFloat(v, 'g', -1, 64))
+		case bool:
+			b.WriteString("b" + strconv.FormatBool(v))
+		case string:
+			b.WriteString("s" + strconv.Itoa(len(v)) + ":" + v)
+		case []byte:
+			b.WriteString("s" + strconv.Itoa(len(v)) + ":" + string(v))
+		default:
+			// ここに来る型はDBのドライバに渡せる値なので、%vで値が決まる
+			s := fmt.Sprintf("%T:%v", v, v)
+			b.WriteString("v" + strconv.Itoa(len(s)) + ":" + s)
+		}
+	}
+	return b.String()
+}
+
+// sharedQuery flagSingleflight が有効なら同じクエリの実行を1回にまとめる
+// まとめたクエリは1つのリクエストが取り消されても他のリクエストのために続けるので、
+// fnに渡すcontextはctxのデッドラインだけを引き継ぐ
+func sharedQuery(ctx context.Context, query string, params []interface{}, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	if !flagSingleflight.Enabled() {
+		return fn(ctx)
+	}
+	return queryFlight.Do(ctx, queryKey(query, params), func() (interface{}, error) {
+		shared, cancel := detachedContext(ctx)
+		defer cancel()
+		return fn(shared)
+	})
+}
+
+// detachedContext ctxの取り消しは引き継がず、デッドラインとクエリ数の集計先だけを引き継ぐ
+func detachedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	base := context.Background()
+	if rq := requestQueriesOf(ctx); rq != nil {
+		base = withRequestQueries(base, rq)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(base, deadline)
+	}
+	return context.WithCancel(base)
+}
+
+// selectChairs queryの結果をdstに追加する
+func (s *Server) selectChairs(ctx context.Context, dst []Chair, query string, params ...interface{}) ([]Chair, error) {
+	v, err := sharedQuery(ctx, query, params, func(ctx context.Context) (interface{}, error) {
+		var rows []Chair
+		err := s.DB.SelectContext(ctx, &rows, query, params...)
+		return rows, err
+	})
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, v.([]Chair)...), nil
+}
+
+// selectEstates queryの結果をdstに追加する
+func (s *Server) selectEstates(ctx context.Context, dst []Estate, query string, params ...interface{}) ([]Estate, error) {
+	v, err := sharedQuery(ctx, query, params, func(ctx context.Context) (interface{}, error) {
+		var rows []Estate
+		err := s.DB.SelectContext(ctx, &rows, query, params...)
+		return rows, err
+	})
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, v.([]Estate)...), nil
+}
+
+// selectInts queryの結果をdstに追加する
+func (s *Server) selectInts(ctx context.Context, dst []int, query string, params ...interface{}) ([]int, error) {
+	v, err := sharedQuery(ctx, query, params, func(ctx context.Context) (interface{}, error) {
+		var rows []int
+		err := s.DB.SelectContext(ctx, &rows, query, params...)
+		return rows, err
+	})
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, v.([]int)...), nil
+}
+
+// getCount queryの COUNT(*) を返す
+func getCount(ctx context.Context, db *sqlx.DB, query string, params ...interface{}) (int64, error) {
+	v, err := sharedQuery(ctx, query, params, func(ctx context.Context) (interface{}, error) {
+		var n int64
+		err := db.GetContext(ctx, &n, query, params...)
+		return n, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return v.(int64), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSingleflightGroupDo(t *testing.T) {
+	var g singleflightGroup
+	release := make(chan struct{})
+	var calls int
+	var mu sync.Mutex
+	fn := func() (interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := g.Do(context.Background(), "k", fn)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+	for _, v := range results {
+		if v != 42 {
+			t.Errorf("result = %v, want 42", v)
+		}
+	}
+}
+
+func TestSingleflightGroupDoPanic(t *testing.T) {
+	var g singleflightGroup
+	_, err := g.Do(context.Background(), "k", func() (interface{}, error) {
+		panic("boom")
+	})
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("err = %v, want panic error", err)
+	}
+
+	// panicした後も同じキーで呼べる
+	v, err := g.Do(context.Background(), "k", func() (interface{}, error) { return 1, nil })
+	if err != nil || v != 1 {
+		t.Fatalf("Do after panic = %v, %v", v, err)
+	}
+}
+
+func TestSingleflightGroupDoCanceled(t *testing.T) {
+	var g singleflightGroup
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	release := make(chan struct{})
+	defer close(release)
+	_, err := g.Do(ctx, "k", func() (interface{}, error) {
+		<-release
+		return nil, nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestQueryKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   []interface{}
+		sameAs bool
+	}{
+		{"same values", []interface{}{1, "a"}, []interface{}{1, "a"}, true},
+		{"int and int64", []interface{}{1}, []interface{}{int64(1)}, true},
+		{"int and string", []interface{}{1}, []interface{}{"1"}, false},
+		{"separator in string", []interface{}{"a\x00sb"}, []interface{}{"a", "b"}, false},
+		{"split strings", []interface{}{"ab", "c"}, []interface{}{"a", "bc"}, false},
+		{"nil and empty string", []interface{}{nil}, []interface{}{""}, false},
+		{"slices", []interface{}{[]int{1, 2}}, []interface{}{[]int{1, 2}}, true},
+		{"different slices", []interface{}{[]int{1, 2}}, []interface{}{[]int{12}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := queryKey("q", tt.a), queryKey("q", tt.b)
+			if (a == b) != tt.sameAs {
+				t.Errorf("queryKey(%v) == queryKey(%v) is %v, want %v", tt.a, tt.b, a == b, tt.sameAs)
+			}
+		})
+	}
+	if queryKey("q1", nil) == queryKey("q2", nil) {
+		t.Error("different queries must have different keys")
+	}
+}
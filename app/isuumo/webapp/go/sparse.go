@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/labstack/echo"
+)
+
+// ?fields=id,name,thumbnail のように指定すると、chair/estateはそのキーだけを返す
+// キーはJSONのキー名で、chairとestateで共通 (どちらにもないキーは400)
+const (
+	sparseFieldsParam      = "fields"
+	sparseFieldsContextKey = "sparseFields"
+)
+
+// fieldSet 返すキーの集合
+type fieldSet map[string]bool
+
+type chairField struct {
+	name  string
+	write func(stream *jsoniter.Stream, chair *Chair)
+}
+
+type estateField struct {
+	name  string
+	write func(stream *jsoniter.Stream, estate *Estate)
+}
+
+// chairFields, estateFields writeChair, writeEstate と同じ順に並べる
+var chairFields = []chairField{
+	{"id", func(s *jsoniter.Stream, c *Chair) { s.WriteInt64(c.ID) }},
+	{"name", func(s *jsoniter.Stream, c *Chair) { s.WriteString(c.Name) }},
+	{"description", func(s *jsoniter.Stream, c *Chair) { s.WriteString(c.Description) }},
+	{"thumbnail", func(s *jsoniter.Stream, c *Chair) { s.WriteString(c.Thumbnail) }},
+	{"price", func(s *jsoniter.Stream, c *Chair) { s.WriteInt64(c.Price) }},
+	{"height", func(s *jsoniter.Stream, c *Chair) { s.WriteInt64(c.Height) }},
+	{"width", func(s *jsoniter.Stream, c *Chair) { s.WriteInt64(c.Width) }},
+	{"depth", func(s *jsoniter.Stream, c *Chair) { s.WriteInt64(c.Depth) }},
+	{"color", func(s *jsoniter.Stream, c *Chair) { s.WriteString(c.Color) }},
+	{"features", func(s *jsoniter.Stream, c *Chair) { s.WriteString(c.Features) }},
+	{"kind", func(s *jsoniter.Stream, c *Chair) { s.WriteString(c.Kind) }},
+}
+
+var estateFields = []estateField{
+	{"id", func(s *jsoniter.Stream, e *Estate) { s.WriteInt64(e.ID) }},
+	{"thumbnail", func(s *jsoniter.Stream, e *Estate) { s.WriteString(e.Thumbnail) }},
+	{"name", func(s *jsoniter.Stream, e *Estate) { s.WriteString(e.Name) }},
+	{"description", func(s *jsoniter.Stream, e *Estate) { s.WriteString(e.Description) }},
+	{"latitude", func(s *jsoniter.Stream, e *Estate) { s.WriteFloat64(e.Latitude) }},
+	{"longitude", func(s *jsoniter.Stream, e *Estate) { s.WriteFloat64(e.Longitude) }},
+	{"address", func(s *jsoniter.Stream, e *Estate) { s.WriteString(e.Address) }},
+	{"rent", func(s *jsoniter.Stream, e *Estate) { s.WriteInt64(e.Rent) }},
+	{"doorHeight", func(s *jsoniter.Stream, e *Estate) { s.WriteInt64(e.DoorHeight) }},
+	{"doorWidth", func(s *jsoniter.Stream, e *Estate) { s.WriteInt64(e.DoorWidth) }},
+	{"features", func(s *jsoniter.Stream, e *Estate) { s.WriteString(e.Features) }},
+}
+
+// parseFieldSet カンマ区切りのキーを読む 知らないキーがあればfalseを返す
+func parseFieldSet(s string) (fieldSet, bool) {
+	known := map[string]bool{}
+	for _, f := range chairFields {
+		known[f.name] = true
+	}
+	for _, f := range estateFields {
+		known[f.name] = true
+	}
+
+	fs := fieldSet{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if !known[name] {
+			return nil, false
+		}
+		fs[name] = true
+	}
+	return fs, true
+}
+
+// sparseFieldsMiddleware fieldsをcontextに入れ、JSON() がエンコードするときに使う
+// fieldsがなく view=summary なら summaryFields を使う
+func sparseFieldsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if v := c.QueryParam(viewParam); v != "" && v != viewSummary {
+			c.Echo().Logger.Infof("Invalid view parameter : %v", v)
+			return invalidParam(c, viewParam, "must be summary")
+		}
+		s := c.QueryParam(sparseFieldsParam)
+		if s == "" {
+			if summaryView(c) {
+				c.Set(sparseFieldsContextKey, summaryFields)
+			}
+			return next(c)
+		}
+		fs, ok := parseFieldSet(s)
+		if !ok {
+			c.Echo().Logger.Infof("Invalid fields parameter : %v", s)
+			return invalidParam(c, sparseFieldsParam, "unknown field")
+		}
+		c.Set(sparseFieldsContextKey, fs)
+		return next(c)
+	}
+}
+
+// sparseFieldsOf リクエストで指定されたキー 指定されていなければnil
+// エンコードするStreamのAttachmentに入れると writeChair, writeEstate が絞り込む
+func sparseFieldsOf(c echo.Context) fieldSet {
+	fs, _ := c.Get(sparseFieldsContextKey).(fieldSet)
+	return fs
+}
+
+func writeSparseChair(stream *jsoniter.Stream, chair *Chair, fs fieldSet) {
+	stream.WriteObjectStart()
+	first := true
+	for _, f := range chairFields {
+		if !fs[f.name] {
+			continue
+		}
+		if !first {
+			stream.WriteMore()
+		}
+		first = false
+		stream.WriteObjectField(f.name)
+		f.write(stream, chair)
+	}
+	stream.WriteObjectEnd()
+}
+
+func writeSparseEstate(stream *jsoniter.Stream, estate *Estate, fs fieldSet) {
+	stream.WriteObjectStart()
+	first := true
+	for _, f := range estateFields {
+		if !fs[f.name] {
+			continue
+		}
+		if !first {
+			stream.WriteMore()
+		}
+		first = false
+		stream.WriteObjectField(f.name)
+		f.write(stream, estate)
+	}
+	stream.WriteObjectEnd()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+)
+
+// SQL_METRICS=1 のときに使うドライバ名
+const metricsDriverName = "mysql+metrics"
+
+func init() {
+	sql.Register(metricsDriverName, metricsDriver{})
+}
+
+// レイテンシのヒストグラムの境界(ms) 最後のバケットはそれ以上
+var sqlLatencyBucketsMs = []float64{1, 5, 10, 50, 100, 500, 1000}
+
+type sqlStat struct {
+	Fingerprint string  `json:"fingerprint"`
+	Count       int64   `json:"count"`
+	Errors      int64   `json:"errors"`
+	TotalMs     float64 `json:"totalMs"`
+	MaxMs       float64 `json:"maxMs"`
+	AvgMs       float64 `json:"avgMs"`
+	Histogram   []int64 `json:"histogram"`
+}
+
+var sqlStats = map[string]*sqlStat{}
+var sqlStatsMutex sync.Mutex
+
+var (
+	fingerprintString  = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"`)
+	fingerprintNumber  = regexp.MustCompile(`\b-?\d+(?:\.\d+)?\b`)
+	fingerprintInList  = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	fingerprintValues  = regexp.MustCompile(`(\(\?\+\))(?:\s*,\s*\(\?\+\))+`)
+	fingerprintSpace   = regexp.MustCompile(`\s+`)
+	fingerprintCache   = map[string]string{}
+	fingerprintCacheMu sync.RWMutex
+)
+
+// fingerprint リテラルやプレースホルダを正規化して同じ形のクエリをまとめる
+func fingerprint(query string) string {
+	fingerprintCacheMu.RLock()
+	fp, ok := fingerprintCache[query]
+	fingerprintCacheMu.RUnlock()
+	if ok {
+		return fp
+	}
+
+	fp = fingerprintString.ReplaceAllString(query, "?")
+	fp = fingerprintNumber.ReplaceAllString(fp, "?")
+	fp = fingerprintInList.ReplaceAllString(fp, "(?+)")
+	fp = fingerprintValues.ReplaceAllString(fp, "$1, ...")
+	fp = fingerprintSpace.ReplaceAllString(strings.TrimSpace(fp), " ")
+
+	// バルクインサートなどでクエリ文字列の種類が際限なく増えないように上限を設ける
+	fingerprintCacheMu.Lock()
+	if len(fingerprintCache) < 10000 {
+		fingerprintCache[query] = fp
+	}
+	fingerprintCacheMu.Unlock()
+
+	return fp
+}
+
+func recordSQL(ctx context.Context, query string, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	elapsed := time.Since(start)
+	if rq := requestQueriesOf(ctx); rq != nil {
+		rq.record(elapsed, err)
+	}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	fp := fingerprint(query)
+
+	sqlStatsMutex.Lock()
+	defer sqlStatsMutex.Unlock()
+
+	st, ok := sqlStats[fp]
+	if !ok {
+		st = &sqlStat{Fingerprint: fp, Histogram: make([]int64, len(sqlLatencyBucketsMs)+1)}
+		sqlStats[fp] = st
+	}
+	st.Count++
+	if err != nil {
+		st.Errors++
+	}
+	st.TotalMs += ms
+	if ms > st.MaxMs {
+		st.MaxMs = ms
+	}
+	i := sort.SearchFloat64s(sqlLatencyBucketsMs, ms)
+	st.Histogram[i]++
+}
+
+// getSQLStats フィンガープリントごとの統計を合計時間の降順で返す
+func getSQLStats(c echo.Context) error {
+	sqlStatsMutex.Lock()
+	res := make([]sqlStat, 0, len(sqlStats))
+	for _, st := range sqlStats {
+		s := *st
+		s.Histogram = append([]int64{}, st.Histogram...)
+		s.AvgMs = s.TotalMs / float64(s.Count)
+		res = append(res, s)
+	}
+	sqlStatsMutex.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].TotalMs > res[j].TotalMs
+	})
+
+	return JSON(c, http.StatusOK, echo.Map{
+		"bucketsMs": sqlLatencyBucketsMs,
+		"stats":     res,
+	})
+}
+
+// resetSQLStats 統計をリセットする
+func resetSQLStats(c echo.Context) error {
+	sqlStatsMutex.Lock()
+	sqlStats = map[string]*sqlStat{}
+	sqlStatsMutex.Unlock()
+	return c.NoContent(http.StatusNoContent)
+}
+
+// metricsDriver mysqlドライバをラップしてクエリごとの時間を計測する
+type metricsDriver struct{}
+
+func (metricsDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := mysql.MySQLDriver{}.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsConn{conn}, nil
+}
+
+type metricsConn struct {
+	driver.Conn
+}
+
+func (mc *metricsConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := mc.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsStmt{stmt, query}, nil
+}
+
+func (mc *metricsConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := mc.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsStmt{stmt, query}, nil
+}
+
+func (mc *metricsConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return mc.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (mc *metricsConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := mc.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	recordSQL(ctx, query, start, err)
+	return rows, err
+}
+
+func (mc *metricsConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := mc.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	recordSQL(ctx, query, start, err)
+	return res, err
+}
+
+func (mc *metricsConn) Ping(ctx context.Context) error {
+	return mc.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (mc *metricsConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return mc.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+func (mc *metricsConn) ResetSession(ctx context.Context) error {
+	return mc.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+type metricsStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (ms *metricsStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := ms.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	recordSQL(ctx, ms.query, start, err)
+	return rows, err
+}
+
+func (ms *metricsStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := ms.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	recordSQL(ctx, ms.query, start, err)
+	return res, err
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/labstack/echo"
+)
+
+// 中身の変わらないレスポンスはエンコード済みのバイト列をそのまま返す
+var (
+	initializeResponseJSON = staticJSON(InitializeResponse{Language: "go"})
+	// jsonenc.go で登録するエンコーダーより先に myjson でエンコードすると登録が効かなくなるので書き下す
+	emptyEstateListJSON = []byte(`{"estates":[]}` + "\n")
+)
+
+// staticJSON JSON() と同じ形 (末尾に改行) でエンコードする
+// 固定の値だけに使うので、失敗したら起動時に落とす
+func staticJSON(v interface{}) []byte {
+	b, err := myjson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return append(b, '\n')
+}
+
+// JSONBlob staticJSON で作ったバイト列を返す
+func JSONBlob(c echo.Context, code int, b []byte) error {
+	return c.Blob(code, echo.MIMEApplicationJSONCharsetUTF8, b)
+}
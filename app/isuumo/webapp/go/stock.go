@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/gommon/log"
+)
+
+// 在庫の差分をDBに書き出す間隔
+// 人気の椅子に購入が集中しても、同じ行へのUPDATEはこの間隔に1回にまとまる
+var stockFlushInterval = parseDurationEnv("STOCK_FLUSH_INTERVAL", 100*time.Millisecond)
+
+// 在庫をメモリ上で管理し、DBには差分を非同期でまとめて書き出す
+// 有効にした場合、在庫を変更する処理は全て adjustStock を経由する
+var flagInMemoryStock = newFeatureFlag("IN_MEMORY_STOCK", false)
+
+// stockCounters chair id -> 在庫
+var stockCounters = map[int64]*int64{}
+var stockCountersMutex sync.RWMutex
+
+// stockPending DBにまだ書き出していない在庫の差分
+var stockPending = map[int64]int64{}
+
+// stockAvailabilityChanged 在庫の有無が変わったchair id
+// DBに書き出した後に検索結果のキャッシュを捨てる
+var stockAvailabilityChanged = map[int64]bool{}
+var stockPendingMutex sync.Mutex
+
+// stockFlushMutex 書き出しを直列化する
+var stockFlushMutex sync.Mutex
+
+// loadStocks DBから全ての椅子の在庫を読み込む
+func loadStocks() error {
+	var rows []struct {
+		ID    int64 `db:"id"`
+		Stock int64 `db:"stock"`
+	}
+	if err := db.Select(&rows, "SELECT id, stock FROM chair"); err != nil {
+		return err
+	}
+
+	counters := make(map[int64]*int64, len(rows))
+	for _, r := range rows {
+		v := r.Stock
+		counters[r.ID] = &v
+	}
+
+	stockPendingMutex.Lock()
+	stockPending = map[int64]int64{}
+	stockAvailabilityChanged = map[int64]bool{}
+	stockPendingMutex.Unlock()
+
+	stockCountersMutex.Lock()
+	stockCounters = counters
+	stockCountersMutex.Unlock()
+
+	return nil
+}
+
+// addStock postChairで追加された椅子の在庫を登録する
+func addStock(id, stock int64) {
+	v := stock
+	stockCountersMutex.Lock()
+	stockCounters[id] = &v
+	stockCountersMutex.Unlock()
+}
+
+// currentStock メモリ上の在庫を返す
+func currentStock(id int64) (int64, bool) {
+	stockCountersMutex.RLock()
+	p, ok := stockCounters[id]
+	stockCountersMutex.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	return atomic.LoadInt64(p), true
+}
+
+// adjustStock 在庫をdeltaだけ変更して変更後の在庫を返す
+// 在庫が負になる場合は変更せずにokがfalseになる
+func adjustStock(id, delta int64) (after int64, ok bool, known bool) {
+	stockCountersMutex.RLock()
+	p, known := stockCounters[id]
+	stockCountersMutex.RUnlock()
+	if !known {
+		return 0, false, false
+	}
+
+	for {
+		before := atomic.LoadInt64(p)
+		after = before + delta
+		if after < 0 {
+			return before, false, true
+		}
+		if atomic.CompareAndSwapInt64(p, before, after) {
+			stockPendingMutex.Lock()
+			stockPending[id] += delta
+			if (before > 0) != (after > 0) {
+				stockAvailabilityChanged[id] = true
+			}
+			stockPendingMutex.Unlock()
+			return after, true, true
+		}
+	}
+}
+
+// flushStocks 溜まっている差分を1つのUPDATEでDBに書き出す
+func flushStocks() error {
+	stockFlushMutex.Lock()
+	defer stockFlushMutex.Unlock()
+
+	stockPendingMutex.Lock()
+	pending := stockPending
+	changed := stockAvailabilityChanged
+	stockPending = map[int64]int64{}
+	stockAvailabilityChanged = map[int64]bool{}
+	stockPendingMutex.Unlock()
+
+	cases := make([]string, 0, len(pending))
+	args := make([]interface{}, 0, len(pending)*2)
+	ids := make([]int64, 0, len(pending))
+	for id, delta := range pending {
+		if delta == 0 {
+			continue
+		}
+		cases = append(cases, "WHEN ? THEN ?")
+		args = append(args, id, delta)
+		ids = append(ids, id)
+	}
+
+	if len(ids) > 0 {
+		query, args, err := sqlx.In("UPDATE chair SET stock = stock + CASE id "+strings.Join(cases, " ")+" END WHERE id IN (?)", append(args, ids)...)
+		if err == nil {
+			err = retryWrite(context.Background(), func() error {
+				_, err := db.Exec(db.Rebind(query), args...)
+				return err
+			})
+		}
+		if err != nil {
+			// 次回に書き出せるように戻しておく
+			stockPendingMutex.Lock()
+			for id, delta := range pending {
+				stockPending[id] += delta
+			}
+			for id := range changed {
+				stockAvailabilityChanged[id] = true
+			}
+			stockPendingMutex.Unlock()
+			return err
+		}
+	}
+
+	for id := range changed {
+		invalidateChairStock(int(id), true)
+	}
+
+	return nil
+}
+
+// syncStocks 定期的に在庫の差分をDBに書き出す
+func syncStocks() {
+	ticker := time.NewTicker(stockFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !flagInMemoryStock.Enabled() {
+			continue
+		}
+		if err := flushStocks(); err != nil {
+			log.Errorf("syncStocks DB execution error : %v", err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/labstack/echo"
+)
+
+// ?view=summary で一覧のchair/estateを説明やfeaturesを除いた小さい形で返す (モバイルや地図向け)
+// 返すキーは summaryFields で、?fields= と同じ仕組みで絞り込む
+const (
+	viewParam   = "view"
+	viewSummary = "summary"
+)
+
+// summaryFields 要約で返すキー chairとestateで共通
+var summaryFields = fieldSet{
+	"id": true, "name": true, "thumbnail": true,
+	"price": true, "height": true, "width": true, "depth": true, "color": true, "kind": true,
+	"latitude": true, "longitude": true, "address": true, "rent": true, "doorHeight": true, "doorWidth": true,
+}
+
+// chairSummaryColumns, estateSummaryColumns 要約のときにDBから読むカラム
+// 並び替えとカーソルに使うpopularityも読む
+const (
+	chairSummaryColumns  = "chair.id, chair.name, chair.thumbnail, chair.price, chair.height, chair.width, chair.depth, chair.color, chair.kind, chair.popularity"
+	estateSummaryColumns = "id, name, thumbnail, latitude, longitude, address, rent, door_height, door_width, popularity"
+)
+
+// summaryView 要約で返すか
+func summaryView(c echo.Context) bool {
+	return c.QueryParam(viewParam) == viewSummary
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// バックグラウンドタスクの同時実行数の上限
+	maxConcurrentTasks = 16
+	// 実行を待てるタスクの数 これを超えると Go は空くまで待つ
+	maxQueuedTasks = 1024
+)
+
+type taskStat struct {
+	Name      string `json:"name"`
+	Started   int64  `json:"started"`
+	Completed int64  `json:"completed"`
+	Panicked  int64  `json:"panicked"`
+	Running   int64  `json:"running"`
+	// Queued 実行を待っている数
+	Queued int64 `json:"queued"`
+}
+
+type task struct {
+	name string
+	fn   func()
+}
+
+// taskRunner バックグラウンド処理を実行する
+// Go のタスクは maxConcurrentTasks 個のワーカーがキューから順に実行するので、呼ぶたびにgoroutineは増えない
+// 止まらないループは Loop で専用のgoroutineで動かし、ワーカーを占有しない
+// panicしてもサーバーを落とさず、名前ごとに実行状況を記録する
+type taskRunner struct {
+	queue     chan task
+	startOnce sync.Once
+
+	mu    sync.Mutex
+	stats map[string]*taskStat
+}
+
+var tasks = newTaskRunner(maxQueuedTasks)
+
+func newTaskRunner(queueSize int) *taskRunner {
+	return &taskRunner{
+		queue: make(chan task, queueSize),
+		stats: map[string]*taskStat{},
+	}
+}
+
+func (tr *taskRunner) stat(name string) *taskStat {
+	st, ok := tr.stats[name]
+	if !ok {
+		st = &taskStat{Name: name}
+		tr.stats[name] = st
+	}
+	return st
+}
+
+// Go fnをキューに入れ、ワーカーが空いたら実行する
+// キューが一杯なら空くまで待つ
+func (tr *taskRunner) Go(name string, fn func()) {
+	tr.startOnce.Do(func() {
+		for i := 0; i < maxConcurrentTasks; i++ {
+			go tr.work()
+		}
+	})
+
+	tr.mu.Lock()
+	st := tr.stat(name)
+	st.Started++
+	st.Queued++
+	tr.mu.Unlock()
+
+	tr.queue <- task{name: name, fn: fn}
+}
+
+func (tr *taskRunner) work() {
+	for t := range tr.queue {
+		tr.mu.Lock()
+		tr.stat(t.name).Queued--
+		tr.mu.Unlock()
+		tr.run(t.name, t.fn)
+	}
+}
+
+// Loop 定期的な書き出しのように終わらないfnを、ワーカーとは別のgoroutineで実行する
+func (tr *taskRunner) Loop(name string, fn func()) {
+	tr.mu.Lock()
+	tr.stat(name).Started++
+	tr.mu.Unlock()
+
+	go tr.run(name, fn)
+}
+
+func (tr *taskRunner) run(name string, fn func()) {
+	tr.mu.Lock()
+	tr.stat(name).Running++
+	tr.mu.Unlock()
+
+	panicked := false
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			log.Errorf("task %s panicked : %v\n%s", name, r, debug.Stack())
+		}
+
+		tr.mu.Lock()
+		st := tr.stat(name)
+		st.Running--
+		if panicked {
+			st.Panicked++
+		} else {
+			st.Completed++
+		}
+		tr.mu.Unlock()
+	}()
+
+	fn()
+}
+
+func getTaskStats(c echo.Context) error {
+	tasks.mu.Lock()
+	res := make([]taskStat, 0, len(tasks.stats))
+	for _, st := range tasks.stats {
+		res = append(res, *st)
+	}
+	tasks.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return JSON(c, http.StatusOK, res)
+}
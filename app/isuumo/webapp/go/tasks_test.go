@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func (tr *taskRunner) statOf(name string) taskStat {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return *tr.stat(name)
+}
+
+func TestTaskRunnerQueuesBeyondWorkers(t *testing.T) {
+	tr := newTaskRunner(4)
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// 止まらないループはワーカーを使わない
+	wg.Add(1)
+	tr.Loop("loop", func() {
+		defer wg.Done()
+		<-release
+	})
+
+	for i := 0; i < maxConcurrentTasks+2; i++ {
+		wg.Add(1)
+		tr.Go("blocked", func() {
+			defer wg.Done()
+			<-release
+		})
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	st := tr.statOf("blocked")
+	if st.Running != maxConcurrentTasks || st.Queued != 2 {
+		t.Errorf("running = %d, queued = %d, want %d, 2", st.Running, st.Queued, maxConcurrentTasks)
+	}
+	if st := tr.statOf("loop"); st.Running != 1 {
+		t.Errorf("loop running = %d, want 1", st.Running)
+	}
+
+	close(release)
+	wg.Wait()
+	time.Sleep(10 * time.Millisecond)
+
+	st = tr.statOf("blocked")
+	if st.Running != 0 || st.Queued != 0 || st.Completed != maxConcurrentTasks+2 {
+		t.Errorf("stat = %+v, want all completed", st)
+	}
+}
+
+func TestTaskRunnerRecoversPanic(t *testing.T) {
+	tr := newTaskRunner(1)
+	done := make(chan struct{})
+	tr.Go("panics", func() { panic("boom") })
+	tr.Go("after", func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("task after a panic did not run")
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if st := tr.statOf("panics"); st.Panicked != 1 || st.Running != 0 {
+		t.Errorf("stat = %+v, want 1 panicked", st)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// 詳細の閲覧と購入を数えて GET /api/trending で返す
+var flagTrending = newFeatureFlag("TRENDING", true)
+
+const (
+	// trendingFlushInterval 数えた分を分ごとの集計に移す間隔
+	trendingFlushInterval = time.Second
+	// trendingWindowMinutes 何分前まで集計を持っておくか
+	trendingWindowMinutes = 60
+	// trendingDefaultMinutes minutes を指定しなかったときに集計する分数
+	trendingDefaultMinutes = 10
+)
+
+// 閲覧や購入を記録する対象の種類
+const (
+	itemChair  = "chair"
+	itemEstate = "estate"
+)
+
+type trendingKey struct {
+	kind string
+	id   int64
+}
+
+type trendingCount struct {
+	views     int64
+	purchases int64
+}
+
+// trendingPending まだ分ごとの集計に移していない回数
+// リクエストごとに触るので、集計とは別のロックにして短く持つ
+var trendingPending = map[trendingKey]trendingCount{}
+var trendingPendingMutex sync.Mutex
+
+// trendingBucket 1分間の回数
+type trendingBucket struct {
+	minute int64
+	counts map[trendingKey]trendingCount
+}
+
+// trendingBuckets 分 % trendingWindowMinutes -> その分の回数
+var trendingBuckets [trendingWindowMinutes]trendingBucket
+var trendingBucketsMutex sync.RWMutex
+
+func recordTrending(kind string, id int64, views, purchases int64) {
+	if !flagTrending.Enabled() {
+		return
+	}
+	k := trendingKey{kind, id}
+	trendingPendingMutex.Lock()
+	cnt := trendingPending[k]
+	cnt.views += views
+	cnt.purchases += purchases
+	trendingPending[k] = cnt
+	trendingPendingMutex.Unlock()
+}
+
+// recordView 詳細を返したときに呼ぶ
+func recordView(kind string, id int64) {
+	recordTrending(kind, id, 1, 0)
+}
+
+// recordPurchase 購入や資料請求が成功したときに呼ぶ
+func recordPurchase(kind string, id int64, quantity int64) {
+	recordTrending(kind, id, 0, quantity)
+}
+
+// flushTrending 数えた分をnowの分の集計に足す
+func flushTrending(now time.Time) {
+	trendingPendingMutex.Lock()
+	pending := trendingPending
+	trendingPending = map[trendingKey]trendingCount{}
+	trendingPendingMutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	minute := now.Unix() / 60
+	trendingBucketsMutex.Lock()
+	b := &trendingBuckets[minute%trendingWindowMinutes]
+	if b.minute != minute || b.counts == nil {
+		b.minute = minute
+		b.counts = map[trendingKey]trendingCount{}
+	}
+	for k, v := range pending {
+		cnt := b.counts[k]
+		cnt.views += v.views
+		cnt.purchases += v.purchases
+		b.counts[k] = cnt
+	}
+	trendingBucketsMutex.Unlock()
+}
+
+// resetTrending /initialize で集計を始め直す
+func resetTrending() {
+	trendingPendingMutex.Lock()
+	trendingPending = map[trendingKey]trendingCount{}
+	trendingPendingMutex.Unlock()
+
+	trendingBucketsMutex.Lock()
+	trendingBuckets = [trendingWindowMinutes]trendingBucket{}
+	trendingBucketsMutex.Unlock()
+}
+
+// syncTrending 定期的に数えた分を集計に移す
+func syncTrending() {
+	ticker := time.NewTicker(trendingFlushInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		flushTrending(now)
+	}
+}
+
+// trendingIDs nowまでのminutes分間で閲覧の多い順 (同じなら購入の多い順) にkindのidを返す
+func trendingIDs(kind string, minutes int, now time.Time) []int {
+	to := now.Unix() / 60
+	from := to - int64(minutes) + 1
+
+	total := map[int64]trendingCount{}
+	trendingBucketsMutex.RLock()
+	for i := range trendingBuckets {
+		b := &trendingBuckets[i]
+		if b.minute < from || b.minute > to {
+			continue
+		}
+		for k, v := range b.counts {
+			if k.kind != kind {
+				continue
+			}
+			cnt := total[k.id]
+			cnt.views += v.views
+			cnt.purchases += v.purchases
+			total[k.id] = cnt
+		}
+	}
+	trendingBucketsMutex.RUnlock()
+
+	ids := make([]int, 0, len(total))
+	for id := range total {
+		ids = append(ids, int(id))
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := total[int64(ids[i])], total[int64(ids[j])]
+		if a.views != b.views {
+			return a.views > b.views
+		}
+		if a.purchases != b.purchases {
+			return a.purchases > b.purchases
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+type TrendingResponse struct {
+	Chairs  []Chair  `json:"chairs"`
+	Estates []Estate `json:"estates"`
+}
+
+// getTrending 直近minutes分間によく見られた椅子と物件をそれぞれ Limit 件返す
+// 非表示や売り切れの椅子は飛ばす
+func getTrending(c echo.Context) error {
+	minutes := trendingDefaultMinutes
+	if v := c.QueryParam("minutes"); v != "" {
+		var err error
+		minutes, err = strconv.Atoi(v)
+		if err != nil || minutes <= 0 || minutes > trendingWindowMinutes {
+			c.Echo().Logger.Infof("minutes invalid, %v : %v", v, err)
+			return invalidParam(c, "minutes", "out of range")
+		}
+	}
+
+	now := time.Now()
+	res := TrendingResponse{Chairs: []Chair{}, Estates: constEmptyEstates}
+
+	for _, id := range trendingIDs(itemChair, minutes, now) {
+		if len(res.Chairs) >= Limit {
+			break
+		}
+		chair, err := srv.getChair(id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			c.Logger().Errorf("getTrending DB execution error : %v", err)
+			return internalError(c)
+		}
+		if flagInMemoryStock.Enabled() {
+			if stock, ok := currentStock(int64(id)); ok {
+				chair.Stock = stock
+			}
+		}
+		if chair.Hidden || chair.Stock <= 0 {
+			continue
+		}
+		res.Chairs = append(res.Chairs, chair)
+	}
+
+	ids := trendingIDs(itemEstate, minutes, now)
+	if len(ids) > Limit {
+		ids = ids[:Limit]
+	}
+	if len(ids) > 0 {
+		estates, err := srv.getEstatesByIDs(c.Request().Context(), ids, nil)
+		if err != nil {
+			c.Logger().Errorf("getTrending DB execution error : %v", err)
+			return internalError(c)
+		}
+		if len(estates) > 0 {
+			res.Estates = estates
+		}
+	}
+
+	return JSON(c, http.StatusOK, res)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// 書き込みがデッドロックやロック待ちタイムアウトで失敗したら、少し待って最初からやり直す
+var (
+	txMaxRetry       = parseIntEnv("TX_MAX_RETRY", 3)
+	txRetryBaseDelay = parseDurationEnv("TX_RETRY_BASE_DELAY", 5*time.Millisecond)
+)
+
+// runInTx のfnが返す、再試行せずにクライアントへ返す失敗
+var (
+	errChairNotFound = errors.New("chair not found")
+	errOutOfStock    = errors.New("chair is out of stock")
+	errNegativeStock = errors.New("stock would be negative")
+)
+
+// isRetryableMySQLError デッドロックとロック待ちタイムアウトは再試行できる
+func isRetryableMySQLError(err error) bool {
+	if me, ok := err.(*mysql.MySQLError); ok {
+		return me.Number == 1213 || me.Number == 1205
+	}
+	return false
+}
+
+// retryWrite fnが再試行できるエラーで失敗したら txMaxRetry 回までやり直す
+// 同時に失敗した書き込みが揃ってやり直さないように、待ち時間は倍にしながらばらつかせる
+func retryWrite(ctx context.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetryableMySQLError(err) || attempt >= txMaxRetry {
+			return err
+		}
+		select {
+		case <-time.After(txRetryDelay(attempt)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// txRetryDelay attempt回目の失敗の後に待つ時間 (基準の半分から基準まで)
+func txRetryDelay(attempt int) time.Duration {
+	d := txRetryBaseDelay << uint(attempt)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// runInTx fnをdbのトランザクションで実行してコミットする
+// 再試行するとfnは最初から呼ばれるので、fnの中ではDB以外の状態を変えない
+func runInTx(ctx context.Context, db *sqlx.DB, fn func(tx *sqlx.Tx) error) error {
+	return retryWrite(ctx, func() error {
+		tx, err := db.BeginTxx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"strings"
+)
+
+// uploadFile アップロードされたファイルを必要なら展開して読む
+type uploadFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (u *uploadFile) Close() error {
+	var err error
+	for i := len(u.closers) - 1; i >= 0; i-- {
+		if e := u.closers[i].Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// openCSVUpload アップロードされたファイルを開いてCSVのReaderを返す
+// gzipはContent-Typeか先頭のマジックバイトで、TSVはContent-Type・拡張子か1行目の区切り文字で判定する
+// columns は1行あたりのカラム数で、TSVの判定に使う
+func openCSVUpload(header *multipart.FileHeader, columns int) (*csv.Reader, io.Closer, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	return openCSV(f, header.Header.Get("Content-Type"), header.Filename, columns)
+}
+
+// openCSV fをCSVとして読む contentType と filename はアップロードされたときのもの
+func openCSV(f io.ReadCloser, contentType, filename string, columns int) (*csv.Reader, io.Closer, error) {
+	u := &uploadFile{closers: []io.Closer{f}}
+
+	contentType = strings.ToLower(contentType)
+	filename = strings.ToLower(filename)
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) || strings.Contains(contentType, "gzip") {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			u.Close()
+			return nil, nil, err
+		}
+		u.closers = append(u.closers, zr)
+		br = bufio.NewReader(zr)
+		filename = strings.TrimSuffix(filename, ".gz")
+	}
+	u.Reader = br
+
+	r := csv.NewReader(u)
+	if strings.Contains(contentType, "tab-separated-values") || strings.HasSuffix(filename, ".tsv") || looksLikeTSV(br, columns) {
+		r.Comma = '\t'
+		// TSVはクォートしないことが多いので " をそのまま読めるようにする
+		r.LazyQuotes = true
+	}
+	return r, u, nil
+}
+
+// looksLikeTSV 1行目にカラム数分のタブがあればTSVとみなす
+func looksLikeTSV(br *bufio.Reader, columns int) bool {
+	line, _ := br.Peek(br.Size())
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return bytes.Count(line, []byte{'\t'}) >= columns-1
+}
+
+// csvHeaderError ヘッダ行に必要なカラムがない
+type csvHeaderError struct {
+	Missing []string
+}
+
+func (e *csvHeaderError) Error() string {
+	return "missing columns in header: " + strings.Join(e.Missing, ", ")
+}
+
+// normalizeColumnName door_height, doorHeight, Door Height を同じ名前として扱う
+func normalizeColumnName(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.ReplaceAll(s, "_", "")
+	return strings.ReplaceAll(s, " ", "")
+}
+
+// csvRows 1行目がヘッダ行ならカラム名で対応付けて、colsの順番に並べ替えた行を返す
+// ヘッダ行がなければ cols の順番に並んでいるものとして扱う
+type csvRows struct {
+	r     *csv.Reader
+	cols  []csvColumn
+	index []int
+	buf   []string
+	read  bool
+}
+
+func newCSVRows(r *csv.Reader, cols []csvColumn) *csvRows {
+	return &csvRows{r: r, cols: cols}
+}
+
+// isHeader id というカラム名があればヘッダ行とみなす
+func (cr *csvRows) isHeader(row []string) bool {
+	for _, v := range row {
+		if normalizeColumnName(v) == "id" {
+			return true
+		}
+	}
+	return false
+}
+
+func (cr *csvRows) readHeader(row []string) error {
+	pos := map[string]int{}
+	for i, v := range row {
+		pos[normalizeColumnName(v)] = i
+	}
+	cr.index = make([]int, len(cr.cols))
+	var missing []string
+	for i, col := range cr.cols {
+		p, ok := pos[normalizeColumnName(col.Name)]
+		if !ok {
+			missing = append(missing, col.Name)
+			continue
+		}
+		cr.index[i] = p
+	}
+	if len(missing) > 0 {
+		return &csvHeaderError{Missing: missing}
+	}
+	cr.buf = make([]string, len(cr.cols))
+	return nil
+}
+
+// Read 次の行を返す 返したスライスは次の呼び出しで上書きされる
+func (cr *csvRows) Read() ([]string, error) {
+	if !cr.read {
+		cr.read = true
+		row, err := cr.r.Read()
+		if err != nil {
+			return nil, err
+		}
+		if !cr.isHeader(row) {
+			return row, nil
+		}
+		if err := cr.readHeader(row); err != nil {
+			return nil, err
+		}
+		// ヘッダ行とデータ行でカラム数が違っていてもよい
+		cr.r.FieldsPerRecord = -1
+	}
+
+	row, err := cr.r.Read()
+	if err != nil || cr.index == nil {
+		return row, err
+	}
+	for i, p := range cr.index {
+		if p < len(row) {
+			cr.buf[i] = row[p]
+		} else {
+			cr.buf[i] = ""
+		}
+	}
+	return cr.buf, nil
+}
+
+// csvInputError CSVの中身が誤っている 再試行せずに400で message を返す
+type csvInputError struct {
+	message string
+	err     error
+}
+
+func (e *csvInputError) Error() string {
+	return e.message + ": " + e.err.Error()
+}
+
+type RecordMapper struct {
+	Record []string
+
+	offset int
+	err    error
+}
+
+func (r *RecordMapper) next() (string, error) {
+	if r.err != nil {
+		return "", r.err
+	}
+	if r.offset >= len(r.Record) {
+		r.err = fmt.Errorf("too many read")
+		return "", r.err
+	}
+	s := r.Record[r.offset]
+	r.offset++
+	return s, nil
+}
+
+func (r *RecordMapper) NextInt() int {
+	s, err := r.next()
+	if err != nil {
+		return 0
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		r.err = err
+		return 0
+	}
+	return i
+}
+
+func (r *RecordMapper) NextFloat() float64 {
+	s, err := r.next()
+	if err != nil {
+		return 0
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		r.err = err
+		return 0
+	}
+	return f
+}
+
+func (r *RecordMapper) NextString() string {
+	s, err := r.next()
+	if err != nil {
+		return ""
+	}
+	return s
+}
+
+func (r *RecordMapper) Err() error {
+	return r.err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+
+	"github.com/labstack/echo"
+)
+
+// なぞって検索のリクエストボディを厳密に検証する
+var flagStrictNazotte = newFeatureFlag("STRICT_NAZOTTE", false)
+
+type strictCoordinate struct {
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+type strictCoordinates struct {
+	Coordinates *[]strictCoordinate `json:"coordinates"`
+}
+
+// bindStrictCoordinates 未知のフィールドや欠けた値、範囲外の値を拒否してCoordinatesを読み込む
+// 始点と終点が同じ閉じた多角形でもそうでなくても良い
+func bindStrictCoordinates(c echo.Context) (Coordinates, error) {
+	var res Coordinates
+
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return res, err
+	}
+
+	var raw strictCoordinates
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&raw); err != nil {
+		return res, fmt.Errorf("invalid body: %v", err)
+	}
+	if dec.More() {
+		return res, fmt.Errorf("invalid body: unexpected data after object")
+	}
+	if raw.Coordinates == nil {
+		return res, fmt.Errorf("coordinates is required")
+	}
+
+	res.Coordinates = make([]Coordinate, 0, len(*raw.Coordinates))
+	for i, co := range *raw.Coordinates {
+		if co.Latitude == nil {
+			return res, fmt.Errorf("coordinates[%d].latitude is required", i)
+		}
+		if co.Longitude == nil {
+			return res, fmt.Errorf("coordinates[%d].longitude is required", i)
+		}
+		lat, lng := *co.Latitude, *co.Longitude
+		if math.IsNaN(lat) || math.IsInf(lat, 0) || lat < -90 || lat > 90 {
+			return res, fmt.Errorf("coordinates[%d].latitude must be between -90 and 90", i)
+		}
+		if math.IsNaN(lng) || math.IsInf(lng, 0) || lng < -180 || lng > 180 {
+			return res, fmt.Errorf("coordinates[%d].longitude must be between -180 and 180", i)
+		}
+		res.Coordinates = append(res.Coordinates, Coordinate{Latitude: lat, Longitude: lng})
+	}
+
+	// 閉じていない多角形は3点、閉じている多角形は4点必要
+	minPoints := 3
+	if n := len(res.Coordinates); n > 1 && res.Coordinates[0] == res.Coordinates[n-1] {
+		minPoints = 4
+	}
+	if len(res.Coordinates) < minPoints {
+		return res, fmt.Errorf("coordinates must have at least %d points", minPoints)
+	}
+
+	return res, nil
+}
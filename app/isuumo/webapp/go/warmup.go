@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// initialize の最後にキャッシュを温めてから返す
+// 無効ならこれまで通りバックグラウンドで作り直す
+var flagWarmup = newFeatureFlag("WARMUP", true)
+
+// warmupBatchSize estateをcachedEstatesに読み込むときに1回で取得する件数
+var warmupBatchSize = parseIntEnv("WARMUP_BATCH_SIZE", 5000)
+
+// resetCaches DBから作った手元のキャッシュとインデックスを全て捨てる
+// 共有キャッシュは他のサーバーが入れた古いデータを持っているかもしれないので世代を変える
+func resetCaches() {
+	cachedChairs.Purge()
+	cachedEstates.Purge()
+
+	lowPricedChairMutex.Lock()
+	clearLowPricedChair()
+	lowPricedChairMutex.Unlock()
+	lowPricedEstateMutex.Lock()
+	clearLowPricedEstate()
+	lowPricedEstateMutex.Unlock()
+
+	invalidateChairSearchCaches()
+	invalidateEstateSearchCaches()
+	invalidateRecommendedEstateIDs()
+
+	bumpChairETagEpoch()
+	bumpEstateETagEpoch()
+
+	sharedChairs.invalidate()
+	sharedEstates.invalidate()
+}
+
+// warmupCaches 最初のリクエストが冷えたキャッシュに当たらないように読み込んでおく
+// low_priced, 全てのestate, おすすめ物件の事前計算
+func warmupCaches() error {
+	if _, err := loadLowPricedChair(); err != nil {
+		return err
+	}
+	if _, err := loadLowPricedEstate(); err != nil {
+		return err
+	}
+	if err := warmupEstates(); err != nil {
+		return err
+	}
+	if flagPrecomputeRecommended.Enabled() {
+		if err := precomputeRecommendedEstateIDs(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmupEstates estateをidの順に cachedEstates の上限まで読み込む
+func warmupEstates() error {
+	lastID := int64(-1)
+	for loaded := 0; loaded < cachedEstates.MaxEntries(); {
+		estates := make([]Estate, 0, warmupBatchSize)
+		query := `SELECT * FROM estate WHERE id > ? ORDER BY id ASC LIMIT ?`
+		if err := db.Select(&estates, query, lastID, warmupBatchSize); err != nil {
+			return err
+		}
+		if len(estates) == 0 {
+			break
+		}
+		cacheEstates(estates)
+		loaded += len(estates)
+		lastID = estates[len(estates)-1].ID
+	}
+	return nil
+}
+
+// postWarmup キャッシュを温める
+// initialize の後にキャッシュが捨てられたときや、他のサーバーを温めるときに呼ぶ
+func postWarmup(c echo.Context) error {
+	if err := warmupCaches(); err != nil {
+		c.Logger().Errorf("warmup DB execution error : %v", err)
+		return internalError(c)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -1,10 +1,17 @@
+-- go/migrate.go の migrations から生成している 直接編集せずに go/ で go run . schema > ../mysql/db/0_Schema.sql する
 DROP DATABASE IF EXISTS isuumo;
 CREATE DATABASE isuumo;
+USE isuumo;
 
-DROP TABLE IF EXISTS isuumo.estate;
-DROP TABLE IF EXISTS isuumo.chair;
+CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version     INTEGER         NOT NULL PRIMARY KEY,
+    name        VARCHAR(128)    NOT NULL,
+    applied_at  DATETIME        NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
 
-CREATE TABLE isuumo.estate
+-- 1_create_tables
+CREATE TABLE IF NOT EXISTS estate
 (
     id          INTEGER             NOT NULL PRIMARY KEY,
     name        VARCHAR(64)         NOT NULL,
@@ -20,10 +27,26 @@ CREATE TABLE isuumo.estate
     popularity  INTEGER             NOT NULL,
     width_level  INTEGER NOT NULL DEFAULT -1,
     height_level INTEGER NOT NULL DEFAULT -1,
-    rent_level   INTEGER NOT NULL DEFAULT -1
+    rent_level   INTEGER NOT NULL DEFAULT -1,
+    prefecture   VARCHAR(8) NOT NULL DEFAULT '',
+    neg_popularity INTEGER AS (-popularity) STORED NOT NULL,
+    point        POINT AS (POINT(latitude, longitude)) STORED NOT NULL,
+    geohash      CHAR(5) NOT NULL DEFAULT '',
+    cell_id      BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    door_min     INTEGER AS (LEAST(door_width, door_height)) STORED NOT NULL,
+    door_max     INTEGER AS (GREATEST(door_width, door_height)) STORED NOT NULL,
+    INDEX estate1 (door_width, door_height, neg_popularity, id),
+    INDEX estate2 (rent, id),
+    INDEX estate3 (rent, neg_popularity, id),
+    INDEX estate4 (latitude, longitude, neg_popularity, id),
+    INDEX estate5 (id, popularity),
+    INDEX estate6 (height_level, width_level, neg_popularity, id),
+    INDEX estate7 (prefecture, neg_popularity, id),
+    INDEX estate8 (geohash),
+    INDEX estate9 (cell_id),
+    INDEX estate10 (door_min, door_max, neg_popularity, id)
 );
-
-CREATE TABLE isuumo.chair
+CREATE TABLE IF NOT EXISTS chair
 (
     id          INTEGER         NOT NULL PRIMARY KEY,
     name        VARCHAR(64)     NOT NULL,
@@ -41,31 +64,71 @@ CREATE TABLE isuumo.chair
     width_level  INTEGER NOT NULL DEFAULT -1,
     height_level INTEGER NOT NULL DEFAULT -1,
     depth_level   INTEGER NOT NULL DEFAULT -1,
-    price_level   INTEGER NOT NULL DEFAULT -1
+    price_level   INTEGER NOT NULL DEFAULT -1,
+    hidden        BOOLEAN NOT NULL DEFAULT FALSE,
+    len_min       INTEGER AS (LEAST(width, height, depth)) STORED NOT NULL,
+    len_mid       INTEGER AS (width + height + depth - LEAST(width, height, depth) - GREATEST(width, height, depth)) STORED NOT NULL,
+    INDEX chair1 (stock, price, id),
+    INDEX chair2 (price, stock),
+    INDEX chair3 (kind, stock),
+    INDEX chair4 (price, stock, popularity, id)
 );
-
-CREATE TABLE isuumo.chair_feature
+CREATE TABLE IF NOT EXISTS chair_feature
 (
     chair_id         INTEGER         NOT NULL,
     feature_id       INTEGER         NOT NULL,
-    PRIMARY KEY (chair_id, feature_id)
+    PRIMARY KEY (chair_id, feature_id),
+    INDEX chair_feature1 (feature_id, chair_id)
 );
-
-CREATE TABLE isuumo.estate_feature
+CREATE TABLE IF NOT EXISTS estate_feature
 (
     estate_id        INTEGER         NOT NULL,
     feature_id       INTEGER         NOT NULL,
     PRIMARY KEY (estate_id, feature_id)
 );
+CREATE TABLE IF NOT EXISTS estate_search
+(
+    id           INTEGER         NOT NULL PRIMARY KEY,
+    popularity   INTEGER         NOT NULL,
+    rent_level   INTEGER         NOT NULL,
+    height_level INTEGER         NOT NULL,
+    width_level  INTEGER         NOT NULL,
+    feature_bits BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    neg_popularity INTEGER AS (-popularity) STORED NOT NULL,
+    INDEX estate_search1 (rent_level, height_level, width_level, neg_popularity, id, feature_bits),
+    INDEX estate_search2 (height_level, width_level, neg_popularity, id, feature_bits),
+    INDEX estate_search3 (width_level, neg_popularity, id, feature_bits),
+    INDEX estate_search4 (neg_popularity, id, feature_bits)
+);
+CREATE TABLE IF NOT EXISTS reservation
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id    INTEGER         NOT NULL,
+    email       VARCHAR(128)    NOT NULL,
+    status      VARCHAR(16)     NOT NULL,
+    expires_at  DATETIME        NOT NULL,
+    created_at  DATETIME        NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX reservation_status_expires (status, expires_at)
+);
+CREATE TABLE IF NOT EXISTS purchase
+(
+    id          BIGINT          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    email       VARCHAR(128)    NOT NULL,
+    chair_id    INTEGER         NOT NULL,
+    quantity    INTEGER         NOT NULL,
+    created_at  DATETIME        NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX purchase_email_chair (email, chair_id)
+);
+INSERT INTO schema_migrations (version, name) VALUES (1, 'create_tables');
+
+-- 2_estate_fulltext
+ALTER TABLE estate ADD FULLTEXT INDEX estate_fulltext (name, description, address) WITH PARSER ngram;
+INSERT INTO schema_migrations (version, name) VALUES (2, 'estate_fulltext');
 
-CREATE INDEX estate1 ON isuumo.estate (door_width, door_height, popularity, id);
-CREATE INDEX estate2 ON isuumo.estate (rent, id);
-CREATE INDEX estate3 ON isuumo.estate (rent, popularity, id);
-CREATE INDEX estate4 ON isuumo.estate (latitude, longitude, popularity, id);
-CREATE INDEX estate5 ON isuumo.estate (id, popularity);
-CREATE INDEX estate6 ON isuumo.estate (height_level, width_level, popularity, id);
+-- 3_estate_point
+ALTER TABLE estate ADD SPATIAL INDEX estate_point (point);
+INSERT INTO schema_migrations (version, name) VALUES (3, 'estate_point');
 
-CREATE INDEX chair1 ON isuumo.chair (stock, price, id);
-CREATE INDEX chair2 ON isuumo.chair (price, stock);
-CREATE INDEX chair3 ON isuumo.chair (kind, stock);
-CREATE INDEX chair4 ON isuumo.chair (price, stock, popularity, id);
+-- 4_reservation_token
+ALTER TABLE reservation ADD COLUMN token CHAR(32) NOT NULL DEFAULT '' AFTER email;
+INSERT INTO schema_migrations (version, name) VALUES (4, 'reservation_token');
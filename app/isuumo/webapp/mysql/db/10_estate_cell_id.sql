@@ -0,0 +1,16 @@
+-- 12桁のgeohash (60ビット) を整数にした値 Goの cellID と同じになる
+UPDATE isuumo.estate e
+INNER JOIN (SELECT id, ST_GeoHash(longitude, latitude, 12) AS gh FROM isuumo.estate) g ON e.id = g.id
+SET e.cell_id =
+    (CAST(LOCATE(SUBSTRING(gh, 1, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 55) +
+    (CAST(LOCATE(SUBSTRING(gh, 2, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 50) +
+    (CAST(LOCATE(SUBSTRING(gh, 3, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 45) +
+    (CAST(LOCATE(SUBSTRING(gh, 4, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 40) +
+    (CAST(LOCATE(SUBSTRING(gh, 5, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 35) +
+    (CAST(LOCATE(SUBSTRING(gh, 6, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 30) +
+    (CAST(LOCATE(SUBSTRING(gh, 7, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 25) +
+    (CAST(LOCATE(SUBSTRING(gh, 8, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 20) +
+    (CAST(LOCATE(SUBSTRING(gh, 9, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 15) +
+    (CAST(LOCATE(SUBSTRING(gh, 10, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 10) +
+    (CAST(LOCATE(SUBSTRING(gh, 11, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 5) +
+    (CAST(LOCATE(SUBSTRING(gh, 12, 1), '0123456789bcdefghjkmnpqrstuvwxyz') - 1 AS UNSIGNED) << 0);
@@ -0,0 +1,9 @@
+UPDATE isuumo.estate SET prefecture = CASE
+    WHEN address LIKE '北海道%' THEN '北海道'
+    WHEN address LIKE '東京都%' THEN '東京都'
+    WHEN address LIKE '京都府%' THEN '京都府'
+    WHEN address LIKE '大阪府%' THEN '大阪府'
+    WHEN SUBSTRING(address, 3, 1) = '県' THEN SUBSTRING(address, 1, 3)
+    WHEN SUBSTRING(address, 4, 1) = '県' THEN SUBSTRING(address, 1, 4)
+    ELSE ''
+END;
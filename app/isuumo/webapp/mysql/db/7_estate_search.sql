@@ -0,0 +1,6 @@
+INSERT INTO isuumo.estate_search (id, popularity, rent_level, height_level, width_level, feature_bits)
+SELECT estate.id, estate.popularity, estate.rent_level, estate.height_level, estate.width_level, COALESCE(f.bits, 0)
+FROM isuumo.estate
+LEFT JOIN (
+    SELECT estate_id, BIT_OR(CAST(1 AS UNSIGNED) << feature_id) AS bits FROM isuumo.estate_feature GROUP BY estate_id
+) f ON estate.id = f.estate_id;
@@ -0,0 +1 @@
+UPDATE isuumo.estate SET geohash = ST_GeoHash(longitude, latitude, 5);